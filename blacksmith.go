@@ -1,9 +1,11 @@
 package main // import "github.com/cafebazaar/blacksmith"
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -17,6 +19,7 @@ import (
 	"github.com/cafebazaar/blacksmith/datasource"
 	"github.com/cafebazaar/blacksmith/dhcp"
 	"github.com/cafebazaar/blacksmith/pxe"
+	"github.com/cafebazaar/blacksmith/utils"
 	"github.com/cafebazaar/blacksmith/web"
 )
 
@@ -38,12 +41,40 @@ const (
 var (
 	versionFlag       = flag.Bool("version", false, "Print version info and exit")
 	debugFlag         = flag.Bool("debug", false, "Log more things that aren't directly related to booting a recognized client")
+	traceFlag         = flag.Bool("trace", false, "Log hex dumps of the dhcp packets and their replies (implies -debug)")
+	logOutputFlag     = flag.String("log-output", "stderr", "Where to write the logs: stderr, syslog, or the path of a file")
+	logMaxSizeFlag    = flag.Int64("log-max-size", 100, "Size in megabytes at which the -log-output file is rotated (0 to disable the rotation)")
+	logMaxFilesFlag   = flag.Int("log-max-files", 5, "Number of the rotated -log-output files to keep")
 	listenIFFlag      = flag.String("if", "", "Interface name for DHCP and PXE to listen on")
 	httpListenFlag    = flag.String("http-listen", httpListenFlagDefaultTCPAddress, "IP range to listen on for web requests")
+	httpSocketFlag    = flag.String("http-socket", "", "Path of a unix domain socket to serve the web api on too, for the local integrations")
+	socketModeFlag    = flag.String("http-socket-mode", "0660", "Permissions (in octal) of the -http-socket")
+	tlsCertFlag       = flag.String("tls-cert", "", "Path to the certificate file, to serve the web api over https")
+	tlsKeyFlag        = flag.String("tls-key", "", "Path to the private key file of -tls-cert")
+	accessLogFlag     = flag.Bool("access-log", true, "Log the requests of the web api")
+	exportLimitFlag   = flag.Int("export-concurrency", 1, "Number of the csv exports of the machines (/api/machines?format=csv) and the imports which are served at the same time, the json list is not limited (0 to disable the limit)")
+	exportTimeoutFlag = flag.Duration("export-timeout", 5*time.Minute, "Timeout of the machine exports and imports (0 to disable)")
+	readOnlyFlag      = flag.Bool("read-only", false, "Serve the web api as a read-only replica, refusing the requests which change the cluster")
+	httpRedirectFlag  = flag.String("http-redirect-listen", "", "If set along with -tls-cert, plain http requests to this address are redirected to https")
 	workspacePathFlag = flag.String("workspace", "/workspace", workspacePathHelp)
 	etcdFlag          = flag.String("etcd", "", "Etcd endpoints")
 	clusterNameFlag   = flag.String("cluster-name", "blacksmith", "The name of this cluster. Will be used as etcd path prefixes.")
 	dnsAddressesFlag  = flag.String("dns", "8.8.8.8", "comma separated IPs which will be used as default nameservers for skydns.")
+	rolesFlag         = flag.String("roles", "", "Comma separated roles of this instance, e.g. ntp to be advertised as an ntp server")
+	configFileFlag    = flag.String("config-file", "", "Path to a yaml file of cluster variables, lease-start, lease-range and subnets, which is reloaded when it's changed")
+	configWinsFlag    = flag.Bool("config-file-wins", false, "Prefer the values of -config-file over the ones which are stored in etcd or given by the flags")
+	etcdRetriesFlag   = flag.Int("etcd-set-retries", 2, "Number of the times a write to etcd is retried, if it fails with a transient error")
+	dnsFreshnessFlag  = flag.Duration("dns-freshness", time.Minute, "Instances without a heartbeat in this window are not advertised as nameservers (0 to disable)")
+	logThrottleFlag   = flag.Duration("dhcp-log-throttle", time.Minute, "Identical dhcp warnings of a machine are logged a few times in this window, and the rest are counted (0 to disable)")
+	replyDelayFlag    = flag.Duration("dhcp-reply-delay", 0, "Delay the dhcp replies, to test the clients in a lab (needs -debug, at most 10s)")
+	nakLimitFlag      = flag.Int("dhcp-nak-limit", 0, "Number of the dhcp naks which are sent to a machine in each -dhcp-nak-window, the rest are dropped (0 to disable)")
+	nakWindowFlag     = flag.Duration("dhcp-nak-window", time.Minute, "The window of -dhcp-nak-limit")
+	ipamWebhookFlag   = flag.String("dhcp-ipam-webhook", "", "Url of an external ipam which is asked (with a json post of the mac and the subnet) for the ips of the new machines, instead of the lease range")
+	ipamTimeoutFlag   = flag.Duration("dhcp-ipam-timeout", 5*time.Second, "Timeout of -dhcp-ipam-webhook, the request of the machine is dropped if it's passed")
+	maxLeasesFlag     = flag.Int("max-leases", 0, "Number of the leases which are kept, the machines of the oldest expired ones are deleted beyond it (0 to disable)")
+	leaseRetainFlag   = flag.Duration("lease-retention", 0, "Machines whose leases have expired longer than this are deleted (0 to keep them)")
+	dhcpKeepRunFlag   = flag.Bool("dhcp-keep-running", false, "Keep the other services running if dhcp fails, which is reported by /api/dhcp/probe, instead of exiting")
+	strictConfigFlag  = flag.Bool("strict-config", false, "Refuse to start if a stored cluster or machine variable is invalid, instead of logging it")
 
 	leaseStartFlag = flag.String("lease-start", "", "Begining of lease starting IP")
 	leaseRangeFlag = flag.Int("lease-range", 0, "Lease range")
@@ -116,12 +147,32 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *debugFlag {
+	logOutput, err := utils.LogOutput(*logOutputFlag, *logMaxSizeFlag*1024*1024, *logMaxFilesFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCouldn't open the log output: %s\n", err)
+		os.Exit(1)
+	}
+	log.SetOutput(logOutput)
+
+	if *debugFlag || *traceFlag {
 		log.SetLevel(log.DebugLevel)
 	} else {
 		log.SetLevel(log.InfoLevel)
 	}
 
+	if *replyDelayFlag != 0 {
+		if !*debugFlag && !*traceFlag {
+			fmt.Fprint(os.Stderr, "\n-dhcp-reply-delay is only for testing, and needs -debug\n")
+			os.Exit(1)
+		}
+		if *replyDelayFlag < 0 || *replyDelayFlag > dhcp.MaxReplyDelay {
+			fmt.Fprintf(os.Stderr, "\n-dhcp-reply-delay should be between 0 and %s\n", dhcp.MaxReplyDelay)
+			os.Exit(1)
+		}
+		log.WithField("where", "blacksmith.main").Warnf(
+			"the dhcp replies are delayed by %s, which is only for testing", *replyDelayFlag)
+	}
+
 	// etcd config
 	if etcdFlag == nil || clusterNameFlag == nil {
 		fmt.Fprint(os.Stderr, "\nPlease specify the etcd endpoints\n")
@@ -169,6 +220,41 @@ func main() {
 		webAddr.Port = int(port)
 	}
 
+	// web api can be served on a unix socket too
+	var webSocketMode os.FileMode
+	if *httpSocketFlag != "" {
+		mode, err := strconv.ParseUint(*socketModeFlag, 8, 32)
+		if err != nil || mode > 0777 {
+			fmt.Fprintf(os.Stderr, "\nIncorrect -http-socket-mode provided: %s\n", *socketModeFlag)
+			os.Exit(1)
+		}
+		webSocketMode = os.FileMode(mode)
+	}
+
+	// web api can be served over https
+	var tlsConfig *tls.Config
+	webScheme := "http"
+	if *tlsCertFlag != "" || *tlsKeyFlag != "" {
+		tlsConfig, err = web.LoadTLSConfig(*tlsCertFlag, *tlsKeyFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nError while loading the tls certificate: %s\n", err)
+			os.Exit(1)
+		}
+		webScheme = "https"
+	}
+	var httpRedirectAddr *net.TCPAddr
+	if *httpRedirectFlag != "" {
+		if tlsConfig == nil {
+			fmt.Fprint(os.Stderr, "\n-http-redirect-listen needs -tls-cert and -tls-key\n")
+			os.Exit(1)
+		}
+		httpRedirectAddr, err = net.ResolveTCPAddr("tcp", *httpRedirectFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nIncorrect tcp address provided: %s\n", *httpRedirectFlag)
+			os.Exit(1)
+		}
+	}
+
 	// other services are exposed just through the given interface, on hard coded ports
 	var httpBooterAddr = net.TCPAddr{IP: serverIP, Port: 70}
 	var tftpAddr = net.UDPAddr{IP: serverIP, Port: 69}
@@ -192,12 +278,42 @@ func main() {
 		}
 	}
 
-	if leaseStart == nil {
-		fmt.Fprint(os.Stderr, "\nPlease specify the lease start ip\n")
-		os.Exit(1)
+	var fileConfig *datasource.FileConfig
+	if *configFileFlag != "" {
+		var err error
+		fileConfig, err = datasource.NewFileConfig(*configFileFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nCouldn't load the config file: %s\n", err)
+			os.Exit(1)
+		}
+		go func() {
+			if err := fileConfig.Watch(nil); err != nil {
+				log.WithField("where", "blacksmith.main").WithError(err).Warn(
+					"the config file is not reloaded when it's changed")
+			}
+		}()
 	}
-	if leaseRange <= 1 {
-		fmt.Fprint(os.Stderr, "\nLease range should be greater that 1\n")
+
+	// the lease range may be given by the config file instead
+	if fileStart, _ := fileConfig.LeaseRange(); fileStart == nil || *leaseStartFlag != "" {
+		if leaseStart == nil {
+			fmt.Fprint(os.Stderr, "\nPlease specify the lease start ip\n")
+			os.Exit(1)
+		}
+		if leaseRange <= 1 {
+			fmt.Fprint(os.Stderr, "\nLease range should be greater that 1\n")
+			os.Exit(1)
+		}
+	}
+	if *ipamWebhookFlag != "" {
+		u, err := url.Parse(*ipamWebhookFlag)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "\nInvalid -dhcp-ipam-webhook, an absolute http(s) url is expected: %s\n", *ipamWebhookFlag)
+			os.Exit(1)
+		}
+	}
+	if *ipamTimeoutFlag <= 0 {
+		fmt.Fprint(os.Stderr, "\nPlease specify a positive -dhcp-ipam-timeout\n")
 		os.Exit(1)
 	}
 
@@ -224,20 +340,99 @@ func main() {
 		BuildTime:        buildTime,
 		ServiceStartTime: time.Now().UTC().Unix(),
 	}
+	for _, role := range strings.Split(*rolesFlag, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			selfInfo.Roles = append(selfInfo.Roles, role)
+		}
+	}
+	if *etcdRetriesFlag < 0 {
+		fmt.Fprint(os.Stderr, "\nPlease specify a non-negative -etcd-set-retries\n")
+		os.Exit(1)
+	}
+	if *maxLeasesFlag < 0 || *leaseRetainFlag < 0 {
+		fmt.Fprint(os.Stderr, "\nPlease specify a non-negative -max-leases and -lease-retention\n")
+		os.Exit(1)
+	}
+	if *nakLimitFlag < 0 || *nakWindowFlag < 0 {
+		fmt.Fprint(os.Stderr, "\nPlease specify a non-negative -dhcp-nak-limit and -dhcp-nak-window\n")
+		os.Exit(1)
+	}
 	etcdDataSource, err := datasource.NewEtcdDataSource(kapi, etcdClient,
 		leaseStart, leaseRange, *clusterNameFlag, *workspacePathFlag,
-		dnsIPStrings, selfInfo)
+		dnsIPStrings, selfInfo, datasource.Options{
+			SetRetries:     *etcdRetriesFlag,
+			MaxLeases:      *maxLeasesFlag,
+			LeaseRetention: *leaseRetainFlag,
+			FileConfig:     fileConfig,
+			FileConfigWins: *configWinsFlag,
+		})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "\nCouldn't create runtime configuration: %s\n", err)
 		os.Exit(1)
 	}
 
+	// the broken variables are found before a machine fails to boot
+	problems, err := datasource.CheckConfigs(etcdDataSource)
+	if err != nil {
+		log.WithField("where", "blacksmith.main").WithError(err).Warn(
+			"couldn't check the stored variables")
+	}
+	for _, problem := range problems {
+		log.WithFields(log.Fields{
+			"where":   "blacksmith.main",
+			"object":  problem.Mac,
+			"subject": problem.Key,
+		}).Warnf("invalid stored variable: %s", problem.Error)
+	}
+	// the new machines get the network configuration of the cluster
+	if netConf, err := etcdDataSource.GetClusterVariable(datasource.SpecialKeyNetworkConfiguration); err == nil && netConf == "" {
+		log.WithField("where", "blacksmith.main").Warnf(
+			"the cluster %q variable is not set, the machines without their own won't get an address",
+			datasource.SpecialKeyNetworkConfiguration)
+	}
+	if *strictConfigFlag && (err != nil || len(problems) != 0) {
+		fmt.Fprintf(os.Stderr, "\n%d stored variables are invalid (-strict-config), see /api/config/problems\n", len(problems))
+		os.Exit(1)
+	}
+
+	dhcpHandler := dhcp.NewHandler(dhcpIF.Name, serverIP, etcdDataSource, dhcp.HandlerOptions{
+		InstanceFreshness: *dnsFreshnessFlag,
+		LogThrottleWindow: *logThrottleFlag,
+		ReplyDelay:        *replyDelayFlag,
+		NAKLimit:          *nakLimitFlag,
+		NAKLimitWindow:    *nakWindowFlag,
+		IPAMWebhook:       *ipamWebhookFlag,
+		IPAMTimeout:       *ipamTimeoutFlag,
+		TracePackets:      *traceFlag,
+	})
+
 	// serving api
+	webOptions := web.Options{
+		LogRequests:       *accessLogFlag,
+		ExportConcurrency: *exportLimitFlag,
+		ExportTimeout:     *exportTimeoutFlag,
+		ReadOnly:          *readOnlyFlag,
+	}
+	webHandler := web.NewHandler(etcdDataSource, dhcpHandler, webOptions)
 	go func() {
-		err := web.ServeWeb(etcdDataSource, webAddr)
+		err := web.ServeWeb(webHandler, webAddr, tlsConfig)
 		log.Fatalf("\nError while serving api: %s\n", err)
 	}()
 
+	if *httpSocketFlag != "" {
+		go func() {
+			err := web.ServeUnixSocket(webHandler, *httpSocketFlag, webSocketMode)
+			log.Fatalf("\nError while serving api on the unix socket: %s\n", err)
+		}()
+	}
+
+	if httpRedirectAddr != nil {
+		go func() {
+			err := web.ServeHTTPSRedirect(*httpRedirectAddr, webAddr.Port)
+			log.Fatalf("\nError while serving http to https redirect: %s\n", err)
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
@@ -262,7 +457,7 @@ func main() {
 
 	// serving http booter
 	go func() {
-		err := pxe.ServeHTTPBooter(httpBooterAddr, etcdDataSource, webAddr.Port)
+		err := pxe.ServeHTTPBooter(httpBooterAddr, etcdDataSource, webAddr.Port, webScheme)
 		log.Fatalf("\nError while serving http booter: %s\n", err)
 	}()
 
@@ -280,10 +475,19 @@ func main() {
 
 	// serving dhcp
 	go func() {
-		err := dhcp.StartDHCP(dhcpIF.Name, serverIP, etcdDataSource)
+		err := dhcp.StartDHCP(dhcpHandler)
+		if *dhcpKeepRunFlag {
+			log.Errorf("\nError while serving dhcp: %s\n", err)
+			return
+		}
 		log.Fatalf("\nError while serving dhcp: %s\n", err)
 	}()
 
+	// keeping the lease table bounded
+	if *maxLeasesFlag > 0 || *leaseRetainFlag > 0 {
+		go datasource.PruneLeasesEvery(etcdDataSource, datasource.LeasePruneInterval, nil)
+	}
+
 	for etcdDataSource.WhileMaster() == nil {
 		time.Sleep(datasource.ActiveMasterUpdateTime)
 	}
@@ -0,0 +1,105 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// States which are reported by the agents of the machines
+const (
+	AgentStateBooting      = "booting"
+	AgentStateRunning      = "running"
+	AgentStateShuttingDown = "shutting-down"
+)
+
+const (
+	// DefaultAgentStateTTL is how long a reported state is kept, if the agent
+	// hasn't asked for another ttl
+	DefaultAgentStateTTL = 3 * time.Minute
+	// MaxAgentStateTTL is the longest ttl an agent may ask for
+	MaxAgentStateTTL = time.Hour
+)
+
+// AgentState is the power/os state of a machine, as it's last reported by
+// the agent which runs on it
+type AgentState struct {
+	State string `json:"state"`
+	// Time is the unix time of the report
+	Time int64 `json:"time"`
+	// Expiry is the unix time after which the state is stale
+	Expiry int64 `json:"expiry"`
+}
+
+// ValidateAgentState checks that the state is one of the known states
+func ValidateAgentState(state string) error {
+	switch state {
+	case AgentStateBooting, AgentStateRunning, AgentStateShuttingDown:
+		return nil
+	}
+	return fmt.Errorf("unknown agent state: %q", state)
+}
+
+// AgentState returns the state which is last reported by the agent of the
+// machine, or nil if there's none or it's stale
+func (m *etcdMachineInterface) AgentState() (*AgentState, error) {
+	stateJSON, err := m.selfGet("_agent_state")
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var state AgentState
+	if err := json.Unmarshal([]byte(stateJSON), &state); err != nil {
+		return nil, fmt.Errorf("error while unmarshaling the agent state: %s", err)
+	}
+	// etcd may take a while to remove the expired keys
+	if state.Expiry <= time.Now().Unix() {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+// SetAgentState stores the state reported by the agent of the machine, which
+// expires after ttl
+func (m *etcdMachineInterface) SetAgentState(state string, ttl time.Duration) error {
+	if err := ValidateAgentState(state); err != nil {
+		return err
+	}
+	// etcd keeps the ttls in seconds
+	if ttl < time.Second || ttl > MaxAgentStateTTL {
+		return fmt.Errorf("the ttl should be between 1s and %s", MaxAgentStateTTL)
+	}
+
+	now := time.Now()
+	stateJSON, err := json.Marshal(AgentState{
+		State:  state,
+		Time:   now.Unix(),
+		Expiry: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("error while marshaling the agent state: %s", err)
+	}
+
+	previous, err := m.AgentState()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	_, err = m.keysAPI.Set(ctx, m.prefixifyForMachine("_agent_state"), string(stateJSON),
+		&etcd.SetOptions{TTL: ttl})
+	if err != nil {
+		return err
+	}
+	// the heartbeats which report the same state are not recorded
+	if previous == nil || previous.State != state {
+		m.recordEvent(EventAgentState, state)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package datasource
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+// etcdClientIDsDirName holds the macs of the machines which are bound to the
+// client identifiers (dhcp option 61), by the hex of the identifiers
+const etcdClientIDsDirName = "client-ids"
+
+func (ds *EtcdDataSource) prefixifyForClientID(clientID []byte) string {
+	return path.Join(ds.clusterName, etcdClientIDsDirName, hex.EncodeToString(clientID))
+}
+
+// ClientIDLookup reports whether the machines are looked up by their client
+// identifiers
+func (ds *EtcdDataSource) ClientIDLookup() (bool, error) {
+	value, err := ds.GetClusterVariable(SpecialKeyClientIDLookup)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// ClientIDMachine returns the mac of the machine which is bound to the
+// client identifier, or nil if there's none
+func (ds *EtcdDataSource) ClientIDMachine(clientID []byte) (net.HardwareAddr, error) {
+	macStr, err := ds.get(ds.prefixifyForClientID(clientID))
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	mac, err := net.ParseMAC(macStr)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing the mac of the client identifier: %s", err)
+	}
+	return mac, nil
+}
+
+// BindClientID binds the client identifier to the machine
+func (ds *EtcdDataSource) BindClientID(clientID []byte, mac net.HardwareAddr) error {
+	if len(clientID) == 0 {
+		return fmt.Errorf("empty client identifier")
+	}
+	return ds.set(ds.prefixifyForClientID(clientID), mac.String())
+}
@@ -0,0 +1,73 @@
+package datasource
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ConfigProblem is a stored variable which doesn't pass the validation of
+// its key, e.g. one which is stored by an older version or directly in etcd.
+// Mac is empty for the cluster variables.
+type ConfigProblem struct {
+	Mac   string `json:"mac,omitempty"`
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+type configProblemsByKey []ConfigProblem
+
+func (p configProblemsByKey) Len() int      { return len(p) }
+func (p configProblemsByKey) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p configProblemsByKey) Less(i, j int) bool {
+	if p[i].Mac != p[j].Mac {
+		return p[i].Mac < p[j].Mac
+	}
+	return p[i].Key < p[j].Key
+}
+
+// CheckConfigs validates the cluster variables and the variables of all the
+// machines the same way they're validated when they're set, and returns the
+// broken ones, sorted by their macs and keys
+func CheckConfigs(ds DataSource) ([]ConfigProblem, error) {
+	problems := []ConfigProblem{}
+
+	clusterVariables, err := ds.ListClusterVariables()
+	if err != nil {
+		return nil, fmt.Errorf("error while listing the cluster variables: %s", err)
+	}
+	for key, value := range clusterVariables {
+		if err := validateVariable(key, value); err != nil {
+			problems = append(problems, ConfigProblem{Key: key, Error: err.Error()})
+		}
+	}
+
+	machineInterfaces, err := ds.MachineInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting the machine interfaces: %s", err)
+	}
+	for _, machineInterface := range machineInterfaces {
+		mac := machineInterface.Mac().String()
+		variables, err := machineInterface.ListVariables()
+		if err != nil {
+			return nil, fmt.Errorf("error while listing the variables of %s: %s", mac, err)
+		}
+		for key, value := range variables {
+			if key == "" || key[0] == '_' {
+				continue
+			}
+			err := validateVariable(key, value)
+			if err == nil && key == SpecialKeyNetworkConfiguration {
+				var machine Machine
+				if machine, err = machineInterface.Machine(false, nil); err == nil {
+					err = checkNetworkConfigurationSubnet(value, machine.IP)
+				}
+			}
+			if err != nil {
+				problems = append(problems, ConfigProblem{Mac: mac, Key: key, Error: err.Error()})
+			}
+		}
+	}
+
+	sort.Sort(configProblemsByKey(problems))
+	return problems, nil
+}
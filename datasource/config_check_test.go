@@ -0,0 +1,81 @@
+package datasource
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestCheckConfigs(t *testing.T) {
+	ds, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	mac, _ := net.ParseMAC("00:11:22:33:47:05")
+	machineInterface := ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+	if err := machineInterface.SetVariable(SpecialKeyPXEMenuTimeout, "5"); err != nil {
+		t.Error("error while setting the pxe menu timeout:", err)
+		return
+	}
+	if err := ds.SetClusterVariable(SpecialKeyNTPServers, "10.0.0.1"); err != nil {
+		t.Error("error while setting the ntp servers:", err)
+		return
+	}
+
+	problems, err := CheckConfigs(ds)
+	if err != nil {
+		t.Error("error while checking the configs:", err)
+		return
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected no problem, got %+v", problems)
+	}
+
+	// stored as an older version or a manual edit of etcd would do, without
+	// the validation
+	etcdDS := ds.(*EtcdDataSource)
+	if err := etcdDS.set(etcdDS.prefixifyForClusterVariables(SpecialKeyNTPServers), "ntp.example.com"); err != nil {
+		t.Error("error while storing the broken ntp servers:", err)
+		return
+	}
+	if err := machineInterface.(*etcdMachineInterface).selfSet(SpecialKeyNetworkConfiguration,
+		`{"netmask": "255.255.255.0", "router": "10.1.2.1"}`); err != nil {
+		t.Error("error while storing the broken network configuration:", err)
+		return
+	}
+
+	problems, err = CheckConfigs(ds)
+	if err != nil {
+		t.Error("error while checking the configs:", err)
+		return
+	}
+	var found []ConfigProblem
+	for _, problem := range problems {
+		found = append(found, ConfigProblem{Mac: problem.Mac, Key: problem.Key})
+		if problem.Error == "" {
+			t.Errorf("expected the error of %+v", problem)
+		}
+	}
+	expected := []ConfigProblem{
+		{Key: SpecialKeyNTPServers},
+		{Mac: mac.String(), Key: SpecialKeyNetworkConfiguration},
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected the problems %+v, got %+v", expected, problems)
+	}
+}
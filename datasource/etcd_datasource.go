@@ -6,6 +6,8 @@ import (
 	"net"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +23,9 @@ const (
 	etcdCluserVarsDirName    = "cluster-variables"
 	etcdConfigurationDirName = "configuration"
 	etcdFilesDirName         = "files"
+	// etcdModifiedDirName holds the modification times of the variables of
+	// a machine
+	etcdModifiedDirName = "_modified"
 )
 
 // EtcdDataSource implements MasterDataSource interface using etcd as it's
@@ -35,7 +40,32 @@ type EtcdDataSource struct {
 	workspacePath   string
 	dhcpAssignLock  *sync.Mutex
 	instanceEtcdKey string // HA
-	selfInfo        InstanceInfo
+	selfInfoLock    *sync.Mutex
+	selfInfo        InstanceInfo // guarded by selfInfoLock
+	options         Options
+}
+
+// Options are the settings of the datasource, which are given by the command
+// line flags
+type Options struct {
+	// SetRetries is the number of the times a write to etcd is retried, if
+	// it fails with a transient error, e.g. while the etcd cluster elects a
+	// leader. 0 disables the retries.
+	SetRetries int
+	// MaxLeases is the number of the leases which are kept. Once there are
+	// more, the machines of the oldest expired ones are pruned, but the
+	// active leases are never pruned. 0 disables the limit.
+	MaxLeases int
+	// LeaseRetention is how long the machine of an expired lease is kept
+	// before it's pruned, regardless of MaxLeases. 0 keeps them.
+	LeaseRetention time.Duration
+	// FileConfig, if it's not nil, is merged with the cluster variables, the
+	// lease range and the subnet definitions. If FileConfigWins is set, its
+	// values override the ones which are stored in etcd (or given by the
+	// flags, for the lease range), otherwise they're used only for the ones
+	// which are not set there.
+	FileConfig     *FileConfig
+	FileConfigWins bool
 }
 
 // WorkspacePath returns the path to the workspace
@@ -96,12 +126,36 @@ func (ds *EtcdDataSource) get(keyPath string) (string, error) {
 	return response.Node.Value, nil
 }
 
-// set expects absolute key path
+// set expects absolute key path. The transient failures are retried, see
+// withRetries.
 func (ds *EtcdDataSource) set(keyPath string, value string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	_, err := ds.keysAPI.Set(ctx, keyPath, value, nil)
-	return err
+	return ds.withRetries(keyPath, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		_, err := ds.keysAPI.Set(ctx, keyPath, value, nil)
+		return err
+	})
+}
+
+// create expects absolute key path, and fails with an etcd.Error of
+// etcd.ErrorCodeNodeExist if the key is already set. A retry which finds the
+// key set to the same value succeeds, as the response of an earlier attempt
+// may have been lost after it was applied.
+func (ds *EtcdDataSource) create(keyPath string, value string) error {
+	retried := false
+	return ds.withRetries(keyPath, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		_, err := ds.keysAPI.Set(ctx, keyPath, value,
+			&etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeNodeExist && retried {
+			if stored, getErr := ds.get(keyPath); getErr == nil && stored == value {
+				return nil
+			}
+		}
+		retried = true
+		return err
+	})
 }
 
 // delete expects absolute key path
@@ -112,9 +166,34 @@ func (ds *EtcdDataSource) delete(keyPath string) error {
 	return err
 }
 
-// GetClusterVariable returns a cluster variables with the given name
+// GetClusterVariable returns a cluster variables with the given name. The
+// values of the config file, if any, are merged in.
 func (ds *EtcdDataSource) GetClusterVariable(key string) (string, error) {
-	return ds.get(ds.prefixifyForClusterVariables(key))
+	fileValue, isInFile := ds.options.FileConfig.Get(key)
+	if isInFile && ds.options.FileConfigWins {
+		return fileValue, nil
+	}
+
+	value, err := ds.get(ds.prefixifyForClusterVariables(key))
+	if err != nil && isInFile && etcd.IsKeyNotFound(err) {
+		return fileValue, nil
+	}
+	return value, err
+}
+
+// ClusterVariableEtcdKey returns the etcd key of the given cluster variable
+func (ds *EtcdDataSource) ClusterVariableEtcdKey(key string) string {
+	return ds.prefixifyForClusterVariables(key)
+}
+
+// leaseRangeOf returns the lease range in effect, which is the one of the
+// config file if it's set and either it wins or the flags have set none
+func (ds *EtcdDataSource) leaseRangeOf() (net.IP, int) {
+	if start, size := ds.options.FileConfig.LeaseRange(); start != nil &&
+		(ds.options.FileConfigWins || ds.leaseStart == nil) {
+		return start, size
+	}
+	return ds.leaseStart, ds.leaseRange
 }
 
 func (ds *EtcdDataSource) listNonDirKeyValues(dir string) (map[string]string, error) {
@@ -138,11 +217,78 @@ func (ds *EtcdDataSource) listNonDirKeyValues(dir string) (map[string]string, er
 	return flags, nil
 }
 
-// ListClusterVariables returns the list of all the cluster variables from etcd
+// PageKeys sorts the keys which start with prefix, and returns up to limit of
+// them which come after the given key (0 for no limit). It also reports
+// whether there are more keys after the returned ones.
+func PageKeys(keys []string, prefix, after string, limit int) ([]string, bool) {
+	var res []string
+	for _, k := range keys {
+		if strings.HasPrefix(k, prefix) && k > after {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+
+	if limit > 0 && len(res) > limit {
+		return res[:limit], true
+	}
+	return res, false
+}
+
+// ListClusterVariables returns the list of all the cluster variables, merged
+// from etcd and the config file the same way GetClusterVariable does
 func (ds *EtcdDataSource) ListClusterVariables() (map[string]string, error) {
+	variables, err := ds.EffectiveClusterVariables()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for key, variable := range variables {
+		values[key] = variable.Value
+	}
+	return values, nil
+}
+
+// listEtcdClusterVariables returns the cluster variables which are stored in
+// etcd
+func (ds *EtcdDataSource) listEtcdClusterVariables() (map[string]string, error) {
 	return ds.listNonDirKeyValues(path.Join(ds.clusterName, etcdCluserVarsDirName))
 }
 
+// Sources of EffectiveVariable
+const (
+	VariableSourceEtcd = "etcd"
+	VariableSourceFile = "file"
+)
+
+// EffectiveVariable is the value of a cluster variable which is in effect,
+// along with where it comes from
+type EffectiveVariable struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// EffectiveClusterVariables returns the cluster variables which are in
+// effect, merged from etcd and the config file the same way
+// GetClusterVariable does
+func (ds *EtcdDataSource) EffectiveClusterVariables() (map[string]EffectiveVariable, error) {
+	etcdValues, err := ds.listEtcdClusterVariables()
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return nil, err
+	}
+
+	variables := make(map[string]EffectiveVariable)
+	for key, value := range etcdValues {
+		variables[key] = EffectiveVariable{Value: value, Source: VariableSourceEtcd}
+	}
+	for key, value := range ds.options.FileConfig.Values() {
+		if _, isIn := variables[key]; !isIn || ds.options.FileConfigWins {
+			variables[key] = EffectiveVariable{Value: value, Source: VariableSourceFile}
+		}
+	}
+	return variables, nil
+}
+
 // ListConfigurations returns the list of all the configuration variables from etcd
 func (ds *EtcdDataSource) ListConfigurations() (map[string]string, error) {
 	return ds.listNonDirKeyValues(path.Join(ds.clusterName, etcdConfigurationDirName))
@@ -154,6 +300,22 @@ func (ds *EtcdDataSource) SetClusterVariable(key string, value string) error {
 	if err != nil {
 		return err
 	}
+	if key == SpecialKeyIgnore || key == SpecialKeyNoInstall {
+		return fmt.Errorf("%q can only be set for the machines", key)
+	}
+	if key == SpecialKeyNetworkConfiguration {
+		// the machines are in the subnet of the lease range
+		leaseStart, _ := ds.leaseRangeOf()
+		if err := checkNetworkConfigurationSubnet(value, leaseStart); err != nil {
+			return err
+		}
+	}
+	if key == SpecialKeyQuarantineSubnet {
+		leaseStart, leaseRange := ds.leaseRangeOf()
+		if err := checkQuarantineSubnetRange(value, leaseStart, leaseRange); err != nil {
+			return err
+		}
+	}
 	return ds.set(ds.prefixifyForClusterVariables(key), value)
 }
 
@@ -162,6 +324,26 @@ func (ds *EtcdDataSource) DeleteClusterVariable(key string) error {
 	return ds.delete(ds.prefixifyForClusterVariables(key))
 }
 
+// Maintenance reports whether the maintenance mode is on
+func (ds *EtcdDataSource) Maintenance() (bool, error) {
+	value, err := ds.GetClusterVariable(SpecialKeyMaintenance)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// SetMaintenance turns the maintenance mode on or off
+func (ds *EtcdDataSource) SetMaintenance(on bool) error {
+	return ds.SetClusterVariable(SpecialKeyMaintenance, strconv.FormatBool(on))
+}
+
 // ClusterName returns the name of the cluster
 func (ds *EtcdDataSource) ClusterName() string {
 	return ds.clusterName
@@ -194,7 +376,7 @@ func (ds *EtcdDataSource) EtcdMembers() (string, error) {
 // a MasterDataSource
 func NewEtcdDataSource(kapi etcd.KeysAPI, client etcd.Client, leaseStart net.IP,
 	leaseRange int, clusterName, workspacePath string, defaultNameServers []string,
-	selfInfo InstanceInfo) (DataSource, error) {
+	selfInfo InstanceInfo, options Options) (DataSource, error) {
 
 	data, err := ioutil.ReadFile(filepath.Join(workspacePath, "initial.yaml"))
 	if err != nil {
@@ -216,7 +398,9 @@ func NewEtcdDataSource(kapi etcd.KeysAPI, client etcd.Client, leaseStart net.IP,
 		workspacePath:   workspacePath,
 		dhcpAssignLock:  &sync.Mutex{},
 		instanceEtcdKey: invalidEtcdKey,
+		selfInfoLock:    &sync.Mutex{},
 		selfInfo:        selfInfo,
+		options:         options,
 	}
 
 	for key, value := range iVals {
@@ -1,6 +1,7 @@
 package datasource
 
 import (
+	"net"
 	"strings"
 	"testing"
 )
@@ -39,3 +40,108 @@ func TestEtcdMembers(t *testing.T) {
 		t.Error("expecting EtcdMembers result to conatins etcd0= and ends with 80, got:", got)
 	}
 }
+
+func TestNetworkConfigurationSubnet(t *testing.T) {
+	ds, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	tests := []struct {
+		netConf string
+		isErr   bool
+	}{
+		{`{"netmask": "255.255.255.0", "router": "127.0.0.254"}`, false},
+		{`{"netmask": "255.255.255.0", "router": "10.0.0.1"}`, true},
+		{`{"netmask": "255.0.0.0", "router": "127.1.0.1"}`, false},
+		{`{"netmask": "255.255.255.0", "classlessRouteOption": [{"router": "127.0.1.1", "size": 8, "destination": "10.0.0.0"}]}`, true},
+		{`{"netmask": "255.0.255.0", "router": "127.0.0.254"}`, true},
+	}
+
+	for i, tt := range tests {
+		err := ds.SetClusterVariable(SpecialKeyNetworkConfiguration, tt.netConf)
+		if (err != nil) != tt.isErr {
+			t.Errorf("#%d: expected error=%v, got %v", i, tt.isErr, err)
+		}
+	}
+
+	// the machine-level configuration is checked against the ip of the
+	// machine
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:F2")
+	machineInterface := ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(true, net.IPv4(10, 1, 1, 10)); err != nil {
+		t.Error("error in creating the machine:", err)
+		return
+	}
+	err = machineInterface.SetVariable(SpecialKeyNetworkConfiguration,
+		`{"netmask": "255.255.255.0", "router": "10.1.1.1"}`)
+	if err != nil {
+		t.Error("unexpected error for an in-subnet router:", err)
+	}
+	err = machineInterface.SetVariable(SpecialKeyNetworkConfiguration,
+		`{"netmask": "255.255.255.0", "router": "127.0.0.254"}`)
+	if err == nil || !strings.Contains(err.Error(), "outside the subnet") {
+		t.Error("expected an error for an out-of-subnet router, got", err)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	ds, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	// the lease range is 127.0.0.2-127.0.0.11
+	tests := []struct {
+		subnet string
+		isErr  bool
+	}{
+		{`{"start": "127.0.0.12", "range": 10, "netmask": "255.255.255.0"}`, false},
+		{`{"start": "127.0.0.11", "range": 10, "netmask": "255.255.255.0"}`, true},
+		{`{"start": "127.0.0.1", "range": 2, "netmask": "255.255.255.0"}`, true},
+		{`{"start": "127.0.0.1", "range": 1, "netmask": "255.255.255.0"}`, false},
+	}
+	for i, tt := range tests {
+		err := ds.SetClusterVariable(SpecialKeyQuarantineSubnet, tt.subnet)
+		if (err != nil) != tt.isErr {
+			t.Errorf("#%d: expected error=%v, got %v", i, tt.isErr, err)
+		}
+	}
+
+	// an approved machine isn't quarantined again
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:F3")
+	subnet, _ := UnmarshalQuarantineSubnet(tests[0].subnet)
+	if ip, err := ds.QuarantineLease(mac, subnet); err != nil || !ip.Equal(net.IPv4(127, 0, 0, 12)) {
+		t.Errorf("unexpected quarantine lease %s, %v", ip, err)
+	}
+	if _, err := ds.ApproveMachine(mac, "test"); err != nil {
+		t.Error("failed to approve the machine:", err)
+		return
+	}
+	if ip, err := ds.QuarantineLease(mac, subnet); err == nil {
+		t.Error("expected an error for quarantining an approved machine, got", ip)
+	}
+	if quarantined, err := ds.QuarantinedMachines(); err != nil || len(quarantined) != 0 {
+		t.Errorf("expected no quarantined machine, got %v, %v", quarantined, err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	etcd "github.com/coreos/etcd/client"
 	"github.com/krolaw/dhcp4"
 	"golang.org/x/net/context"
@@ -67,7 +68,11 @@ func (m *etcdMachineInterface) Machine(createIfNeeded bool,
 			IP:        createWithIP, // to be assigned automatically
 			FirstSeen: time.Now().Unix(),
 		}
-		err := m.store(&machine)
+		err := m.store(&machine, false)
+		if err == ErrMachineExists {
+			// created or claimed concurrently
+			return m.Machine(false, nil)
+		}
 		if err != nil {
 			return machine, fmt.Errorf("error while storing _machine: %s", err)
 		}
@@ -77,7 +82,58 @@ func (m *etcdMachineInterface) Machine(createIfNeeded bool,
 	return machine, nil
 }
 
-func (m *etcdMachineInterface) store(machine *Machine) error {
+// Known reports whether there's a record for the machine
+func (m *etcdMachineInterface) Known() (bool, error) {
+	_, err := m.selfGet("_machine")
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// StoreMachine stores the given machine for this mac, replacing the
+// current record if there is one
+func (m *etcdMachineInterface) StoreMachine(machine Machine) (Machine, error) {
+	if machine.FirstSeen == 0 {
+		machine.FirstSeen = time.Now().Unix()
+	}
+	err := m.store(&machine, true)
+	if err != nil {
+		return machine, fmt.Errorf("error while storing _machine: %s", err)
+	}
+	return machine, nil
+}
+
+// Claim stores the given machine for this mac, if there's no record for it
+// yet. Otherwise ErrMachineExists is returned.
+func (m *etcdMachineInterface) Claim(machine Machine) (Machine, error) {
+	if machine.FirstSeen == 0 {
+		machine.FirstSeen = time.Now().Unix()
+	}
+	err := m.store(&machine, false)
+	if err == ErrMachineExists {
+		return machine, err
+	}
+	if err != nil {
+		return machine, fmt.Errorf("error while storing _machine: %s", err)
+	}
+	return machine, nil
+}
+
+// store writes the machine, after assigning an IP to it if it has none. If
+// replace is false, the write is a compare-and-swap which fails with
+// ErrMachineExists if there's already a record for the mac.
+func (m *etcdMachineInterface) store(machine *Machine, replace bool) error {
+	m.etcdDS.dhcpAssignLock.Lock()
+	defer m.etcdDS.dhcpAssignLock.Unlock()
+	return m.storeLocked(machine, replace)
+}
+
+// storeLocked is store, with dhcpAssignLock held by the caller
+func (m *etcdMachineInterface) storeLocked(machine *Machine, replace bool) error {
 	if machine.Type == 0 {
 		if machine.IP == nil {
 			machine.Type = MTNormal
@@ -86,15 +142,15 @@ func (m *etcdMachineInterface) store(machine *Machine) error {
 		}
 	}
 
-	m.etcdDS.dhcpAssignLock.Lock()
-	defer m.etcdDS.dhcpAssignLock.Unlock()
-
 	machineInterfaces, err := m.etcdDS.MachineInterfaces()
 	if err != nil {
 		return fmt.Errorf("error while getting the machine interfaces: %s", err)
 	}
 	ipToMac := make(map[string]net.HardwareAddr)
 	for _, mi := range machineInterfaces {
+		if bytes.Equal(mi.Mac(), m.mac) {
+			continue // the record which is going to be replaced
+		}
 		machine, err := mi.Machine(false, nil)
 		if err != nil {
 			return fmt.Errorf("error while getting the machine for (%s): %s",
@@ -113,17 +169,28 @@ func (m *etcdMachineInterface) store(machine *Machine) error {
 				err)
 		}
 
-		counter := len(ipToMac) % m.etcdDS.leaseRange
-		firstCandidateIP := dhcp4.IPAdd(m.etcdDS.leaseStart, counter) // kickstarted
+		// the ranges and the exclusions of the subnets are respected
+		subnets, err := m.etcdDS.Subnets()
+		if err != nil {
+			return fmt.Errorf("error while getting the subnets: %s", err)
+		}
+		usable := func(ip net.IP) bool {
+			_, isAssigned := ipToMac[ip.String()]
+			return !isAssigned && allocatable(ip, subnets)
+		}
+
+		leaseStart, leaseRange := m.etcdDS.leaseRangeOf()
+		counter := len(ipToMac) % leaseRange
+		firstCandidateIP := dhcp4.IPAdd(leaseStart, counter) // kickstarted
 		candidateIP := net.IPv4(
 			firstCandidateIP[0], firstCandidateIP[1],
 			firstCandidateIP[2], firstCandidateIP[3]) // copy
 
-		for _, isAssigned := ipToMac[candidateIP.String()]; isAssigned; {
+		for !usable(candidateIP) {
 			candidateIP = dhcp4.IPAdd(candidateIP, 1)
 			counter++
-			if counter == m.etcdDS.leaseRange {
-				candidateIP = m.etcdDS.leaseStart
+			if counter == leaseRange {
+				candidateIP = leaseStart
 				counter = 0
 			}
 			if firstCandidateIP.Equal(candidateIP) {
@@ -131,7 +198,7 @@ func (m *etcdMachineInterface) store(machine *Machine) error {
 			}
 		}
 
-		if _, isAssigned := ipToMac[candidateIP.String()]; isAssigned {
+		if !usable(candidateIP) {
 			return fmt.Errorf("no unassigned IP was found")
 		}
 
@@ -148,7 +215,14 @@ func (m *etcdMachineInterface) store(machine *Machine) error {
 	if err != nil {
 		return fmt.Errorf("error while marshaling the machine: %s", err)
 	}
-	err = m.selfSet("_machine", string(jsonedStats))
+	if replace {
+		err = m.selfSet("_machine", string(jsonedStats))
+	} else {
+		err = m.etcdDS.create(m.prefixifyForMachine("_machine"), string(jsonedStats))
+		if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeNodeExist {
+			return ErrMachineExists
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("error while setting the marshaled machine: %s", err)
 	}
@@ -156,21 +230,212 @@ func (m *etcdMachineInterface) store(machine *Machine) error {
 	return nil
 }
 
-// CheckIn updates the _last_seen field of the machine
+// CheckIn updates the _last_seen field of the machine, and sets the
+// _first_boot field if it's not set yet. The failures are logged.
 func (m *etcdMachineInterface) CheckIn() {
-	m.selfSet("_last_seen", strconv.FormatInt(time.Now().Unix(), 10))
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	m.selfSet("_last_seen", now)
+
+	// it's never overwritten, so once it's set it's not written again
+	if firstBoot, err := m.FirstBoot(); err == nil && firstBoot != 0 {
+		return
+	}
+	err := m.etcdDS.create(m.prefixifyForMachine("_first_boot"), now)
+	if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeNodeExist {
+		return // set concurrently
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"where":  "datasource.CheckIn",
+			"object": m.mac.String(),
+		}).WithError(err).Warn("failed to set the first boot of the machine")
+	}
 }
 
 // LastSeen returns the last time the machine has been seen, 0 for never
 func (m *etcdMachineInterface) LastSeen() (int64, error) {
 	unixString, err := m.selfGet("_last_seen")
 	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return 0, nil
+		}
 		return 0, err
 	}
 	unixInt64, _ := strconv.ParseInt(unixString, 10, 64)
 	return unixInt64, nil
 }
 
+// FirstBoot returns the first time the machine has checked in, 0 for never
+func (m *etcdMachineInterface) FirstBoot() (int64, error) {
+	unixString, err := m.selfGet("_first_boot")
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	unixInt64, _ := strconv.ParseInt(unixString, 10, 64)
+	return unixInt64, nil
+}
+
+// Notes returns the notes of the machine, "" if there's none
+func (m *etcdMachineInterface) Notes() (string, error) {
+	notes, err := m.selfGet("_notes")
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return notes, nil
+}
+
+// SetNotes replaces the notes of the machine, an empty string removes them
+func (m *etcdMachineInterface) SetNotes(notes string) error {
+	if len(notes) > MaxNotesLength {
+		return fmt.Errorf("notes are longer than %d bytes", MaxNotesLength)
+	}
+	if notes == "" {
+		err := m.selfDelete("_notes")
+		if err != nil && !etcd.IsKeyNotFound(err) {
+			return err
+		}
+		return nil
+	}
+	return m.selfSet("_notes", notes)
+}
+
+// Lease returns the last lease of the machine, or nil if there's none
+func (m *etcdMachineInterface) Lease() (*Lease, error) {
+	leaseJSON, err := m.selfGet("_lease")
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var lease Lease
+	if err := json.Unmarshal([]byte(leaseJSON), &lease); err != nil {
+		return nil, fmt.Errorf("error while unmarshaling the lease: %s", err)
+	}
+	return &lease, nil
+}
+
+// StoreLease stores the lease which is acknowledged to the machine. A new
+// ip is recorded as an EventLease, but the renewals are not.
+func (m *etcdMachineInterface) StoreLease(lease Lease) error {
+	leaseJSON, err := json.Marshal(lease)
+	if err != nil {
+		return fmt.Errorf("error while marshaling the lease: %s", err)
+	}
+	previous, err := m.Lease()
+	if err != nil {
+		return err
+	}
+	if err := m.selfSet("_lease", string(leaseJSON)); err != nil {
+		return err
+	}
+	if previous == nil || !previous.IP.Equal(lease.IP) {
+		m.recordEvent(EventLease, lease.IP.String())
+	}
+	return nil
+}
+
+// ClientArch returns the client architecture which is last reported by the
+// machine, and false if there's none
+func (m *etcdMachineInterface) ClientArch() (uint16, bool, error) {
+	archString, err := m.selfGet("_client_arch")
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	arch, err := strconv.ParseUint(archString, 10, 16)
+	if err != nil {
+		return 0, false, fmt.Errorf("error while parsing the client arch: %s", err)
+	}
+	return uint16(arch), true, nil
+}
+
+// StoreClientArch stores the client architecture reported by the machine
+func (m *etcdMachineInterface) StoreClientArch(arch uint16) error {
+	return m.selfSet("_client_arch", strconv.FormatUint(uint64(arch), 10))
+}
+
+// UserClassProfile returns the match of the user class profile which is
+// chosen in the last dhcp ACK of the machine, "" if there's none
+func (m *etcdMachineInterface) UserClassProfile() (string, error) {
+	match, err := m.selfGet("_user_class_profile")
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return match, nil
+}
+
+// StoreUserClassProfile stores the match of the chosen user class profile,
+// and an empty string removes it
+func (m *etcdMachineInterface) StoreUserClassProfile(match string) error {
+	if match == "" {
+		err := m.selfDelete("_user_class_profile")
+		if err != nil && !etcd.IsKeyNotFound(err) {
+			return err
+		}
+		return nil
+	}
+	return m.selfSet("_user_class_profile", match)
+}
+
+// Provisioned returns the last time the pxelinux config is served to the
+// machine, 0 for never
+func (m *etcdMachineInterface) Provisioned() (int64, error) {
+	unixString, err := m.selfGet("_provisioned")
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	unixInt64, _ := strconv.ParseInt(unixString, 10, 64)
+	return unixInt64, nil
+}
+
+// StoreProvisioned records that the pxelinux config is served to the machine
+// now
+func (m *etcdMachineInterface) StoreProvisioned() error {
+	return m.selfSet("_provisioned", strconv.FormatInt(time.Now().Unix(), 10))
+}
+
+// Ignored reports whether the ignore variable of the machine is set. The
+// cluster variables are not looked up.
+func (m *etcdMachineInterface) Ignored() (bool, error) {
+	return m.selfBool(SpecialKeyIgnore)
+}
+
+// NoInstall reports whether the no-install variable of the machine is set.
+// The cluster variables are not looked up.
+func (m *etcdMachineInterface) NoInstall() (bool, error) {
+	return m.selfBool(SpecialKeyNoInstall)
+}
+
+// selfBool returns the boolean variable of the machine, false if it's not set
+func (m *etcdMachineInterface) selfBool(key string) (bool, error) {
+	value, err := m.selfGet(key)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
 // DeleteMachine deletes associated etcd folder of a machine entirely
 func (m *etcdMachineInterface) DeleteMachine() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -184,22 +449,92 @@ func (m *etcdMachineInterface) DeleteMachine() error {
 // ListFlags returns the list of all the flgas of a machine from Etcd
 // etcd and machine prefix will be added to the path
 func (m *etcdMachineInterface) ListVariables() (map[string]string, error) {
+	variables, err := m.ListVariablesWithMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	flags := make(map[string]string)
+	for k, variable := range variables {
+		flags[k] = variable.Value
+	}
+
+	return flags, nil
+}
+
+// ListVariablesPage returns the variables of the machine whose keys start
+// with prefix, see PageKeys
+func (m *etcdMachineInterface) ListVariablesPage(prefix, after string,
+	limit int) (map[string]string, bool, error) {
+	variables, err := m.ListVariables()
+	if err != nil {
+		return nil, false, err
+	}
+
+	keys := make([]string, 0, len(variables))
+	for k := range variables {
+		keys = append(keys, k)
+	}
+	keys, more := PageKeys(keys, prefix, after, limit)
+
+	page := make(map[string]string)
+	for _, k := range keys {
+		page[k] = variables[k]
+	}
+	return page, more, nil
+}
+
+// ListVariablesWithMetadata returns the variables of the machine, along with
+// their modification times
+func (m *etcdMachineInterface) ListVariablesWithMetadata() (map[string]VariableInfo, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	response, err := m.keysAPI.Get(ctx, path.Join(m.etcdDS.ClusterName(),
-		"machines", m.Hostname()), nil)
+		"machines", m.Hostname()), &etcd.GetOptions{Recursive: true})
 	if err != nil {
 		return nil, err
 	}
 
-	flags := make(map[string]string)
-	for i := range response.Node.Nodes {
-		_, k := path.Split(response.Node.Nodes[i].Key)
-		flags[k] = response.Node.Nodes[i].Value
+	variables := make(map[string]VariableInfo)
+	modified := make(map[string]int64)
+	for _, n := range response.Node.Nodes {
+		_, k := path.Split(n.Key)
+		if n.Dir {
+			if k == etcdModifiedDirName {
+				for _, child := range n.Nodes {
+					_, childKey := path.Split(child.Key)
+					modified[childKey], _ = strconv.ParseInt(child.Value, 10, 64)
+				}
+			}
+			continue
+		}
+		variables[k] = VariableInfo{
+			Value:         n.Value,
+			ModifiedIndex: n.ModifiedIndex,
+		}
+	}
+	for k, variable := range variables {
+		variable.Modified = modified[k]
+		variables[k] = variable
 	}
 
-	return flags, nil
+	return variables, nil
+}
+
+// OwnVariable returns the machine's own value of the variable, and false if
+// it's not set for the machine
+func (m *etcdMachineInterface) OwnVariable(key string) (string, bool, error) {
+	value, err := m.selfGet(key)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf(
+			"error while getting variable key=%s for machine=%s: %s",
+			key, m.mac, err)
+	}
+	return value, true, nil
 }
 
 // GetVariable Gets a machine's variable, or the global if it was not
@@ -237,12 +572,74 @@ func (m *etcdMachineInterface) SetVariable(key, value string) error {
 	if err != nil {
 		return err
 	}
-	return m.selfSet(key, value)
+	if key == SpecialKeyNetworkConfiguration {
+		ip, _ := m.etcdDS.leaseRangeOf()
+		if machine, err := m.Machine(false, nil); err == nil {
+			ip = machine.IP
+		}
+		if err := checkNetworkConfigurationSubnet(value, ip); err != nil {
+			return err
+		}
+	}
+	if key == SpecialKeyQuarantineSubnet {
+		leaseStart, leaseRange := m.etcdDS.leaseRangeOf()
+		if err := checkQuarantineSubnetRange(value, leaseStart, leaseRange); err != nil {
+			return err
+		}
+	}
+	err = m.selfSet(key, value)
+	if err != nil {
+		return err
+	}
+	err = m.selfSet(path.Join(etcdModifiedDirName, key),
+		strconv.FormatInt(time.Now().Unix(), 10))
+	if err != nil {
+		return err
+	}
+	m.recordEvent(EventVariableSet, key)
+	return nil
 }
 
 // DeleteVariable erases the entry specified by key
 func (m *etcdMachineInterface) DeleteVariable(key string) error {
-	return m.selfDelete(key)
+	m.selfDelete(path.Join(etcdModifiedDirName, key))
+	if err := m.selfDelete(key); err != nil {
+		return err
+	}
+	m.recordEvent(EventVariableDeleted, key)
+	return nil
+}
+
+// DeleteVariables erases all the variables of the machine, except the ones
+// in preserve and the hidden keys, and returns the number of the erased ones
+func (m *etcdMachineInterface) DeleteVariables(preserve ...string) (int, error) {
+	variables, err := m.ListVariables()
+	if err != nil {
+		return 0, err
+	}
+
+	preserved := make(map[string]bool)
+	for _, key := range preserve {
+		preserved[key] = true
+	}
+
+	count := 0
+	for key := range variables {
+		if key[0] == '_' || preserved[key] {
+			continue
+		}
+		if err := m.DeleteVariable(key); err != nil {
+			return count, fmt.Errorf("error while deleting variable key=%s: %s", key, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// EtcdKey returns the etcd key of the given variable of the machine, or the
+// key of the machine's directory if key is empty
+func (m *etcdMachineInterface) EtcdKey(key string) string {
+	return m.prefixifyForMachine(key)
 }
 
 func (m *etcdMachineInterface) prefixifyForMachine(key string) string {
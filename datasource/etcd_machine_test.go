@@ -2,7 +2,9 @@ package datasource
 
 import (
 	"net"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestAssign(t *testing.T) {
@@ -127,3 +129,259 @@ func TestLeaseRange(t *testing.T) {
 		return
 	}
 }
+
+func TestLeaseRangeExclusions(t *testing.T) {
+	ds, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	// the lease range is 127.0.0.2-127.0.0.11
+	err = ds.SetSubnet(&SubnetDefinition{
+		CIDR:       "127.0.0.0/24",
+		RangeStart: net.IPv4(127, 0, 0, 3),
+		RangeEnd:   net.IPv4(127, 0, 0, 8),
+		Exclude:    []net.IP{net.IPv4(127, 0, 0, 4), net.IPv4(127, 0, 0, 6)},
+	})
+	if err != nil {
+		t.Error("error while setting the subnet:", err)
+		return
+	}
+
+	assigned := make(map[string]bool)
+	for i := 1; i <= 4; i++ {
+		mac := net.HardwareAddr{1, 1, 1, 1, 2, byte(i)}
+		machine, err := ds.MachineInterface(mac).Machine(true, nil)
+		if err != nil {
+			t.Error("error in creating machine:", err)
+			return
+		}
+		assigned[machine.IP.String()] = true
+	}
+	for _, ip := range []string{"127.0.0.3", "127.0.0.5", "127.0.0.7", "127.0.0.8"} {
+		if !assigned[ip] {
+			t.Errorf("expected %s to be assigned, got %v", ip, assigned)
+		}
+	}
+
+	mac := net.HardwareAddr{1, 1, 1, 1, 2, 5}
+	if _, err := ds.MachineInterface(mac).Machine(true, nil); err == nil {
+		t.Error("expecting 'no unassigned IP was found' error")
+	}
+}
+
+func TestFirstBoot(t *testing.T) {
+	ds, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:F0")
+	machineInterface := ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(true, nil); err != nil {
+		t.Error("error in creating the machine:", err)
+		return
+	}
+
+	if firstBoot, err := machineInterface.FirstBoot(); firstBoot != 0 || err != nil {
+		t.Error("expected no first boot before checking in, got", firstBoot, err)
+	}
+
+	machineInterface.CheckIn()
+	firstBoot, err := machineInterface.FirstBoot()
+	if err != nil || firstBoot == 0 {
+		t.Error("expected the first boot to be set by CheckIn:", firstBoot, err)
+		return
+	}
+
+	// pretend it has happened a while ago
+	m := machineInterface.(*etcdMachineInterface)
+	if err := m.selfSet("_first_boot", "1000"); err != nil {
+		t.Error("error while setting _first_boot:", err)
+		return
+	}
+
+	machineInterface.CheckIn()
+	if firstBoot, _ := machineInterface.FirstBoot(); firstBoot != 1000 {
+		t.Error("expected the first boot not to be overwritten, got", firstBoot)
+	}
+}
+
+func TestMachineEvents(t *testing.T) {
+	ds, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:F4")
+	machineInterface := ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(true, nil); err != nil {
+		t.Error("error in creating the machine:", err)
+		return
+	}
+	if events, err := machineInterface.Events(); err != nil || len(events) != 0 {
+		t.Error("expected no events for a new machine, got", events, err)
+	}
+
+	// only the changes of the agent state are recorded
+	for _, state := range []string{AgentStateBooting, AgentStateRunning, AgentStateRunning} {
+		if err := machineInterface.SetAgentState(state, time.Minute); err != nil {
+			t.Error("error while setting the agent state:", err)
+			return
+		}
+	}
+	events, err := machineInterface.Events()
+	if err != nil || len(events) != 2 ||
+		events[0].Detail != AgentStateBooting || events[1].Detail != AgentStateRunning {
+		t.Error("expected the transitions of the agent state, got", events, err)
+	}
+
+	// the events beyond MaxMachineEvents are dropped, the oldest first
+	for i := 0; i < MaxMachineEvents; i++ {
+		if err := machineInterface.SetVariable("key", strconv.Itoa(i)); err != nil {
+			t.Error("error while setting the variable:", err)
+			return
+		}
+	}
+	events, err = machineInterface.Events()
+	if err != nil || len(events) != MaxMachineEvents {
+		t.Errorf("expected %d events, got %d: %v", MaxMachineEvents, len(events), err)
+		return
+	}
+	for i, event := range events {
+		if event.Event != EventVariableSet || event.Detail != "key" {
+			t.Errorf("#%d: expected only the variable events to be kept, got %v", i, event)
+			break
+		}
+	}
+}
+
+func TestClaim(t *testing.T) {
+	ds, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:F1")
+	machineInterface := ds.MachineInterface(mac)
+	claimed, err := machineInterface.Claim(Machine{Labels: []string{"rack-a1"}})
+	if err != nil {
+		t.Error("error while claiming the machine:", err)
+		return
+	}
+	if claimed.IP == nil || claimed.Type != MTNormal || claimed.FirstSeen == 0 {
+		t.Error("expected an assigned ip and the defaults in the claimed machine:", claimed)
+	}
+
+	if _, err := machineInterface.Claim(Machine{}); err != ErrMachineExists {
+		t.Error("expected the second claim to fail with ErrMachineExists, got", err)
+	}
+
+	// the auto-creation keeps the claimed record
+	machine, err := machineInterface.Machine(true, nil)
+	if err != nil {
+		t.Error("error while getting the machine:", err)
+		return
+	}
+	if !machine.IP.Equal(claimed.IP) || len(machine.Labels) != 1 {
+		t.Error("expected the claimed machine, got", machine)
+	}
+}
+
+func TestListVariablesPage(t *testing.T) {
+	ds, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:F1")
+	machineInterface := ds.MachineInterface(mac)
+	for _, key := range []string{"disk-a", "disk-b", "disk-c", "role"} {
+		if err := machineInterface.SetVariable(key, "x"); err != nil {
+			t.Error("error while setting variable:", err)
+			return
+		}
+	}
+
+	tests := []struct {
+		prefix   string
+		after    string
+		limit    int
+		expected []string
+		more     bool
+	}{
+		{"disk-", "", 0, []string{"disk-a", "disk-b", "disk-c"}, false},
+		{"disk-", "", 2, []string{"disk-a", "disk-b"}, true},
+		{"disk-", "disk-b", 2, []string{"disk-c"}, false},
+		{"role", "", 0, []string{"role"}, false},
+		{"none", "", 0, nil, false},
+	}
+
+	for i, tt := range tests {
+		page, more, err := machineInterface.ListVariablesPage(tt.prefix, tt.after, tt.limit)
+		if err != nil {
+			t.Errorf("#%d: error while listing the variables: %s", i, err)
+			continue
+		}
+		if more != tt.more || len(page) != len(tt.expected) {
+			t.Errorf("#%d: expected %v (more=%v), got %v (more=%v)", i, tt.expected, tt.more, page, more)
+			continue
+		}
+		for _, key := range tt.expected {
+			if _, found := page[key]; !found {
+				t.Errorf("#%d: expected %q in %v", i, key, page)
+			}
+		}
+	}
+}
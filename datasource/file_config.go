@@ -0,0 +1,254 @@
+package datasource
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+)
+
+// The keys of the config file which are not cluster variables
+const (
+	// fileKeyLeaseStart and fileKeyLeaseRange set the lease range, like the
+	// -lease-start and -lease-range flags
+	fileKeyLeaseStart = "lease-start"
+	fileKeyLeaseRange = "lease-range"
+	// fileKeySubnets sets the subnet definitions, as a json list
+	fileKeySubnets = "subnets"
+)
+
+// fileConfigSettle is how long the changes of the config file settle before
+// it's reloaded, so a file which is being written isn't read half-written
+const fileConfigSettle = 200 * time.Millisecond
+
+// FileConfig is a set of cluster variables which are read from a local yaml
+// file, in the same format as initial.yaml. The lease range, which is given
+// by lease-start and lease-range, and the subnet definitions, which are
+// given by subnets as a json list, may be set in it too. The file is
+// reloaded when it's changed, so it can be used before etcd is populated,
+// or for the settings which are better kept out of etcd. It's safe for
+// concurrent use.
+type FileConfig struct {
+	path string
+
+	mu         sync.RWMutex
+	data       []byte
+	values     map[string]string
+	leaseStart net.IP
+	leaseRange int
+	subnets    []SubnetDefinition
+}
+
+// NewFileConfig reads the config file at the given path
+func NewFileConfig(path string) (*FileConfig, error) {
+	fc := &FileConfig{path: path}
+	if _, err := fc.Reload(); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// Get returns the value of the variable, and whether it's set in the file
+func (fc *FileConfig) Get(key string) (string, bool) {
+	if fc == nil {
+		return "", false
+	}
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	value, isIn := fc.values[key]
+	return value, isIn
+}
+
+// Values returns a copy of the variables of the file
+func (fc *FileConfig) Values() map[string]string {
+	values := make(map[string]string)
+	if fc == nil {
+		return values
+	}
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	for key, value := range fc.values {
+		values[key] = value
+	}
+	return values
+}
+
+// LeaseRange returns the lease range of the file, or nil and 0 if it's not
+// set
+func (fc *FileConfig) LeaseRange() (net.IP, int) {
+	if fc == nil {
+		return nil, 0
+	}
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.leaseStart, fc.leaseRange
+}
+
+// Subnets returns a copy of the subnet definitions of the file
+func (fc *FileConfig) Subnets() []SubnetDefinition {
+	if fc == nil {
+		return nil
+	}
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return append([]SubnetDefinition(nil), fc.subnets...)
+}
+
+// Reload reads the file again, and reports whether it's changed since the
+// last read. An invalid file is rejected as a whole, and the previous
+// values are kept.
+func (fc *FileConfig) Reload() (bool, error) {
+	data, err := ioutil.ReadFile(fc.path)
+	if err != nil {
+		return false, fmt.Errorf("error while reading the config file: %s", err)
+	}
+
+	fc.mu.RLock()
+	unchanged := fc.values != nil && bytes.Equal(data, fc.data)
+	fc.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	values := make(map[string]string)
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return false, fmt.Errorf("error while parsing the config file: %s", err)
+	}
+	leaseStart, leaseRange, err := parseFileLeaseRange(values)
+	if err != nil {
+		return false, fmt.Errorf("invalid lease range in the config file: %s", err)
+	}
+	subnets, err := parseFileSubnets(values)
+	if err != nil {
+		return false, fmt.Errorf("invalid %q in the config file: %s", fileKeySubnets, err)
+	}
+	for key, value := range values {
+		if err := validateVariable(key, value); err != nil {
+			return false, fmt.Errorf("invalid value for %q in the config file: %s", key, err)
+		}
+	}
+
+	fc.mu.Lock()
+	fc.data, fc.values = data, values
+	fc.leaseStart, fc.leaseRange, fc.subnets = leaseStart, leaseRange, subnets
+	fc.mu.Unlock()
+	return true, nil
+}
+
+// parseFileLeaseRange takes the lease range out of the values of the file
+func parseFileLeaseRange(values map[string]string) (net.IP, int, error) {
+	startStr, hasStart := values[fileKeyLeaseStart]
+	rangeStr, hasRange := values[fileKeyLeaseRange]
+	delete(values, fileKeyLeaseStart)
+	delete(values, fileKeyLeaseRange)
+	if !hasStart && !hasRange {
+		return nil, 0, nil
+	}
+	if !hasStart || !hasRange {
+		return nil, 0, fmt.Errorf("both of %q and %q are required", fileKeyLeaseStart, fileKeyLeaseRange)
+	}
+
+	leaseStart := net.ParseIP(startStr).To4()
+	if leaseStart == nil {
+		return nil, 0, fmt.Errorf("invalid ipv4 address: %q", startStr)
+	}
+	leaseRange, err := strconv.Atoi(rangeStr)
+	if err != nil {
+		return nil, 0, err
+	}
+	if leaseRange <= 1 {
+		return nil, 0, errors.New("lease range should be greater that 1")
+	}
+	return leaseStart, leaseRange, nil
+}
+
+// parseFileSubnets takes the subnet definitions out of the values of the
+// file, and validates them the same way SetSubnet does
+func parseFileSubnets(values map[string]string) ([]SubnetDefinition, error) {
+	subnetsJSON, isIn := values[fileKeySubnets]
+	delete(values, fileKeySubnets)
+	if !isIn {
+		return nil, nil
+	}
+
+	var subnets []SubnetDefinition
+	if err := json.Unmarshal([]byte(subnetsJSON), &subnets); err != nil {
+		return nil, err
+	}
+	for i := range subnets {
+		if _, err := subnets[i].Validate(); err != nil {
+			return nil, err
+		}
+		if err := checkSubnetOverlap(&subnets[i], subnets[:i]); err != nil {
+			return nil, err
+		}
+	}
+	return subnets, nil
+}
+
+// Watch reloads the file when it's changed, until stop is closed. The
+// directory of the file is watched rather than the file, so the file may be
+// replaced, e.g. by an editor which renames a new file over it, or by the
+// symlink swap of a kubernetes config map.
+func (fc *FileConfig) Watch(stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error while watching the config file: %s", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(fc.path)); err != nil {
+		return fmt.Errorf("error while watching the config file: %s", err)
+	}
+	// the changes before the watch has started are not missed
+	fc.reloadAndLog()
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return nil
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// the other files of the directory don't change the content,
+			// and then it's not reloaded
+			settled = time.After(fileConfigSettle)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.WithField("where", "datasource.FileConfig.Watch").WithError(err).Warn(
+				"error while watching the config file")
+		case <-settled:
+			settled = nil
+			fc.reloadAndLog()
+		}
+	}
+}
+
+func (fc *FileConfig) reloadAndLog() {
+	reloaded, err := fc.Reload()
+	if err != nil {
+		log.WithField("where", "datasource.FileConfig.Watch").WithError(err).Warn(
+			"failed to reload the config file, keeping the previous values")
+		return
+	}
+	if reloaded {
+		log.WithFields(log.Fields{
+			"where":   "datasource.FileConfig.Watch",
+			"action":  "reload",
+			"subject": fc.path,
+		}).Info("config file is reloaded")
+	}
+}
@@ -0,0 +1,258 @@
+package datasource
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-file-config")
+	if err != nil {
+		t.Error("failed to create a temp dir:", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	if err := ioutil.WriteFile(path, []byte("wpad-url: http://a/wpad.dat\n"), 0644); err != nil {
+		t.Error("failed to write the config file:", err)
+		return
+	}
+	fc, err := NewFileConfig(path)
+	if err != nil {
+		t.Error("failed to load the config file:", err)
+		return
+	}
+	if value, _ := fc.Get(SpecialKeyWPADURL); value != "http://a/wpad.dat" {
+		t.Error("unexpected value after the first load:", value)
+	}
+
+	if reloaded, err := fc.Reload(); err != nil || reloaded {
+		t.Error("expected no reload for an unchanged file, got", reloaded, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("wpad-url: http://bb/wpad.dat\nmaintenance: \"true\"\n"), 0644); err != nil {
+		t.Error("failed to write the config file:", err)
+		return
+	}
+	if reloaded, err := fc.Reload(); err != nil || !reloaded {
+		t.Error("expected a reload for the changed file, got", reloaded, err)
+		return
+	}
+	if value, _ := fc.Get(SpecialKeyWPADURL); value != "http://bb/wpad.dat" {
+		t.Error("unexpected value after the reload:", value)
+	}
+	if _, isIn := fc.Get(SpecialKeyMaintenance); !isIn {
+		t.Error("expected the added variable to be loaded")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("maintenance: maybe\n"), 0644); err != nil {
+		t.Error("failed to write the config file:", err)
+		return
+	}
+	if _, err := fc.Reload(); err == nil {
+		t.Error("expected an error for an invalid value")
+	}
+	if value, _ := fc.Get(SpecialKeyWPADURL); value != "http://bb/wpad.dat" {
+		t.Error("expected the previous values to be kept, got", value)
+	}
+}
+
+func TestFileConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-file-config")
+	if err != nil {
+		t.Error("failed to create a temp dir:", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	content := "wpad-url: http://file/wpad.dat\nntp-servers: 10.0.0.1\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Error("failed to write the config file:", err)
+		return
+	}
+	fc, err := NewFileConfig(path)
+	if err != nil {
+		t.Error("failed to load the config file:", err)
+		return
+	}
+
+	testCases := []struct {
+		fileWins bool
+		key      string
+		expected string
+	}{
+		{false, SpecialKeyWPADURL, "http://etcd/wpad.dat"},
+		{false, SpecialKeyNTPServers, "10.0.0.1"},
+		{true, SpecialKeyWPADURL, "http://file/wpad.dat"},
+		{true, SpecialKeyNTPServers, "10.0.0.1"},
+	}
+	for i, tc := range testCases {
+		ds, err := ForTest(&ForTestParams{FileConfig: fc, FileConfigWins: tc.fileWins})
+		if err != nil {
+			t.Error("error in getting a DataSource instance for our test:", err)
+			return
+		}
+		if err := ds.WhileMaster(); err != nil {
+			t.Error("failed to register as the master instance:", err)
+			return
+		}
+		defer func() {
+			if err := ds.Shutdown(); err != nil {
+				t.Error("failed to shutdown:", err)
+			}
+		}()
+		if err := ds.SetClusterVariable(SpecialKeyWPADURL, "http://etcd/wpad.dat"); err != nil {
+			t.Error("failed to set the cluster variable:", err)
+			return
+		}
+
+		value, err := ds.GetClusterVariable(tc.key)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %s", i, err)
+		} else if value != tc.expected {
+			t.Errorf("#%d: expected %q, got %q", i, tc.expected, value)
+		}
+		variables, err := ds.ListClusterVariables()
+		if err != nil {
+			t.Errorf("#%d: unexpected error while listing: %s", i, err)
+		} else if variables[tc.key] != tc.expected {
+			t.Errorf("#%d: expected %q in the list, got %q", i, tc.expected, variables[tc.key])
+		}
+	}
+}
+
+func TestFileConfigLeaseRangeAndSubnets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-file-config")
+	if err != nil {
+		t.Error("failed to create a temp dir:", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	content := "lease-start: 127.0.0.50\nlease-range: \"2\"\n" +
+		`subnets: '[{"cidr": "127.0.0.0/24", "router": "127.0.0.254"}, {"cidr": "10.0.0.0/8"}]'` + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Error("failed to write the config file:", err)
+		return
+	}
+	fc, err := NewFileConfig(path)
+	if err != nil {
+		t.Error("failed to load the config file:", err)
+		return
+	}
+	if _, isIn := fc.Get(fileKeySubnets); isIn {
+		t.Error("expected the subnets not to be a cluster variable")
+	}
+
+	for _, fileWins := range []bool{false, true} {
+		ds, err := ForTest(&ForTestParams{FileConfig: fc, FileConfigWins: fileWins})
+		if err != nil {
+			t.Error("error in getting a DataSource instance for our test:", err)
+			return
+		}
+		if err := ds.WhileMaster(); err != nil {
+			t.Error("failed to register as the master instance:", err)
+			return
+		}
+		defer func() {
+			if err := ds.Shutdown(); err != nil {
+				t.Error("failed to shutdown:", err)
+			}
+		}()
+		etcdDS := ds.(*EtcdDataSource)
+		if err := ds.SetSubnet(&SubnetDefinition{CIDR: "127.0.0.0/24", Router: net.IPv4(127, 0, 0, 1)}); err != nil {
+			t.Error("failed to set the subnet:", err)
+			return
+		}
+
+		leaseStart, leaseRange := etcdDS.leaseRangeOf()
+		if fileWins != leaseStart.Equal(net.IPv4(127, 0, 0, 50)) || fileWins != (leaseRange == 2) {
+			t.Errorf("fileWins=%v: unexpected lease range %s+%d", fileWins, leaseStart, leaseRange)
+		}
+
+		subnets, err := ds.Subnets()
+		if err != nil || len(subnets) != 2 {
+			t.Errorf("fileWins=%v: expected two subnets, got %v, %v", fileWins, subnets, err)
+			continue
+		}
+		expectedRouter := net.IPv4(127, 0, 0, 1)
+		if fileWins {
+			expectedRouter = net.IPv4(127, 0, 0, 254)
+		}
+		if subnets[1].CIDR != "127.0.0.0/24" || !subnets[1].Router.Equal(expectedRouter) {
+			t.Errorf("fileWins=%v: expected the router %s, got %+v", fileWins, expectedRouter, subnets[1])
+		}
+	}
+
+	for _, invalid := range []string{
+		"lease-start: 127.0.0.50\n",
+		"lease-start: 127.0.0.50\nlease-range: \"1\"\n",
+		`subnets: '[{"cidr": "10.0.0.0/8"}, {"cidr": "10.1.0.0/16"}]'` + "\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(invalid), 0644); err != nil {
+			t.Error("failed to write the config file:", err)
+			return
+		}
+		if _, err := fc.Reload(); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestFileConfigWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-file-config")
+	if err != nil {
+		t.Error("failed to create a temp dir:", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	if err := ioutil.WriteFile(path, []byte("wpad-url: http://a/wpad.dat\n"), 0644); err != nil {
+		t.Error("failed to write the config file:", err)
+		return
+	}
+	fc, err := NewFileConfig(path)
+	if err != nil {
+		t.Error("failed to load the config file:", err)
+		return
+	}
+
+	stop := make(chan struct{})
+	watchErr := make(chan error, 1)
+	go func() { watchErr <- fc.Watch(stop) }()
+	defer func() {
+		close(stop)
+		if err := <-watchErr; err != nil {
+			t.Error("failed to watch the config file:", err)
+		}
+	}()
+
+	// the file is replaced, the way the editors save it
+	tmpPath := filepath.Join(dir, "config.yaml.tmp")
+	if err := ioutil.WriteFile(tmpPath, []byte("wpad-url: http://bb/wpad.dat\n"), 0644); err != nil {
+		t.Error("failed to write the config file:", err)
+		return
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		t.Error("failed to replace the config file:", err)
+		return
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if value, _ := fc.Get(SpecialKeyWPADURL); value == "http://bb/wpad.dat" {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	value, _ := fc.Get(SpecialKeyWPADURL)
+	t.Error("expected the changed file to be reloaded, got", value)
+}
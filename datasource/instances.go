@@ -22,14 +22,20 @@ const (
 	etcdTimeout      = 5 * time.Second
 )
 
+// instanceTTL is the ttl of the record of the instance, which is renewed by
+// each heartbeat (WhileMaster). The record of an instance which misses its
+// heartbeats expires, so it's no longer listed by Instances, e.g. as a
+// nameserver. It's shortened in the tests.
+var instanceTTL = masterTTLTime
+
 func (ds *EtcdDataSource) registerOnEtcd() error {
 	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
 	defer cancel()
 	masterOrderOption := etcd.CreateInOrderOptions{
-		TTL: masterTTLTime,
+		TTL: instanceTTL,
 	}
 	resp, err := ds.keysAPI.CreateInOrder(ctx, path.Join(ds.ClusterName(), instancesEtcdDir),
-		ds.selfInfo.String(), &masterOrderOption)
+		ds.heartbeatInfo(), &masterOrderOption)
 	if err != nil {
 		return err
 	}
@@ -43,12 +49,21 @@ func (ds *EtcdDataSource) etcdHeartbeat() error {
 	defer cancel()
 	masterSetOption := etcd.SetOptions{
 		PrevExist: etcd.PrevExist,
-		TTL:       masterTTLTime,
+		TTL:       instanceTTL,
 	}
-	_, err := ds.keysAPI.Set(ctx, ds.instanceEtcdKey, ds.selfInfo.String(), &masterSetOption)
+	_, err := ds.keysAPI.Set(ctx, ds.instanceEtcdKey, ds.heartbeatInfo(), &masterSetOption)
 	return err
 }
 
+// heartbeatInfo updates the time of the last heartbeat of the instance, and
+// returns its marshaled InstanceInfo
+func (ds *EtcdDataSource) heartbeatInfo() string {
+	ds.selfInfoLock.Lock()
+	defer ds.selfInfoLock.Unlock()
+	ds.selfInfo.LastHeartbeat = time.Now().UTC().Unix()
+	return ds.selfInfo.String()
+}
+
 // IsMaster checks for being master
 func (ds *EtcdDataSource) IsMaster() error {
 	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
@@ -100,7 +115,7 @@ func (ds *EtcdDataSource) Shutdown() error {
 }
 
 // Instances returns the InstanceInfo of all the present instances of
-// blacksmith in our cluster
+// blacksmith in our cluster, i.e. the ones whose records haven't expired
 func (ds *EtcdDataSource) Instances() ([]InstanceInfo, error) {
 	var instances []InstanceInfo
 
@@ -129,6 +144,8 @@ func (ds *EtcdDataSource) Instances() ([]InstanceInfo, error) {
 
 // SelfInfo return InstanceInfo of this instance of blacksmith
 func (ds *EtcdDataSource) SelfInfo() InstanceInfo {
+	ds.selfInfoLock.Lock()
+	defer ds.selfInfoLock.Unlock()
 	return ds.selfInfo
 }
 
@@ -1,6 +1,9 @@
 package datasource
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestInstances(t *testing.T) {
 	ds, err := ForTest(nil)
@@ -42,3 +45,84 @@ func TestInstances(t *testing.T) {
 		return
 	}
 }
+
+func TestInstanceMissedHeartbeat(t *testing.T) {
+	defer func(ttl time.Duration) {
+		instanceTTL = ttl
+	}(instanceTTL)
+	instanceTTL = time.Second
+
+	ds, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	if instances, err := ds.Instances(); err != nil || len(instances) != 1 {
+		t.Errorf("expected the instance to be listed, got (%v, %v)", instances, err)
+		return
+	}
+
+	// no heartbeat in the ttl
+	time.Sleep(2 * instanceTTL)
+	if instances, err := ds.Instances(); err != nil || len(instances) != 0 {
+		t.Errorf("expected the record of the instance to be expired, got (%v, %v)", instances, err)
+	}
+
+	// the next heartbeat fails, and the one after it registers again
+	if err := ds.WhileMaster(); err == nil {
+		t.Error("expected the heartbeat of the expired record to fail")
+	}
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register again:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	if instances, err := ds.Instances(); err != nil || len(instances) != 1 {
+		t.Errorf("expected the instance to be listed again, got (%v, %v)", instances, err)
+	}
+}
+
+func TestSelfInfoWhileHeartbeat(t *testing.T) {
+	ds, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	// the heartbeats update the info which is read by the other goroutines,
+	// which is caught by the race detector if it's not guarded
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			ds.WhileMaster()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		ds.SelfInfo()
+	}
+	<-done
+
+	if ds.SelfInfo().LastHeartbeat == 0 {
+		t.Error("expected the time of the last heartbeat to be set")
+	}
+}
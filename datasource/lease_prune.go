@@ -0,0 +1,109 @@
+package datasource
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	etcd "github.com/coreos/etcd/client"
+)
+
+// LeasePruneInterval is how often the leases are pruned, if MaxLeases or
+// LeaseRetention of the Options is set
+const LeasePruneInterval = 10 * time.Minute
+
+type expiredLease struct {
+	machineInterface *etcdMachineInterface
+	expiry           int64
+}
+
+type expiredLeasesByExpiry []expiredLease
+
+func (l expiredLeasesByExpiry) Len() int           { return len(l) }
+func (l expiredLeasesByExpiry) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l expiredLeasesByExpiry) Less(i, j int) bool { return l[i].expiry < l[j].expiry }
+
+// PruneLeases deletes the records of the machines whose leases have expired
+// longer than LeaseRetention ago, and then the ones of the oldest expired
+// leases until there are at most MaxLeases leases, see Options. The whole
+// record of a machine is deleted along with its variables, so its ip is
+// freed, and a late renewal of it isn't honored but is ignored, as it's
+// unknown. The machines without a lease, e.g. the imported ones, and the
+// ones with an active lease are kept. It returns the number of the pruned
+// machines.
+func (ds *EtcdDataSource) PruneLeases(now time.Time) (int, error) {
+	maxLeases, retention := ds.options.MaxLeases, ds.options.LeaseRetention
+	if maxLeases <= 0 && retention <= 0 {
+		return 0, nil
+	}
+	if err := ds.IsMaster(); err != nil {
+		return 0, fmt.Errorf("only the master instance is allowed to prune the leases: %s", err)
+	}
+
+	machineInterfaces, err := ds.MachineInterfaces()
+	if err != nil {
+		return 0, fmt.Errorf("error while getting the machine interfaces: %s", err)
+	}
+
+	var leases int
+	var expired []expiredLease
+	for _, mi := range machineInterfaces {
+		lease, err := mi.Lease()
+		if err != nil {
+			return 0, fmt.Errorf("error while getting the lease of (%s): %s", mi.Mac(), err)
+		}
+		if lease == nil {
+			continue
+		}
+		leases++
+		if !lease.Active(now) {
+			expired = append(expired, expiredLease{mi.(*etcdMachineInterface), lease.Expiry})
+		}
+	}
+	sort.Sort(expiredLeasesByExpiry(expired))
+
+	var pruned int
+	for _, e := range expired {
+		tooOld := retention > 0 && e.expiry < now.Add(-retention).Unix()
+		tooMany := maxLeases > 0 && leases-pruned > maxLeases
+		if !tooOld && !tooMany {
+			break
+		}
+		if err := e.machineInterface.DeleteMachine(); err != nil && !etcd.IsKeyNotFound(err) {
+			return pruned, fmt.Errorf("error while deleting the machine (%s): %s",
+				e.machineInterface.Mac(), err)
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// PruneLeasesEvery prunes the leases of ds every interval, until stop is
+// closed. Only the master prunes them, the other instances skip it.
+func PruneLeasesEvery(ds DataSource, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if ds.IsMaster() != nil {
+			continue
+		}
+
+		pruned, err := ds.PruneLeases(time.Now())
+		if err != nil {
+			log.WithField("where", "datasource.PruneLeasesEvery").WithError(err).Warn(
+				"failed to prune the leases")
+		}
+		if pruned > 0 {
+			log.WithFields(log.Fields{
+				"where":  "datasource.PruneLeasesEvery",
+				"action": "prune",
+			}).Infof("%d machines with expired leases are pruned", pruned)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package datasource
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPruneLeases(t *testing.T) {
+	ds, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	etcdDS := ds.(*EtcdDataSource)
+
+	now := time.Now()
+	expiries := []time.Time{
+		now.Add(time.Hour),       // active
+		now.Add(-48 * time.Hour), // beyond the retention
+		now.Add(-time.Hour),
+		now.Add(-10 * time.Minute),
+	}
+	var macs []net.HardwareAddr
+	for i, expiry := range expiries {
+		mac := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, byte(0xf2 + i)}
+		machineInterface := ds.MachineInterface(mac)
+		machine, err := machineInterface.Machine(true, nil)
+		if err != nil {
+			t.Error("error while creating the machine:", err)
+			return
+		}
+		if err := machineInterface.StoreLease(Lease{IP: machine.IP, Expiry: expiry.Unix()}); err != nil {
+			t.Error("error while storing the lease:", err)
+			return
+		}
+		macs = append(macs, mac)
+	}
+	hasLease := func(i int) bool {
+		known, err := ds.MachineInterface(macs[i]).Known()
+		if err != nil {
+			t.Error("error while checking the machine:", err)
+		}
+		return known
+	}
+
+	if pruned, err := ds.PruneLeases(now); err != nil || pruned != 0 {
+		t.Error("expected nothing to be pruned without a limit, got", pruned, err)
+	}
+
+	etcdDS.options.MaxLeases, etcdDS.options.LeaseRetention = 3, 24*time.Hour
+	if pruned, err := ds.PruneLeases(now); err != nil || pruned != 1 {
+		t.Error("expected the lease beyond the retention to be pruned, got", pruned, err)
+	}
+	if hasLease(1) || !hasLease(2) || !hasLease(3) {
+		t.Error("expected only the machine of the lease beyond the retention to be pruned")
+	}
+
+	etcdDS.options.MaxLeases = 1
+	if pruned, err := ds.PruneLeases(now); err != nil || pruned != 2 {
+		t.Error("expected the expired leases beyond the limit to be pruned, got", pruned, err)
+	}
+	if !hasLease(0) || hasLease(2) || hasLease(3) {
+		t.Error("expected only the machine of the active lease to be kept")
+	}
+
+	// a machine without a lease, e.g. an imported one, is kept
+	if _, err := ds.MachineInterface(macs[1]).Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+	if pruned, err := ds.PruneLeases(now); err != nil || pruned != 0 || !hasLease(1) {
+		t.Error("expected the machine without a lease to be kept, got", pruned, err)
+	}
+
+	// the active leases are kept even beyond the limit
+	if err := ds.MachineInterface(macs[1]).StoreLease(Lease{Expiry: now.Add(time.Hour).Unix()}); err != nil {
+		t.Error("error while storing the lease:", err)
+		return
+	}
+	if pruned, err := ds.PruneLeases(now); err != nil || pruned != 0 {
+		t.Error("expected the active leases to be kept, got", pruned, err)
+	}
+	if !hasLease(0) || !hasLease(1) {
+		t.Error("expected the machines of the active leases to be kept")
+	}
+}
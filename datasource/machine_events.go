@@ -0,0 +1,108 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+const (
+	// etcdEventsDirName holds the events of a machine, in the order of their
+	// creation
+	etcdEventsDirName = "_events"
+	// MaxMachineEvents is the number of the last events which are kept for
+	// each machine, the older ones are dropped
+	MaxMachineEvents = 100
+)
+
+// Events of MachineEvent
+const (
+	EventLease           = "lease"
+	EventAgentState      = "agent-state"
+	EventQuarantine      = "quarantine"
+	EventVariableSet     = "variable-set"
+	EventVariableDeleted = "variable-deleted"
+)
+
+// MachineEvent is a change in the state of a machine, e.g. a new lease or a
+// variable which is set. Detail depends on the event, e.g. the leased ip or
+// the name of the variable.
+type MachineEvent struct {
+	// Time is the unix time of the event
+	Time   int64  `json:"time"`
+	Event  string `json:"event"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Events returns the last MaxMachineEvents events of the machine, the oldest
+// first
+func (m *etcdMachineInterface) Events() ([]MachineEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	response, err := m.keysAPI.Get(ctx, m.prefixifyForMachine(etcdEventsDirName),
+		&etcd.GetOptions{Sort: true})
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return []MachineEvent{}, nil
+		}
+		return nil, err
+	}
+
+	events := make([]MachineEvent, 0, len(response.Node.Nodes))
+	for _, n := range response.Node.Nodes {
+		var event MachineEvent
+		if err := json.Unmarshal([]byte(n.Value), &event); err != nil {
+			return nil, fmt.Errorf("error while unmarshaling the event %s: %s", n.Key, err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// addEvent appends the event to the events of the machine, and drops the
+// ones beyond MaxMachineEvents
+func (m *etcdMachineInterface) addEvent(event, detail string) error {
+	eventJSON, err := json.Marshal(MachineEvent{
+		Time:   time.Now().Unix(),
+		Event:  event,
+		Detail: detail,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	dir := m.prefixifyForMachine(etcdEventsDirName)
+	if _, err := m.keysAPI.CreateInOrder(ctx, dir, string(eventJSON), nil); err != nil {
+		return err
+	}
+
+	response, err := m.keysAPI.Get(ctx, dir, &etcd.GetOptions{Sort: true})
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(response.Node.Nodes)-MaxMachineEvents; i++ {
+		_, err := m.keysAPI.Delete(ctx, response.Node.Nodes[i].Key, nil)
+		if err != nil && !etcd.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordEvent adds the event like addEvent, but only logs the failures, as
+// the change which is recorded is already made
+func (m *etcdMachineInterface) recordEvent(event, detail string) {
+	if err := m.addEvent(event, detail); err != nil {
+		log.WithFields(log.Fields{
+			"where":   "datasource.recordEvent",
+			"object":  m.mac.String(),
+			"subject": event,
+		}).WithError(err).Warn("failed to record the event of the machine")
+	}
+}
@@ -0,0 +1,215 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/krolaw/dhcp4"
+)
+
+const (
+	// etcdQuarantineDirName holds the addresses of the quarantined machines,
+	// by their colon-less macs
+	etcdQuarantineDirName = "quarantine"
+	// etcdQuarantineDecisionsDirName holds the last decisions which are made
+	// about the quarantined machines, by their colon-less macs
+	etcdQuarantineDecisionsDirName = "quarantine-decisions"
+)
+
+// Decisions of QuarantineDecision
+const (
+	QuarantineApproved = "approved"
+	QuarantineRejected = "rejected"
+)
+
+// QuarantineDecision is the record of approving or rejecting a quarantined
+// machine, which is kept for auditing
+type QuarantineDecision struct {
+	Decision string `json:"decision"`
+	By       string `json:"by"`
+	Time     int64  `json:"time"`
+}
+
+func (ds *EtcdDataSource) prefixifyForQuarantine(mac net.HardwareAddr) string {
+	return path.Join(ds.clusterName, etcdQuarantineDirName, ds.MachineInterface(mac).Hostname())
+}
+
+func (ds *EtcdDataSource) prefixifyForQuarantineDecision(mac net.HardwareAddr) string {
+	return path.Join(ds.clusterName, etcdQuarantineDecisionsDirName, ds.MachineInterface(mac).Hostname())
+}
+
+// QuarantinedMachines returns the addresses of the quarantined machines, by
+// their macs
+func (ds *EtcdDataSource) QuarantinedMachines() (map[string]net.IP, error) {
+	entries, err := ds.listNonDirKeyValues(path.Join(ds.clusterName, etcdQuarantineDirName))
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return map[string]net.IP{}, nil
+		}
+		return nil, err
+	}
+
+	res := make(map[string]net.IP)
+	for name, ipStr := range entries {
+		mac, err := macFromName(name)
+		if err != nil {
+			return nil, fmt.Errorf("error while converting name to mac: %s", err)
+		}
+		res[mac.String()] = net.ParseIP(ipStr)
+	}
+	return res, nil
+}
+
+// QuarantineLease returns the address of the machine in the quarantine
+// subnet, and assigns one if it's not quarantined yet
+func (ds *EtcdDataSource) QuarantineLease(mac net.HardwareAddr,
+	subnet *QuarantineSubnet) (net.IP, error) {
+	ds.dhcpAssignLock.Lock()
+	defer ds.dhcpAssignLock.Unlock()
+
+	quarantined, err := ds.QuarantinedMachines()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting the quarantined machines: %s", err)
+	}
+	if ip, isIn := quarantined[mac.String()]; isIn {
+		return ip, nil
+	}
+	// it may have been approved since it was found unknown
+	known, err := ds.MachineInterface(mac).Known()
+	if err != nil {
+		return nil, err
+	}
+	if known {
+		return nil, fmt.Errorf("machine %s is already known", mac)
+	}
+
+	if err := ds.IsMaster(); err != nil {
+		return nil, fmt.Errorf(
+			"only the master instance is allowed to quarantine machines: %s", err)
+	}
+
+	assigned := make(map[string]bool)
+	for _, ip := range quarantined {
+		assigned[ip.String()] = true
+	}
+	for i := 0; i < subnet.Range; i++ {
+		candidateIP := dhcp4.IPAdd(subnet.Start, i)
+		if assigned[candidateIP.String()] {
+			continue
+		}
+		if err := ds.set(ds.prefixifyForQuarantine(mac), candidateIP.String()); err != nil {
+			return nil, fmt.Errorf("error while storing the quarantine lease: %s", err)
+		}
+		return candidateIP, nil
+	}
+	return nil, fmt.Errorf("no unassigned IP was found in the quarantine subnet")
+}
+
+// ApproveMachine releases the machine from the quarantine, and creates its
+// record so it's served normally from now on. The decision is recorded along
+// with by, which identifies the approver. It holds dhcpAssignLock, so a
+// concurrent QuarantineLease either finds the machine known, or its lease is
+// released here.
+func (ds *EtcdDataSource) ApproveMachine(mac net.HardwareAddr, by string) (Machine, error) {
+	m := &etcdMachineInterface{mac: mac, etcdDS: ds, keysAPI: ds.keysAPI}
+
+	ds.dhcpAssignLock.Lock()
+	defer ds.dhcpAssignLock.Unlock()
+
+	machine := Machine{FirstSeen: time.Now().Unix()}
+	err := m.storeLocked(&machine, false)
+	if err == ErrMachineExists {
+		machine, err = m.Machine(false, nil)
+	}
+	if err != nil {
+		return machine, fmt.Errorf("error while storing _machine: %s", err)
+	}
+
+	if err := ds.decideQuarantine(mac, QuarantineApproved, by); err != nil {
+		return machine, err
+	}
+	m.recordEvent(EventQuarantine, QuarantineApproved+" by "+by)
+	return machine, nil
+}
+
+// RejectMachine releases the quarantine lease of the machine, and its dhcp
+// requests are not answered anymore, unless it's approved later. The
+// decision is recorded along with by, which identifies the rejecter.
+func (ds *EtcdDataSource) RejectMachine(mac net.HardwareAddr, by string) error {
+	known, err := ds.MachineInterface(mac).Known()
+	if err != nil {
+		return err
+	}
+	if known {
+		return fmt.Errorf("machine %s is already known", mac)
+	}
+	return ds.decideQuarantine(mac, QuarantineRejected, by)
+}
+
+func (ds *EtcdDataSource) decideQuarantine(mac net.HardwareAddr, decision, by string) error {
+	decisionJSON, err := json.Marshal(QuarantineDecision{
+		Decision: decision,
+		By:       by,
+		Time:     time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := ds.set(ds.prefixifyForQuarantineDecision(mac), string(decisionJSON)); err != nil {
+		return fmt.Errorf("error while recording the quarantine decision: %s", err)
+	}
+
+	err = ds.delete(ds.prefixifyForQuarantine(mac))
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return fmt.Errorf("error while releasing the quarantine lease: %s", err)
+	}
+	return nil
+}
+
+// QuarantineDecision returns the last decision which is made about the
+// machine, or nil if there's none
+func (ds *EtcdDataSource) QuarantineDecision(mac net.HardwareAddr) (*QuarantineDecision, error) {
+	decisionJSON, err := ds.get(ds.prefixifyForQuarantineDecision(mac))
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var decision QuarantineDecision
+	if err := json.Unmarshal([]byte(decisionJSON), &decision); err != nil {
+		return nil, fmt.Errorf("error while unmarshaling the quarantine decision: %s", err)
+	}
+	return &decision, nil
+}
+
+// QuarantineDecisions returns the last decisions which are made about the
+// quarantined machines, by their macs
+func (ds *EtcdDataSource) QuarantineDecisions() (map[string]QuarantineDecision, error) {
+	entries, err := ds.listNonDirKeyValues(path.Join(ds.clusterName, etcdQuarantineDecisionsDirName))
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return map[string]QuarantineDecision{}, nil
+		}
+		return nil, err
+	}
+
+	res := make(map[string]QuarantineDecision)
+	for name, decisionJSON := range entries {
+		mac, err := macFromName(name)
+		if err != nil {
+			return nil, fmt.Errorf("error while converting name to mac: %s", err)
+		}
+		var decision QuarantineDecision
+		if err := json.Unmarshal([]byte(decisionJSON), &decision); err != nil {
+			return nil, fmt.Errorf("error while unmarshaling the quarantine decision: %s", err)
+		}
+		res[mac.String()] = decision
+	}
+	return res, nil
+}
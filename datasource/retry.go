@@ -0,0 +1,46 @@
+package datasource
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// setRetryDelay is the delay before the first retry, which is doubled for
+// each of the next ones
+var setRetryDelay = 100 * time.Millisecond
+
+// retryableError reports whether the write may succeed if it's retried, e.g.
+// while the etcd cluster elects a leader
+func retryableError(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	if etcdErr, ok := err.(etcd.Error); ok {
+		switch etcdErr.Code {
+		case etcd.ErrorCodeRaftInternal, etcd.ErrorCodeLeaderElect:
+			return true
+		}
+	}
+	return false
+}
+
+// withRetries calls write at most SetRetries+1 times, see Options, until it
+// succeeds or fails with an error which is not retryable
+func (ds *EtcdDataSource) withRetries(keyPath string, write func() error) error {
+	delay := setRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil || attempt >= ds.options.SetRetries || !retryableError(err) {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"where":  "datasource.set",
+			"object": keyPath,
+		}).WithError(err).Debugf("retrying the write (attempt %d)", attempt+1)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,171 @@
+package datasource
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// conflictingKeysAPI fails the first conflicts writes with err
+type conflictingKeysAPI struct {
+	etcd.KeysAPI
+	conflicts int
+	err       error
+	calls     int
+	// only the writes to the keys which end with it conflict, if it's set
+	suffix string
+}
+
+func (k *conflictingKeysAPI) Set(ctx context.Context, key, value string,
+	opts *etcd.SetOptions) (*etcd.Response, error) {
+	if !strings.HasSuffix(key, k.suffix) {
+		return k.KeysAPI.Set(ctx, key, value, opts)
+	}
+	k.calls++
+	if k.calls <= k.conflicts {
+		return nil, k.err
+	}
+	return k.KeysAPI.Set(ctx, key, value, opts)
+}
+
+// lostResponseKeysAPI applies the first write, but fails it with
+// context.DeadlineExceeded as if its response was lost
+type lostResponseKeysAPI struct {
+	etcd.KeysAPI
+	calls int
+}
+
+func (k *lostResponseKeysAPI) Set(ctx context.Context, key, value string,
+	opts *etcd.SetOptions) (*etcd.Response, error) {
+	k.calls++
+	resp, err := k.KeysAPI.Set(ctx, key, value, opts)
+	if k.calls == 1 && err == nil {
+		return nil, context.DeadlineExceeded
+	}
+	return resp, err
+}
+
+func TestSetRetries(t *testing.T) {
+	defer func(delay time.Duration) {
+		setRetryDelay = delay
+	}(setRetryDelay)
+	setRetryDelay = time.Millisecond
+
+	dsInterface, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := dsInterface.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := dsInterface.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	ds := dsInterface.(*EtcdDataSource)
+	ds.options.SetRetries = 2
+	etcdKeysAPI := ds.keysAPI
+
+	raftErr := etcd.Error{Code: etcd.ErrorCodeRaftInternal, Message: "Raft Internal Error"}
+	tests := []struct {
+		conflicts int
+		err       error
+		calls     int
+		fails     bool
+	}{
+		{0, nil, 1, false},
+		{1, raftErr, 2, false},
+		{2, etcd.Error{Code: etcd.ErrorCodeLeaderElect}, 3, false},
+		{3, raftErr, 3, true},
+		// the other errors are not retried
+		{1, etcd.Error{Code: etcd.ErrorCodeNotFile}, 1, true},
+		{1, etcd.Error{Code: etcd.ErrorCodeTestFailed}, 1, true},
+	}
+
+	for i, tt := range tests {
+		keysAPI := &conflictingKeysAPI{KeysAPI: etcdKeysAPI, conflicts: tt.conflicts, err: tt.err}
+		ds.keysAPI = keysAPI
+
+		err = ds.SetClusterVariable("foo", "bar")
+		if (err != nil) != tt.fails {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if keysAPI.calls != tt.calls {
+			t.Errorf("#%d: expected %d calls, got %d", i, tt.calls, keysAPI.calls)
+		}
+
+		// SetVariable of the machines goes through the same retries
+		mac, _ := net.ParseMAC("00:11:22:33:44:55")
+		keysAPI.calls = 0
+		err = ds.MachineInterface(mac).SetVariable("foo", "bar")
+		if (err != nil) != tt.fails {
+			t.Errorf("#%d: unexpected error for the machine variable: %v", i, err)
+		}
+	}
+	ds.keysAPI = etcdKeysAPI
+}
+
+func TestCreateRetries(t *testing.T) {
+	defer func(delay time.Duration) {
+		setRetryDelay = delay
+	}(setRetryDelay)
+	setRetryDelay = time.Millisecond
+
+	dsInterface, err := ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := dsInterface.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := dsInterface.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	ds := dsInterface.(*EtcdDataSource)
+	etcdKeysAPI := ds.keysAPI
+	defer func() { ds.keysAPI = etcdKeysAPI }()
+
+	// the retry of a create whose response is lost finds its own value
+	keysAPI := &lostResponseKeysAPI{KeysAPI: etcdKeysAPI}
+	ds.keysAPI = keysAPI
+	key := ds.prefixifyForClusterVariables("created")
+	if err := ds.create(key, "a"); err != nil || keysAPI.calls != 2 {
+		t.Errorf("expected the retried create to succeed, got %v after %d calls", err, keysAPI.calls)
+	}
+
+	// but another value is still a conflict
+	ds.keysAPI = etcdKeysAPI
+	err = ds.create(key, "b")
+	if etcdErr, ok := err.(etcd.Error); !ok || etcdErr.Code != etcd.ErrorCodeNodeExist {
+		t.Error("expected a NodeExist error for another value, got", err)
+	}
+
+	// the first boot, which is set once, goes through the same retries
+	ds.options.SetRetries = 2
+	mac, _ := net.ParseMAC("FF:FF:FF:FF:FF:F5")
+	machineInterface := ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(true, nil); err != nil {
+		t.Error("error in creating the machine:", err)
+		return
+	}
+	raftErr := etcd.Error{Code: etcd.ErrorCodeRaftInternal, Message: "Raft Internal Error"}
+	ds.keysAPI = &conflictingKeysAPI{KeysAPI: etcdKeysAPI, conflicts: 1, err: raftErr, suffix: "_first_boot"}
+	machineInterface.CheckIn()
+	ds.keysAPI = etcdKeysAPI
+	if firstBoot, err := machineInterface.FirstBoot(); err != nil || firstBoot == 0 {
+		t.Error("expected the first boot to be set after a transient failure, got", firstBoot, err)
+	}
+}
@@ -1,24 +1,156 @@
 package datasource
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/krolaw/dhcp4"
 )
 
 const (
 	// SpecialKeyCoreosVersion is a special key for the coreos version of the machines
 	SpecialKeyCoreosVersion = "coreos-version"
-	// SpecialKeyNetworkConfiguration is a special key for the network of the cluster
+	// SpecialKeyNetworkConfiguration is a special key for the network of the
+	// cluster. The one of the cluster is the default of the machines which
+	// have none of their own, e.g. on their first boot, and it's checked
+	// against the lease range when it's set.
 	SpecialKeyNetworkConfiguration = "net-conf"
+	// SpecialKeyWPADURL is a special key for the proxy auto-config URL which
+	// is sent through dhcp option 252 to the clients which request it
+	SpecialKeyWPADURL = "wpad-url"
+	// SpecialKeyIgnoredVendorClasses is a special key for the comma separated
+	// list of vendor classes (dhcp option 60) which are not answered
+	SpecialKeyIgnoredVendorClasses = "dhcp-ignored-vendor-classes"
+	// SpecialKeyEchoedVendorClasses is a special key for the comma separated
+	// list of vendor classes (dhcp option 60) which are echoed back to the
+	// clients which aren't pxe booted
+	SpecialKeyEchoedVendorClasses = "dhcp-echoed-vendor-classes"
+	// SpecialKeyDNSSource is a special key for the source of the nameservers
+	// which are sent to the clients through dhcp option 6
+	SpecialKeyDNSSource = "dns-source"
+	// SpecialKeyMaintenance is a special key for the maintenance mode, in
+	// which no machine is network booted
+	SpecialKeyMaintenance = "maintenance"
+	// SpecialKeySearchDomains is a special key for the comma separated list of
+	// search domains which are sent to the clients through dhcp option 119
+	SpecialKeySearchDomains = "search-domains"
+	// SpecialKeyDomainName is a special key for the domain which is sent to
+	// the clients through dhcp option 15, instead of the cluster name
+	SpecialKeyDomainName = "domain-name"
+	// SpecialKeyExtraSearchDomains is a special key for the search domains of
+	// a machine which are appended to the ones of SpecialKeySearchDomains
+	SpecialKeyExtraSearchDomains = "extra-search-domains"
+	// SpecialKeyNTPServers is a special key for the comma separated list of
+	// ntp servers which are advertised if no instance has the ntp role
+	SpecialKeyNTPServers = "ntp-servers"
+	// SpecialKeyLeaseDuration is a special key for the lease duration (as a
+	// go duration) which overrides the default random one
+	SpecialKeyLeaseDuration = "lease-duration"
+	// SpecialKeyLeaseGrace is a special key for the time (as a go duration)
+	// after the expiry of a lease in which its renewal is still honored, see
+	// ParseLeaseGrace
+	SpecialKeyLeaseGrace = "lease-grace"
+	// SpecialKeyNetBIOSNameServers is a special key for the comma separated
+	// list of WINS servers which are sent through dhcp option 44
+	SpecialKeyNetBIOSNameServers = "netbios-name-servers"
+	// SpecialKeyNetBIOSNodeType is a special key for the NetBIOS node type
+	// which is sent through dhcp option 46, either as a number (1, 2, 4, 8)
+	// or a letter (B, P, M, H)
+	SpecialKeyNetBIOSNodeType = "netbios-node-type"
+	// SpecialKeyTFTPServers is a special key for the comma separated list of
+	// tftp servers which are sent through dhcp option 150, which some cisco
+	// devices read instead of siaddr and option 66
+	SpecialKeyTFTPServers = "tftp-servers"
+	// SpecialKeyQuarantineSubnet is a special key for the subnet in which the
+	// unknown machines are held until they're approved, see QuarantineSubnet
+	SpecialKeyQuarantineSubnet = "quarantine-subnet"
+	// SpecialKeyNextBootfile is a special key for the bootfile (a path or an
+	// url) which is handed to the machine when it's requested from iPXE, to
+	// continue its boot chain
+	SpecialKeyNextBootfile = "next-bootfile"
+	// SpecialKeyClientIDLookup is a special key for looking up the machines
+	// by their client identifiers (dhcp option 61), instead of their macs
+	SpecialKeyClientIDLookup = "client-id-lookup"
+	// SpecialKeyPXEMenuTimeout is a special key for the seconds (0 to 255)
+	// the pxe boot menu prompt waits before booting, see ParsePXEMenuTimeout
+	SpecialKeyPXEMenuTimeout = "pxe-menu-timeout"
+	// SpecialKeyVendorClassBootfiles is a special key for the rules which
+	// hand dedicated bootfiles to the clients by their vendor classes (dhcp
+	// option 60), see VendorClassBootfile
+	SpecialKeyVendorClassBootfiles = "vendor-class-bootfiles"
+	// SpecialKeyUserClassProfiles is a special key for the boot profiles
+	// which are chosen by the user classes (dhcp option 77) of the clients,
+	// see UserClassProfile
+	SpecialKeyUserClassProfiles = "user-class-profiles"
+	// SpecialKeyIgnore is a special key of the machines whose dhcp requests
+	// are not answered at all, e.g. the devices which are not managed by
+	// blacksmith. It can't be set as a cluster variable.
+	SpecialKeyIgnore = "ignore"
+	// SpecialKeyNoInstall is a special key of the machines which only boot
+	// from their local disks, and are never handed the installer, even if
+	// they're asked to be reprovisioned. It's kept when the variables of the
+	// machine are cleared, and it can't be set as a cluster variable.
+	SpecialKeyNoInstall = "no-install"
+	// SpecialKeyReprovisionCooldown is a special key for the time (as a go
+	// duration) after a machine is provisioned in which it's not network
+	// booted again, so it boots from its local disk
+	SpecialKeyReprovisionCooldown = "reprovision-cooldown"
+	// SpecialKeyBootServerHostname is a special key for the hostname of the
+	// server of the handed bootfiles, which is sent as dhcp option 66 while
+	// its address is sent as siaddr
+	SpecialKeyBootServerHostname = "boot-server-hostname"
+	// SpecialKeyPXEBootMessage is a special key for the text of the pxe boot
+	// menu, which replaces the default one with the version of blacksmith,
+	// see ValidatePXEBootMessage
+	SpecialKeyPXEBootMessage = "pxe-boot-message"
+	// SpecialKeyPXEMenu is a special key for the extra entries of the pxe
+	// boot menu, which hand their own bootfiles, see PXEMenuEntry
+	SpecialKeyPXEMenu = "pxe-menu"
+	// SpecialKeyPXEOptionsLength is a special key for the length to which
+	// the pxe vendor options (option 43) are padded, for the firmwares which
+	// expect a fixed length, see ParsePXEOptionsLength
+	SpecialKeyPXEOptionsLength = "pxe-options-length"
+	// SpecialKeyOmitHostname is a special key for leaving the hostname (dhcp
+	// option 12) out of the replies, for the clients which set their own
+	// hostnames and reject the one of the server
+	SpecialKeyOmitHostname = "omit-hostname"
+	// SpecialKeyTZPOSIX is a special key for the posix timezone string, e.g.
+	// "CET-1CEST,M3.5.0,M10.5.0/3", which is sent through dhcp option 100 to
+	// the clients which request it
+	SpecialKeyTZPOSIX = "tz-posix"
+	// SpecialKeyTZDatabase is a special key for the name of the timezone in
+	// the tz database, e.g. "Europe/Amsterdam", which is sent through dhcp
+	// option 101 to the clients which request it
+	SpecialKeyTZDatabase = "tz-database"
+)
+
+// Modes of DNSSource
+const (
+	// DNSSourceSelf advertises the ip of the serving instance
+	DNSSourceSelf = "self"
+	// DNSSourceInstances advertises the ips of the live blacksmith instances
+	DNSSourceInstances = "instances"
+	// DNSSourceStatic advertises the configured servers
+	DNSSourceStatic = "static"
 )
 
-// NetworkConfiguration is used to configure clients through dhcp
+// NetworkConfiguration is used to configure clients through dhcp. The
+// classless routes (option 121) are only sent to the clients which request
+// them, unless ForceClasslessRouteOption is set.
 type NetworkConfiguration struct {
-	Netmask              net.IP                     `json:"netmask"`
-	Router               net.IP                     `json:"router"`
-	ClasslessRouteOption []ClasslessRouteOptionPart `json:"classlessRouteOption"`
+	Netmask                   net.IP                     `json:"netmask"`
+	Router                    net.IP                     `json:"router"`
+	ClasslessRouteOption      []ClasslessRouteOptionPart `json:"classlessRouteOption"`
+	ForceClasslessRouteOption bool                       `json:"forceClasslessRouteOption,omitempty"`
 }
 
 // ClasslessRouteOptionPart is the static route which consists of a destination
@@ -55,10 +187,19 @@ func (c *ClasslessRouteOptionPart) ToBytes() []byte {
 	return ret
 }
 
+// DNSSource selects the nameservers which are sent to the clients. Servers is
+// only used, and required, in the static mode.
+type DNSSource struct {
+	Mode    string   `json:"mode"`
+	Servers []net.IP `json:"servers,omitempty"`
+}
+
 var (
 	emptyNotAllowed = map[string]bool{
 		SpecialKeyCoreosVersion:        true,
 		SpecialKeyNetworkConfiguration: true,
+		SpecialKeyTZPOSIX:              true,
+		SpecialKeyTZDatabase:           true,
 	}
 )
 
@@ -73,6 +214,121 @@ func UnmarshalNetworkConfiguration(netConfStr string) (*NetworkConfiguration, er
 	return &netConf, nil
 }
 
+// UnmarshalDNSSource returns a pointer to a newly constructed and validated
+// DNSSource from the given string. An empty string means DNSSourceInstances.
+func UnmarshalDNSSource(dnsSourceStr string) (*DNSSource, error) {
+	if dnsSourceStr == "" {
+		return &DNSSource{Mode: DNSSourceInstances}, nil
+	}
+
+	var dnsSource DNSSource
+	if err := json.Unmarshal([]byte(dnsSourceStr), &dnsSource); err != nil {
+		return nil, err
+	}
+
+	switch dnsSource.Mode {
+	case DNSSourceSelf, DNSSourceInstances:
+		if len(dnsSource.Servers) != 0 {
+			return nil, fmt.Errorf("servers are only used in the %q mode", DNSSourceStatic)
+		}
+	case DNSSourceStatic:
+		if len(dnsSource.Servers) == 0 {
+			return nil, fmt.Errorf("at least one server is needed in the %q mode", DNSSourceStatic)
+		}
+		for _, server := range dnsSource.Servers {
+			if server.To4() == nil {
+				return nil, fmt.Errorf("invalid ipv4 address for a server: %s", server)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown dns source mode: %q", dnsSource.Mode)
+	}
+	return &dnsSource, nil
+}
+
+// CheckSubnet checks that the routers are in the subnet of ip, which is
+// implied by the netmask
+func (n *NetworkConfiguration) CheckSubnet(ip net.IP) error {
+	if n.Netmask == nil || ip == nil {
+		return nil
+	}
+	subnet, err := n.Subnet(ip)
+	if err != nil {
+		return err
+	}
+
+	validationErr := &ValidationError{}
+	checkRoutes(subnet, n.Router, n.ClasslessRouteOption, validationErr)
+	return validationErr.errOrNil()
+}
+
+// Subnet returns the subnet of the given ip according to the netmask
+func (n *NetworkConfiguration) Subnet(ip net.IP) (*net.IPNet, error) {
+	mask := net.IPMask(n.Netmask.To4())
+	if ones, bits := mask.Size(); len(mask) != net.IPv4len || (ones == 0 && bits == 0) {
+		return nil, fmt.Errorf("invalid netmask: %s", n.Netmask)
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("invalid ipv4 address: %s", ip)
+	}
+	return &net.IPNet{IP: ip.To4().Mask(mask), Mask: mask}, nil
+}
+
+// checkNetworkConfigurationSubnet checks the network configuration of a
+// machine with the given ip, and reports all of its invalid fields as a
+// *ValidationError
+func checkNetworkConfigurationSubnet(netConfStr string, ip net.IP) error {
+	netConf, err := UnmarshalNetworkConfiguration(netConfStr)
+	if err != nil {
+		return err
+	}
+
+	validationErr := &ValidationError{}
+	var subnet *net.IPNet
+	if netConf.Netmask != nil && ip != nil {
+		subnet, err = netConf.Subnet(ip)
+		if err != nil {
+			validationErr.add("netmask", "%s", err)
+		}
+	}
+	checkRoutes(subnet, netConf.Router, netConf.ClasslessRouteOption, validationErr)
+	return validationErr.errOrNil()
+}
+
+// checkRoutes checks the router and the classless routes of a network, and
+// that their routers are in its subnet, unless the subnet is nil. The
+// invalid fields are added to validationErr.
+func checkRoutes(subnet *net.IPNet, router net.IP, routes []ClasslessRouteOptionPart,
+	validationErr *ValidationError) {
+	checkRouter := func(field string, router net.IP) {
+		if router.To4() == nil {
+			validationErr.add(field, "not an ipv4 address")
+		} else if subnet != nil && !subnet.Contains(router) {
+			validationErr.add(field, "%s is outside the subnet %s", router, subnet)
+		}
+	}
+
+	if router != nil {
+		checkRouter("router", router)
+	}
+	for i, part := range routes {
+		field := fmt.Sprintf("classlessRouteOption[%d]", i)
+		if part.Size > 32 {
+			validationErr.add(field+".size", "%d is larger than 32", part.Size)
+		}
+		if part.Size > 0 && part.Destination.To4() == nil {
+			validationErr.add(field+".destination", "not an ipv4 address")
+		}
+		checkRouter(field+".router", part.Router)
+	}
+}
+
+// ValidateVariable returns the error which SetVariable would return for the
+// value of the key, without storing it
+func ValidateVariable(key, value string) error {
+	return validateVariable(key, value)
+}
+
 func validateVariable(key, value string) error {
 	if key == "" {
 		return errors.New("empty value for key is not permitted")
@@ -89,6 +345,513 @@ func validateVariable(key, value string) error {
 	case SpecialKeyNetworkConfiguration:
 		_, err := UnmarshalNetworkConfiguration(value)
 		return err
+	case SpecialKeyWPADURL:
+		return validateWPADURL(value)
+	case SpecialKeyTZPOSIX, SpecialKeyTZDatabase:
+		return validateTimezone(value)
+	case SpecialKeyIgnoredVendorClasses, SpecialKeyEchoedVendorClasses:
+		return validateVendorClasses(value)
+	case SpecialKeyDNSSource:
+		_, err := UnmarshalDNSSource(value)
+		return err
+	case SpecialKeySearchDomains, SpecialKeyExtraSearchDomains:
+		return validateSearchDomains(value)
+	case SpecialKeyNTPServers:
+		_, err := ParseIPList(value)
+		return err
+	case SpecialKeyLeaseDuration:
+		_, err := ParseLeaseDuration(value)
+		return err
+	case SpecialKeyLeaseGrace:
+		_, err := ParseLeaseGrace(value)
+		return err
+	case SpecialKeyReprovisionCooldown:
+		_, err := ParseReprovisionCooldown(value)
+		return err
+	case SpecialKeyNetBIOSNameServers, SpecialKeyTFTPServers:
+		_, err := ParseIPList(value)
+		return err
+	case SpecialKeyNetBIOSNodeType:
+		_, err := ParseNetBIOSNodeType(value)
+		return err
+	case SpecialKeyQuarantineSubnet:
+		_, err := UnmarshalQuarantineSubnet(value)
+		return err
+	case SpecialKeyNextBootfile:
+		return validateNextBootfile(value)
+	case SpecialKeyBootServerHostname, SpecialKeyDomainName:
+		if value == "" {
+			return nil
+		}
+		return validateDomain(value)
+	case SpecialKeyVendorClassBootfiles:
+		_, err := UnmarshalVendorClassBootfiles(value)
+		return err
+	case SpecialKeyUserClassProfiles:
+		_, err := UnmarshalUserClassProfiles(value)
+		return err
+	case SpecialKeyPXEMenu:
+		_, err := UnmarshalPXEMenu(value)
+		return err
+	case SpecialKeyPXEOptionsLength:
+		_, err := ParsePXEOptionsLength(value)
+		return err
+	case SpecialKeyPXEMenuTimeout:
+		_, err := ParsePXEMenuTimeout(value)
+		return err
+	case SpecialKeyPXEBootMessage:
+		return ValidatePXEBootMessage(value)
+	case SpecialKeyMaintenance, SpecialKeyClientIDLookup, SpecialKeyIgnore, SpecialKeyOmitHostname,
+		SpecialKeyNoInstall:
+		if value == "" {
+			return nil
+		}
+		_, err := strconv.ParseBool(value)
+		return err
+	}
+	return nil
+}
+
+func validateWPADURL(value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid wpad url: %s", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("wpad url should be an absolute http(s) url: %q", value)
+	}
+	return nil
+}
+
+// validateTimezone checks that the timezone fits in a dhcp option, and it
+// has no spaces or control characters
+func validateTimezone(value string) error {
+	if len(value) > 255 {
+		return fmt.Errorf("timezone is longer than 255 bytes")
+	}
+	for _, r := range value {
+		if r <= ' ' || r >= unicode.MaxASCII {
+			return fmt.Errorf("invalid character %q in the timezone %q", r, value)
+		}
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var res []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// SplitVendorClasses returns the non-empty vendor classes of the given comma
+// separated list
+func SplitVendorClasses(value string) []string {
+	return splitList(value)
+}
+
+func validateVendorClasses(value string) error {
+	for _, class := range strings.Split(value, ",") {
+		if value != "" && strings.TrimSpace(class) == "" {
+			return fmt.Errorf("empty vendor class in %q", value)
+		}
+	}
+	return nil
+}
+
+// SplitSearchDomains returns the non-empty domains of the given comma
+// separated list
+func SplitSearchDomains(value string) []string {
+	return splitList(value)
+}
+
+func validateSearchDomains(value string) error {
+	for _, domain := range SplitSearchDomains(value) {
+		if err := validateDomain(domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateDomain checks the domain against the rules of rfc1035 for the
+// labels, which is what option 119 can carry
+func validateDomain(domain string) error {
+	if len(domain) > 253 {
+		return fmt.Errorf("domain is too long: %q", domain)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("invalid label length in domain %q", domain)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label starts or ends with a hyphen in domain %q", domain)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid character %q in domain %q", c, domain)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseIPList returns the ipv4 addresses of the given comma separated list
+func ParseIPList(value string) ([]net.IP, error) {
+	var res []net.IP
+	for _, item := range splitList(value) {
+		ip := net.ParseIP(item).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ipv4 address: %q", item)
+		}
+		res = append(res, ip)
+	}
+	return res, nil
+}
+
+// ParseLeaseDuration parses the value of SpecialKeyLeaseDuration. 0 is
+// returned for an empty value.
+func ParseLeaseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	// the lease time is sent in seconds, as an uint32
+	if d < time.Minute || d.Seconds() > math.MaxUint32 {
+		return 0, fmt.Errorf("lease duration is out of range: %s", value)
+	}
+	return d, nil
+}
+
+// DefaultLeaseGrace is the grace window of the expired leases, if it's not
+// set
+const DefaultLeaseGrace = 10 * time.Minute
+
+// ParseLeaseGrace parses the value of SpecialKeyLeaseGrace, the window after
+// the expiry of a lease in which a late renewal keeps its ip. The renewals
+// after it are NAKed, so the clients start over. DefaultLeaseGrace is
+// returned for an empty value.
+func ParseLeaseGrace(value string) (time.Duration, error) {
+	if value == "" {
+		return DefaultLeaseGrace, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative lease grace: %s", value)
+	}
+	return d, nil
+}
+
+// ParseReprovisionCooldown parses the value of SpecialKeyReprovisionCooldown,
+// 0 for an empty value which disables the cooldown
+func ParseReprovisionCooldown(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("reprovision cooldown is negative: %s", value)
+	}
+	return d, nil
+}
+
+// validateNextBootfile checks the bootfile fits in the file field of a dhcp
+// packet
+func validateNextBootfile(value string) error {
+	if len(value) > 127 {
+		return fmt.Errorf("bootfile is longer than 127 bytes")
+	}
+	if strings.IndexFunc(value, unicode.IsSpace) != -1 {
+		return fmt.Errorf("bootfile contains whitespace: %q", value)
+	}
+	return nil
+}
+
+// ParseNetBIOSNodeType parses the value of SpecialKeyNetBIOSNodeType, as
+// specified in rfc2132. 0 is returned for an empty value.
+func ParseNetBIOSNodeType(value string) (byte, error) {
+	switch strings.ToUpper(strings.TrimSpace(value)) {
+	case "":
+		return 0, nil
+	case "1", "B":
+		return 1, nil
+	case "2", "P":
+		return 2, nil
+	case "4", "M":
+		return 4, nil
+	case "8", "H":
+		return 8, nil
+	}
+	return 0, fmt.Errorf("invalid netbios node type: %q", value)
+}
+
+// DefaultPXEMenuTimeout is the timeout of the pxe boot menu prompt, if it's
+// not set
+const DefaultPXEMenuTimeout = 2
+
+// ParsePXEMenuTimeout parses the value of SpecialKeyPXEMenuTimeout, which is
+// the timeout byte of the pxe menu prompt (sub-option 10 of option 43). 0
+// boots without prompting, and 255 waits for the user. DefaultPXEMenuTimeout
+// is returned for an empty value.
+func ParsePXEMenuTimeout(value string) (byte, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return DefaultPXEMenuTimeout, nil
+	}
+	timeout, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid pxe menu timeout (0 to 255 seconds): %q", value)
+	}
+	return byte(timeout), nil
+}
+
+// ParsePXEOptionsLength parses the value of SpecialKeyPXEOptionsLength, the
+// length (up to 255) to which the pxe vendor options are padded with the pad
+// sub-option (0) before the end one (255). 0, which is returned for an empty
+// value, disables the padding.
+func ParsePXEOptionsLength(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	length, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid pxe options length (0 to 255 bytes): %q", value)
+	}
+	return int(length), nil
+}
+
+// MaxPXEBootMessageLength is the longest pxe boot message. It's written
+// twice in option 43, as the menu entry and the prompt, which have to fit in
+// 255 bytes along with the other pxe sub-options.
+const MaxPXEBootMessageLength = 117
+
+// ValidatePXEBootMessage checks the boot message fits in option 43, and has
+// no control characters
+func ValidatePXEBootMessage(value string) error {
+	if len(value) > MaxPXEBootMessageLength {
+		return fmt.Errorf("pxe boot message is longer than %d bytes", MaxPXEBootMessageLength)
+	}
+	for _, c := range value {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("invalid character %q in pxe boot message", c)
+		}
+	}
+	return nil
+}
+
+// PXEMenuEntry is an extra entry of the pxe boot menu (sub-option 9 of option
+// 43), after the default one which boots blacksmith. The clients which select
+// it request its boot item (sub-option 71), and are handed Bootfile.
+type PXEMenuEntry struct {
+	Description string `json:"description"`
+	Bootfile    string `json:"bootfile"`
+}
+
+// UnmarshalPXEMenu returns the validated entries of the given json list, in
+// the order of the menu. nil is returned for an empty value. Whether they fit
+// in option 43 along with the boot message is checked while it's built.
+func UnmarshalPXEMenu(value string) ([]PXEMenuEntry, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var entries []PXEMenuEntry
+	if err := json.Unmarshal([]byte(value), &entries); err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entry.Description == "" {
+			return nil, fmt.Errorf("entry #%d: empty description", i)
+		}
+		if err := ValidatePXEBootMessage(entry.Description); err != nil {
+			return nil, fmt.Errorf("entry #%d: %s", i, err)
+		}
+		if entry.Bootfile == "" {
+			return nil, fmt.Errorf("entry #%d: empty bootfile", i)
+		}
+		if err := validateNextBootfile(entry.Bootfile); err != nil {
+			return nil, fmt.Errorf("entry #%d: %s", i, err)
+		}
+	}
+	return entries, nil
+}
+
+// QuarantineSubnet is the subnet in which the machines which are not known
+// yet are held, until they're approved. They're given an address from the
+// Range addresses after Start, and only the DNS servers, without any boot
+// option.
+type QuarantineSubnet struct {
+	Start   net.IP   `json:"start"`
+	Range   int      `json:"range"`
+	Netmask net.IP   `json:"netmask"`
+	DNS     []net.IP `json:"dns"`
+}
+
+// UnmarshalQuarantineSubnet returns the validated QuarantineSubnet of the
+// given string. nil is returned for an empty string, which disables the
+// quarantine.
+func UnmarshalQuarantineSubnet(value string) (*QuarantineSubnet, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var q QuarantineSubnet
+	if err := json.Unmarshal([]byte(value), &q); err != nil {
+		return nil, err
+	}
+
+	if q.Start.To4() == nil {
+		return nil, fmt.Errorf("invalid quarantine start: %s", q.Start)
+	}
+	if q.Range < 1 {
+		return nil, fmt.Errorf("invalid quarantine range: %d", q.Range)
+	}
+	mask := net.IPMask(q.Netmask.To4())
+	if ones, bits := mask.Size(); len(mask) != net.IPv4len || (ones == 0 && bits == 0) {
+		return nil, fmt.Errorf("invalid quarantine netmask: %s", q.Netmask)
+	}
+	subnet := net.IPNet{IP: q.Start.Mask(mask), Mask: mask}
+	if last := dhcp4.IPAdd(q.Start, q.Range-1); !subnet.Contains(last) {
+		return nil, fmt.Errorf("quarantine range ends outside the subnet %s", subnet.String())
+	}
+	for _, server := range q.DNS {
+		if server.To4() == nil {
+			return nil, fmt.Errorf("invalid quarantine dns server: %s", server)
+		}
+	}
+	return &q, nil
+}
+
+// checkQuarantineSubnetRange checks that the range of the quarantine subnet
+// doesn't overlap the lease range, whose addresses are given to the known
+// machines
+func checkQuarantineSubnetRange(value string, leaseStart net.IP, leaseRange int) error {
+	q, err := UnmarshalQuarantineSubnet(value)
+	if err != nil || q == nil || leaseStart.To4() == nil || leaseRange < 1 {
+		return err
+	}
+	qStart, qEnd := q.Start.To4(), dhcp4.IPAdd(q.Start, q.Range-1).To4()
+	lStart, lEnd := leaseStart.To4(), dhcp4.IPAdd(leaseStart, leaseRange-1).To4()
+	if bytes.Compare(qStart, lEnd) <= 0 && bytes.Compare(lStart, qEnd) <= 0 {
+		return fmt.Errorf("quarantine range %s-%s overlaps the lease range %s-%s", qStart, qEnd, lStart, lEnd)
+	}
+	return nil
+}
+
+// VendorClassBootfile hands Bootfile to the clients whose vendor class (dhcp
+// option 60) contains Match, case-insensitively, e.g. the out-of-band
+// controllers. NextServer is the server of the bootfile, which defaults to
+// the serving instance.
+type VendorClassBootfile struct {
+	Match      string `json:"match"`
+	Bootfile   string `json:"bootfile"`
+	NextServer net.IP `json:"nextServer,omitempty"`
+}
+
+// UnmarshalVendorClassBootfiles returns the validated rules of the given json
+// list, which are tried in order. nil is returned for an empty value.
+func UnmarshalVendorClassBootfiles(value string) ([]VendorClassBootfile, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var rules []VendorClassBootfile
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if rule.Match == "" {
+			return nil, fmt.Errorf("rule #%d: empty match", i)
+		}
+		if rule.Bootfile == "" {
+			return nil, fmt.Errorf("rule #%d: empty bootfile", i)
+		}
+		if err := validateNextBootfile(rule.Bootfile); err != nil {
+			return nil, fmt.Errorf("rule #%d: %s", i, err)
+		}
+		if rule.NextServer != nil && rule.NextServer.To4() == nil {
+			return nil, fmt.Errorf("rule #%d: invalid ipv4 address for the next server: %s", i, rule.NextServer)
+		}
+	}
+	return rules, nil
+}
+
+// UserClassProfile is the boot profile of the clients whose user class (dhcp
+// option 77) is Match, case-insensitively, e.g. "rescue" which is set by
+// iPXE's user-class setting. Bootfile and NextServer are handed to them like
+// VendorClassBootfile, and KernelArgs are appended to the kernel command line
+// of the pxelinux config. Either of Bootfile or KernelArgs is needed.
+type UserClassProfile struct {
+	Match      string `json:"match"`
+	Bootfile   string `json:"bootfile,omitempty"`
+	NextServer net.IP `json:"nextServer,omitempty"`
+	KernelArgs string `json:"kernelArgs,omitempty"`
+}
+
+// UnmarshalUserClassProfiles returns the validated profiles of the given json
+// list. nil is returned for an empty value.
+func UnmarshalUserClassProfiles(value string) ([]UserClassProfile, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var profiles []UserClassProfile
+	if err := json.Unmarshal([]byte(value), &profiles); err != nil {
+		return nil, err
+	}
+	matches := make(map[string]bool)
+	for i, profile := range profiles {
+		if profile.Match == "" {
+			return nil, fmt.Errorf("profile #%d: empty match", i)
+		}
+		if matches[strings.ToLower(profile.Match)] {
+			return nil, fmt.Errorf("profile #%d: duplicate match %q", i, profile.Match)
+		}
+		matches[strings.ToLower(profile.Match)] = true
+		if profile.Bootfile == "" && profile.KernelArgs == "" {
+			return nil, fmt.Errorf("profile #%d: neither a bootfile nor kernel args", i)
+		}
+		if profile.Bootfile != "" {
+			if err := validateNextBootfile(profile.Bootfile); err != nil {
+				return nil, fmt.Errorf("profile #%d: %s", i, err)
+			}
+		}
+		if profile.NextServer != nil && profile.NextServer.To4() == nil {
+			return nil, fmt.Errorf("profile #%d: invalid ipv4 address for the next server: %s", i, profile.NextServer)
+		}
+		if strings.ContainsAny(profile.KernelArgs, "\r\n") {
+			return nil, fmt.Errorf("profile #%d: kernel args span multiple lines", i)
+		}
+	}
+	return profiles, nil
+}
+
+// FindUserClassProfile returns the profile of the user class, or nil if
+// there's none
+func FindUserClassProfile(userClass string, profiles []UserClassProfile) *UserClassProfile {
+	if userClass == "" {
+		return nil
+	}
+	for i := range profiles {
+		if strings.EqualFold(profiles[i].Match, userClass) {
+			return &profiles[i]
+		}
 	}
 	return nil
 }
@@ -1,6 +1,9 @@
 package datasource
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestValidateVariable(t *testing.T) {
 	tests := []struct {
@@ -28,6 +31,147 @@ func TestValidateVariable(t *testing.T) {
 		{SpecialKeyNetworkConfiguration, "", true},
 		{SpecialKeyNetworkConfiguration,
 			`{"netmask":"invalid"}`, true},
+
+		// WPADURL
+		{SpecialKeyWPADURL, "http://proxy.example.com/wpad.dat", false},
+		{SpecialKeyWPADURL, "", false},
+		{SpecialKeyWPADURL, "proxy.example.com/wpad.dat", true},
+		{SpecialKeyWPADURL, "ftp://proxy.example.com/wpad.dat", true},
+		// Timezones
+		{SpecialKeyTZPOSIX, "CET-1CEST,M3.5.0,M10.5.0/3", false},
+		{SpecialKeyTZPOSIX, "", true},
+		{SpecialKeyTZPOSIX, "CET -1", true},
+		{SpecialKeyTZDatabase, "Europe/Amsterdam", false},
+		{SpecialKeyTZDatabase, "", true},
+		{SpecialKeyTZDatabase, strings.Repeat("a", 256), true},
+		// IgnoredVendorClasses
+		{SpecialKeyIgnoredVendorClasses, "ArubaAP, Cisco", false},
+		{SpecialKeyIgnoredVendorClasses, "", false},
+		{SpecialKeyIgnoredVendorClasses, "ArubaAP,,Cisco", true},
+		{SpecialKeyEchoedVendorClasses, "MSFT 5.0", false},
+		{SpecialKeyEchoedVendorClasses, "MSFT 5.0,", true},
+		// DNSSource
+		{SpecialKeyDNSSource, "", false},
+		{SpecialKeyDNSSource, `{"mode": "self"}`, false},
+		{SpecialKeyDNSSource, `{"mode": "instances"}`, false},
+		{SpecialKeyDNSSource, `{"mode": "static", "servers": ["8.8.8.8", "8.8.4.4"]}`, false},
+		{SpecialKeyDNSSource, `{"mode": "static"}`, true},
+		{SpecialKeyDNSSource, `{"mode": "static", "servers": ["::1"]}`, true},
+		{SpecialKeyDNSSource, `{"mode": "self", "servers": ["8.8.8.8"]}`, true},
+		{SpecialKeyDNSSource, `{"mode": "anycast"}`, true},
+		{SpecialKeyDNSSource, `self`, true},
+		// Maintenance
+		{SpecialKeyMaintenance, "true", false},
+		{SpecialKeyMaintenance, "false", false},
+		{SpecialKeyMaintenance, "", false},
+		{SpecialKeyMaintenance, "yes", true},
+		{SpecialKeyOmitHostname, "true", false},
+		{SpecialKeyOmitHostname, "on", true},
+		// Client identifier lookup
+		{SpecialKeyClientIDLookup, "true", false},
+		{SpecialKeyClientIDLookup, "", false},
+		{SpecialKeyClientIDLookup, "on", true},
+		// SearchDomains
+		{SpecialKeySearchDomains, "example.com, corp.example.com.", false},
+		{SpecialKeySearchDomains, "", false},
+		{SpecialKeyExtraSearchDomains, "tenant-1.example.com", false},
+		{SpecialKeyExtraSearchDomains, "-tenant.example.com", true},
+		{SpecialKeyExtraSearchDomains, "tenant..example.com", true},
+		{SpecialKeySearchDomains, "exa_mple.com", true},
+		// NTPServers
+		{SpecialKeyNTPServers, "10.0.0.1, 10.0.0.2", false},
+		{SpecialKeyNTPServers, "", false},
+		{SpecialKeyNTPServers, "ntp.example.com", true},
+		// LeaseDuration
+		{SpecialKeyLeaseDuration, "720h", false},
+		{SpecialKeyLeaseDuration, "", false},
+		{SpecialKeyLeaseDuration, "30s", true},
+		{SpecialKeyLeaseDuration, "a week", true},
+		// NetBIOS
+		{SpecialKeyNetBIOSNameServers, "10.0.0.3", false},
+		{SpecialKeyNetBIOSNameServers, "wins.example.com", true},
+		{SpecialKeyTFTPServers, "10.0.0.5, 10.0.0.6", false},
+		{SpecialKeyTFTPServers, "::1", true},
+		{SpecialKeyDomainName, "", false},
+		{SpecialKeyDomainName, "zone-a.example.com", false},
+		{SpecialKeyDomainName, "zone_a.example.com", true},
+		{SpecialKeyNetBIOSNodeType, "8", false},
+		{SpecialKeyNetBIOSNodeType, "h", false},
+		{SpecialKeyNetBIOSNodeType, "", false},
+		{SpecialKeyNetBIOSNodeType, "3", true},
+		// NextBootfile
+		{SpecialKeyNextBootfile, "http://10.0.0.1/stage2.ipxe", false},
+		{SpecialKeyNextBootfile, "", false},
+		{SpecialKeyNextBootfile, "stage 2.ipxe", true},
+		{SpecialKeyNextBootfile, strings.Repeat("a", 128), true},
+		// VendorClassBootfiles
+		{SpecialKeyVendorClassBootfiles, `[{"match": "iDRAC", "bootfile": "idrac.efi"}]`, false},
+		{SpecialKeyVendorClassBootfiles, `[{"match": "iLO", "bootfile": "ilo.efi", "nextServer": "10.0.0.5"}]`, false},
+		{SpecialKeyVendorClassBootfiles, "", false},
+		{SpecialKeyVendorClassBootfiles, `[{"match": "", "bootfile": "idrac.efi"}]`, true},
+		{SpecialKeyVendorClassBootfiles, `[{"match": "iDRAC"}]`, true},
+		{SpecialKeyVendorClassBootfiles, `[{"match": "iLO", "bootfile": "ilo.efi", "nextServer": "::1"}]`, true},
+		{SpecialKeyVendorClassBootfiles, `{"match": "iDRAC"}`, true},
+		// Ignore
+		{SpecialKeyIgnore, "true", false},
+		{SpecialKeyIgnore, "yes", true},
+		{SpecialKeyNoInstall, "true", false},
+		{SpecialKeyNoInstall, "never", true},
+		// BootServerHostname
+		{SpecialKeyBootServerHostname, "boot.example.com", false},
+		{SpecialKeyBootServerHostname, "", false},
+		{SpecialKeyBootServerHostname, "boot server", true},
+		// ReprovisionCooldown
+		{SpecialKeyReprovisionCooldown, "30m", false},
+		{SpecialKeyReprovisionCooldown, "", false},
+		{SpecialKeyReprovisionCooldown, "-1m", true},
+		{SpecialKeyReprovisionCooldown, "half an hour", true},
+		// UserClassProfiles
+		{SpecialKeyUserClassProfiles, `[{"match": "rescue", "bootfile": "rescue.ipxe"}]`, false},
+		{SpecialKeyUserClassProfiles, `[{"match": "debug", "kernelArgs": "console=ttyS0 coreos.autologin"}]`, false},
+		{SpecialKeyUserClassProfiles, "", false},
+		{SpecialKeyUserClassProfiles, `[{"match": "rescue"}]`, true},
+		{SpecialKeyUserClassProfiles, `[{"match": "", "bootfile": "rescue.ipxe"}]`, true},
+		{SpecialKeyUserClassProfiles, `[{"match": "a", "bootfile": "a.ipxe"}, {"match": "A", "bootfile": "b.ipxe"}]`, true},
+		{SpecialKeyUserClassProfiles, `[{"match": "debug", "kernelArgs": "a\nb"}]`, true},
+		{SpecialKeyUserClassProfiles, `[{"match": "rescue", "bootfile": "rescue.ipxe", "nextServer": "::1"}]`, true},
+		// PXEMenu
+		{SpecialKeyPXEMenu, `[{"description": "Memtest", "bootfile": "memtest.0"}]`, false},
+		{SpecialKeyPXEMenu, "", false},
+		{SpecialKeyPXEMenu, `[{"description": "", "bootfile": "memtest.0"}]`, true},
+		{SpecialKeyPXEMenu, `[{"description": "Memtest"}]`, true},
+		{SpecialKeyPXEMenu, `[{"description": "Mem\ttest", "bootfile": "memtest.0"}]`, true},
+		{SpecialKeyPXEMenu, `[{"description": "Memtest", "bootfile": "mem test.0"}]`, true},
+		// LeaseGrace
+		{SpecialKeyLeaseGrace, "5m", false},
+		{SpecialKeyLeaseGrace, "0s", false},
+		{SpecialKeyLeaseGrace, "", false},
+		{SpecialKeyLeaseGrace, "-1m", true},
+		{SpecialKeyLeaseGrace, "soon", true},
+		// PXEOptionsLength
+		{SpecialKeyPXEOptionsLength, "64", false},
+		{SpecialKeyPXEOptionsLength, "", false},
+		{SpecialKeyPXEOptionsLength, "256", true},
+		{SpecialKeyPXEOptionsLength, "-1", true},
+		// PXEMenuTimeout
+		{SpecialKeyPXEMenuTimeout, "10", false},
+		{SpecialKeyPXEMenuTimeout, "0", false},
+		{SpecialKeyPXEMenuTimeout, "255", false},
+		{SpecialKeyPXEMenuTimeout, "", false},
+		{SpecialKeyPXEMenuTimeout, "256", true},
+		{SpecialKeyPXEMenuTimeout, "-1", true},
+		{SpecialKeyPXEMenuTimeout, "2s", true},
+		// PXEBootMessage
+		{SpecialKeyPXEBootMessage, "Rack 12 (staging)", false},
+		{SpecialKeyPXEBootMessage, "", false},
+		{SpecialKeyPXEBootMessage, strings.Repeat("x", MaxPXEBootMessageLength+1), true},
+		{SpecialKeyPXEBootMessage, "line1\nline2", true},
+		// QuarantineSubnet
+		{SpecialKeyQuarantineSubnet, `{"start": "10.99.0.10", "range": 10, "netmask": "255.255.255.0", "dns": ["10.99.0.1"]}`, false},
+		{SpecialKeyQuarantineSubnet, "", false},
+		{SpecialKeyQuarantineSubnet, `{"start": "10.99.0.250", "range": 10, "netmask": "255.255.255.0"}`, true},
+		{SpecialKeyQuarantineSubnet, `{"start": "10.99.0.10", "range": 0, "netmask": "255.255.255.0"}`, true},
+		{SpecialKeyQuarantineSubnet, `{"start": "10.99.0.10", "range": 10, "netmask": "255.0.255.0"}`, true},
 	}
 
 	for i, tt := range tests {
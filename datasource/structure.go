@@ -1,6 +1,12 @@
 package datasource // import "github.com/cafebazaar/blacksmith/datasource"
 
-import "net"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
 
 // MachineType distinguishes normal servers from static ones, and from the BMC inside those machines
 type MachineType int16
@@ -18,13 +24,76 @@ const (
 	MTBMC MachineType = 3
 )
 
+var machineTypeNames = map[MachineType]string{
+	MTNormal: "normal",
+	MTStatic: "static",
+	MTBMC:    "bmc",
+}
+
+// String returns the name of the machine type, or its number if it's unknown
+func (t MachineType) String() string {
+	if name, isIn := machineTypeNames[t]; isIn {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+// ParseMachineType returns the MachineType with the given name (normal,
+// static, bmc) or number
+func ParseMachineType(s string) (MachineType, error) {
+	for t, name := range machineTypeNames {
+		if s == name {
+			return t, nil
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 16)
+	if err == nil {
+		if _, isIn := machineTypeNames[MachineType(n)]; isIn {
+			return MachineType(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown machine type: %q", s)
+}
+
 // Machine details
 type Machine struct {
 	IP        net.IP      `json:"ip"`
 	FirstSeen int64       `json:"first_seen"`
 	Type      MachineType `json:"type"`
+	Labels    []string    `json:"labels,omitempty"`
 }
 
+// Lease is the last lease which is acknowledged to a machine
+type Lease struct {
+	IP net.IP `json:"ip"`
+	// Expiry is the unix time at which the lease expires
+	Expiry int64 `json:"expiry"`
+	// Revoked is set for a lease which is expired through the api, so its
+	// ip is not honored anymore, even in the lease grace
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+// Active reports whether the lease hasn't expired at the given time
+func (l *Lease) Active(now time.Time) bool {
+	return l.Expiry > now.Unix()
+}
+
+// VariableInfo is the value of a variable along with its metadata
+type VariableInfo struct {
+	Value string `json:"value"`
+	// Modified is the unix time of the last SetVariable, or 0 if unknown
+	Modified int64 `json:"modified"`
+	// ModifiedIndex is the etcd index of the last modification
+	ModifiedIndex uint64 `json:"modifiedIndex"`
+}
+
+// MaxNotesLength is the maximum length of the notes of a machine, in bytes
+const MaxNotesLength = 1024
+
+// ErrMachineExists is returned by MachineInterface.Claim if the mac already
+// has a machine record
+var ErrMachineExists = errors.New("the machine already exists")
+
 // MachineInterface provides the interface for querying/altering
 // Machine entries in the datasource
 type MachineInterface interface {
@@ -48,27 +117,125 @@ type MachineInterface interface {
 	// for the returned Machine to have an IP different from createWithIP.
 	Machine(createIfNeeded bool, createWithIP net.IP) (Machine, error)
 
-	// LastSeen returns the last time the machine has been seen
+	// Known reports whether there's a record for the machine
+	Known() (bool, error)
+
+	// StoreMachine stores the given machine for this mac, replacing the
+	// current record if there is one. If machine.IP is nil, the IP will be
+	// assigned automatically, and if machine.Type is not set, it's chosen
+	// the same way as Machine does. The stored Machine is returned.
+	StoreMachine(machine Machine) (Machine, error)
+
+	// Claim stores the given machine like StoreMachine, but only if there's
+	// no record for this mac. The check and the write are atomic, so a
+	// concurrent claim or dhcp auto-creation can't replace the record.
+	// ErrMachineExists is returned if the record already exists.
+	Claim(machine Machine) (Machine, error)
+
+	// LastSeen returns the last time the machine has been seen, 0 for never
 	LastSeen() (int64, error)
 
+	// FirstBoot returns the time of the first successful dhcp ACK of the
+	// machine, which is set by CheckIn and never overwritten, 0 for never
+	FirstBoot() (int64, error)
+
+	// Events returns the last MaxMachineEvents changes of the machine, e.g.
+	// its new leases, agent states and variables, the oldest first
+	Events() ([]MachineEvent, error)
+
+	// Notes returns the free text notes of the machine, "" if there's none
+	Notes() (string, error)
+
+	// SetNotes replaces the notes of the machine, and an empty string
+	// removes them. The notes are limited to MaxNotesLength bytes.
+	SetNotes(notes string) error
+
+	// Lease returns the last lease of the machine, or nil if there's none
+	Lease() (*Lease, error)
+
+	// StoreLease stores the lease which is acknowledged to the machine
+	StoreLease(lease Lease) error
+
+	// AgentState returns the state which is last reported by the agent of
+	// the machine, or nil if there's none or it has expired
+	AgentState() (*AgentState, error)
+
+	// SetAgentState stores the state which is reported by the agent of the
+	// machine, which expires after ttl (at most MaxAgentStateTTL)
+	SetAgentState(state string, ttl time.Duration) error
+
+	// ClientArch returns the client architecture (option 93) which is last
+	// reported by the machine, and false if it has never reported one
+	ClientArch() (uint16, bool, error)
+
+	// StoreClientArch stores the client architecture reported by the machine
+	StoreClientArch(arch uint16) error
+
+	// UserClassProfile returns the match of the UserClassProfile which is
+	// chosen in the last dhcp ACK of the machine, "" if there's none
+	UserClassProfile() (string, error)
+
+	// StoreUserClassProfile stores the match of the chosen UserClassProfile,
+	// and an empty string removes it
+	StoreUserClassProfile(match string) error
+
+	// Provisioned returns the last time the pxelinux config, which installs
+	// the machine, is served to the machine, 0 for never
+	Provisioned() (int64, error)
+
+	// StoreProvisioned records that the pxelinux config is served to the
+	// machine now
+	StoreProvisioned() error
+
+	// Ignored reports whether the machine's own SpecialKeyIgnore variable is
+	// set, in which case its dhcp requests are not answered
+	Ignored() (bool, error)
+
+	// NoInstall reports whether the machine's own SpecialKeyNoInstall
+	// variable is set, in which case it's never handed the installer
+	NoInstall() (bool, error)
+
 	// DeleteMachine deletes a machine from the store entirely
 	DeleteMachine() error
 
-	// CheckIn updates the _last_seen field of the machine
+	// CheckIn updates the _last_seen field of the machine, and sets the
+	// _first_boot field if it's the first time
 	CheckIn()
 
 	// ListVariables returns the list of all the flgas of a machine from Etcd
 	ListVariables() (map[string]string, error)
 
+	// ListVariablesPage returns up to limit variables of the machine whose
+	// keys start with prefix and come after the given key, in the order of
+	// the keys. It also reports whether there are more variables.
+	ListVariablesPage(prefix, after string, limit int) (map[string]string, bool, error)
+
+	// ListVariablesWithMetadata returns the variables of the machine, along
+	// with their modification times
+	ListVariablesWithMetadata() (map[string]VariableInfo, error)
+
 	// GetVariable Gets a machine's variable, or the global if it was not
 	// set for the machine
 	GetVariable(key string) (string, error)
 
+	// OwnVariable returns the machine's own value of the variable, and
+	// false if it's not set for the machine, without falling back to the
+	// cluster variable
+	OwnVariable(key string) (string, bool, error)
+
 	// SetVariable sets the value of the specified key
 	SetVariable(key string, value string) error
 
 	// DeleteVariable erases the entry specified by key
 	DeleteVariable(key string) error
+
+	// DeleteVariables erases all the variables of the machine, except the
+	// ones in preserve, and returns the number of the erased ones
+	DeleteVariables(preserve ...string) (int, error)
+
+	// EtcdKey returns the etcd key of the given variable of the machine, or
+	// the key of the machine's directory if key is empty
+	EtcdKey(key string) string
 }
 
 // InstanceInfo describes an active instance of blacksmith running on some machine
@@ -80,6 +247,22 @@ type InstanceInfo struct {
 	Commit           string           `json:"commit"`
 	BuildTime        string           `json:"buildTime"`
 	ServiceStartTime int64            `json:"serviceStartTime"`
+	LastHeartbeat    int64            `json:"lastHeartbeat"`
+	Roles            []string         `json:"roles,omitempty"`
+}
+
+// InstanceRoleNTP is the role of the instances which serve ntp, and are
+// advertised through dhcp option 42
+const InstanceRoleNTP = "ntp"
+
+// HasRole reports whether the instance has the given role
+func (i *InstanceInfo) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 // File describes a file located inside our workspace
@@ -127,7 +310,8 @@ type DataSource interface {
 	// mac
 	MachineInterface(mac net.HardwareAddr) MachineInterface
 
-	// ListClusterVariables returns the list of all the cluster variables
+	// ListClusterVariables returns the list of all the cluster variables,
+	// along with the ones of the config file
 	ListClusterVariables() (map[string]string, error)
 
 	// GetClusterVariable returns a cluster variables with the given name
@@ -139,6 +323,76 @@ type DataSource interface {
 	// DeleteClusterVariable delete a cluster variable from etcd.
 	DeleteClusterVariable(key string) error
 
+	// QuarantinedMachines returns the addresses of the quarantined machines,
+	// by their macs
+	QuarantinedMachines() (map[string]net.IP, error)
+
+	// QuarantineLease returns the address of the unknown machine in the
+	// quarantine subnet, and assigns one if it's not quarantined yet
+	QuarantineLease(mac net.HardwareAddr, subnet *QuarantineSubnet) (net.IP, error)
+
+	// ApproveMachine releases the machine from the quarantine, and creates
+	// its record so it's served normally from now on. The decision is
+	// recorded along with by, which identifies the approver.
+	ApproveMachine(mac net.HardwareAddr, by string) (Machine, error)
+
+	// RejectMachine releases the quarantine lease of the unknown machine,
+	// and its requests are not answered anymore, unless it's approved later.
+	// The decision is recorded along with by, which identifies the rejecter.
+	RejectMachine(mac net.HardwareAddr, by string) error
+
+	// QuarantineDecision returns the last decision which is made about the
+	// machine, or nil if there's none
+	QuarantineDecision(mac net.HardwareAddr) (*QuarantineDecision, error)
+
+	// QuarantineDecisions returns the last decisions which are made about
+	// the quarantined machines, by their macs
+	QuarantineDecisions() (map[string]QuarantineDecision, error)
+
+	// PruneLeases deletes the records of the machines whose leases have
+	// expired longer than LeaseRetention ago, and then the ones of the
+	// oldest expired leases until there are at most MaxLeases leases. It
+	// returns the number of the pruned machines.
+	PruneLeases(now time.Time) (int, error)
+
+	// ClusterVariableEtcdKey returns the etcd key of the given cluster
+	// variable
+	ClusterVariableEtcdKey(key string) string
+
+	// EffectiveClusterVariables returns the cluster variables which are in
+	// effect, along with whether they come from etcd or the config file
+	EffectiveClusterVariables() (map[string]EffectiveVariable, error)
+
+	// ClientIDLookup reports whether the machines are looked up by their
+	// client identifiers (dhcp option 61) rather than their macs
+	ClientIDLookup() (bool, error)
+
+	// ClientIDMachine returns the mac of the machine which is bound to the
+	// client identifier, or nil if there's none
+	ClientIDMachine(clientID []byte) (net.HardwareAddr, error)
+
+	// BindClientID binds the client identifier to the machine
+	BindClientID(clientID []byte, mac net.HardwareAddr) error
+
+	// Subnets returns the subnet definitions, sorted by their addresses
+	Subnets() ([]SubnetDefinition, error)
+
+	// SetSubnet validates and normalizes the subnet definition and stores
+	// it, replacing the one with the same cidr. An invalid definition is
+	// refused with an *InvalidSubnetError, and the one which overlaps
+	// another subnet with a *SubnetOverlapError.
+	SetSubnet(s *SubnetDefinition) error
+
+	// DeleteSubnet deletes the definition of the subnet with the given cidr
+	DeleteSubnet(cidr string) error
+
+	// Maintenance reports whether the maintenance mode is on. In this mode,
+	// the machines are given their addresses, but not network booted.
+	Maintenance() (bool, error)
+
+	// SetMaintenance turns the maintenance mode on or off
+	SetMaintenance(on bool) error
+
 	// EtcdMembers returns a string suitable for `-initial-cluster`
 	// This is the etcd the Blacksmith instance is using as its datastore
 	// Smelly function to be here! but it's a lot helpful.
@@ -0,0 +1,256 @@
+package datasource
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+// etcdSubnetsDirName holds the subnet definitions, by their cidrs with the
+// slash replaced by an underscore
+const etcdSubnetsDirName = "subnets"
+
+// SubnetDefinition is the network configuration of a subnet. Netmask is
+// implied by CIDR, and it's filled by Validate if it's not given. The
+// Netmask, and the Router, DNS and ClasslessRouteOption which are set,
+// override the network configuration of the machines in the subnet.
+// RangeStart and RangeEnd bound the addresses of the subnet which are
+// allocated to the machines, and the Exclude addresses (e.g. the gateways
+// and the reserved ones) are never allocated.
+type SubnetDefinition struct {
+	CIDR                 string                     `json:"cidr"`
+	Netmask              net.IP                     `json:"netmask"`
+	Router               net.IP                     `json:"router,omitempty"`
+	DNS                  []net.IP                   `json:"dns,omitempty"`
+	ClasslessRouteOption []ClasslessRouteOptionPart `json:"classlessRouteOption,omitempty"`
+	RangeStart           net.IP                     `json:"rangeStart,omitempty"`
+	RangeEnd             net.IP                     `json:"rangeEnd,omitempty"`
+	Exclude              []net.IP                   `json:"exclude,omitempty"`
+}
+
+// Validate checks the subnet definition, normalizes its CIDR and fills its
+// Netmask, and returns the parsed subnet
+func (s *SubnetDefinition) Validate() (*net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(s.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	if subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid ipv4 subnet: %s", s.CIDR)
+	}
+	netmask := net.IP(subnet.Mask).To4()
+	if s.Netmask != nil && !s.Netmask.Equal(netmask) {
+		return nil, fmt.Errorf("netmask %s doesn't match the subnet %s", s.Netmask, subnet.String())
+	}
+	s.CIDR, s.Netmask = subnet.String(), netmask
+
+	validationErr := &ValidationError{}
+	checkRoutes(subnet, s.Router, s.ClasslessRouteOption, validationErr)
+	if err := validationErr.errOrNil(); err != nil {
+		return nil, err
+	}
+	for _, server := range s.DNS {
+		if server.To4() == nil {
+			return nil, fmt.Errorf("invalid ipv4 address for a dns server: %s", server)
+		}
+	}
+
+	if (s.RangeStart == nil) != (s.RangeEnd == nil) {
+		return nil, errors.New("both of rangeStart and rangeEnd are required for a range")
+	}
+	if s.RangeStart != nil {
+		s.RangeStart, s.RangeEnd = s.RangeStart.To4(), s.RangeEnd.To4()
+		for _, ip := range []net.IP{s.RangeStart, s.RangeEnd} {
+			if ip == nil || !subnet.Contains(ip) {
+				return nil, fmt.Errorf("range is outside the subnet %s", subnet.String())
+			}
+		}
+		if bytes.Compare(s.RangeStart, s.RangeEnd) > 0 {
+			return nil, fmt.Errorf("range start %s is after its end %s", s.RangeStart, s.RangeEnd)
+		}
+	}
+	for i, ip := range s.Exclude {
+		if ip.To4() == nil || !subnet.Contains(ip) || !s.inRange(ip) {
+			return nil, fmt.Errorf("excluded address %s is outside the range of the subnet %s", ip, subnet.String())
+		}
+		s.Exclude[i] = ip.To4()
+	}
+	return subnet, nil
+}
+
+// inRange reports whether the ip is in the range of the subnet, which is the
+// whole subnet if there's no range
+func (s *SubnetDefinition) inRange(ip net.IP) bool {
+	if s.RangeStart == nil {
+		return true
+	}
+	ip = ip.To4()
+	return bytes.Compare(ip, s.RangeStart.To4()) >= 0 && bytes.Compare(ip, s.RangeEnd.To4()) <= 0
+}
+
+// SubnetOf returns the definition of the subnet which contains the ip, or
+// nil if there's none
+func SubnetOf(ip net.IP, subnets []SubnetDefinition) *SubnetDefinition {
+	for i := range subnets {
+		_, subnet, err := net.ParseCIDR(subnets[i].CIDR)
+		if err == nil && subnet.Contains(ip) {
+			return &subnets[i]
+		}
+	}
+	return nil
+}
+
+// allocatable reports whether the ip may be allocated to a machine, which
+// it may not if it's outside the range of its subnet or is excluded
+func allocatable(ip net.IP, subnets []SubnetDefinition) bool {
+	s := SubnetOf(ip, subnets)
+	if s == nil {
+		return true
+	}
+	if !s.inRange(ip) {
+		return false
+	}
+	for _, excluded := range s.Exclude {
+		if excluded.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// InvalidSubnetError is the reason a subnet definition is invalid
+type InvalidSubnetError struct {
+	Err error
+}
+
+func (e *InvalidSubnetError) Error() string { return e.Err.Error() }
+
+// SubnetOverlapError is returned for a subnet definition which overlaps
+// another one
+type SubnetOverlapError struct {
+	CIDR  string
+	Other string
+}
+
+func (e *SubnetOverlapError) Error() string {
+	return fmt.Sprintf("subnet %s overlaps %s", e.CIDR, e.Other)
+}
+
+// checkSubnetOverlap checks that the validated subnet definition doesn't
+// overlap the given ones, except the one with the same cidr, which is
+// replaced by it
+func checkSubnetOverlap(s *SubnetDefinition, subnets []SubnetDefinition) error {
+	_, subnet, err := net.ParseCIDR(s.CIDR)
+	if err != nil {
+		return err
+	}
+	for _, other := range subnets {
+		if other.CIDR == s.CIDR {
+			continue
+		}
+		_, otherSubnet, err := net.ParseCIDR(other.CIDR)
+		if err != nil {
+			return fmt.Errorf("invalid stored subnet %q: %s", other.CIDR, err)
+		}
+		if subnet.Contains(otherSubnet.IP) || otherSubnet.Contains(subnet.IP) {
+			return &SubnetOverlapError{CIDR: s.CIDR, Other: other.CIDR}
+		}
+	}
+	return nil
+}
+
+func (ds *EtcdDataSource) prefixifyForSubnet(cidr string) string {
+	return path.Join(ds.clusterName, etcdSubnetsDirName, strings.Replace(cidr, "/", "_", 1))
+}
+
+type subnetsByIP []SubnetDefinition
+
+func (s subnetsByIP) Len() int      { return len(s) }
+func (s subnetsByIP) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s subnetsByIP) Less(i, j int) bool {
+	ipI, sizeI := splitCIDR(s[i].CIDR)
+	ipJ, sizeJ := splitCIDR(s[j].CIDR)
+	if c := bytes.Compare(ipI, ipJ); c != 0 {
+		return c < 0
+	}
+	return sizeI < sizeJ
+}
+
+func splitCIDR(cidr string) (net.IP, int) {
+	parts := strings.SplitN(cidr, "/", 2)
+	if len(parts) != 2 {
+		return nil, 0
+	}
+	size, _ := strconv.Atoi(parts[1])
+	return net.ParseIP(parts[0]).To4(), size
+}
+
+// Subnets returns the subnet definitions, sorted by their addresses. The
+// ones of the config file, if any, are merged in by their cidrs, the same
+// way the cluster variables are.
+func (ds *EtcdDataSource) Subnets() ([]SubnetDefinition, error) {
+	entries, err := ds.listNonDirKeyValues(path.Join(ds.clusterName, etcdSubnetsDirName))
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return nil, err
+	}
+
+	subnets := make([]SubnetDefinition, 0, len(entries))
+	byCIDR := make(map[string]int)
+	for name, value := range entries {
+		var s SubnetDefinition
+		if err := json.Unmarshal([]byte(value), &s); err != nil {
+			return nil, fmt.Errorf("error while unmarshalling the subnet %s: %s", name, err)
+		}
+		byCIDR[s.CIDR] = len(subnets)
+		subnets = append(subnets, s)
+	}
+	for _, s := range ds.options.FileConfig.Subnets() {
+		i, isIn := byCIDR[s.CIDR]
+		if !isIn {
+			subnets = append(subnets, s)
+		} else if ds.options.FileConfigWins {
+			subnets[i] = s
+		}
+	}
+	sort.Sort(subnetsByIP(subnets))
+	return subnets, nil
+}
+
+// SetSubnet validates and normalizes the subnet definition and stores it,
+// replacing the one with the same cidr. It's refused if it overlaps another
+// subnet.
+func (ds *EtcdDataSource) SetSubnet(s *SubnetDefinition) error {
+	if _, err := s.Validate(); err != nil {
+		return &InvalidSubnetError{Err: err}
+	}
+	subnets, err := ds.Subnets()
+	if err != nil {
+		return err
+	}
+	if err := checkSubnetOverlap(s, subnets); err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ds.set(ds.prefixifyForSubnet(s.CIDR), string(value))
+}
+
+// DeleteSubnet deletes the definition of the subnet with the given cidr
+func (ds *EtcdDataSource) DeleteSubnet(cidr string) error {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	return ds.delete(ds.prefixifyForSubnet(subnet.String()))
+}
@@ -21,6 +21,10 @@ type ForTestParams struct {
 	workspacePath *string
 	listenIF      *string
 	dnsIPStrings  *[]string
+
+	// FileConfig and FileConfigWins are the ones of the Options
+	FileConfig     *FileConfig
+	FileConfigWins bool
 }
 
 const (
@@ -29,6 +33,7 @@ const (
 	forTestDefaultWorkspacePath = "/tmp/blacksmith/workspaces/test-workspace"
 	forTestDefaultListenIF      = "lo"
 	forTestDNSIPStrings         = "8.8.8.8"
+	forTestSetRetries           = 2
 )
 
 var (
@@ -56,6 +61,7 @@ func ForTest(params *ForTestParams) (DataSource, error) {
 	workspacePath := forTestDefaultWorkspacePath
 	listenIF := "lo"
 	dnsIPStrings := strings.Split(forTestDNSIPStrings, ",")
+	options := Options{SetRetries: forTestSetRetries}
 
 	if params != nil {
 		if params.leaseStart != nil {
@@ -73,6 +79,7 @@ func ForTest(params *ForTestParams) (DataSource, error) {
 		if params.dnsIPStrings != nil {
 			dnsIPStrings = *params.dnsIPStrings
 		}
+		options.FileConfig, options.FileConfigWins = params.FileConfig, params.FileConfigWins
 	}
 
 	// For tests to be safe for parallel execution
@@ -125,6 +132,7 @@ func ForTest(params *ForTestParams) (DataSource, error) {
 		workspacePath,
 		dnsIPStrings,
 		selfInfo,
+		options,
 	)
 
 	if err != nil {
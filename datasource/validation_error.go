@@ -0,0 +1,38 @@
+package datasource
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError is the reason a field of a value is invalid
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// ValidationError lists the invalid fields of a value, so they can be
+// reported all at once
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, 0, len(e.Errors))
+	for _, fieldError := range e.Errors {
+		parts = append(parts, fmt.Sprintf("%s: %s", fieldError.Field, fieldError.Reason))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Reason: fmt.Sprintf(format, args...)})
+}
+
+// errOrNil returns the error if any field is invalid, and nil otherwise
+func (e *ValidationError) errOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
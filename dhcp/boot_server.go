@@ -0,0 +1,131 @@
+package dhcp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+const (
+	// hostCacheTTL is how long a resolved boot server is served without
+	// resolving it again
+	hostCacheTTL = time.Minute
+	// hostCacheRetryAfter is how long a failed lookup is served before it's
+	// retried
+	hostCacheRetryAfter = 10 * time.Second
+	// hostCacheSize bounds the number of the cached hostnames
+	hostCacheSize = 64
+)
+
+// lookupIP resolves the hostname of the boot server, it's replaced in the
+// tests
+var lookupIP = net.LookupIP
+
+type hostCacheEntry struct {
+	ips        []net.IP
+	err        error
+	fetched    time.Time
+	refreshing bool
+}
+
+// hostCache keeps the addresses of the boot servers by their hostnames, so
+// the replies don't block on the dns. Only the first lookup of a hostname
+// waits for it. After the ttl, or after hostCacheRetryAfter for a failed
+// lookup, the cached result is served while it's resolved again in the
+// background, and the addresses are kept if it fails. It's safe for
+// concurrent use, and a nil *hostCache resolves the hostname on each call.
+type hostCache struct {
+	lookup func(string) ([]net.IP, error)
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*hostCacheEntry
+}
+
+func newHostCache(lookup func(string) ([]net.IP, error), ttl time.Duration) *hostCache {
+	return &hostCache{
+		lookup:  lookup,
+		ttl:     ttl,
+		entries: make(map[string]*hostCacheEntry),
+	}
+}
+
+// get returns the addresses of the hostname, through the cache
+func (c *hostCache) get(hostname string, now time.Time) ([]net.IP, error) {
+	if c == nil {
+		return lookupIP(hostname)
+	}
+	c.mu.Lock()
+	entry, found := c.entries[hostname]
+	if !found {
+		c.mu.Unlock()
+		ips, err := c.lookup(hostname)
+		c.store(hostname, ips, err, now)
+		return ips, err
+	}
+
+	ttl := c.ttl
+	if entry.err != nil {
+		ttl = hostCacheRetryAfter
+	}
+	if now.Sub(entry.fetched) >= ttl && !entry.refreshing {
+		entry.refreshing = true
+		go c.refresh(hostname, now)
+	}
+	ips, err := entry.ips, entry.err
+	c.mu.Unlock()
+	return ips, err
+}
+
+func (c *hostCache) refresh(hostname string, now time.Time) {
+	ips, err := c.lookup(hostname)
+	if err != nil {
+		c.mu.Lock()
+		entry, found := c.entries[hostname]
+		if found && entry.err == nil {
+			entry.refreshing = false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+	}
+	c.store(hostname, ips, err, now)
+}
+
+func (c *hostCache) store(hostname string, ips []net.IP, err error, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.entries[hostname]; !found && len(c.entries) >= hostCacheSize {
+		for other := range c.entries {
+			delete(c.entries, other)
+			break
+		}
+	}
+	c.entries[hostname] = &hostCacheEntry{ips: ips, err: err, fetched: now}
+}
+
+// bootServer returns the hostname of the boot server of the machine along
+// with its ipv4 address, or "" and nil if it's not configured
+func (h *Handler) bootServer(machineInterface datasource.MachineInterface) (string, net.IP, error) {
+	hostname, err := machineInterface.GetVariable(datasource.SpecialKeyBootServerHostname)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get boot server hostname: %s", err)
+	}
+	if hostname == "" {
+		return "", nil, nil
+	}
+
+	ips, err := h.bootServers.get(hostname, time.Now())
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve boot server %q: %s", hostname, err)
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return hostname, ip4, nil
+		}
+	}
+	return "", nil, fmt.Errorf("boot server %q has no ipv4 address", hostname)
+}
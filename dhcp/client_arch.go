@@ -0,0 +1,52 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// clientArchNames are the names of the client architectures, as registered
+// by iana for option 93
+var clientArchNames = map[uint16]string{
+	0: "x86 BIOS",
+	1: "NEC/PC98",
+	2: "EFI Itanium",
+	3: "DEC Alpha",
+	4: "Arc x86",
+	5: "Intel Lean Client",
+	6: "x86 UEFI",
+	// rfc4578 has assigned 7 to EFI BC and 9 to x64 UEFI, and the firmwares
+	// send either of them for x64 UEFI
+	7:  "x64 UEFI",
+	8:  "EFI Xscale",
+	9:  "x64 UEFI",
+	10: "ARM 32-bit UEFI",
+	11: "ARM 64-bit UEFI",
+	15: "x86 UEFI HTTP",
+	16: "x64 UEFI HTTP",
+	17: "EBC HTTP",
+	18: "ARM 32-bit UEFI HTTP",
+	19: "ARM 64-bit UEFI HTTP",
+}
+
+// ClientArchName returns the name of the client architecture, or its number
+// if it's unknown
+func ClientArchName(arch uint16) string {
+	if name, isIn := clientArchNames[arch]; isIn {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", arch)
+}
+
+// clientArch returns the client architecture of option 93, which is a list of
+// 16-bit big-endian values. Only the first one is used, as the clients send
+// a single one in practice.
+func clientArch(options dhcp4.Options) (uint16, bool) {
+	value := options[optionClientArch]
+	if len(value) < 2 || len(value)%2 != 0 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(value), true
+}
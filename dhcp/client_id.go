@@ -0,0 +1,62 @@
+package dhcp
+
+import (
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/krolaw/dhcp4"
+)
+
+// clientIDTypeEthernet is the hardware type of the client identifiers which
+// carry a mac, rfc2132 (section 9.14)
+const clientIDTypeEthernet = 1
+
+// machineMac returns the mac by which the machine of the packet is known,
+// which keys its record along with its logs, its cached replies and its
+// transactions. If the client identifier lookup is enabled and the packet
+// has option 61, it's either the mac of the identifier (for the ethernet
+// type), or the mac which is bound to the identifier. Otherwise it's chaddr.
+// An identifier which isn't bound yet is returned too, to be bound to chaddr
+// by bindClientID once the machine is served.
+func (h *Handler) machineMac(p dhcp4.Packet, options dhcp4.Options) (net.HardwareAddr, []byte, error) {
+	// the first byte is the type of the identifier, followed by the
+	// identifier itself
+	clientID := options[dhcp4.OptionClientIdentifier]
+	if len(clientID) < 2 {
+		return p.CHAddr(), nil, nil
+	}
+
+	enabled, err := h.datasource.ClientIDLookup()
+	if err != nil || !enabled {
+		return p.CHAddr(), nil, err
+	}
+
+	if clientID[0] == clientIDTypeEthernet && len(clientID) == 7 {
+		return net.HardwareAddr(clientID[1:]), nil, nil
+	}
+
+	mac, err := h.datasource.ClientIDMachine(clientID)
+	if err != nil || mac != nil {
+		return mac, nil, err
+	}
+	return p.CHAddr(), clientID, nil
+}
+
+// bindClientID binds the client identifier, which isn't bound yet, to the
+// mac. Only the master binds the identifiers, the other instances know the
+// machine by its chaddr until it's bound.
+func (h *Handler) bindClientID(clientID []byte, mac net.HardwareAddr) error {
+	if len(clientID) == 0 || h.datasource.IsMaster() != nil {
+		return nil
+	}
+	if err := h.datasource.BindClientID(clientID, mac); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"where":   "dhcp.ServeDHCP",
+		"action":  "bind",
+		"object":  mac.String(),
+		"subject": "client-id",
+	}).Infof("client identifier %x is bound to the machine", clientID)
+	return nil
+}
@@ -0,0 +1,531 @@
+package dhcp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/krolaw/dhcp4"
+)
+
+// MachineConfiguration is the resolved network configuration which is handed
+// to a machine through dhcp. Hostname (option 12) is the short name of the
+// machine and Domain (option 15) is the cluster name, unless it's overridden
+// by the domain-name variable, so the clients form the fqdn as Hostname +
+// "." + Domain.
+type MachineConfiguration struct {
+	IP                   net.IP                                `json:"ip"`
+	Hostname             string                                `json:"hostname"`
+	Domain               string                                `json:"domain"`
+	Netmask              net.IP                                `json:"netmask"`
+	Router               net.IP                                `json:"router,omitempty"`
+	ClasslessRouteOption []datasource.ClasslessRouteOptionPart `json:"classlessRouteOption,omitempty"`
+	DNS                  []net.IP                              `json:"dns"`
+	NTP                  []net.IP                              `json:"ntp,omitempty"`
+	WPADURL              string                                `json:"wpadURL,omitempty"`
+	SearchDomains        []string                              `json:"searchDomains,omitempty"`
+	// LeaseDuration is 0 if it's not overridden for the machine, in which
+	// case a random duration is used for each lease
+	LeaseDuration      time.Duration `json:"leaseDuration,omitempty"`
+	NetBIOSNameServers []net.IP      `json:"netbiosNameServers,omitempty"`
+	// NetBIOSNodeType is 0 if it's not set
+	NetBIOSNodeType byte     `json:"netbiosNodeType,omitempty"`
+	TFTPServers     []net.IP `json:"tftpServers,omitempty"`
+	// TZPOSIX and TZDatabase are sent only to the clients which request them
+	TZPOSIX    string `json:"tzPOSIX,omitempty"`
+	TZDatabase string `json:"tzDatabase,omitempty"`
+	// NextBootfile is handed only to the iPXE clients
+	NextBootfile string `json:"nextBootfile,omitempty"`
+	// ForceClasslessRouteOption sends the classless routes to the clients
+	// which haven't requested them
+	ForceClasslessRouteOption bool `json:"forceClasslessRouteOption,omitempty"`
+	// OmitHostname leaves option 12 out of the replies, while the Hostname
+	// is still used to form the fqdn
+	OmitHostname bool `json:"omitHostname,omitempty"`
+}
+
+// MachineConfiguration resolves the configuration of the given machine the
+// same way it's done while replying its dhcp requests
+func (h *Handler) MachineConfiguration(machineInterface datasource.MachineInterface,
+	machine datasource.Machine) (*MachineConfiguration, error) {
+	netConfStr, own, err := machineInterface.OwnVariable(datasource.SpecialKeyNetworkConfiguration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network configuration: %s", err)
+	}
+	if !own {
+		netConfStr, err = machineInterface.GetVariable(datasource.SpecialKeyNetworkConfiguration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get network configuration: %s", err)
+		}
+		if netConfStr == "" {
+			return nil, fmt.Errorf("no network-configuration is set, neither for the machine nor for the cluster")
+		}
+		h.logClusterNetworkConfiguration(machineInterface)
+	}
+
+	netConf, err := datasource.UnmarshalNetworkConfiguration(netConfStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal network-configuration=%q: %s", netConfStr, err)
+	}
+
+	dns, err := h.nameservers(machineInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	ntp, err := h.ntpServers(machineInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	domain, err := machineInterface.GetVariable(datasource.SpecialKeyDomainName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain name: %s", err)
+	}
+	if domain == "" {
+		domain = h.datasource.ClusterName()
+	}
+
+	wpadURL, err := machineInterface.GetVariable(datasource.SpecialKeyWPADURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get wpad url: %s", err)
+	}
+
+	searchDomains, err := searchDomains(machineInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseDurationStr, err := machineInterface.GetVariable(datasource.SpecialKeyLeaseDuration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lease duration: %s", err)
+	}
+	leaseDuration, err := datasource.ParseLeaseDuration(leaseDurationStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse lease-duration=%q: %s", leaseDurationStr, err)
+	}
+
+	netBIOSNameServersStr, err := machineInterface.GetVariable(datasource.SpecialKeyNetBIOSNameServers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get netbios name servers: %s", err)
+	}
+	netBIOSNameServers, err := datasource.ParseIPList(netBIOSNameServersStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse netbios-name-servers=%q: %s", netBIOSNameServersStr, err)
+	}
+
+	netBIOSNodeTypeStr, err := machineInterface.GetVariable(datasource.SpecialKeyNetBIOSNodeType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get netbios node type: %s", err)
+	}
+	netBIOSNodeType, err := datasource.ParseNetBIOSNodeType(netBIOSNodeTypeStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse netbios-node-type=%q: %s", netBIOSNodeTypeStr, err)
+	}
+
+	tftpServersStr, err := machineInterface.GetVariable(datasource.SpecialKeyTFTPServers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tftp servers: %s", err)
+	}
+	tftpServers, err := datasource.ParseIPList(tftpServersStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tftp-servers=%q: %s", tftpServersStr, err)
+	}
+
+	nextBootfile, err := machineInterface.GetVariable(datasource.SpecialKeyNextBootfile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get next bootfile: %s", err)
+	}
+
+	tzPOSIX, err := machineInterface.GetVariable(datasource.SpecialKeyTZPOSIX)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get posix timezone: %s", err)
+	}
+	tzDatabase, err := machineInterface.GetVariable(datasource.SpecialKeyTZDatabase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tz database timezone: %s", err)
+	}
+
+	omitHostnameStr, err := machineInterface.GetVariable(datasource.SpecialKeyOmitHostname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get omit hostname: %s", err)
+	}
+	omitHostname := false
+	if omitHostnameStr != "" {
+		omitHostname, err = strconv.ParseBool(omitHostnameStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse omit-hostname=%q: %s", omitHostnameStr, err)
+		}
+	}
+
+	hostname, truncated := sanitizeHostname(machineInterface.Hostname())
+	if truncated {
+		key := limiterKey{mac: machineInterface.Mac().String(), msg: "hostname truncated"}
+		if allowed, _ := h.logThrottle.allow(key, time.Now()); allowed {
+			log.WithFields(log.Fields{
+				"where":  "dhcp.MachineConfiguration",
+				"object": machineInterface.Mac().String(),
+			}).Warnf("hostname %q is truncated to %q", machineInterface.Hostname(), hostname)
+		}
+	}
+
+	conf := &MachineConfiguration{
+		IP:                   machine.IP,
+		Hostname:             hostname,
+		Domain:               domain,
+		Netmask:              netConf.Netmask.To4(),
+		ClasslessRouteOption: netConf.ClasslessRouteOption,
+		DNS:                  dns,
+		NTP:                  ntp,
+		WPADURL:              wpadURL,
+		SearchDomains:        withDomain(domain, searchDomains),
+		LeaseDuration:        leaseDuration,
+		NetBIOSNameServers:   netBIOSNameServers,
+		NetBIOSNodeType:      netBIOSNodeType,
+		TFTPServers:          tftpServers,
+		NextBootfile:         nextBootfile,
+		TZPOSIX:              tzPOSIX,
+		TZDatabase:           tzDatabase,
+		OmitHostname:         omitHostname,
+	}
+	if netConf.Router != nil {
+		conf.Router = netConf.Router.To4()
+	}
+	conf.ForceClasslessRouteOption = netConf.ForceClasslessRouteOption
+
+	subnets, err := h.datasource.Subnets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the subnets: %s", err)
+	}
+	if subnet := datasource.SubnetOf(machine.IP, subnets); subnet != nil {
+		conf.applySubnet(subnet)
+	}
+	return conf, nil
+}
+
+// applySubnet overrides the configuration by the fields of the definition
+// of the subnet of the machine, which are set
+func (c *MachineConfiguration) applySubnet(subnet *datasource.SubnetDefinition) {
+	if subnet.Netmask != nil {
+		c.Netmask = subnet.Netmask.To4()
+	}
+	if subnet.Router != nil {
+		c.Router = subnet.Router.To4()
+	}
+	if len(subnet.DNS) != 0 {
+		c.DNS = nil
+		for _, server := range subnet.DNS {
+			c.DNS = append(c.DNS, server.To4())
+		}
+	}
+	if len(subnet.ClasslessRouteOption) != 0 {
+		c.ClasslessRouteOption = subnet.ClasslessRouteOption
+	}
+}
+
+// maxNameservers is the number of ipv4 addresses which fit in option 6
+const maxNameservers = 255 / net.IPv4len
+
+// Nameservers returns the dns servers which the machine is told to use in
+// the dhcp replies
+func (h *Handler) Nameservers(machineInterface datasource.MachineInterface) ([]net.IP, error) {
+	return h.nameservers(machineInterface)
+}
+
+// nameservers returns the nameservers of the machine, according to its
+// dns source. The duplicates are dropped and the list is capped to the
+// length of option 6.
+func (h *Handler) nameservers(machineInterface datasource.MachineInterface) ([]net.IP, error) {
+	dnsSourceStr, err := machineInterface.GetVariable(datasource.SpecialKeyDNSSource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dns source: %s", err)
+	}
+
+	dnsSource, err := datasource.UnmarshalDNSSource(dnsSourceStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dns-source=%q: %s", dnsSourceStr, err)
+	}
+
+	res := []net.IP{}
+	switch dnsSource.Mode {
+	case datasource.DNSSourceSelf:
+		res = append(res, h.serverIP.To4())
+	case datasource.DNSSourceStatic:
+		for _, server := range dnsSource.Servers {
+			res = append(res, server.To4())
+		}
+	default:
+		instanceInfos, err := h.instanceInfos()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get instances: %s", err)
+		}
+		for _, instanceInfo := range freshInstances(instanceInfos, h.options.InstanceFreshness, time.Now()) {
+			res = append(res, instanceInfo.IP.To4())
+		}
+	}
+	return uniqueIPs(res, maxNameservers), nil
+}
+
+// uniqueIPs returns the first limit distinct ips of the list, in order
+func uniqueIPs(ips []net.IP, limit int) []net.IP {
+	res := []net.IP{}
+	for _, ip := range ips {
+		if len(res) == limit {
+			break
+		}
+		duplicate := false
+		for _, seen := range res {
+			if seen.Equal(ip) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			res = append(res, ip)
+		}
+	}
+	return res
+}
+
+// ntpServers returns the instances which have the ntp role, or the
+// configured ntp servers if there's none
+func (h *Handler) ntpServers(machineInterface datasource.MachineInterface) ([]net.IP, error) {
+	instanceInfos, err := h.instanceInfos()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instances: %s", err)
+	}
+	res := ntpAddresses(freshInstances(instanceInfos, h.options.InstanceFreshness, time.Now()))
+	if len(res) != 0 {
+		return res, nil
+	}
+
+	ntpServersStr, err := machineInterface.GetVariable(datasource.SpecialKeyNTPServers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ntp servers: %s", err)
+	}
+	res, err = datasource.ParseIPList(ntpServersStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ntp-servers=%q: %s", ntpServersStr, err)
+	}
+	return res, nil
+}
+
+// ntpAddresses returns the ips of the instances which have the ntp role
+func ntpAddresses(instances []datasource.InstanceInfo) []net.IP {
+	var res []net.IP
+	for _, instanceInfo := range instances {
+		if instanceInfo.HasRole(datasource.InstanceRoleNTP) {
+			res = append(res, instanceInfo.IP.To4())
+		}
+	}
+	return res
+}
+
+// searchDomains returns the search domains of the machine, which are the
+// extra search domains appended to the default ones, without duplicates
+func searchDomains(machineInterface datasource.MachineInterface) ([]string, error) {
+	var res []string
+	seen := make(map[string]bool)
+	for _, key := range []string{datasource.SpecialKeySearchDomains, datasource.SpecialKeyExtraSearchDomains} {
+		value, err := machineInterface.GetVariable(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s: %s", key, err)
+		}
+		for _, domain := range datasource.SplitSearchDomains(value) {
+			normalized := strings.ToLower(strings.TrimSuffix(domain, "."))
+			if seen[normalized] {
+				continue
+			}
+			seen[normalized] = true
+			res = append(res, domain)
+		}
+	}
+	return res, nil
+}
+
+// withDomain returns the search domains with the domain (option 15) in front
+// of them, unless it's already among them. The clients which use option 119
+// ignore option 15, so it has to be in the search list for them to resolve the
+// same short names as the others. Nothing is added if there is no search
+// domain.
+func withDomain(domain string, domains []string) []string {
+	if len(domains) == 0 || domain == "" {
+		return domains
+	}
+	normalizedDomain := strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, d := range domains {
+		if strings.ToLower(strings.TrimSuffix(d, ".")) == normalizedDomain {
+			return domains
+		}
+	}
+	return append([]string{domain}, domains...)
+}
+
+// encodeSearchDomains formats the domains as specified in rfc3397, without
+// using the compression. The domains which don't fit in a single option are
+// left out.
+func encodeSearchDomains(domains []string) []byte {
+	var res []byte
+	for _, domain := range domains {
+		var encoded []byte
+		for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+			encoded = append(encoded, byte(len(label)))
+			encoded = append(encoded, label...)
+		}
+		encoded = append(encoded, 0)
+
+		if len(res)+len(encoded) > 255 {
+			log.WithField("where", "dhcp.encodeSearchDomains").Warnf(
+				"option 119 is full, leaving out %q", domain)
+			continue
+		}
+		res = append(res, encoded...)
+	}
+	return res
+}
+
+// maxLabelLength is the maximum length of a dns label
+const maxLabelLength = 63
+
+// sanitizeHostname returns the hostname as a valid dns label: the characters
+// other than letters, digits and hyphens are dropped, along with the leading
+// and trailing hyphens, and it's truncated to maxLabelLength. It also reports
+// whether it's truncated.
+func sanitizeHostname(hostname string) (string, bool) {
+	var b []byte
+	for i := 0; i < len(hostname); i++ {
+		c := hostname[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' {
+			b = append(b, c)
+		}
+	}
+	sanitized := strings.Trim(string(b), "-")
+	truncated := len(sanitized) > maxLabelLength
+	if truncated {
+		sanitized = strings.TrimRight(sanitized[:maxLabelLength], "-")
+	}
+	return sanitized, truncated
+}
+
+// FQDN returns the fully qualified domain name which the clients form from
+// options 12 and 15
+func (c *MachineConfiguration) FQDN() string {
+	return c.Hostname + "." + c.Domain
+}
+
+// dhcpOptions returns the configuration as dhcp options
+func (c *MachineConfiguration) dhcpOptions() dhcp4.Options {
+	var dns []byte
+	for _, ip := range c.DNS {
+		dns = append(dns, ip.To4()...)
+	}
+
+	dhcpOptions := dhcp4.Options{
+		dhcp4.OptionSubnetMask:       c.Netmask.To4(),
+		dhcp4.OptionDomainNameServer: dns,
+		dhcp4.OptionDomainName:       []byte(c.Domain),
+	}
+	if !c.OmitHostname {
+		dhcpOptions[dhcp4.OptionHostName] = []byte(c.Hostname)
+	}
+
+	if c.Router != nil {
+		dhcpOptions[dhcp4.OptionRouter] = c.Router.To4()
+	}
+	if len(c.ClasslessRouteOption) != 0 {
+		var res []byte
+		for _, part := range c.ClasslessRouteOption {
+			res = append(res, part.ToBytes()...)
+		}
+		dhcpOptions[dhcp4.OptionClasslessRouteFormat] = res
+	}
+	if len(c.NTP) != 0 {
+		var ntp []byte
+		for _, ip := range c.NTP {
+			ntp = append(ntp, ip.To4()...)
+		}
+		dhcpOptions[dhcp4.OptionNetworkTimeProtocolServers] = ntp
+	}
+	if c.WPADURL != "" {
+		dhcpOptions[optionWPAD] = []byte(c.WPADURL)
+	}
+	if c.TZPOSIX != "" {
+		dhcpOptions[optionTZPOSIX] = []byte(c.TZPOSIX)
+	}
+	if c.TZDatabase != "" {
+		dhcpOptions[optionTZDatabase] = []byte(c.TZDatabase)
+	}
+	if len(c.NetBIOSNameServers) != 0 {
+		var wins []byte
+		for _, ip := range c.NetBIOSNameServers {
+			wins = append(wins, ip.To4()...)
+		}
+		dhcpOptions[dhcp4.OptionNetBIOSOverTCPIPNameServer] = wins
+	}
+	if c.NetBIOSNodeType != 0 {
+		dhcpOptions[dhcp4.OptionNetBIOSOverTCPIPNodeType] = []byte{c.NetBIOSNodeType}
+	}
+	if len(c.TFTPServers) != 0 {
+		var tftp []byte
+		for _, ip := range c.TFTPServers {
+			tftp = append(tftp, ip.To4()...)
+		}
+		dhcpOptions[optionTFTPServers] = tftp
+	}
+	if len(c.SearchDomains) != 0 {
+		dhcpOptions[optionDomainSearch] = encodeSearchDomains(c.SearchDomains)
+	}
+	return dhcpOptions
+}
+
+// selectReplyOptions returns the options which are requested in the
+// parameter request list, in its order, or all of them if there's no list.
+// The timezones are left out if they're not requested, as rfc4833 asks, and
+// so is the wpad url, which makes the clients use the proxy. So are the
+// classless routes, as some clients reject them, unless
+// ForceClasslessRouteOption is set.
+func (c *MachineConfiguration) selectReplyOptions(dhcpOptions dhcp4.Options,
+	requestList []byte) []dhcp4.Option {
+	requested := func(code dhcp4.OptionCode) bool {
+		return bytes.IndexByte(requestList, byte(code)) >= 0
+	}
+
+	replyOptions := dhcpOptions.SelectOrderOrAll(requestList)
+	selected := replyOptions[:0]
+	for _, option := range replyOptions {
+		switch option.Code {
+		case dhcp4.OptionClasslessRouteFormat, optionTZPOSIX, optionTZDatabase, optionWPAD:
+			if !requested(option.Code) {
+				continue
+			}
+		}
+		selected = append(selected, option)
+	}
+
+	routes, hasRoutes := dhcpOptions[dhcp4.OptionClasslessRouteFormat]
+	if hasRoutes && !requested(dhcp4.OptionClasslessRouteFormat) && c.ForceClasslessRouteOption {
+		selected = append(selected, dhcp4.Option{Code: dhcp4.OptionClasslessRouteFormat, Value: routes})
+	}
+	return selected
+}
+
+// logClusterNetworkConfiguration logs that the machine has no network
+// configuration of its own and gets the one of the cluster, which is the
+// default of the new machines. Like the warnings, it's logged at most
+// logThrottleBurst times in each log throttle window, or each time if the
+// throttle is disabled.
+func (h *Handler) logClusterNetworkConfiguration(machineInterface datasource.MachineInterface) {
+	key := limiterKey{mac: machineInterface.Mac().String(), msg: "cluster network configuration"}
+	if allowed, _ := h.logThrottle.allow(key, time.Now()); !allowed {
+		return
+	}
+	log.WithFields(log.Fields{
+		"where":  "dhcp.MachineConfiguration",
+		"object": machineInterface.Mac().String(),
+	}).Info("no network configuration is set for the machine, using the one of the cluster")
+}
@@ -2,33 +2,2856 @@ package dhcp
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/metrics"
+	"github.com/krolaw/dhcp4"
 )
 
-func TestDnsAddressesForDHCP(t *testing.T) {
+func TestFreshInstances(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	fresh := datasource.InstanceInfo{IP: net.IPv4(1, 2, 3, 4), LastHeartbeat: now.Unix() - 10}
+	stale := datasource.InstanceInfo{IP: net.IPv4(1, 2, 3, 5), LastHeartbeat: now.Unix() - 600}
+	unknown := datasource.InstanceInfo{IP: net.IPv4(1, 2, 3, 6)}
+
+	tests := []struct {
+		input    []datasource.InstanceInfo
+		window   time.Duration
+		expected []datasource.InstanceInfo
+	}{
+		{[]datasource.InstanceInfo{fresh, stale, unknown}, time.Minute, []datasource.InstanceInfo{fresh, unknown}},
+		{[]datasource.InstanceInfo{stale}, time.Minute, nil},
+		{[]datasource.InstanceInfo{fresh, stale}, time.Hour, []datasource.InstanceInfo{fresh, stale}},
+		{[]datasource.InstanceInfo{fresh, stale}, 0, []datasource.InstanceInfo{fresh, stale}},
+	}
+
+	for i, tt := range tests {
+		got := freshInstances(tt.input, tt.window, now)
+		if len(got) != len(tt.expected) {
+			t.Errorf("#%d: expected %v, got %v", i, tt.expected, got)
+			continue
+		}
+		for j := range got {
+			if !got[j].IP.Equal(tt.expected[j].IP) {
+				t.Errorf("#%d: expected %v, got %v", i, tt.expected, got)
+				break
+			}
+		}
+	}
+}
+
+func handlerForTest() (*Handler, datasource.DataSource, error) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		return nil, nil, err
+	}
+
+	h := &Handler{
+		serverIP:    net.IPv4(127, 0, 0, 1),
+		datasource:  ds,
+		bootMessage: "Blacksmith (test)",
+	}
+	return h, ds, nil
+}
+
+func discoverForTest(mac net.HardwareAddr, options []dhcp4.Option) (dhcp4.Packet, dhcp4.Options) {
+	p := dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{1, 2, 3, 4}, false, options)
+	return p, p.ParseOptions()
+}
+
+func TestWPADOption(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:01")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	wpadURL := "http://proxy.example.com/wpad.dat"
+	if err := ds.SetClusterVariable(datasource.SpecialKeyWPADURL, wpadURL); err != nil {
+		t.Error("error while setting wpad url:", err)
+		return
+	}
+
+	// it's only sent to the clients which request it
+	tests := []struct {
+		options  []dhcp4.Option
+		expected string
+	}{
+		{[]dhcp4.Option{{Code: dhcp4.OptionParameterRequestList, Value: []byte{1, 3, 6, 252}}}, wpadURL},
+		{[]dhcp4.Option{{Code: dhcp4.OptionParameterRequestList, Value: []byte{1, 3, 6}}}, ""},
+		{nil, ""},
+	}
+
+	for i, tt := range tests {
+		p, options := discoverForTest(mac, tt.options)
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+
+		got := string(reply.ParseOptions()[optionWPAD])
+		if got != tt.expected {
+			t.Errorf("#%d: expected option 252 to be %q, got %q", i, tt.expected, got)
+		}
+	}
+}
+
+func TestTimezoneOptions(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:0e")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	tzPOSIX, tzDatabase := "CET-1CEST,M3.5.0,M10.5.0/3", "Europe/Amsterdam"
+	if err := ds.SetClusterVariable(datasource.SpecialKeyTZPOSIX, tzPOSIX); err != nil {
+		t.Error("error while setting tz-posix:", err)
+		return
+	}
+	if err := ds.SetClusterVariable(datasource.SpecialKeyTZDatabase, tzDatabase); err != nil {
+		t.Error("error while setting tz-database:", err)
+		return
+	}
+
+	tests := []struct {
+		requestList []byte
+		posix       string
+		database    string
+	}{
+		{[]byte{1, 3, 6, 100, 101}, tzPOSIX, tzDatabase},
+		{[]byte{1, 3, 6, 101}, "", tzDatabase},
+		{[]byte{1, 3, 6, 100}, tzPOSIX, ""},
+		{[]byte{1, 3, 6}, "", ""},
+		{nil, "", ""},
+	}
+
+	for i, tt := range tests {
+		var options []dhcp4.Option
+		if tt.requestList != nil {
+			options = []dhcp4.Option{{Code: dhcp4.OptionParameterRequestList, Value: tt.requestList}}
+		}
+		p, parsed := discoverForTest(mac, options)
+		reply := h.ServeDHCP(p, dhcp4.Discover, parsed)
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+
+		replyOptions := reply.ParseOptions()
+		if got := string(replyOptions[optionTZPOSIX]); got != tt.posix {
+			t.Errorf("#%d: expected option 100 to be %q, got %q", i, tt.posix, got)
+		}
+		if got := string(replyOptions[optionTZDatabase]); got != tt.database {
+			t.Errorf("#%d: expected option 101 to be %q, got %q", i, tt.database, got)
+		}
+	}
+}
+
+func TestMalformedGUIDOption(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:02")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	tests := [][]byte{
+		{},
+		{0},
+	}
+
+	for i, guid := range tests {
+		p, options := discoverForTest(mac, []dhcp4.Option{
+			{Code: 97, Value: guid},
+		})
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+
+		replyOptions := reply.ParseOptions()
+		if _, isIn := replyOptions[97]; isIn {
+			t.Errorf("#%d: expected no option 97 in the reply, got %q", i, replyOptions[97])
+		}
+		if _, isIn := replyOptions[dhcp4.OptionVendorSpecificInformation]; !isIn {
+			t.Errorf("#%d: expected the pxe vendor options in the reply", i)
+		}
+	}
+}
+
+func TestTracePackets(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:03")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	defer log.SetOutput(os.Stderr)
+	defer log.SetLevel(log.GetLevel())
+
+	tests := []struct {
+		level    log.Level
+		trace    bool
+		expected bool
+	}{
+		{log.InfoLevel, false, false},
+		{log.DebugLevel, false, false},
+		{log.InfoLevel, true, false},
+		{log.DebugLevel, true, true},
+	}
+
+	for i, tt := range tests {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		log.SetLevel(tt.level)
+		h.options.TracePackets = tt.trace
+
+		p, options := discoverForTest(mac, nil)
+		if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+
+		out := buf.String()
+		got := strings.Contains(out, "received packet") && strings.Contains(out, "reply packet")
+		if got != tt.expected {
+			t.Errorf("#%d: expected the dumps to be logged=%v, got:\n%s", i, tt.expected, out)
+		}
+	}
+}
+
+func TestIgnoredVendorClasses(t *testing.T) {
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyIgnoredVendorClasses, "ArubaAP, cisco"); err != nil {
+		t.Error("error while setting the ignored vendor classes:", err)
+		return
+	}
+
+	tests := []struct {
+		vendorClass string
+		expected    bool
+	}{
+		{"ArubaAP", false},
+		{"Cisco AP c3600", false},
+		{"PXEClient:Arch:00000:UNDI:002001", true},
+		{"", true},
+	}
+
+	for i, tt := range tests {
+		mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x45, byte(i)}
+		var options []dhcp4.Option
+		if tt.vendorClass != "" {
+			options = append(options, dhcp4.Option{
+				Code:  dhcp4.OptionVendorClassIdentifier,
+				Value: []byte(tt.vendorClass),
+			})
+		}
+
+		p, parsedOptions := discoverForTest(mac, options)
+		reply := h.ServeDHCP(p, dhcp4.Discover, parsedOptions)
+		if (reply != nil) != tt.expected {
+			t.Errorf("#%d: expected a reply=%v for vendor class %q", i, tt.expected, tt.vendorClass)
+		}
+	}
+}
+
+func TestEchoedVendorClasses(t *testing.T) {
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyEchoedVendorClasses, "MSFT, udhcp"); err != nil {
+		t.Error("error while setting the echoed vendor classes:", err)
+		return
+	}
+
+	tests := []struct {
+		vendorClass string
+		expected    string
+	}{
+		{"MSFT 5.0", "MSFT 5.0"},
+		{"udhcp 1.23.1", "udhcp 1.23.1"},
+		{"dhcpcd-6.8.2", ""},
+		{"PXEClient:Arch:00000:UNDI:002001", "PXEClient"},
+		{"", ""},
+	}
+
+	for i, tt := range tests {
+		mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x46, byte(i)}
+		var options []dhcp4.Option
+		if tt.vendorClass != "" {
+			options = append(options, dhcp4.Option{
+				Code:  dhcp4.OptionVendorClassIdentifier,
+				Value: []byte(tt.vendorClass),
+			})
+		}
+
+		p, parsedOptions := discoverForTest(mac, options)
+		reply := h.ServeDHCP(p, dhcp4.Discover, parsedOptions)
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for vendor class %q", i, tt.vendorClass)
+			continue
+		}
+		if vendorClass := string(reply.ParseOptions()[dhcp4.OptionVendorClassIdentifier]); vendorClass != tt.expected {
+			t.Errorf("#%d: expected vendor class %q in the reply, got %q", i, tt.expected, vendorClass)
+		}
+	}
+}
+
+func TestFirstBootOnACK(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:04")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	p, options := discoverForTest(mac, nil)
+	offer := h.ServeDHCP(p, dhcp4.Discover, options)
+	if offer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	machineInterface := ds.MachineInterface(mac)
+	if firstBoot, _ := machineInterface.FirstBoot(); firstBoot != 0 {
+		t.Error("expected no first boot after an Offer, got", firstBoot)
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Request, mac, nil, []byte{1, 2, 3, 5}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionRequestedIPAddress, Value: offer.YIAddr().To4()},
+	})
+	if ack := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions()); ack == nil {
+		t.Error("expected a reply for the Request")
+		return
+	}
+
+	if firstBoot, _ := machineInterface.FirstBoot(); firstBoot == 0 {
+		t.Error("expected the first boot to be set after an ACK")
+	}
+}
+
+func TestDNSSource(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:05")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	instanceInfos, err := ds.Instances()
+	if err != nil {
+		t.Error("error while getting the instances:", err)
+		return
+	}
+	var instancesDNS []byte
+	for _, instanceInfo := range instanceInfos {
+		instancesDNS = append(instancesDNS, instanceInfo.IP.To4()...)
+	}
+
+	tests := []struct {
+		dnsSource string
+		expected  []byte
+	}{
+		{"", instancesDNS},
+		{`{"mode": "instances"}`, instancesDNS},
+		{`{"mode": "self"}`, []byte{127, 0, 0, 1}},
+		{`{"mode": "static", "servers": ["8.8.8.8", "8.8.4.4"]}`, []byte{8, 8, 8, 8, 8, 8, 4, 4}},
+	}
+
+	for i, tt := range tests {
+		if err := ds.SetClusterVariable(datasource.SpecialKeyDNSSource, tt.dnsSource); err != nil {
+			t.Errorf("#%d: error while setting the dns source: %s", i, err)
+			continue
+		}
+
+		p, options := discoverForTest(mac, nil)
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+
+		got := reply.ParseOptions()[dhcp4.OptionDomainNameServer]
+		if res := bytes.Compare(tt.expected, got); res != 0 {
+			t.Errorf("#%d: expected option 6 to be %v, got %v", i, tt.expected, got)
+		}
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:07")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	for _, maintenance := range []bool{true, false} {
+		if err := ds.SetMaintenance(maintenance); err != nil {
+			t.Error("error while setting the maintenance mode:", err)
+			return
+		}
+
+		p, options := discoverForTest(mac, []dhcp4.Option{
+			{Code: 97, Value: []byte{0, 1, 2, 3, 4}},
+		})
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Errorf("maintenance=%v: expected a reply for the Discover", maintenance)
+			continue
+		}
+
+		replyOptions := reply.ParseOptions()
+		if reply.YIAddr().Equal(net.IPv4zero) {
+			t.Errorf("maintenance=%v: expected an address in the reply", maintenance)
+		}
+		if _, isIn := replyOptions[dhcp4.OptionDomainNameServer]; !isIn {
+			t.Errorf("maintenance=%v: expected the nameservers in the reply", maintenance)
+		}
+		if _, isIn := replyOptions[dhcp4.OptionVendorSpecificInformation]; isIn == maintenance {
+			t.Errorf("maintenance=%v: unexpected presence of the pxe options: %v", maintenance, isIn)
+		}
+	}
+}
+
+func TestSearchDomains(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:08")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeySearchDomains, "example.com,corp.example.com"); err != nil {
+		t.Error("error while setting the search domains:", err)
+		return
+	}
+
+	machineInterface := ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+	if err := machineInterface.SetVariable(datasource.SpecialKeyExtraSearchDomains, "tenant.example.org, Example.com."); err != nil {
+		t.Error("error while setting the extra search domains:", err)
+		return
+	}
+
+	p, options := discoverForTest(mac, []dhcp4.Option{
+		{Code: dhcp4.OptionParameterRequestList, Value: []byte{1, 3, 6, 119}},
+	})
+	reply := h.ServeDHCP(p, dhcp4.Discover, options)
+	if reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	expected := encodeSearchDomains([]string{ds.ClusterName(), "example.com", "corp.example.com", "tenant.example.org"})
+	got := reply.ParseOptions()[optionDomainSearch]
+	if !bytes.Equal(expected, got) {
+		t.Errorf("expected option 119 to be %q, got %q", expected, got)
+	}
+}
+
+func TestEncodeSearchDomains(t *testing.T) {
+	got := encodeSearchDomains([]string{"example.com", "a.b."})
+	expected := []byte("\x07example\x03com\x00\x01a\x01b\x00")
+	if !bytes.Equal(expected, got) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	var long []string
+	for i := 0; i < 20; i++ {
+		long = append(long, fmt.Sprintf("subdomain-%02d.example.com", i))
+	}
+	if got := encodeSearchDomains(long); len(got) > 255 {
+		t.Errorf("expected option 119 to fit in 255 bytes, got %d", len(got))
+	}
+}
+
+func TestDomainInSearchList(t *testing.T) {
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeySearchDomains, "example.com"); err != nil {
+		t.Error("error while setting the search domains:", err)
+		return
+	}
+
+	tests := []struct {
+		requestList []byte
+		expected119 []byte
+	}{
+		{[]byte{15, 119}, encodeSearchDomains([]string{ds.ClusterName(), "example.com"})},
+		{[]byte{119, 15}, encodeSearchDomains([]string{ds.ClusterName(), "example.com"})},
+		{[]byte{15}, nil},
+	}
+
+	for i, test := range tests {
+		mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, byte(0x70 + i)}
+		p, options := discoverForTest(mac, []dhcp4.Option{
+			{Code: dhcp4.OptionParameterRequestList, Value: test.requestList},
+		})
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+
+		replyOptions := reply.ParseOptions()
+		if domain := string(replyOptions[dhcp4.OptionDomainName]); domain != ds.ClusterName() {
+			t.Errorf("#%d: expected option 15 to be %q, got %q", i, ds.ClusterName(), domain)
+		}
+		if got := replyOptions[optionDomainSearch]; !bytes.Equal(test.expected119, got) {
+			t.Errorf("#%d: expected option 119 to be %q, got %q", i, test.expected119, got)
+		}
+	}
+
+	// the domain isn't repeated if it's already in the search list
+	got := withDomain("Cluster", []string{"example.com", "cluster."})
+	if expected := []string{"example.com", "cluster."}; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if got := withDomain("cluster", nil); got != nil {
+		t.Errorf("expected no search domain, got %v", got)
+	}
+}
+
+func TestNTPAddresses(t *testing.T) {
 	tests := []struct {
 		input    []datasource.InstanceInfo
-		expected []byte
+		expected []net.IP
 	}{
-		{[]datasource.InstanceInfo{}, []byte{}},
+		{[]datasource.InstanceInfo{}, nil},
 		{
 			[]datasource.InstanceInfo{
-				{IP: net.IPv4(1, 2, 3, 4)},
+				{IP: net.IPv4(1, 2, 3, 4), Roles: []string{"ntp"}},
 				{IP: net.IPv4(1, 2, 3, 5)},
+				{IP: net.IPv4(1, 2, 3, 6), Roles: []string{"dns", "ntp"}},
+				{IP: net.IPv4(1, 2, 3, 7), Roles: []string{"dns"}},
 			},
-			[]byte{1, 2, 3, 4, 1, 2, 3, 5},
+			[]net.IP{net.IPv4(1, 2, 3, 4), net.IPv4(1, 2, 3, 6)},
 		},
 	}
 
 	for i, tt := range tests {
-		got := dnsAddressesForDHCP(&tt.input)
-		if res := bytes.Compare(tt.expected, got); res != 0 {
-			t.Errorf(
-				"#%d: expected same []byes, but Compare(%q, %q)=%d",
-				i, tt.expected, got, res)
+		got := ntpAddresses(tt.input)
+		if len(got) != len(tt.expected) {
+			t.Errorf("#%d: expected %v, got %v", i, tt.expected, got)
+			continue
+		}
+		for j := range got {
+			if !got[j].Equal(tt.expected[j]) {
+				t.Errorf("#%d: expected %v, got %v", i, tt.expected, got)
+				break
+			}
+		}
+	}
+}
+
+func TestNTPServersFallback(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:09")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	p, options := discoverForTest(mac, nil)
+	reply := h.ServeDHCP(p, dhcp4.Discover, options)
+	if reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	if _, isIn := reply.ParseOptions()[dhcp4.OptionNetworkTimeProtocolServers]; isIn {
+		t.Error("expected no option 42 without any ntp server")
+	}
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyNTPServers, "10.0.0.1,10.0.0.2"); err != nil {
+		t.Error("error while setting the ntp servers:", err)
+		return
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{1, 2, 3, 7}, false, nil)
+	reply = h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	expected := []byte{10, 0, 0, 1, 10, 0, 0, 2}
+	if got := reply.ParseOptions()[dhcp4.OptionNetworkTimeProtocolServers]; !bytes.Equal(expected, got) {
+		t.Errorf("expected option 42 to be %v, got %v", expected, got)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:0a")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	p, options := discoverForTest(mac, nil)
+	offer := h.ServeDHCP(p, dhcp4.Discover, options)
+	if offer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	ip := offer.YIAddr().To4()
+
+	h.SetDraining(true)
+	defer h.SetDraining(false)
+
+	if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply != nil {
+		t.Error("expected no reply for a Discover while draining")
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Request, mac, nil, []byte{1, 2, 3, 5}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionRequestedIPAddress, Value: ip},
+	})
+	if reply := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions()); reply != nil {
+		t.Error("expected no reply for a non-renewal Request while draining")
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Request, mac, ip, []byte{1, 2, 3, 6}, false, nil)
+	if reply := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions()); reply == nil {
+		t.Error("expected an ACK for a renewal while draining")
+	}
+}
+
+func TestLeaseDurationOverride(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:0b")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	leaseTime := func() time.Duration {
+		p, options := discoverForTest(mac, nil)
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			return 0
+		}
+		b := reply.ParseOptions()[dhcp4.OptionIPAddressLeaseTime]
+		if len(b) != 4 {
+			return 0
+		}
+		return time.Duration(binary.BigEndian.Uint32(b)) * time.Second
+	}
+
+	if d := leaseTime(); d < minLeaseHours*time.Hour || d > maxLeaseHours*time.Hour {
+		t.Error("expected the default lease duration, got", d)
+	}
+
+	if err := ds.MachineInterface(mac).SetVariable(datasource.SpecialKeyLeaseDuration, "720h"); err != nil {
+		t.Error("error while setting the lease duration:", err)
+		return
+	}
+	if d := leaseTime(); d != 720*time.Hour {
+		t.Error("expected the overridden lease duration, got", d)
+	}
+}
+
+func TestOptionsSent(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:0c")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	optionsSent := func(code dhcp4.OptionCode) uint64 {
+		return metrics.Default.Counter(metrics.WithLabel(metricOptionsSent, "code", strconv.Itoa(int(code))))
+	}
+	codes := []dhcp4.OptionCode{dhcp4.OptionDHCPMessageType, dhcp4.OptionSubnetMask, dhcp4.OptionDomainNameServer}
+	before := make(map[dhcp4.OptionCode]uint64)
+	for _, code := range codes {
+		before[code] = optionsSent(code)
+	}
+
+	for i := 0; i < 2; i++ {
+		p, options := discoverForTest(mac, []dhcp4.Option{
+			{Code: dhcp4.OptionParameterRequestList, Value: []byte{1, 3}},
+		})
+		if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply == nil {
+			t.Error("expected a reply for the Discover")
+			return
+		}
+	}
+
+	for _, code := range codes[:2] {
+		if delta := optionsSent(code) - before[code]; delta != 2 {
+			t.Errorf("expected option %d to be counted twice, got %d", code, delta)
+		}
+	}
+	if delta := optionsSent(dhcp4.OptionDomainNameServer) - before[dhcp4.OptionDomainNameServer]; delta != 0 {
+		t.Error("expected option 6 not to be counted, as it's not requested")
+	}
+}
+
+func TestNetBIOSOptions(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:0d")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	requested := []dhcp4.Option{{
+		Code: dhcp4.OptionParameterRequestList,
+		Value: []byte{
+			byte(dhcp4.OptionSubnetMask),
+			byte(dhcp4.OptionNetBIOSOverTCPIPNameServer),
+			byte(dhcp4.OptionNetBIOSOverTCPIPNodeType),
+		},
+	}}
+
+	p, options := discoverForTest(mac, requested)
+	reply := h.ServeDHCP(p, dhcp4.Discover, options)
+	if reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	replyOptions := reply.ParseOptions()
+	for _, code := range []dhcp4.OptionCode{dhcp4.OptionNetBIOSOverTCPIPNameServer, dhcp4.OptionNetBIOSOverTCPIPNodeType} {
+		if _, isIn := replyOptions[code]; isIn {
+			t.Errorf("expected no option %d when it's not configured", code)
+		}
+	}
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyNetBIOSNameServers, "10.0.0.3, 10.0.0.4"); err != nil {
+		t.Error("error while setting the netbios name servers:", err)
+		return
+	}
+	if err := ds.SetClusterVariable(datasource.SpecialKeyNetBIOSNodeType, "H"); err != nil {
+		t.Error("error while setting the netbios node type:", err)
+		return
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{1, 2, 3, 8}, false, requested)
+	reply = h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	replyOptions = reply.ParseOptions()
+	expected := []byte{10, 0, 0, 3, 10, 0, 0, 4}
+	if got := replyOptions[dhcp4.OptionNetBIOSOverTCPIPNameServer]; !bytes.Equal(expected, got) {
+		t.Errorf("expected option 44 to be %v, got %v", expected, got)
+	}
+	if got := replyOptions[dhcp4.OptionNetBIOSOverTCPIPNodeType]; !bytes.Equal([]byte{8}, got) {
+		t.Errorf("expected option 46 to be [8], got %v", got)
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{1, 2, 3, 9}, false, []dhcp4.Option{{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionSubnetMask)},
+	}})
+	reply = h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	if _, isIn := reply.ParseOptions()[dhcp4.OptionNetBIOSOverTCPIPNodeType]; isIn {
+		t.Error("expected no option 46 when it's not requested")
+	}
+}
+
+func TestTFTPServersOption(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:03")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	requested := []dhcp4.Option{{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionSubnetMask), byte(optionTFTPServers)},
+	}}
+
+	p, options := discoverForTest(mac, requested)
+	reply := h.ServeDHCP(p, dhcp4.Discover, options)
+	if reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	if _, isIn := reply.ParseOptions()[optionTFTPServers]; isIn {
+		t.Error("expected no option 150 when it's not configured")
+	}
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyTFTPServers, "10.0.0.5, 10.0.0.6"); err != nil {
+		t.Error("error while setting the tftp servers:", err)
+		return
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{1, 2, 3, 8}, false, requested)
+	reply = h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	expected := []byte{10, 0, 0, 5, 10, 0, 0, 6}
+	if got := reply.ParseOptions()[optionTFTPServers]; !bytes.Equal(expected, got) {
+		t.Errorf("expected option 150 to be %v, got %v", expected, got)
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{1, 2, 3, 9}, false, []dhcp4.Option{{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionSubnetMask)},
+	}})
+	reply = h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	if _, isIn := reply.ParseOptions()[optionTFTPServers]; isIn {
+		t.Error("expected no option 150 when it's not requested")
+	}
+}
+
+func TestIPv6ServerIP(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:0e")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	h.serverIP = net.ParseIP("fe80::1")
+
+	err = StartDHCP(h)
+	if err == nil || !strings.Contains(err.Error(), "ipv4") {
+		t.Error("expected a startup error for an ipv6 server ip, got", err)
+	}
+
+	p, options := discoverForTest(mac, []dhcp4.Option{
+		{Code: 97, Value: []byte{0, 1, 2, 3}},
+	})
+	if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply != nil {
+		t.Error("expected no reply with an ipv6 server ip")
+	}
+	if _, err := h.fillPXE(datasource.DefaultPXEMenuTimeout, "", nil, nil, 0); err == nil {
+		t.Error("expected an error while filling the pxe options with an ipv6 server ip")
+	}
+}
+
+func TestBootOptionsOnlyForBootClients(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:0f")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	p, options := discoverForTest(mac, nil)
+	offer := h.ServeDHCP(p, dhcp4.Discover, options)
+	if offer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	tests := []struct {
+		options     []dhcp4.Option
+		bootClient  bool
+		vendorClass string
+	}{
+		{nil, false, ""},
+		{[]dhcp4.Option{{Code: dhcp4.OptionVendorClassIdentifier, Value: []byte("MSFT 5.0")}}, false, ""},
+		{[]dhcp4.Option{{Code: 97, Value: []byte{0, 1, 2, 3}}}, true, "PXEClient"},
+		{[]dhcp4.Option{{Code: dhcp4.OptionVendorClassIdentifier, Value: []byte("PXEClient:Arch:00000")}}, true, "PXEClient"},
+		{[]dhcp4.Option{{Code: dhcp4.OptionVendorClassIdentifier, Value: []byte("HTTPClient:Arch:00016")}}, true, "HTTPClient"},
+		{[]dhcp4.Option{{Code: dhcp4.OptionUserClass, Value: []byte("iPXE")}}, true, "PXEClient"},
+	}
+
+	for i, tt := range tests {
+		requestOptions := append([]dhcp4.Option{
+			{Code: dhcp4.OptionRequestedIPAddress, Value: offer.YIAddr().To4()},
+		}, tt.options...)
+		p := dhcp4.RequestPacket(dhcp4.Request, mac, nil, []byte{2, 0, 0, byte(i)}, false, requestOptions)
+		ack := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+		if ack == nil {
+			t.Errorf("#%d: expected a reply for the Request", i)
+			continue
+		}
+
+		ackOptions := ack.ParseOptions()
+		if _, isIn := ackOptions[dhcp4.OptionBootFileName]; isIn || len(ack.File()) != 0 {
+			t.Errorf("#%d: expected no bootfile", i)
+		}
+		if !ack.SIAddr().Equal(net.IPv4zero) {
+			t.Errorf("#%d: expected no siaddr, got %s", i, ack.SIAddr())
+		}
+		if _, isIn := ackOptions[dhcp4.OptionVendorSpecificInformation]; isIn != tt.bootClient {
+			t.Errorf("#%d: expected the pxe options to be sent=%v", i, tt.bootClient)
+		}
+		if vendorClass := string(ackOptions[dhcp4.OptionVendorClassIdentifier]); vendorClass != tt.vendorClass {
+			t.Errorf("#%d: expected the vendor class %q, got %q", i, tt.vendorClass, vendorClass)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	known, _ := net.ParseMAC("00:11:22:33:44:10")
+	unknown, _ := net.ParseMAC("00:11:22:33:44:11")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	p, options := discoverForTest(known, nil)
+	knownOffer := h.ServeDHCP(p, dhcp4.Discover, options)
+	if knownOffer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	err = ds.SetClusterVariable(datasource.SpecialKeyQuarantineSubnet,
+		`{"start": "10.99.0.10", "range": 5, "netmask": "255.255.255.0", "dns": ["10.99.0.1"]}`)
+	if err != nil {
+		t.Error("error while setting the quarantine subnet:", err)
+		return
+	}
+
+	p, options = discoverForTest(known, []dhcp4.Option{{Code: 97, Value: []byte{0, 1}}})
+	reply := h.ServeDHCP(p, dhcp4.Discover, options)
+	if reply == nil || !reply.YIAddr().Equal(knownOffer.YIAddr()) {
+		t.Error("expected the known machine to be served normally")
+		return
+	}
+
+	p, options = discoverForTest(unknown, []dhcp4.Option{{Code: 97, Value: []byte{0, 1}}})
+	offer := h.ServeDHCP(p, dhcp4.Discover, options)
+	if offer == nil {
+		t.Error("expected a reply for the unknown machine")
+		return
+	}
+	if !offer.YIAddr().Equal(net.IPv4(10, 99, 0, 10)) {
+		t.Error("expected a quarantine address, got", offer.YIAddr())
+	}
+	offerOptions := offer.ParseOptions()
+	if got := offerOptions[dhcp4.OptionDomainNameServer]; !bytes.Equal(got, []byte{10, 99, 0, 1}) {
+		t.Error("expected only the quarantine dns server, got", got)
+	}
+	for _, code := range []dhcp4.OptionCode{dhcp4.OptionVendorSpecificInformation, dhcp4.OptionRouter, dhcp4.OptionHostName} {
+		if _, isIn := offerOptions[code]; isIn {
+			t.Errorf("expected no option %d in the quarantine", code)
+		}
+	}
+	if isKnown, _ := ds.MachineInterface(unknown).Known(); isKnown {
+		t.Error("expected no record for the quarantined machine")
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Request, unknown, nil, []byte{3, 0, 0, 1}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionRequestedIPAddress, Value: offer.YIAddr().To4()},
+	})
+	if ack := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions()); ack == nil || !ack.YIAddr().Equal(offer.YIAddr()) {
+		t.Error("expected the quarantine address to be acknowledged")
+	}
+
+	machine, err := ds.ApproveMachine(unknown, "test")
+	if err != nil {
+		t.Error("error while approving the machine:", err)
+		return
+	}
+	if quarantined, _ := ds.QuarantinedMachines(); len(quarantined) != 0 {
+		t.Error("expected no quarantined machine after the approval, got", quarantined)
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Discover, unknown, nil, []byte{3, 0, 0, 2}, false, nil)
+	offer = h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if offer == nil || !offer.YIAddr().Equal(machine.IP) {
+		t.Error("expected the approved machine to be served normally")
+	}
+}
+
+func TestNextBootfile(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:12")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	p, options := discoverForTest(mac, nil)
+	if offer := h.ServeDHCP(p, dhcp4.Discover, options); offer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	nextBootfile := "http://127.0.0.1/stage2.ipxe"
+	if err := ds.MachineInterface(mac).SetVariable(datasource.SpecialKeyNextBootfile, nextBootfile); err != nil {
+		t.Error("error while setting the next bootfile:", err)
+		return
+	}
+
+	tests := []struct {
+		options  []dhcp4.Option
+		expected string
+	}{
+		{nil, ""},
+		{[]dhcp4.Option{{Code: 97, Value: []byte{0, 1}}}, ""},
+		{[]dhcp4.Option{{Code: 97, Value: []byte{0, 1}}, {Code: dhcp4.OptionUserClass, Value: []byte("iPXE")}}, nextBootfile},
+		{[]dhcp4.Option{{Code: optionIPXEEncapsulated, Value: []byte{19, 1, 1}}}, nextBootfile},
+	}
+
+	for i, tt := range tests {
+		p := dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{5, 0, 0, byte(i)}, false, tt.options)
+		reply := h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+
+		if got := string(reply.ParseOptions()[dhcp4.OptionBootFileName]); got != tt.expected {
+			t.Errorf("#%d: expected option 67 to be %q, got %q", i, tt.expected, got)
+		}
+		if got := string(reply.File()); got != tt.expected {
+			t.Errorf("#%d: expected the file field to be %q, got %q", i, tt.expected, got)
+		}
+		if hasSIAddr := !reply.SIAddr().Equal(net.IPv4zero); hasSIAddr != (tt.expected != "") {
+			t.Errorf("#%d: unexpected siaddr: %s", i, reply.SIAddr())
+		}
+	}
+}
+
+func TestFQDNOptions(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:13")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	p, options := discoverForTest(mac, []dhcp4.Option{{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionHostName), byte(dhcp4.OptionDomainName)},
+	}})
+	reply := h.ServeDHCP(p, dhcp4.Discover, options)
+	if reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	replyOptions := reply.ParseOptions()
+	hostname := string(replyOptions[dhcp4.OptionHostName])
+	domain := string(replyOptions[dhcp4.OptionDomainName])
+	if hostname != "001122334413" {
+		t.Error("expected the short name as option 12, got", hostname)
+	}
+	expected := "001122334413." + ds.ClusterName()
+	if fqdn := hostname + "." + domain; fqdn != expected {
+		t.Errorf("expected the fqdn to be %q, got %q", expected, fqdn)
+	}
+
+	machine, err := ds.MachineInterface(mac).Machine(false, nil)
+	if err != nil {
+		t.Error("error while getting the machine:", err)
+		return
+	}
+	conf, err := h.MachineConfiguration(ds.MachineInterface(mac), machine)
+	if err != nil {
+		t.Error("error while getting the machine configuration:", err)
+		return
+	}
+	if conf.FQDN() != expected {
+		t.Errorf("expected FQDN() to be %q, got %q", expected, conf.FQDN())
+	}
+}
+
+func TestSubnetDefinitionOptions(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:16")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	requested := []dhcp4.Option{{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionSubnetMask), byte(dhcp4.OptionRouter), byte(dhcp4.OptionDomainNameServer)},
+	}}
+	discover := func() dhcp4.Options {
+		p, options := discoverForTest(mac, requested)
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Error("expected a reply for the Discover")
+			return nil
+		}
+		return reply.ParseOptions()
+	}
+
+	replyOptions := discover()
+	if router := replyOptions[dhcp4.OptionRouter]; router != nil {
+		t.Errorf("expected no router without a subnet definition, got %v", net.IP(router))
+	}
+
+	if err := ds.SetSubnet(&datasource.SubnetDefinition{
+		CIDR:   "127.0.0.0/16",
+		Router: net.IPv4(127, 0, 0, 1),
+		DNS:    []net.IP{net.IPv4(127, 0, 0, 53)},
+	}); err != nil {
+		t.Error("error while setting the subnet:", err)
+		return
+	}
+	replyOptions = discover()
+	if router := net.IP(replyOptions[dhcp4.OptionRouter]); !router.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("expected the router of the subnet, got %v", router)
+	}
+	if dns := net.IP(replyOptions[dhcp4.OptionDomainNameServer]); !dns.Equal(net.IPv4(127, 0, 0, 53)) {
+		t.Errorf("expected the dns server of the subnet, got %v", dns)
+	}
+	if netmask := net.IP(replyOptions[dhcp4.OptionSubnetMask]); !netmask.Equal(net.IPv4(255, 255, 0, 0)) {
+		t.Errorf("expected the netmask of the subnet, got %v", netmask)
+	}
+}
+
+func TestOmitHostname(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:0d")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	hostnameRequested := []dhcp4.Option{{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionHostName), byte(dhcp4.OptionDomainName)},
+	}}
+	tests := []struct {
+		value    string
+		expected bool
+	}{
+		{"", true},
+		{"false", true},
+		{"true", false},
+	}
+
+	for i, tt := range tests {
+		if err := ds.MachineInterface(mac).SetVariable(datasource.SpecialKeyOmitHostname, tt.value); err != nil {
+			t.Errorf("#%d: error while setting omit-hostname: %s", i, err)
+			continue
+		}
+
+		p, options := discoverForTest(mac, hostnameRequested)
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+
+		replyOptions := reply.ParseOptions()
+		if _, isIn := replyOptions[dhcp4.OptionHostName]; isIn != tt.expected {
+			t.Errorf("#%d: expected option 12 to be sent: %v, got %q", i, tt.expected,
+				replyOptions[dhcp4.OptionHostName])
+		}
+		if _, isIn := replyOptions[dhcp4.OptionDomainName]; !isIn {
+			t.Errorf("#%d: expected option 15 to be sent", i)
+		}
+	}
+}
+
+func TestClientArch(t *testing.T) {
+	testCases := []struct {
+		value    []byte
+		arch     uint16
+		expected bool
+	}{
+		{nil, 0, false},
+		{[]byte{0x00}, 0, false},
+		{[]byte{0x00, 0x00}, 0, true},
+		{[]byte{0x00, 0x07}, 7, true},
+		{[]byte{0x00, 0x09, 0x00, 0x07}, 9, true},
+		{[]byte{0x01, 0x02}, 258, true},
+		{[]byte{0x00, 0x07, 0x00}, 0, false},
+	}
+
+	for i, tc := range testCases {
+		options := dhcp4.Options{}
+		if tc.value != nil {
+			options[optionClientArch] = tc.value
+		}
+		arch, isIn := clientArch(options)
+		if isIn != tc.expected || arch != tc.arch {
+			t.Errorf("#%d: expected (%d, %v), got (%d, %v)", i, tc.arch, tc.expected, arch, isIn)
+		}
+	}
+}
+
+func TestStoreClientArchOnACK(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:1c")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	// UEFI x64
+	archOption := dhcp4.Option{Code: optionClientArch, Value: []byte{0x00, 0x07}}
+	p, options := discoverForTest(mac, []dhcp4.Option{archOption})
+	offer := h.ServeDHCP(p, dhcp4.Discover, options)
+	if offer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Request, mac, nil, []byte{1, 2, 3, 5}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionRequestedIPAddress, Value: offer.YIAddr().To4()},
+		archOption,
+	})
+	if ack := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions()); ack == nil {
+		t.Error("expected a reply for the Request")
+		return
+	}
+
+	arch, hasArch, err := ds.MachineInterface(mac).ClientArch()
+	if err != nil {
+		t.Error("error while getting the client arch:", err)
+		return
+	}
+	if !hasArch || arch != 7 {
+		t.Errorf("expected the client arch 7 to be stored, got (%d, %v)", arch, hasArch)
+	}
+	if name := ClientArchName(arch); name != "x64 UEFI" {
+		t.Error("unexpected name for the client arch:", name)
+	}
+}
+
+func TestMessageMetrics(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:1d")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	h.replies = newReplyCache(replyCacheSize, time.Minute)
+
+	before := metrics.Default.Snapshot()
+	p, options := discoverForTest(mac, nil)
+	for i := 0; i < 2; i++ {
+		if offer := h.ServeDHCP(p, dhcp4.Discover, options); offer == nil {
+			t.Error("expected a reply for the Discover")
+			return
+		}
+	}
+	after := metrics.Default.Snapshot()
+
+	for name, expected := range map[string]uint64{
+		metricReceivedPrefix + "discover": 2,
+		metricRepliedPrefix + "offer":     2,
+		metricReplayed:                    1,
+	} {
+		if delta := after.Counters[name] - before.Counters[name]; delta != expected {
+			t.Errorf("%s: expected %d, got %d", name, expected, delta)
+		}
+	}
+}
+
+func TestClientIDLookup(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:1e")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:1f")
+	mac3, _ := net.ParseMAC("00:11:22:33:44:20")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	vmID := dhcp4.Option{Code: dhcp4.OptionClientIdentifier, Value: []byte("\x00vm-1")}
+	p, options := discoverForTest(mac1, []dhcp4.Option{vmID})
+
+	// the identifier is ignored until the lookup is enabled
+	if offer := h.ServeDHCP(p, dhcp4.Discover, options); offer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	if bound, _ := ds.ClientIDMachine(vmID.Value); bound != nil {
+		t.Error("expected no binding while the lookup is disabled, got", bound)
+	}
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyClientIDLookup, "true"); err != nil {
+		t.Error("error while enabling the client identifier lookup:", err)
+		return
+	}
+
+	offer1 := h.ServeDHCP(p, dhcp4.Discover, options)
+	if offer1 == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	// the mac has changed, but the identifier is the same
+	p, options = discoverForTest(mac2, []dhcp4.Option{vmID})
+	offer2 := h.ServeDHCP(p, dhcp4.Discover, options)
+	if offer2 == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	if !net.IP(offer2.YIAddr()).Equal(offer1.YIAddr()) {
+		t.Errorf("expected the ip of the bound machine %s, got %s", offer1.YIAddr(), offer2.YIAddr())
+	}
+	if !bytes.Equal(offer2.CHAddr(), mac2) {
+		t.Error("expected the reply to be sent to chaddr, got", offer2.CHAddr())
+	}
+	if known, _ := ds.MachineInterface(mac2).Known(); known {
+		t.Error("expected no record for the new mac")
+	}
+
+	// an ethernet identifier carries the mac itself
+	p, options = discoverForTest(mac3, []dhcp4.Option{
+		{Code: dhcp4.OptionClientIdentifier, Value: append([]byte{clientIDTypeEthernet}, mac1...)},
+	})
+	offer3 := h.ServeDHCP(p, dhcp4.Discover, options)
+	if offer3 == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	if !net.IP(offer3.YIAddr()).Equal(offer1.YIAddr()) {
+		t.Errorf("expected the ip of the machine of the identifier %s, got %s", offer1.YIAddr(), offer3.YIAddr())
+	}
+}
+
+func TestClientIDBinding(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:47:17")
+	mac2, _ := net.ParseMAC("00:11:22:33:47:18")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	h.transactions = newTransactionLog(transactionsPerMachine, transactionsMachines)
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyClientIDLookup, "true"); err != nil {
+		t.Error("error while enabling the client identifier lookup:", err)
+		return
+	}
+
+	// an ignored machine doesn't bind its identifier
+	ignoredID := dhcp4.Option{Code: dhcp4.OptionClientIdentifier, Value: []byte("\x00vm-ignored")}
+	if err := ds.MachineInterface(mac1).SetVariable(datasource.SpecialKeyIgnore, "true"); err != nil {
+		t.Error("error while ignoring the machine:", err)
+		return
+	}
+	p, options := discoverForTest(mac1, []dhcp4.Option{ignoredID})
+	if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply != nil {
+		t.Error("expected no reply to the ignored machine")
+	}
+	if bound, _ := ds.ClientIDMachine(ignoredID.Value); bound != nil {
+		t.Error("expected no binding for the ignored machine, got", bound)
+	}
+
+	// the machine, its reply cache and its transactions are keyed by the
+	// bound mac, not by chaddr
+	vmID := dhcp4.Option{Code: dhcp4.OptionClientIdentifier, Value: []byte("\x00vm-bound")}
+	if err := ds.BindClientID(vmID.Value, mac1); err != nil {
+		t.Error("error while binding the client identifier:", err)
+		return
+	}
+	if err := ds.MachineInterface(mac1).SetVariable(datasource.SpecialKeyIgnore, ""); err != nil {
+		t.Error("error while unignoring the machine:", err)
+		return
+	}
+	p, options = discoverForTest(mac2, []dhcp4.Option{vmID})
+	if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	if transactions := h.Transactions(mac1); len(transactions) != 2 || transactions[1].Reply != "offer" {
+		t.Errorf("expected the transactions of the bound mac, got %+v", transactions)
+	}
+	if transactions := h.Transactions(mac2); len(transactions) != 0 {
+		t.Errorf("expected no transactions for chaddr, got %+v", transactions)
+	}
+}
+
+func TestClientIDBindingOnlyMaster(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:19")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+	// not registered, so it's not the master
+	h := &Handler{serverIP: net.IPv4(127, 0, 0, 1), datasource: ds}
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyClientIDLookup, "true"); err != nil {
+		t.Error("error while enabling the client identifier lookup:", err)
+		return
+	}
+	clientID := []byte("\x00vm-standby")
+	p, options := discoverForTest(mac, []dhcp4.Option{{Code: dhcp4.OptionClientIdentifier, Value: clientID}})
+	h.ServeDHCP(p, dhcp4.Discover, options)
+	if bound, _ := ds.ClientIDMachine(clientID); bound != nil {
+		t.Error("expected no binding by a non-master instance, got", bound)
+	}
+}
+
+func TestLogThrottle(t *testing.T) {
+	throttle := newLogThrottle(time.Minute)
+	key := limiterKey{mac: "00:11:22:33:44:21", msg: "failed to get machine"}
+	otherKey := limiterKey{mac: "00:11:22:33:44:22", msg: "failed to get machine"}
+	now := time.Now()
+
+	for i := 0; i < logThrottleBurst; i++ {
+		if allowed, _ := throttle.allow(key, now); !allowed {
+			t.Errorf("#%d: expected the first %d warnings to be logged", i, logThrottleBurst)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if allowed, _ := throttle.allow(key, now.Add(time.Second)); allowed {
+			t.Errorf("#%d: expected the warning to be suppressed in the window", i)
+		}
+	}
+	if allowed, _ := throttle.allow(otherKey, now.Add(time.Second)); !allowed {
+		t.Error("expected the warning of another machine to be logged")
+	}
+
+	allowed, suppressed := throttle.allow(key, now.Add(time.Minute))
+	if !allowed || suppressed != 5 {
+		t.Errorf("expected the warning after the window with 5 suppressed, got (%v, %d)", allowed, suppressed)
+	}
+
+	var disabled *windowLimiter
+	if allowed, _ := disabled.allow(key, now); !allowed {
+		t.Error("expected a nil throttle to allow everything")
+	}
+}
+
+func TestLogThrottleBounded(t *testing.T) {
+	throttle := newLogThrottle(time.Minute)
+	var dropped []limiterKey
+	throttle.dropped = func(key limiterKey, suppressed int) {
+		if suppressed != 2 {
+			t.Errorf("%v: expected 2 suppressed warnings, got %d", key, suppressed)
+		}
+		dropped = append(dropped, key)
+	}
+	now := time.Now()
+
+	key := limiterKey{mac: "00:11:22:33:44:21", msg: "failed to get machine"}
+	for i := 0; i < logThrottleBurst+2; i++ {
+		throttle.allow(key, now)
+	}
+	// the summary is reported once the window is over, without another
+	// warning of the machine
+	throttle.expire(now.Add(time.Minute))
+	if len(dropped) != 1 || dropped[0] != key {
+		t.Error("expected the summary of the suppressed warnings, got", dropped)
+	}
+
+	// the oldest window is dropped once there are too many of them
+	dropped = nil
+	for i := 0; i < logThrottleBurst+2; i++ {
+		throttle.allow(key, now)
+	}
+	for i := 0; i < windowLimiterMaxKeys; i++ {
+		other := limiterKey{mac: fmt.Sprintf("mac-%d", i), msg: key.msg}
+		throttle.allow(other, now.Add(time.Duration(i+1)*time.Millisecond))
+	}
+	if len(throttle.entries) > windowLimiterMaxKeys {
+		t.Errorf("expected at most %d windows, got %d", windowLimiterMaxKeys, len(throttle.entries))
+	}
+	if len(dropped) != 1 || dropped[0] != key {
+		t.Error("expected the oldest window to be dropped with its summary, got", dropped)
+	}
+}
+
+func TestNAKLimiter(t *testing.T) {
+	limiter := newNAKLimiter(2, time.Minute)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.allow(limiterKey{mac: "00:11:22:33:44:80"}, now); !allowed {
+			t.Errorf("#%d: expected the first 2 naks to be allowed", i)
+		}
+	}
+	if allowed, _ := limiter.allow(limiterKey{mac: "00:11:22:33:44:80"}, now.Add(time.Second)); allowed {
+		t.Error("expected the nak to be suppressed in the window")
+	}
+	if allowed, _ := limiter.allow(limiterKey{mac: "00:11:22:33:44:81"}, now.Add(time.Second)); !allowed {
+		t.Error("expected the nak to another machine to be allowed")
+	}
+	if allowed, _ := limiter.allow(limiterKey{mac: "00:11:22:33:44:80"}, now.Add(time.Minute)); !allowed {
+		t.Error("expected the nak after the window to be allowed")
+	}
+
+	if allowed, _ := newNAKLimiter(0, time.Minute).allow(limiterKey{mac: "00:11:22:33:44:80"}, now); !allowed {
+		t.Error("expected a nil limiter to allow everything")
+	}
+
+	h := &Handler{serverIP: net.IPv4(127, 0, 0, 1), naks: newNAKLimiter(2, time.Minute)}
+	mac, _ := net.ParseMAC("00:11:22:33:44:82")
+	p, _ := discoverForTest(mac, nil)
+	nak := dhcp4.ReplyPacket(p, dhcp4.NAK, h.serverIP, nil, 0, nil)
+	offer := dhcp4.ReplyPacket(p, dhcp4.Offer, h.serverIP, net.IPv4(127, 0, 0, 2), time.Hour, nil)
+
+	for i := 0; i < 2; i++ {
+		if h.limitNAK(mac, nak) == nil {
+			t.Errorf("#%d: expected the first 2 naks to be sent", i)
+		}
+	}
+	if h.limitNAK(mac, nak) != nil {
+		t.Error("expected the third nak to be dropped")
+	}
+	if h.limitNAK(mac, offer) == nil {
+		t.Error("expected the offers not to be limited")
+	}
+}
+
+func TestPXEMenuTimeout(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:23")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	// menuTimeout returns the timeout byte of the menu prompt (sub-option 10)
+	// of the pxe vendor options
+	menuTimeout := func() int {
+		p, options := discoverForTest(mac, []dhcp4.Option{{Code: 97, Value: make([]byte, 17)}})
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Error("expected a reply for the Discover")
+			return -1
+		}
+		pxe := reply.ParseOptions()[dhcp4.OptionVendorSpecificInformation]
+		for i := 0; i+1 < len(pxe) && pxe[i] != 255; i += 2 + int(pxe[i+1]) {
+			if pxe[i] == 10 && pxe[i+1] > 0 && i+2 < len(pxe) {
+				return int(pxe[i+2])
+			}
+		}
+		t.Error("expected the menu prompt in the pxe options")
+		return -1
+	}
+
+	if timeout := menuTimeout(); timeout != datasource.DefaultPXEMenuTimeout {
+		t.Errorf("expected the default timeout %d, got %d", datasource.DefaultPXEMenuTimeout, timeout)
+	}
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyPXEMenuTimeout, "10"); err != nil {
+		t.Error("error while setting the pxe menu timeout:", err)
+		return
+	}
+	if timeout := menuTimeout(); timeout != 10 {
+		t.Error("expected the configured timeout 10, got", timeout)
+	}
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyPXEMenuTimeout, "300"); err == nil {
+		t.Error("expected an error for a timeout out of the byte range")
+	}
+}
+
+func TestVendorClassBootfile(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:24")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyVendorClassBootfiles,
+		`[{"match": "idrac", "bootfile": "oob/idrac.efi", "nextServer": "127.0.0.9"},
+		  {"match": "iLO", "bootfile": "oob/ilo.efi"}]`); err != nil {
+		t.Error("error while setting the vendor class bootfiles:", err)
+		return
+	}
+
+	tests := []struct {
+		vendorClass string
+		bootfile    string
+		nextServer  net.IP
+	}{
+		{"PXEClient:Arch:00000:UNDI:002001", "", net.IPv4zero},
+		{"Dell iDRAC9 PXEClient", "oob/idrac.efi", net.IPv4(127, 0, 0, 9)},
+		{"HP iLO 5", "oob/ilo.efi", net.IPv4(127, 0, 0, 1)},
+	}
+
+	for i, tt := range tests {
+		p := dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{7, 0, 0, byte(i)}, false, []dhcp4.Option{
+			{Code: dhcp4.OptionVendorClassIdentifier, Value: []byte(tt.vendorClass)},
+		})
+		reply := h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+		replyOptions := reply.ParseOptions()
+
+		if got := string(replyOptions[dhcp4.OptionBootFileName]); got != tt.bootfile {
+			t.Errorf("#%d: expected option 67 to be %q, got %q", i, tt.bootfile, got)
+		}
+		if !reply.SIAddr().Equal(tt.nextServer) {
+			t.Errorf("#%d: expected siaddr %s, got %s", i, tt.nextServer, reply.SIAddr())
+		}
+		// only the clients without a dedicated bootfile get the pxe options
+		if _, hasPXE := replyOptions[dhcp4.OptionVendorSpecificInformation]; hasPXE != (tt.bootfile == "") {
+			t.Errorf("#%d: unexpected pxe options: %v", i, hasPXE)
+		}
+	}
+}
+
+func TestUserClassProfile(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:25")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyUserClassProfiles,
+		`[{"match": "rescue", "bootfile": "rescue.ipxe", "nextServer": "127.0.0.9"},
+		  {"match": "debug", "kernelArgs": "coreos.autologin"}]`); err != nil {
+		t.Error("error while setting the user class profiles:", err)
+		return
+	}
+
+	tests := []struct {
+		userClass  string
+		bootfile   string
+		nextServer net.IP
+		profile    string
+	}{
+		{"iPXE", "", net.IPv4zero, ""},
+		{"Rescue", "rescue.ipxe", net.IPv4(127, 0, 0, 9), "rescue"},
+		// the kernel args don't change the boot chain
+		{"debug", "", net.IPv4zero, "debug"},
+		{"memtest", "", net.IPv4zero, ""},
+	}
+
+	p, options := discoverForTest(mac, nil)
+	offer := h.ServeDHCP(p, dhcp4.Discover, options)
+	if offer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	for i, tt := range tests {
+		p := dhcp4.RequestPacket(dhcp4.Request, mac, nil, []byte{8, 0, 0, byte(i)}, false, []dhcp4.Option{
+			{Code: dhcp4.OptionRequestedIPAddress, Value: offer.YIAddr().To4()},
+			{Code: dhcp4.OptionVendorClassIdentifier, Value: []byte("PXEClient:Arch:00000:UNDI:002001")},
+			{Code: dhcp4.OptionUserClass, Value: []byte(tt.userClass)},
+		})
+		reply := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Request", i)
+			continue
+		}
+		replyOptions := reply.ParseOptions()
+
+		if got := string(replyOptions[dhcp4.OptionBootFileName]); got != tt.bootfile {
+			t.Errorf("#%d: expected option 67 to be %q, got %q", i, tt.bootfile, got)
+		}
+		if !reply.SIAddr().Equal(tt.nextServer) {
+			t.Errorf("#%d: expected siaddr %s, got %s", i, tt.nextServer, reply.SIAddr())
+		}
+		if _, hasPXE := replyOptions[dhcp4.OptionVendorSpecificInformation]; hasPXE != (tt.bootfile == "") {
+			t.Errorf("#%d: unexpected pxe options: %v", i, hasPXE)
+		}
+
+		profile, err := ds.MachineInterface(mac).UserClassProfile()
+		if err != nil {
+			t.Errorf("#%d: error while getting the user class profile: %s", i, err)
+			continue
+		}
+		if profile != tt.profile {
+			t.Errorf("#%d: expected the stored profile to be %q, got %q", i, tt.profile, profile)
+		}
+	}
+}
+
+func TestClasslessRouteOption(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:26")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	tests := []struct {
+		force       bool
+		requestList []byte
+		expected    bool
+	}{
+		{false, []byte{1, 3, 6, 121}, true},
+		{false, []byte{1, 3, 6}, false},
+		{false, nil, false},
+		{true, []byte{1, 3, 6}, true},
+		{true, nil, true},
+	}
+
+	for i, tt := range tests {
+		if err := ds.SetClusterVariable(datasource.SpecialKeyNetworkConfiguration, fmt.Sprintf(`{
+			"netmask": "255.255.255.0",
+			"classlessRouteOption": [{"router": "127.0.0.253", "size": 8, "destination": "10.0.0.0"}],
+			"forceClasslessRouteOption": %v
+		}`, tt.force)); err != nil {
+			t.Error("error while setting the network configuration:", err)
+			return
+		}
+
+		var opts []dhcp4.Option
+		if tt.requestList != nil {
+			opts = append(opts, dhcp4.Option{Code: dhcp4.OptionParameterRequestList, Value: tt.requestList})
+		}
+		p := dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{9, 0, 0, byte(i)}, false, opts)
+		reply := h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+		replyOptions := reply.ParseOptions()
+
+		routes, hasRoutes := replyOptions[dhcp4.OptionClasslessRouteFormat]
+		if hasRoutes != tt.expected {
+			t.Errorf("#%d: expected option 121 to be sent=%v, got %v", i, tt.expected, hasRoutes)
+		}
+		if hasRoutes && !bytes.Equal(routes, []byte{8, 10, 127, 0, 0, 253}) {
+			t.Errorf("#%d: unexpected classless routes: %v", i, routes)
+		}
+		if _, hasNetmask := replyOptions[dhcp4.OptionSubnetMask]; !hasNetmask {
+			t.Errorf("#%d: expected the other requested options to be sent", i)
+		}
+	}
+}
+
+func TestReplyDelay(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:27")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	defer log.SetLevel(log.GetLevel())
+	h.options.ReplyDelay = 100 * time.Millisecond
+
+	tests := []struct {
+		level   log.Level
+		msgType dhcp4.MessageType
+		delayed bool
+	}{
+		{log.DebugLevel, dhcp4.Discover, true},
+		// not applied outside the debug level
+		{log.InfoLevel, dhcp4.Discover, false},
+		// nor to the messages without a reply
+		{log.DebugLevel, dhcp4.Release, false},
+	}
+
+	for i, tt := range tests {
+		log.SetLevel(tt.level)
+		p := dhcp4.RequestPacket(tt.msgType, mac, nil, []byte{10, 0, 0, byte(i)}, false, nil)
+
+		start := time.Now()
+		reply := h.ServeDHCP(p, tt.msgType, p.ParseOptions())
+		elapsed := time.Since(start)
+
+		if (reply != nil) != (tt.msgType == dhcp4.Discover) {
+			t.Errorf("#%d: unexpected reply: %v", i, reply)
+		}
+		if delayed := elapsed >= h.options.ReplyDelay; delayed != tt.delayed {
+			t.Errorf("#%d: expected the reply to be delayed=%v, took %s", i, tt.delayed, elapsed)
+		}
+	}
+}
+
+func TestSanitizeHostname(t *testing.T) {
+	tests := []struct {
+		hostname  string
+		expected  string
+		truncated bool
+	}{
+		{"001122334455", "001122334455", false},
+		{"node_01.rack 2", "node01rack2", false},
+		{"-édge-node-", "dge-node", false},
+		{strings.Repeat("a", 63), strings.Repeat("a", 63), false},
+		{strings.Repeat("a", 70), strings.Repeat("a", 63), true},
+		// the truncated label doesn't end with a hyphen
+		{strings.Repeat("a", 62) + "-bcd", strings.Repeat("a", 62), true},
+		{strings.Repeat("a", 60) + "....." + "bbbb", strings.Repeat("a", 60) + "bbb", true},
+	}
+
+	for i, tt := range tests {
+		sanitized, truncated := sanitizeHostname(tt.hostname)
+		if sanitized != tt.expected || truncated != tt.truncated {
+			t.Errorf("#%d: expected (%q, %v), got (%q, %v)", i, tt.expected, tt.truncated, sanitized, truncated)
+		}
+	}
+}
+
+func TestIgnoredMachine(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:28")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	// only the machines can be ignored, not the whole cluster
+	if err := ds.SetClusterVariable(datasource.SpecialKeyIgnore, "true"); err == nil {
+		t.Error("expected an error for setting the ignore flag as a cluster variable")
+	}
+
+	tests := []struct {
+		value    string
+		answered bool
+	}{
+		{"", true},
+		{"true", false},
+		{"false", true},
+	}
+
+	for i, tt := range tests {
+		if tt.value != "" {
+			if err := ds.MachineInterface(mac).SetVariable(datasource.SpecialKeyIgnore, tt.value); err != nil {
+				t.Errorf("#%d: error while setting the ignore flag: %s", i, err)
+				continue
+			}
+		}
+
+		p := dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{11, 0, 0, byte(i)}, false, nil)
+		reply := h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+		if (reply != nil) != tt.answered {
+			t.Errorf("#%d: expected the Discover to be answered=%v, got %v", i, tt.answered, reply)
+		}
+	}
+}
+
+func TestNoInstall(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:12")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	// only the machines can be locked, not the whole cluster
+	if err := ds.SetClusterVariable(datasource.SpecialKeyNoInstall, "true"); err == nil {
+		t.Error("expected an error for setting no-install as a cluster variable")
+	}
+
+	machineInterface := ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+	if err := machineInterface.SetVariable(datasource.SpecialKeyNextBootfile, "http://example.com/install.ipxe"); err != nil {
+		t.Error("error while setting next-bootfile:", err)
+		return
+	}
+
+	tests := []struct {
+		noInstall string
+		install   bool
+	}{
+		{"", true},
+		{"true", false},
+		{"false", true},
+	}
+
+	for i, tt := range tests {
+		if err := machineInterface.SetVariable(datasource.SpecialKeyNoInstall, tt.noInstall); err != nil {
+			t.Errorf("#%d: error while setting no-install: %s", i, err)
+			continue
+		}
+
+		for _, options := range [][]dhcp4.Option{
+			{{Code: dhcp4.OptionVendorClassIdentifier, Value: []byte("PXEClient:Arch:00000")}},
+			{{Code: dhcp4.OptionUserClass, Value: []byte("iPXE")}},
+		} {
+			p, parsed := discoverForTest(mac, options)
+			reply := h.ServeDHCP(p, dhcp4.Discover, parsed)
+			if reply == nil {
+				t.Errorf("#%d: expected a reply for the Discover", i)
+				continue
+			}
+			replyOptions := reply.ParseOptions()
+			_, hasPXE := replyOptions[dhcp4.OptionVendorSpecificInformation]
+			_, hasBootfile := replyOptions[dhcp4.OptionBootFileName]
+			if hasPXE || hasBootfile {
+				if !tt.install {
+					t.Errorf("#%d: expected the installer not to be served, got %v", i, replyOptions)
+				}
+			} else if tt.install {
+				t.Errorf("#%d: expected the installer to be served", i)
+			}
+		}
+	}
+}
+
+func TestBMCNotInstalled(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:1a")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	machineInterface := ds.MachineInterface(mac)
+	machine, err := machineInterface.Machine(true, nil)
+	if err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+	if err := machineInterface.SetVariable(datasource.SpecialKeyNextBootfile, "http://example.com/install.ipxe"); err != nil {
+		t.Error("error while setting next-bootfile:", err)
+		return
+	}
+
+	tests := []struct {
+		machineType datasource.MachineType
+		install     bool
+	}{
+		{datasource.MTNormal, true},
+		{datasource.MTBMC, false},
+		{datasource.MTNormal, true},
+	}
+
+	for i, tt := range tests {
+		machine.Type = tt.machineType
+		if _, err := machineInterface.StoreMachine(machine); err != nil {
+			t.Errorf("#%d: error while storing the machine: %s", i, err)
+			continue
+		}
+
+		for _, options := range [][]dhcp4.Option{
+			{{Code: dhcp4.OptionVendorClassIdentifier, Value: []byte("PXEClient:Arch:00000")}},
+			{{Code: dhcp4.OptionUserClass, Value: []byte("iPXE")}},
+		} {
+			p, parsed := discoverForTest(mac, options)
+			reply := h.ServeDHCP(p, dhcp4.Discover, parsed)
+			if reply == nil {
+				t.Errorf("#%d: expected a reply for the Discover", i)
+				continue
+			}
+			replyOptions := reply.ParseOptions()
+			_, hasPXE := replyOptions[dhcp4.OptionVendorSpecificInformation]
+			_, hasBootfile := replyOptions[dhcp4.OptionBootFileName]
+			if (hasPXE || hasBootfile) != tt.install {
+				t.Errorf("#%d: expected the installer to be served for a %s machine: %v, got %v",
+					i, tt.machineType, tt.install, replyOptions)
+			}
+		}
+	}
+}
+
+func TestInstancesCache(t *testing.T) {
+	var mu sync.Mutex
+	fetches := 0
+	var fetchErr error
+	fetched := make(chan struct{}, 10)
+	slowFetch := func() ([]datasource.InstanceInfo, error) {
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		defer func() { fetched <- struct{}{} }()
+		fetches++
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return []datasource.InstanceInfo{{IP: net.IPv4(127, 0, 0, byte(fetches))}}, nil
+	}
+	fetchCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+
+	c := newInstancesCache(slowFetch, time.Minute)
+	now := time.Now()
+
+	// only the first call waits for the datasource
+	instances, err := c.get(now)
+	if err != nil || len(instances) != 1 || !instances[0].IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Error("unexpected instances:", instances, err)
+		return
+	}
+	<-fetched
+
+	start := time.Now()
+	instances, _ = c.get(now.Add(30 * time.Second))
+	if time.Since(start) > 40*time.Millisecond || fetchCount() != 1 {
+		t.Error("expected the fresh list to be served from the cache")
+	}
+
+	// after the ttl, the stale list is served while it's refreshed
+	start = time.Now()
+	instances, _ = c.get(now.Add(time.Minute))
+	if time.Since(start) > 40*time.Millisecond || !instances[0].IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Error("expected the stale list to be served without blocking, got", instances)
+	}
+	<-fetched
+	time.Sleep(10 * time.Millisecond)
+	if instances, _ = c.get(now.Add(time.Minute)); !instances[0].IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Error("expected the refreshed list, got", instances)
+	}
+
+	// the stale list is kept if the refresh fails
+	mu.Lock()
+	fetchErr = fmt.Errorf("etcd is unavailable")
+	mu.Unlock()
+	if _, err := c.get(now.Add(2 * time.Minute)); err != nil {
+		t.Error("expected no error while the refresh is pending:", err)
+	}
+	<-fetched
+	time.Sleep(10 * time.Millisecond)
+	instances, err = c.get(now.Add(2 * time.Minute))
+	if err != nil || !instances[0].IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Error("expected the stale list after a failed refresh, got", instances, err)
+	}
+}
+
+func TestHostCache(t *testing.T) {
+	var mu sync.Mutex
+	lookups := 0
+	var lookupErr error
+	looked := make(chan struct{}, 10)
+	lookup := func(host string) ([]net.IP, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		defer func() { looked <- struct{}{} }()
+		lookups++
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return []net.IP{net.IPv4(10, 0, 0, byte(lookups))}, nil
+	}
+	lookupCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return lookups
+	}
+
+	c := newHostCache(lookup, time.Minute)
+	now := time.Now()
+
+	ips, err := c.get("boot.example.com", now)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Error("unexpected addresses:", ips, err)
+		return
+	}
+	<-looked
+
+	if ips, _ = c.get("boot.example.com", now.Add(30*time.Second)); lookupCount() != 1 {
+		t.Error("expected the fresh addresses to be served from the cache")
+	}
+
+	// after the ttl, the stale addresses are served while they're resolved
+	// again, and they're kept if it fails
+	mu.Lock()
+	lookupErr = fmt.Errorf("no such host")
+	mu.Unlock()
+	if ips, err = c.get("boot.example.com", now.Add(time.Minute)); err != nil || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Error("expected the stale addresses, got", ips, err)
+	}
+	<-looked
+	time.Sleep(10 * time.Millisecond)
+	if ips, err = c.get("boot.example.com", now.Add(time.Minute)); err != nil || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Error("expected the stale addresses after a failed lookup, got", ips, err)
+	}
+	<-looked
+
+	// a failed lookup is cached too, until it's retried
+	if _, err := c.get("missing.example.com", now); err == nil {
+		t.Error("expected the lookup to fail")
+	}
+	<-looked
+	count := lookupCount()
+	if _, err := c.get("missing.example.com", now.Add(hostCacheRetryAfter/2)); err == nil || lookupCount() != count {
+		t.Error("expected the failed lookup to be served from the cache")
+	}
+}
+
+func TestForeignServerIdentifier(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:25")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	h.logThrottle = newLogThrottle(time.Minute)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	before := metrics.Default.Snapshot().Counters[metricForeignServers]
+	for i := 0; i < logThrottleBurst+2; i++ {
+		p := dhcp4.RequestPacket(dhcp4.Request, mac, nil, []byte{9, 0, 0, byte(i)}, false, []dhcp4.Option{
+			{Code: dhcp4.OptionServerIdentifier, Value: []byte{10, 0, 0, 66}},
+			{Code: dhcp4.OptionRequestedIPAddress, Value: []byte{10, 0, 0, 100}},
+		})
+		if reply := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions()); reply != nil {
+			t.Error("expected no reply for a message of a foreign server")
+		}
+	}
+	// the identifier of another instance is not foreign
+	p := dhcp4.RequestPacket(dhcp4.Request, mac, nil, []byte{9, 0, 1, 0}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionServerIdentifier, Value: []byte{127, 0, 0, 1}},
+	})
+	h.serverIP = net.IPv4(127, 0, 0, 2)
+	h.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	if delta := metrics.Default.Snapshot().Counters[metricForeignServers] - before; delta != logThrottleBurst+2 {
+		t.Errorf("expected %d foreign server identifiers, got %d", logThrottleBurst+2, delta)
+	}
+	if count := strings.Count(logs.String(), "foreign dhcp server"); count != logThrottleBurst {
+		t.Errorf("expected %d warnings, got %d:\n%s", logThrottleBurst, count, logs.String())
+	}
+	if !strings.Contains(logs.String(), "10.0.0.66") {
+		t.Error("expected the foreign server in the warnings, got", logs.String())
+	}
+}
+
+func TestServerIdentifier(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:83")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	// option 54 is not in the parameter request list, but it's mandatory
+	requestList := dhcp4.Option{Code: dhcp4.OptionParameterRequestList, Value: []byte{1, 3}}
+	p := dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{12, 0, 0, 1}, false, []dhcp4.Option{requestList})
+	offer := h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if offer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	p = dhcp4.RequestPacket(dhcp4.Request, mac, nil, []byte{12, 0, 0, 2}, false, []dhcp4.Option{
+		requestList,
+		{Code: dhcp4.OptionRequestedIPAddress, Value: offer.YIAddr().To4()},
+		{Code: dhcp4.OptionServerIdentifier, Value: h.serverIP.To4()},
+	})
+	ack := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+	if ack == nil {
+		t.Error("expected a reply for the Request")
+		return
+	}
+
+	for name, reply := range map[string]dhcp4.Packet{"offer": offer, "ack": ack} {
+		serverID := reply.ParseOptions()[dhcp4.OptionServerIdentifier]
+		if !bytes.Equal(serverID, h.serverIP.To4()) {
+			t.Errorf("%s: expected option 54 to be %x, got %x", name, []byte(h.serverIP.To4()), serverID)
+		}
+	}
+}
+
+func TestReprovisionCooldown(t *testing.T) {
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	tests := []struct {
+		cooldown    string
+		provisioned bool
+		pxe         bool
+	}{
+		{"", false, true},
+		{"", true, true},
+		{"30m", false, true},
+		{"30m", true, false},
+	}
+
+	for i, test := range tests {
+		mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, byte(0x90 + i)}
+		machineInterface := ds.MachineInterface(mac)
+		if _, err := machineInterface.Machine(true, nil); err != nil {
+			t.Errorf("#%d: error while creating the machine: %s", i, err)
+			continue
+		}
+		if err := machineInterface.SetVariable(datasource.SpecialKeyReprovisionCooldown, test.cooldown); err != nil {
+			t.Errorf("#%d: error while setting the cooldown: %s", i, err)
+			continue
+		}
+		if test.provisioned {
+			if err := machineInterface.StoreProvisioned(); err != nil {
+				t.Errorf("#%d: error while storing the provision time: %s", i, err)
+				continue
+			}
+		}
+
+		p, options := discoverForTest(mac, []dhcp4.Option{
+			{Code: dhcp4.OptionVendorClassIdentifier, Value: []byte("PXEClient:Arch:00000")},
+		})
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+		if _, isIn := reply.ParseOptions()[dhcp4.OptionVendorSpecificInformation]; isIn != test.pxe {
+			t.Errorf("#%d: expected the presence of the pxe options to be %v", i, test.pxe)
+		}
+	}
+
+	// the cooldown of the last machine is over after 30 minutes
+	machineInterface := ds.MachineInterface(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x93})
+	if cooldown, err := inReprovisionCooldown(machineInterface, time.Now().Add(31*time.Minute)); err != nil || cooldown {
+		t.Errorf("expected the cooldown to be over, got (%v, %v)", cooldown, err)
+	}
+}
+
+func TestBootServerHostname(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:94")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	defer func(lookup func(string) ([]net.IP, error)) {
+		lookupIP = lookup
+	}(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host != "boot.example.com" {
+			return nil, fmt.Errorf("no such host: %s", host)
+		}
+		return []net.IP{net.ParseIP("::1"), net.IPv4(10, 0, 0, 66)}, nil
+	}
+
+	machineInterface := ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+	if err := machineInterface.SetVariable(datasource.SpecialKeyNextBootfile, "stage2.ipxe"); err != nil {
+		t.Error("error while setting the next bootfile:", err)
+		return
+	}
+
+	tests := []struct {
+		hostname   string
+		option66   string
+		nextServer net.IP
+	}{
+		{"", "", h.serverIP},
+		{"boot.example.com", "boot.example.com", net.IPv4(10, 0, 0, 66)},
+		// the unresolvable servers are left out
+		{"missing.example.com", "", h.serverIP},
+	}
+
+	for i, test := range tests {
+		if err := machineInterface.SetVariable(datasource.SpecialKeyBootServerHostname, test.hostname); err != nil {
+			t.Errorf("#%d: error while setting the boot server hostname: %s", i, err)
+			continue
+		}
+
+		p, options := discoverForTest(mac, []dhcp4.Option{
+			{Code: dhcp4.OptionUserClass, Value: []byte("iPXE")},
+		})
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+
+		if got := string(reply.ParseOptions()[dhcp4.OptionTFTPServerName]); got != test.option66 {
+			t.Errorf("#%d: expected option 66 to be %q, got %q", i, test.option66, got)
+		}
+		if !reply.SIAddr().Equal(test.nextServer) {
+			t.Errorf("#%d: expected siaddr to be %s, got %s", i, test.nextServer, reply.SIAddr())
+		}
+	}
+}
+
+func TestPXEBootMessage(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:95")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	// the sub-options of option 43, by their codes
+	pxeSubOptions := func() map[byte][]byte {
+		p, options := discoverForTest(mac, []dhcp4.Option{
+			{Code: 97, Value: []byte{0, 1, 2, 3}},
+		})
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Error("expected a reply for the Discover")
+			return nil
+		}
+		res := make(map[byte][]byte)
+		pxe := reply.ParseOptions()[dhcp4.OptionVendorSpecificInformation]
+		for i := 0; i+1 < len(pxe) && pxe[i] != 255; i += 2 + int(pxe[i+1]) {
+			if i+2+int(pxe[i+1]) > len(pxe) {
+				t.Errorf("sub-option %d overflows option 43", pxe[i])
+				return nil
+			}
+			res[pxe[i]] = pxe[i+2 : i+2+int(pxe[i+1])]
+		}
+		return res
+	}
+
+	for _, message := range []string{"", "Rack 12 (staging)"} {
+		if err := ds.SetClusterVariable(datasource.SpecialKeyPXEBootMessage, message); err != nil {
+			t.Error("error while setting the pxe boot message:", err)
+			return
+		}
+		expected := message
+		if expected == "" {
+			expected = h.bootMessage
+		}
+
+		subOptions := pxeSubOptions()
+		if menu := subOptions[9]; len(menu) < 3 || string(menu[3:]) != expected {
+			t.Errorf("expected the menu entry %q, got %q", expected, menu)
+		} else if int(menu[2]) != len(expected) {
+			t.Errorf("expected the length of the menu entry to be %d, got %d",
+				len(expected), menu[2])
+		}
+		if prompt := subOptions[10]; len(prompt) < 1 || string(prompt[1:]) != expected {
+			t.Errorf("expected the menu prompt %q, got %q", expected, prompt)
+		}
+	}
+}
+
+func TestPXEVendorOptions(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:04")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	machineInterface := ds.MachineInterface(mac)
+	if err := ds.SetClusterVariable(datasource.SpecialKeyPXEMenuTimeout, "7"); err != nil {
+		t.Error("error while setting the pxe menu timeout:", err)
+		return
+	}
+	if err := machineInterface.SetVariable(datasource.SpecialKeyPXEBootMessage, "Rack 12"); err != nil {
+		t.Error("error while setting the pxe boot message:", err)
+		return
+	}
+
+	pxeOptions, err := h.PXEVendorOptions(machineInterface)
+	if err != nil {
+		t.Error("error while getting the pxe vendor options:", err)
+		return
+	}
+	expected, err := h.fillPXE(7, "Rack 12", nil, nil, 0)
+	if err != nil {
+		t.Error("error while filling the pxe options:", err)
+		return
+	}
+	if !bytes.Equal(pxeOptions, expected) {
+		t.Errorf("expected %x, got %x", expected, pxeOptions)
+	}
+
+	h.serverIP = net.ParseIP("fe80::1")
+	if _, err := h.PXEVendorOptions(machineInterface); err == nil {
+		t.Error("expected an error for an ipv6 server ip")
+	}
+}
+
+func TestClusterNetworkConfiguration(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:06")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if err := ds.DeleteClusterVariable(datasource.SpecialKeyNetworkConfiguration); err != nil {
+		t.Error("error while deleting the network configuration:", err)
+		return
+	}
+	p, options := discoverForTest(mac, nil)
+	if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply != nil {
+		t.Error("expected no reply without a network configuration, got", reply)
+	}
+
+	// the new machine gets the one of the cluster
+	if err := ds.SetClusterVariable(datasource.SpecialKeyNetworkConfiguration,
+		`{"netmask": "255.255.255.0", "router": "127.0.0.254"}`); err != nil {
+		t.Error("error while setting the network configuration:", err)
+		return
+	}
+	p, options = discoverForTest(mac, nil)
+	reply := h.ServeDHCP(p, dhcp4.Discover, options)
+	if reply == nil {
+		t.Error("expected a reply with the network configuration of the cluster")
+		return
+	}
+	replyOptions := reply.ParseOptions()
+	if mask := net.IP(replyOptions[dhcp4.OptionSubnetMask]); !mask.Equal(net.IPv4(255, 255, 255, 0)) {
+		t.Errorf("expected the netmask of the cluster, got %s", mask)
+	}
+	if router := net.IP(replyOptions[dhcp4.OptionRouter]); !router.Equal(net.IPv4(127, 0, 0, 254)) {
+		t.Errorf("expected the router of the cluster, got %s", router)
+	}
+
+	// the one of the machine wins
+	machineInterface := ds.MachineInterface(mac)
+	if err := machineInterface.SetVariable(datasource.SpecialKeyNetworkConfiguration,
+		`{"netmask": "255.0.0.0", "router": "127.0.0.253"}`); err != nil {
+		t.Error("error while setting the network configuration of the machine:", err)
+		return
+	}
+	p, options = discoverForTest(mac, nil)
+	reply = h.ServeDHCP(p, dhcp4.Discover, options)
+	if reply == nil {
+		t.Error("expected a reply with the network configuration of the machine")
+		return
+	}
+	if mask := net.IP(reply.ParseOptions()[dhcp4.OptionSubnetMask]); !mask.Equal(net.IPv4(255, 0, 0, 0)) {
+		t.Errorf("expected the netmask of the machine, got %s", mask)
+	}
+}
+
+func TestPXEMenuBootItem(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:07")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyPXEMenu, `[
+		{"description": "Memtest", "bootfile": "memtest.0"},
+		{"description": "Rescue", "bootfile": "rescue.0"}
+	]`); err != nil {
+		t.Error("error while setting the pxe menu:", err)
+		return
+	}
+
+	tests := []struct {
+		bootItem []byte
+		mirrored bool
+		bootfile string
+	}{
+		{nil, false, ""},
+		{[]byte{0x80, 0x00, 0, 0}, true, ""},
+		{[]byte{0x80, 0x02, 0, 0}, true, "rescue.0"},
+		{[]byte{0x80, 0x01, 0, 1}, true, "memtest.0"},
+		{[]byte{0x80, 0x03, 0, 0}, false, ""},
+		{[]byte{0x80, 0x02}, false, ""},
+	}
+	for i, test := range tests {
+		opts := []dhcp4.Option{{Code: 97, Value: make([]byte, 17)}}
+		if test.bootItem != nil {
+			vendorOptions := append([]byte{0, pxeSubOptionBootItem, byte(len(test.bootItem))}, test.bootItem...)
+			opts = append(opts, dhcp4.Option{
+				Code:  dhcp4.OptionVendorSpecificInformation,
+				Value: append(vendorOptions, 255),
+			})
+		}
+		p := dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{7, 0, 0, byte(i)}, false, opts)
+		reply := h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+
+		subOptions := pxeSubOptions(reply.ParseOptions()[dhcp4.OptionVendorSpecificInformation])
+		if len(subOptions[8]) != 3*7 || len(subOptions[9]) != 3+len(h.bootMessage)+3+7+3+6 {
+			t.Errorf("#%d: expected the boot servers and the entries of the menu, got %x and %q",
+				i, subOptions[8], subOptions[9])
+		}
+		if bootItem, isIn := subOptions[pxeSubOptionBootItem]; isIn != test.mirrored ||
+			(test.mirrored && !bytes.Equal(bootItem, test.bootItem)) {
+			t.Errorf("#%d: expected the boot item to be mirrored=%v, got %x", i, test.mirrored, bootItem)
+		}
+		if bootfile := string(bytes.TrimRight(reply.File(), "\x00")); bootfile != test.bootfile {
+			t.Errorf("#%d: expected the bootfile %q, got %q", i, test.bootfile, bootfile)
+		}
+	}
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyPXEMenu, fmt.Sprintf(
+		`[{"description": %q, "bootfile": "a.0"}, {"description": %q, "bootfile": "b.0"}]`,
+		strings.Repeat("a", 100), strings.Repeat("b", 100))); err != nil {
+		t.Error("error while setting the pxe menu:", err)
+		return
+	}
+	p, options := discoverForTest(mac, []dhcp4.Option{{Code: 97, Value: make([]byte, 17)}})
+	if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply != nil {
+		t.Error("expected no reply with a pxe menu which doesn't fit in option 43")
+	}
+}
+
+func TestPXESubOptions(t *testing.T) {
+	tests := []struct {
+		value    []byte
+		expected map[byte][]byte
+	}{
+		{nil, map[byte][]byte{}},
+		{[]byte{0, 0, 71, 4, 0x80, 0, 0, 0, 255, 6, 1, 3}, map[byte][]byte{71: {0x80, 0, 0, 0}}},
+		{[]byte{6, 1, 3, 71, 4, 0x80}, map[byte][]byte{6: {3}}},
+		{[]byte{6}, map[byte][]byte{}},
+	}
+	for i, test := range tests {
+		if subOptions := pxeSubOptions(test.value); !reflect.DeepEqual(subOptions, test.expected) {
+			t.Errorf("#%d: expected %v, got %v", i, test.expected, subOptions)
+		}
+	}
+}
+
+func TestPXEOptionsLength(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:08")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	unpadded, err := h.PXEVendorOptions(ds.MachineInterface(mac))
+	if err != nil {
+		t.Error("error while getting the pxe vendor options:", err)
+		return
+	}
+
+	tests := []struct {
+		length   string
+		expected int
+	}{
+		{"", len(unpadded)},
+		{"10", len(unpadded)},
+		{"128", 128},
+		{"255", 255},
+	}
+	for i, test := range tests {
+		if err := ds.SetClusterVariable(datasource.SpecialKeyPXEOptionsLength, test.length); err != nil {
+			t.Errorf("#%d: error while setting the pxe options length: %s", i, err)
+			continue
+		}
+		p, options := discoverForTest(mac, []dhcp4.Option{{Code: 97, Value: make([]byte, 17)}})
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Discover", i)
+			continue
+		}
+		pxe := reply.ParseOptions()[dhcp4.OptionVendorSpecificInformation]
+		if len(pxe) != test.expected || pxe[len(pxe)-1] != 255 {
+			t.Errorf("#%d: expected %d bytes ending with 255, got %x", i, test.expected, pxe)
+		}
+		if err := checkPXEVendorOptions(pxe); err != nil {
+			t.Errorf("#%d: unexpected error for the pxe vendor options: %s", i, err)
+		}
+		if !bytes.Equal(pxe[:len(unpadded)-1], unpadded[:len(unpadded)-1]) {
+			t.Errorf("#%d: expected the sub-options to be kept, got %x", i, pxe)
+		}
+	}
+}
+
+func TestCheckPXEVendorOptions(t *testing.T) {
+	tests := []struct {
+		value   []byte
+		invalid bool
+	}{
+		{[]byte{6, 1, 3, 255}, false},
+		{[]byte{6, 1, 3, 0, 0, 255}, false},
+		{[]byte{6, 1, 3, 255, 0}, true},
+		{[]byte{6, 1, 3}, true},
+		{[]byte{6, 2, 3, 255}, true},
+		{nil, true},
+	}
+	for i, test := range tests {
+		if err := checkPXEVendorOptions(test.value); (err != nil) != test.invalid {
+			t.Errorf("#%d: expected invalid=%v, got %v", i, test.invalid, err)
 		}
 	}
 }
@@ -0,0 +1,84 @@
+package dhcp
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// instancesCacheTTL is how long the list of the instances is served without
+// refreshing it
+const instancesCacheTTL = 5 * time.Second
+
+// instancesCache keeps the list of the instances, so the replies don't block
+// on the datasource. Only the first call waits for the list. After ttl, the
+// stale list is served while it's refreshed in the background, and it's kept
+// if the refresh fails. It's safe for concurrent use.
+type instancesCache struct {
+	fetch func() ([]datasource.InstanceInfo, error)
+	ttl   time.Duration
+
+	mu         sync.Mutex
+	instances  []datasource.InstanceInfo
+	fetched    time.Time
+	hasValue   bool
+	refreshing bool
+}
+
+func newInstancesCache(fetch func() ([]datasource.InstanceInfo, error),
+	ttl time.Duration) *instancesCache {
+	return &instancesCache{fetch: fetch, ttl: ttl}
+}
+
+// get returns the cached list of the instances, and refreshes it in the
+// background if it's older than ttl
+func (c *instancesCache) get(now time.Time) ([]datasource.InstanceInfo, error) {
+	c.mu.Lock()
+	if !c.hasValue {
+		c.mu.Unlock()
+		instances, err := c.fetch()
+		if err != nil {
+			return nil, err
+		}
+		c.store(instances, now)
+		return instances, nil
+	}
+
+	instances := c.instances
+	if now.Sub(c.fetched) >= c.ttl && !c.refreshing {
+		c.refreshing = true
+		go c.refresh(now)
+	}
+	c.mu.Unlock()
+	return instances, nil
+}
+
+func (c *instancesCache) refresh(now time.Time) {
+	instances, err := c.fetch()
+	if err != nil {
+		log.WithField("where", "dhcp.instancesCache.refresh").WithError(err).Warn(
+			"failed to refresh the instances, serving the stale list")
+		c.mu.Lock()
+		c.refreshing = false
+		c.mu.Unlock()
+		return
+	}
+	c.store(instances, now)
+}
+
+func (c *instancesCache) store(instances []datasource.InstanceInfo, now time.Time) {
+	c.mu.Lock()
+	c.instances, c.fetched, c.hasValue, c.refreshing = instances, now, true, false
+	c.mu.Unlock()
+}
+
+// instanceInfos returns the instances of the datasource, through the cache
+// if the handler has one
+func (h *Handler) instanceInfos() ([]datasource.InstanceInfo, error) {
+	if h.instances == nil {
+		return h.datasource.Instances()
+	}
+	return h.instances.get(time.Now())
+}
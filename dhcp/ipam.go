@@ -0,0 +1,196 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// defaultIPAMTimeout is how long the ipam webhook is waited for, if
+// HandlerOptions.IPAMTimeout is not set
+const defaultIPAMTimeout = 5 * time.Second
+
+const (
+	// ipamMaxResponse is the longest response of the ipam webhook which is
+	// read
+	ipamMaxResponse = 64 << 10
+	// ipamMaxPending bounds the number of the machines whose ips are asked
+	// from the ipam webhook at the same time, e.g. in a boot storm
+	ipamMaxPending = 64
+	// ipamRetryAfter is how long the ipam webhook is not asked again for a
+	// machine, after it has failed for it
+	ipamRetryAfter = 30 * time.Second
+	// ipamMaxFailed bounds the number of the failed machines which are kept
+	ipamMaxFailed = 1024
+)
+
+// errIPAMPending is returned for a new machine whose ip is not answered by
+// the ipam webhook yet. Its request is dropped, and its retransmission is
+// answered once the ip is stored.
+var errIPAMPending = errors.New("waiting for the ipam webhook")
+
+// ipamLookups keeps the machines whose ips are being asked from the ipam
+// webhook, and the ones for which it has recently failed, so a machine is
+// asked once at a time and a failing webhook isn't hammered by the
+// retransmissions. It's safe for concurrent use.
+type ipamLookups struct {
+	mu      sync.Mutex
+	pending map[string]bool
+	failed  map[string]time.Time // by mac, when it may be asked again
+}
+
+func newIPAMLookups() *ipamLookups {
+	return &ipamLookups{
+		pending: make(map[string]bool),
+		failed:  make(map[string]time.Time),
+	}
+}
+
+// start reports whether the ipam webhook should be asked for the ip of mac,
+// and marks it as pending if so
+func (l *ipamLookups) start(mac string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pending[mac] || len(l.pending) >= ipamMaxPending {
+		return false
+	}
+	if retry, isIn := l.failed[mac]; isIn {
+		if now.Before(retry) {
+			return false
+		}
+		delete(l.failed, mac)
+	}
+	l.pending[mac] = true
+	return true
+}
+
+// done marks the lookup of mac as finished. A failed one is not retried for
+// ipamRetryAfter.
+func (l *ipamLookups) done(mac string, failed bool, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.pending, mac)
+	if !failed {
+		return
+	}
+	if len(l.failed) >= ipamMaxFailed {
+		for failedMac, retry := range l.failed {
+			if !now.Before(retry) {
+				delete(l.failed, failedMac)
+			}
+		}
+	}
+	if len(l.failed) < ipamMaxFailed {
+		l.failed[mac] = now.Add(ipamRetryAfter)
+	}
+}
+
+// ipamRequest is posted to the ipam webhook as json. Subnet is the subnet
+// of the serving interface, empty if it's unknown.
+type ipamRequest struct {
+	Mac    string `json:"mac"`
+	Subnet string `json:"subnet"`
+}
+
+// ipamResponse is the expected answer of the ipam webhook
+type ipamResponse struct {
+	IP string `json:"ip"`
+}
+
+// ipamAddress asks the ipam webhook for the ip of the new machine. The ip
+// is expected to be an ipv4 address in the serving subnet, if it's known.
+func (h *Handler) ipamAddress(mac net.HardwareAddr) (net.IP, error) {
+	req := ipamRequest{Mac: mac.String()}
+	if h.subnet != nil {
+		req.Subnet = h.subnet.String()
+	}
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: h.options.IPAMTimeout}
+	resp, err := client.Post(h.options.IPAMWebhook, "application/json", bytes.NewReader(reqJSON))
+	if err != nil {
+		return nil, fmt.Errorf("ipam webhook failed: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, ipamMaxResponse))
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the ipam response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ipam webhook answered %d: %q", resp.StatusCode, body)
+	}
+
+	var res ipamResponse
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("error while unmarshaling the ipam response: %s", err)
+	}
+	ip := net.ParseIP(res.IP).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("ipam answered an invalid ipv4 address: %q", res.IP)
+	}
+	if h.subnet != nil && !h.subnet.Contains(ip) {
+		return nil, fmt.Errorf("ipam answered %s, which is outside the serving subnet %s", ip, h.subnet)
+	}
+	return ip, nil
+}
+
+// ipamMachine returns the machine if it's known. Otherwise the ipam webhook
+// is asked for its ip in the background, so a slow webhook doesn't hold the
+// requests of the other machines, and errIPAMPending is returned. Only the
+// master asks the webhook, as the ipam would give an ip to each instance.
+func (h *Handler) ipamMachine(machineInterface datasource.MachineInterface) (datasource.Machine, error) {
+	known, err := machineInterface.Known()
+	if err != nil {
+		return datasource.Machine{}, err
+	}
+	if known {
+		return machineInterface.Machine(false, nil)
+	}
+
+	if err := h.datasource.IsMaster(); err != nil {
+		return datasource.Machine{}, fmt.Errorf(
+			"only the master instance asks the ipam webhook: %s", err)
+	}
+	if h.ipam.start(machineInterface.Mac().String(), time.Now()) {
+		go h.ipamClaim(machineInterface)
+	}
+	return datasource.Machine{}, errIPAMPending
+}
+
+// ipamClaim creates the record of the new machine with the ip which the ipam
+// webhook answers
+func (h *Handler) ipamClaim(machineInterface datasource.MachineInterface) {
+	mac := machineInterface.Mac()
+	ip, err := h.ipamAddress(mac)
+	if err == nil {
+		_, err = machineInterface.Claim(datasource.Machine{IP: ip, Type: datasource.MTNormal})
+		if err == datasource.ErrMachineExists {
+			// created concurrently, e.g. through the web api
+			err = nil
+		}
+	}
+	h.ipam.done(mac.String(), err != nil, time.Now())
+	if err != nil {
+		h.warn(mac, err, "failed to get the ip from the ipam webhook")
+		return
+	}
+	log.WithFields(log.Fields{
+		"where":  "dhcp.ipamClaim",
+		"object": mac.String(),
+	}).Infof("ipam assigned %s", ip)
+}
@@ -0,0 +1,187 @@
+package dhcp
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/krolaw/dhcp4"
+)
+
+// waitForTest polls cond until it's true, or a second is passed
+func waitForTest(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestIPAMWebhook(t *testing.T) {
+	assigned, _ := net.ParseMAC("00:11:22:33:47:0f")
+	failing, _ := net.ParseMAC("00:11:22:33:47:10")
+	outside, _ := net.ParseMAC("00:11:22:33:47:11")
+	hanging, _ := net.ParseMAC("00:11:22:33:47:14")
+
+	// a stub ipam
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	release := make(chan struct{})
+	ipam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ipamRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requests[req.Mac]++
+		mu.Unlock()
+		if req.Subnet != "127.0.0.0/24" {
+			http.Error(w, "unexpected subnet", http.StatusBadRequest)
+			return
+		}
+
+		switch req.Mac {
+		case assigned.String():
+			w.Write([]byte(`{"ip": "127.0.0.90"}`))
+		case outside.String():
+			w.Write([]byte(`{"ip": "10.9.9.9"}`))
+		case hanging.String():
+			<-release
+			http.Error(w, "too late", http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "no free address", http.StatusServiceUnavailable)
+		}
+	}))
+	defer ipam.Close()
+	defer close(release)
+	asked := func(mac net.HardwareAddr) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[mac.String()]
+	}
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	_, h.subnet, _ = net.ParseCIDR("127.0.0.0/24")
+	h.options.IPAMWebhook = ipam.URL
+	h.options.IPAMTimeout = 10 * time.Second
+	h.ipam = newIPAMLookups()
+
+	// the request of a new machine is dropped while the ipam is asked, and
+	// a hanging ipam doesn't hold the requests of the other machines
+	for _, mac := range []net.HardwareAddr{hanging, assigned} {
+		p, options := discoverForTest(mac, nil)
+		start := time.Now()
+		if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply != nil {
+			t.Errorf("%s: expected the request to be dropped while the ipam is asked, got %v", mac, reply)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: expected the ipam not to be waited for, took %s", mac, elapsed)
+		}
+	}
+	if !waitForTest(func() bool {
+		known, _ := ds.MachineInterface(assigned).Known()
+		return known
+	}) {
+		t.Error("expected the machine to be stored with the ip of the ipam")
+		return
+	}
+	for i := 0; i < 2; i++ {
+		p, options := discoverForTest(assigned, nil)
+		reply := h.ServeDHCP(p, dhcp4.Discover, options)
+		if reply == nil {
+			t.Errorf("#%d: expected an offer with the ip of the ipam", i)
+			continue
+		}
+		if !reply.YIAddr().Equal(net.IPv4(127, 0, 0, 90)) {
+			t.Errorf("#%d: expected the ip of the ipam to be offered, got %s", i, reply.YIAddr())
+		}
+	}
+	if asked(assigned) != 1 {
+		t.Error("expected the ipam to be asked once, got", asked(assigned))
+	}
+	machine, err := ds.MachineInterface(assigned).Machine(false, nil)
+	if err != nil {
+		t.Error("expected the machine to be stored:", err)
+	} else if !machine.IP.Equal(net.IPv4(127, 0, 0, 90)) || machine.Type != datasource.MTNormal {
+		t.Error("unexpected stored machine:", machine)
+	}
+
+	// the pending machine is not asked for again
+	p, options := discoverForTest(hanging, nil)
+	h.ServeDHCP(p, dhcp4.Discover, options)
+	if asked(hanging) != 1 {
+		t.Error("expected the pending machine to be asked once, got", asked(hanging))
+	}
+
+	// the failed machines are not stored, and not asked for again soon
+	for _, mac := range []net.HardwareAddr{failing, outside} {
+		for i := 0; i < 2; i++ {
+			p, options := discoverForTest(mac, nil)
+			if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply != nil {
+				t.Errorf("%s: expected the request to be dropped, got %v", mac, reply)
+			}
+			mac := mac
+			waitForTest(func() bool {
+				h.ipam.mu.Lock()
+				defer h.ipam.mu.Unlock()
+				return !h.ipam.pending[mac.String()]
+			})
+		}
+		if known, _ := ds.MachineInterface(mac).Known(); known {
+			t.Errorf("%s: expected no machine to be stored", mac)
+		}
+		if asked(mac) != 1 {
+			t.Errorf("%s: expected the failed machine to be asked once, got %d", mac, asked(mac))
+		}
+	}
+}
+
+func TestIPAMWebhookOnlyMaster(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:15")
+
+	ipam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the ipam not to be asked by the other instances")
+		w.Write([]byte(`{"ip": "127.0.0.91"}`))
+	}))
+	defer ipam.Close()
+
+	// not registered as an instance, so it's not the master
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+	h := &Handler{
+		serverIP:    net.IPv4(127, 0, 0, 1),
+		datasource:  ds,
+		bootMessage: "Blacksmith (test)",
+		options:     HandlerOptions{IPAMWebhook: ipam.URL},
+		ipam:        newIPAMLookups(),
+	}
+
+	p, options := discoverForTest(mac, nil)
+	if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply != nil {
+		t.Error("expected the request of a new machine to be dropped, got", reply)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if known, _ := ds.MachineInterface(mac).Known(); known {
+		t.Error("expected no machine to be stored")
+	}
+}
@@ -0,0 +1,61 @@
+package dhcp
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/metrics"
+)
+
+// renewal reports whether the request renews a lease, i.e. it's from a
+// client which is using its address (ciaddr), rather than one which is
+// booting or selecting an offer
+func renewal(ciaddr net.IP) bool {
+	return ciaddr != nil && !ciaddr.Equal(net.IPv4zero)
+}
+
+// checkLease checks the last lease of the machine for the requested ip. A
+// revoked lease isn't honored, unless the client is selecting a new offer
+// (it names the server), and a renewal isn't honored if the lease has
+// expired longer than the lease grace ago. The requests are honored if the
+// lease or the grace can't be read, so a datasource outage doesn't take the
+// ips of the running machines.
+func (h *Handler) checkLease(machineInterface datasource.MachineInterface, ip net.IP,
+	renewing, selecting bool, now time.Time) error {
+	lease, err := machineInterface.Lease()
+	if err != nil {
+		metrics.Inc(metricDatasourceErrors)
+		h.warn(machineInterface.Mac(), err, "failed to get the lease, the request is honored")
+		return nil
+	}
+	if lease == nil || !lease.IP.Equal(ip) {
+		return nil
+	}
+	if lease.Revoked && !selecting {
+		return fmt.Errorf("the lease of %s is revoked", ip)
+	}
+	if !renewing {
+		return nil
+	}
+
+	graceStr, err := machineInterface.GetVariable(datasource.SpecialKeyLeaseGrace)
+	if err != nil {
+		metrics.Inc(metricDatasourceErrors)
+		h.warn(machineInterface.Mac(), err, "failed to get the lease grace, the renewal is honored")
+		return nil
+	}
+	grace, err := datasource.ParseLeaseGrace(graceStr)
+	if err != nil {
+		h.warn(machineInterface.Mac(), fmt.Errorf("failed to parse lease-grace=%q: %s", graceStr, err),
+			"invalid lease grace, the renewal is honored")
+		return nil
+	}
+
+	if expiry := time.Unix(lease.Expiry, 0); now.After(expiry.Add(grace)) {
+		return fmt.Errorf("the lease of %s has expired %s ago, after the grace of %s",
+			ip, now.Sub(expiry), grace)
+	}
+	return nil
+}
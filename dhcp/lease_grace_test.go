@@ -0,0 +1,87 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/krolaw/dhcp4"
+)
+
+func TestLeaseGrace(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:0c")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	machineInterface := ds.MachineInterface(mac)
+	machine, err := machineInterface.Machine(true, nil)
+	if err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+	ip := machine.IP.To4()
+
+	tests := []struct {
+		expiredAgo time.Duration
+		grace      string
+		renewing   bool
+		revoked    bool
+		selecting  bool
+		expected   dhcp4.MessageType
+	}{
+		{-time.Hour, "", true, false, false, dhcp4.ACK},
+		{5 * time.Minute, "", true, false, false, dhcp4.ACK},
+		{time.Hour, "", true, false, false, dhcp4.NAK},
+		{time.Hour, "2h", true, false, false, dhcp4.ACK},
+		{time.Minute, "0s", true, false, false, dhcp4.NAK},
+		// a booting client which requests its old address isn't renewing
+		{time.Hour, "", false, false, false, dhcp4.ACK},
+		// a revoked lease isn't honored, even in the grace, but the client
+		// which selects a new offer gets it
+		{0, "", true, true, false, dhcp4.NAK},
+		{0, "", false, true, false, dhcp4.NAK},
+		{0, "", false, true, true, dhcp4.ACK},
+	}
+	for i, test := range tests {
+		if err := ds.SetClusterVariable(datasource.SpecialKeyLeaseGrace, test.grace); err != nil {
+			t.Errorf("#%d: error while setting the lease grace: %s", i, err)
+			continue
+		}
+		lease := datasource.Lease{IP: ip, Expiry: time.Now().Add(-test.expiredAgo).Unix(), Revoked: test.revoked}
+		if err := machineInterface.StoreLease(lease); err != nil {
+			t.Errorf("#%d: error while storing the lease: %s", i, err)
+			continue
+		}
+
+		var p dhcp4.Packet
+		if test.renewing {
+			p = dhcp4.RequestPacket(dhcp4.Request, mac, ip, []byte{4, 9, 0, byte(i)}, false, nil)
+		} else {
+			options := []dhcp4.Option{{Code: dhcp4.OptionRequestedIPAddress, Value: ip}}
+			if test.selecting {
+				options = append(options, dhcp4.Option{
+					Code: dhcp4.OptionServerIdentifier, Value: h.serverIP.To4()})
+			}
+			p = dhcp4.RequestPacket(dhcp4.Request, mac, nil, []byte{4, 9, 0, byte(i)}, false, options)
+		}
+		reply := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+		if reply == nil {
+			t.Errorf("#%d: expected a reply for the Request", i)
+			continue
+		}
+		if msgType := reply.ParseOptions()[dhcp4.OptionDHCPMessageType]; len(msgType) != 1 ||
+			dhcp4.MessageType(msgType[0]) != test.expected {
+			t.Errorf("#%d: expected %v, got %v", i, test.expected, msgType)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package dhcp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/metrics"
+)
+
+// listenerState is what StartDHCP has done with the listener of a handler
+type listenerState struct {
+	mu        sync.Mutex
+	startedAt time.Time
+	stopped   bool
+	err       error
+}
+
+// ListenerStatus reports whether the dhcp listener of a handler is serving.
+// StartDHCP marks the listener as started only after its socket is bound, so
+// a listener which is started and hasn't stopped is bound.
+type ListenerStatus struct {
+	Listening bool   `json:"listening"`
+	Interface string `json:"interface"`
+	ServerIP  net.IP `json:"serverIP"`
+	// StartedAt is the unix time at which the socket of the listener is
+	// bound, 0 if it's not bound yet
+	StartedAt int64  `json:"startedAt,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// PacketsReceived is the number of the packets which are received since
+	// the start of the process, and LastPacket is the unix time of the last
+	// one. They're read from the metrics registry.
+	PacketsReceived uint64 `json:"packetsReceived"`
+	LastPacket      int64  `json:"lastPacket,omitempty"`
+}
+
+// countPacket counts a received packet for the listener status
+func (h *Handler) countPacket(now time.Time) {
+	metrics.Inc(metricPacketsReceived)
+	metrics.Set(metricLastPacket, now.Unix())
+}
+
+func (h *Handler) listenerStarted(now time.Time) {
+	h.listener.mu.Lock()
+	defer h.listener.mu.Unlock()
+	h.listener.startedAt, h.listener.stopped, h.listener.err = now, false, nil
+}
+
+func (h *Handler) listenerStopped(err error) {
+	h.listener.mu.Lock()
+	defer h.listener.mu.Unlock()
+	h.listener.stopped, h.listener.err = true, err
+}
+
+// ListenerStatus returns the status of the dhcp listener of the handler
+func (h *Handler) ListenerStatus() ListenerStatus {
+	h.listener.mu.Lock()
+	defer h.listener.mu.Unlock()
+
+	status := ListenerStatus{
+		Listening:       !h.listener.startedAt.IsZero() && !h.listener.stopped,
+		Interface:       h.ifName,
+		ServerIP:        h.serverIP,
+		PacketsReceived: metrics.Default.Counter(metricPacketsReceived),
+		LastPacket:      metrics.Default.Gauge(metricLastPacket),
+	}
+	if !h.listener.startedAt.IsZero() {
+		status.StartedAt = h.listener.startedAt.Unix()
+	}
+	if h.listener.err != nil {
+		status.Error = h.listener.err.Error()
+	}
+	return status
+}
@@ -0,0 +1,61 @@
+package dhcp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+func TestListenerStatus(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:02")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	before := h.ListenerStatus()
+	if before.Listening || before.StartedAt != 0 {
+		t.Errorf("unexpected status before the start: %+v", before)
+	}
+
+	now := time.Now()
+	h.listenerStarted(now)
+	p, options := discoverForTest(mac, nil)
+	h.ServeDHCP(p, dhcp4.Discover, options)
+	h.ServeDHCP(p, dhcp4.Discover, options)
+
+	status := h.ListenerStatus()
+	if !status.Listening || status.StartedAt != now.Unix() || status.Error != "" {
+		t.Errorf("expected a listening status, got %+v", status)
+	}
+	if status.PacketsReceived-before.PacketsReceived != 2 || status.LastPacket < now.Unix() {
+		t.Errorf("expected 2 received packets, got %+v", status)
+	}
+	if !status.ServerIP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("unexpected server ip: %s", status.ServerIP)
+	}
+
+	h.listenerStopped(errors.New("address already in use"))
+	if status := h.ListenerStatus(); status.Listening || status.Error != "address already in use" {
+		t.Errorf("expected a stopped listener, got %+v", status)
+	}
+
+	// a listener which fails before it's bound is never started
+	unbound := &Handler{ifName: "no-such-if0", serverIP: net.IPv4(127, 0, 0, 1), datasource: ds}
+	if err := StartDHCP(unbound); err == nil {
+		t.Error("expected an error for a missing interface")
+	}
+	if status := unbound.ListenerStatus(); status.Listening || status.StartedAt != 0 || status.Error == "" {
+		t.Errorf("expected a listener which isn't started, got %+v", status)
+	}
+}
@@ -0,0 +1,88 @@
+package dhcp
+
+import (
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cafebazaar/blacksmith/metrics"
+	"github.com/krolaw/dhcp4"
+)
+
+// logThrottleBurst is the number of the identical warnings which are logged
+// in each window before the rest are suppressed
+const logThrottleBurst = 3
+
+// newLogThrottle returns the limiter of the identical warnings, which is nil
+// (limits nothing) if window is not positive. The number of the suppressed
+// warnings is logged once their window is over, see windowLimiter.expireEvery.
+func newLogThrottle(window time.Duration) *windowLimiter {
+	t := newWindowLimiter(logThrottleBurst, window)
+	if t != nil {
+		t.dropped = logSuppressed
+	}
+	return t
+}
+
+// logSuppressed logs the number of the identical warnings which are
+// suppressed in a window
+func logSuppressed(key limiterKey, suppressed int) {
+	log.WithFields(log.Fields{
+		"where":      "dhcp.ServeDHCP",
+		"object":     key.mac,
+		"suppressed": suppressed,
+	}).Warnf("%d more of %q are suppressed", suppressed, key.msg)
+}
+
+// warn logs a warning of the dhcp handling of the machine, unless the same
+// warning has been logged too many times in the current window. It's kept
+// in the recent errors either way.
+func (h *Handler) warn(mac net.HardwareAddr, err error, msg string) {
+	now := time.Now()
+	h.recordError(mac, err, msg, now)
+	allowed, suppressed := h.logThrottle.allow(limiterKey{mac: mac.String(), msg: msg}, now)
+	if !allowed {
+		return
+	}
+	entry := log.WithFields(log.Fields{
+		"where":  "dhcp.ServeDHCP",
+		"object": mac.String(),
+	}).WithError(err)
+	if suppressed > 0 {
+		entry = entry.WithField("suppressed", suppressed)
+	}
+	entry.Warn(msg)
+}
+
+// checkForeignServer warns about a message which is sent to a dhcp server
+// other than the blacksmith instances, which may be a rogue one. The
+// warnings are throttled by the foreign server.
+func (h *Handler) checkForeignServer(p dhcp4.Packet, msgType dhcp4.MessageType, server net.IP) {
+	instances, err := h.instanceInfos()
+	if err != nil {
+		h.warn(p.CHAddr(), err, "failed to get instances")
+		return
+	}
+	for _, instanceInfo := range instances {
+		if instanceInfo.IP.Equal(server) {
+			return // the client has chosen another instance
+		}
+	}
+
+	metrics.Inc(metricForeignServers)
+	key := limiterKey{mac: server.String(), msg: "foreign server identifier"}
+	allowed, suppressed := h.logThrottle.allow(key, time.Now())
+	if !allowed {
+		return
+	}
+	entry := log.WithFields(log.Fields{
+		"where":   "dhcp.ServeDHCP",
+		"object":  p.CHAddr().String(),
+		"subject": msgType,
+		"server":  server.String(),
+	})
+	if suppressed > 0 {
+		entry = entry.WithField("suppressed", suppressed)
+	}
+	entry.Warn("message for a foreign dhcp server, which may be a rogue one")
+}
@@ -0,0 +1,150 @@
+package dhcp
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/metrics"
+)
+
+const (
+	machineCacheSize = 1024
+	machineCacheTTL  = 5 * time.Second
+
+	metricMachineCacheHits = "dhcp_machine_cache_hits"
+)
+
+type machineCacheEntry struct {
+	mac     string
+	machine datasource.Machine
+	at      time.Time
+}
+
+// machineCache is a bounded LRU of the machines by their macs, which spares
+// the datasource the lookups of the retrying clients, e.g. in the boot
+// storms. The entries are short-lived and are invalidated by the changes
+// which are made through the web api. It's safe for concurrent use, and a
+// nil *machineCache caches nothing.
+type machineCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // of *machineCacheEntry, the most recent at front
+	entries map[string]*list.Element
+}
+
+func newMachineCache(size int, ttl time.Duration) *machineCache {
+	return &machineCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the machine which is cached for mac in the last ttl
+func (c *machineCache) get(mac string, now time.Time) (datasource.Machine, bool) {
+	if c == nil {
+		return datasource.Machine{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[mac]
+	if !found {
+		return datasource.Machine{}, false
+	}
+	entry := elem.Value.(*machineCacheEntry)
+	if now.Sub(entry.at) > c.ttl {
+		c.order.Remove(elem)
+		delete(c.entries, mac)
+		return datasource.Machine{}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.machine, true
+}
+
+// put caches machine for mac, evicting the least recently used entries if
+// the cache is full
+func (c *machineCache) put(mac string, machine datasource.Machine, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[mac]; found {
+		entry := elem.Value.(*machineCacheEntry)
+		entry.machine, entry.at = machine, now
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[mac] = c.order.PushFront(&machineCacheEntry{mac: mac, machine: machine, at: now})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*machineCacheEntry).mac)
+	}
+}
+
+// remove drops the machine of mac, or all the machines if mac is empty
+func (c *machineCache) remove(mac string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if mac == "" {
+		c.order.Init()
+		c.entries = make(map[string]*list.Element)
+		return
+	}
+	if elem, found := c.entries[mac]; found {
+		c.order.Remove(elem)
+		delete(c.entries, mac)
+	}
+}
+
+// machine returns the machine of machineInterface, through the cache. The
+// machine is created if it's not known yet, unless the ipam webhook is set,
+// which is asked for its ip in the background (see ipamMachine).
+func (h *Handler) machine(machineInterface datasource.MachineInterface) (datasource.Machine, error) {
+	now := time.Now()
+	mac := machineInterface.Mac().String()
+	if machine, found := h.machines.get(mac, now); found {
+		metrics.Inc(metricMachineCacheHits)
+		return machine, nil
+	}
+	var machine datasource.Machine
+	var err error
+	if h.options.IPAMWebhook == "" {
+		machine, err = machineInterface.Machine(true, nil)
+	} else {
+		machine, err = h.ipamMachine(machineInterface)
+	}
+	if err != nil {
+		return machine, err
+	}
+	h.machines.put(mac, machine, now)
+	return machine, nil
+}
+
+// InvalidateMachine drops the cached record of the machine, so the next
+// reply reads it from the datasource again. It's called after the machine
+// or its variables are changed.
+func (h *Handler) InvalidateMachine(mac net.HardwareAddr) {
+	if len(mac) != 0 {
+		h.machines.remove(mac.String())
+	}
+}
+
+// InvalidateMachines drops the cached records of all the machines, e.g.
+// after the cluster variables are changed
+func (h *Handler) InvalidateMachines() {
+	h.machines.remove("")
+}
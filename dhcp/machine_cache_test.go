@@ -0,0 +1,130 @@
+package dhcp
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/metrics"
+	"github.com/krolaw/dhcp4"
+)
+
+func TestMachineCache(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	machine := func(i byte) datasource.Machine {
+		return datasource.Machine{IP: net.IPv4(10, 0, 0, i).To4()}
+	}
+
+	c := newMachineCache(2, time.Second)
+	c.put("a", machine(1), now)
+	c.put("b", machine(2), now)
+
+	if m, found := c.get("a", now); !found || !m.IP.Equal(machine(1).IP) {
+		t.Error("expected the cached machine of a, got", m, found)
+	}
+
+	// b is the least recently used one now
+	c.put("c", machine(3), now)
+	if _, found := c.get("b", now); found {
+		t.Error("expected b to be evicted")
+	}
+	if _, found := c.get("c", now.Add(2*time.Second)); found {
+		t.Error("expected c to be expired")
+	}
+
+	c.remove("a")
+	if _, found := c.get("a", now); found {
+		t.Error("expected a to be removed")
+	}
+	c.put("a", machine(1), now)
+	c.put("b", machine(2), now)
+	c.remove("")
+	if _, found := c.get("b", now); found || c.order.Len() != 0 {
+		t.Error("expected all the machines to be removed")
+	}
+
+	var nilCache *machineCache
+	nilCache.put("a", machine(1), now)
+	nilCache.remove("a")
+	if _, found := nilCache.get("a", now); found {
+		t.Error("expected a nil cache to cache nothing")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i byte) {
+			defer wg.Done()
+			for j := byte(0); j < 100; j++ {
+				key := string([]byte{i, j})
+				c.put(key, machine(j), now)
+				c.get(string([]byte{j % 8, j}), now)
+				if j%10 == 0 {
+					c.remove(key)
+				}
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+	if c.order.Len() > 2 || len(c.entries) != c.order.Len() {
+		t.Errorf("unexpected size after the concurrent use: %d entries, %d in order",
+			len(c.entries), c.order.Len())
+	}
+}
+
+func TestMachineCacheHits(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:01")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	h.machines = newMachineCache(machineCacheSize, time.Minute)
+
+	hits := func() uint64 {
+		return metrics.Default.Snapshot().Counters[metricMachineCacheHits]
+	}
+	discover := func(xid byte) dhcp4.Packet {
+		p := dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{1, 2, 3, xid}, false, nil)
+		return h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	}
+
+	before := hits()
+	first := discover(1)
+	if first == nil {
+		t.Error("expected a reply for the first Discover")
+		return
+	}
+	if delta := hits() - before; delta != 0 {
+		t.Errorf("expected no cache hit for the first Discover, got %d", delta)
+	}
+
+	second := discover(2)
+	if second == nil || !net.IP(second.YIAddr()).Equal(net.IP(first.YIAddr())) {
+		t.Error("expected the same offer for the second Discover, got", second)
+	}
+	if delta := hits() - before; delta != 1 {
+		t.Errorf("expected a cache hit for the second Discover, got %d", delta)
+	}
+
+	h.InvalidateMachine(mac)
+	if discover(3) == nil {
+		t.Error("expected a reply for the third Discover")
+	}
+	if delta := hits() - before; delta != 1 {
+		t.Errorf("expected a cache miss after the invalidation, got %d hits", delta)
+	}
+
+	h.InvalidateMachines()
+	if _, found := h.machines.get(mac.String(), time.Now()); found {
+		t.Error("expected no cached machine after invalidating all the machines")
+	}
+}
@@ -0,0 +1,51 @@
+package dhcp
+
+import (
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cafebazaar/blacksmith/metrics"
+	"github.com/krolaw/dhcp4"
+)
+
+// metricNAKsSuppressed is the name of the counter of the NAKs which are not
+// sent because of HandlerOptions.NAKLimit
+const metricNAKsSuppressed = "dhcp_naks_suppressed"
+
+// newNAKLimiter returns the limiter of the NAKs to each machine, which is nil
+// (limits nothing) if limit or window is not positive
+func newNAKLimiter(limit int, window time.Duration) *windowLimiter {
+	return newWindowLimiter(limit, window)
+}
+
+// limitNAK returns nil instead of the reply if it's a NAK to a machine which
+// has reached the nak limit in the current window, and the reply otherwise
+func (h *Handler) limitNAK(machineMac net.HardwareAddr, reply dhcp4.Packet) dhcp4.Packet {
+	if reply == nil {
+		return nil
+	}
+	msgType := reply.ParseOptions()[dhcp4.OptionDHCPMessageType]
+	if len(msgType) != 1 || dhcp4.MessageType(msgType[0]) != dhcp4.NAK {
+		return reply
+	}
+
+	mac := machineMac.String()
+	if allowed, _ := h.naks.allow(limiterKey{mac: mac}, time.Now()); allowed {
+		return reply
+	}
+
+	metrics.Inc(metricNAKsSuppressed)
+	key := limiterKey{mac: mac, msg: "nak suppressed"}
+	if allowed, suppressed := h.logThrottle.allow(key, time.Now()); allowed {
+		entry := log.WithFields(log.Fields{
+			"where":  "dhcp.ServeDHCP",
+			"object": mac,
+		})
+		if suppressed > 0 {
+			entry = entry.WithField("suppressed", suppressed)
+		}
+		entry.Warnf("more than %d naks in %s, not sending the nak", h.naks.limit, h.naks.window)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package dhcp
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/krolaw/dhcp4"
+)
+
+// Names of the preflight checks, in the order they're run
+const (
+	PreflightRecord               = "record"
+	PreflightNetworkConfiguration = "network-configuration"
+	PreflightIP                   = "ip"
+	PreflightBootfile             = "bootfile"
+)
+
+// PreflightCheck is the result of one of the checks of Preflight. Reason
+// explains why the check has failed.
+type PreflightCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// PreflightReport is the result of all the checks of Preflight. Ready is set
+// only if all the checks have passed.
+type PreflightReport struct {
+	Ready  bool             `json:"ready"`
+	Checks []PreflightCheck `json:"checks"`
+}
+
+func (r *PreflightReport) add(name string, err error) bool {
+	check := PreflightCheck{Name: name, Passed: err == nil}
+	if err != nil {
+		check.Reason = err.Error()
+	}
+	r.Checks = append(r.Checks, check)
+	return check.Passed
+}
+
+// Preflight checks whether the machine is ready to boot: it has a record, a
+// valid network configuration and an assigned ip, and it receives the boot
+// options as a pxe client. The checks which depend on a failed one are
+// failed too. It has no side effect, the same as Simulate.
+func (h *Handler) Preflight(mac net.HardwareAddr) (*PreflightReport, error) {
+	report := &PreflightReport{}
+	machineInterface := h.datasource.MachineInterface(mac)
+
+	known, err := machineInterface.Known()
+	if err != nil {
+		return nil, err
+	}
+	var recordErr error
+	if !known {
+		recordErr = fmt.Errorf("no record for the machine")
+	}
+	if !report.add(PreflightRecord, recordErr) {
+		report.add(PreflightNetworkConfiguration, fmt.Errorf("the machine has no record"))
+		report.add(PreflightIP, fmt.Errorf("the machine has no record"))
+		report.add(PreflightBootfile, fmt.Errorf("the machine has no record"))
+		return report, nil
+	}
+
+	machine, err := machineInterface.Machine(false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	netConfOK := report.add(PreflightNetworkConfiguration, checkNetworkConfiguration(machineInterface, machine))
+
+	var ipErr error
+	if machine.IP.To4() == nil {
+		ipErr = fmt.Errorf("no ipv4 address is assigned")
+	}
+	ipOK := report.add(PreflightIP, ipErr)
+
+	if !netConfOK || !ipOK {
+		report.add(PreflightBootfile, fmt.Errorf("the network configuration or the ip is not valid"))
+		return report, nil
+	}
+	report.add(PreflightBootfile, h.checkBootfile(mac))
+
+	report.Ready = true
+	for _, check := range report.Checks {
+		report.Ready = report.Ready && check.Passed
+	}
+	return report, nil
+}
+
+// checkNetworkConfiguration checks that the network configuration of the
+// machine (or the one of the cluster) is set, and fits its ip
+func checkNetworkConfiguration(machineInterface datasource.MachineInterface,
+	machine datasource.Machine) error {
+	netConfStr, err := machineInterface.GetVariable(datasource.SpecialKeyNetworkConfiguration)
+	if err != nil {
+		return fmt.Errorf("failed to get network configuration: %s", err)
+	}
+	if netConfStr == "" {
+		return fmt.Errorf("no network configuration is set")
+	}
+	netConf, err := datasource.UnmarshalNetworkConfiguration(netConfStr)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal network-configuration=%q: %s", netConfStr, err)
+	}
+	if netConf.Netmask == nil {
+		return fmt.Errorf("no netmask in the network configuration")
+	}
+	if machine.IP == nil {
+		return nil
+	}
+	if _, err := netConf.Subnet(machine.IP); err != nil {
+		return err
+	}
+	return netConf.CheckSubnet(machine.IP)
+}
+
+// checkBootfile simulates the discover of a pxe client, and checks that the
+// reply points it to the boot server
+func (h *Handler) checkBootfile(mac net.HardwareAddr) error {
+	if h.Draining() {
+		return fmt.Errorf("the instance is draining, and new clients are not answered")
+	}
+	// the guid type, followed by an all zero guid
+	options := []dhcp4.Option{{Code: 97, Value: make([]byte, 17)}}
+	simulation, err := h.Simulate(mac, dhcp4.Discover, options)
+	if err != nil {
+		return fmt.Errorf("failed to simulate the discover: %s", err)
+	}
+	for _, option := range simulation.Options {
+		if option.Code == dhcp4.OptionVendorSpecificInformation {
+			return nil
+		}
+	}
+
+	maintenance, err := h.datasource.Maintenance()
+	if err == nil && maintenance {
+		return fmt.Errorf("the pxe options are left out in the maintenance mode")
+	}
+	cooldown, err := inReprovisionCooldown(h.datasource.MachineInterface(mac), time.Now())
+	if err == nil && cooldown {
+		return fmt.Errorf("the pxe options are left out in the reprovision cooldown of the machine")
+	}
+	return fmt.Errorf("the pxe options are missing from the reply")
+}
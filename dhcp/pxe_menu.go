@@ -0,0 +1,89 @@
+package dhcp
+
+import (
+	"fmt"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/krolaw/dhcp4"
+)
+
+const (
+	// pxeSubOptionBootItem is the sub-option of the pxe vendor options
+	// (option 43) in which the clients request the boot item of the menu
+	// entry which is selected, as its type (2 bytes) and layer (2 bytes)
+	pxeSubOptionBootItem = 71
+	// pxeBootItemDefault is the boot item type of the default menu entry,
+	// which boots blacksmith. The extra entries of the pxe menu follow it.
+	pxeBootItemDefault uint16 = 0x8000
+	// maxPXEVendorOptionsLength is the longest option 43
+	maxPXEVendorOptionsLength = 255
+)
+
+// pxeSubOptions parses the sub-options of the pxe vendor options (option 43)
+// of a request. The parsing stops at the end sub-option (255), or at the
+// first truncated one.
+func pxeSubOptions(value []byte) map[byte][]byte {
+	subOptions := make(map[byte][]byte)
+	for len(value) > 0 {
+		code := value[0]
+		if code == 255 {
+			break
+		}
+		if code == 0 { // pad
+			value = value[1:]
+			continue
+		}
+		if len(value) < 2 || len(value) < 2+int(value[1]) {
+			break
+		}
+		subOptions[code] = value[2 : 2+int(value[1])]
+		value = value[2+int(value[1]):]
+	}
+	return subOptions
+}
+
+// checkPXEVendorOptions checks that the sub-options of the pxe vendor options
+// are well-formed, and the end sub-option (255) is the last byte
+func checkPXEVendorOptions(value []byte) error {
+	for i := 0; i < len(value); {
+		switch value[i] {
+		case 255:
+			if i != len(value)-1 {
+				return fmt.Errorf("%d bytes follow the end of the pxe vendor options", len(value)-1-i)
+			}
+			return nil
+		case 0:
+			i++
+		default:
+			if i+1 >= len(value) || i+2+int(value[i+1]) > len(value) {
+				return fmt.Errorf("pxe sub-option %d overflows the pxe vendor options", value[i])
+			}
+			i += 2 + int(value[i+1])
+		}
+	}
+	return fmt.Errorf("no end in the pxe vendor options")
+}
+
+// selectBootItem returns the boot item which the request has selected, if
+// it's one of the menu, and the selected entry of the menu, which is nil for
+// the default entry
+func selectBootItem(options dhcp4.Options,
+	menu []datasource.PXEMenuEntry) ([]byte, *datasource.PXEMenuEntry) {
+	vendorOptions, isIn := options[dhcp4.OptionVendorSpecificInformation]
+	if !isIn {
+		return nil, nil
+	}
+	bootItem := pxeSubOptions(vendorOptions)[pxeSubOptionBootItem]
+	if len(bootItem) != 4 {
+		return nil, nil
+	}
+
+	itemType := uint16(bootItem[0])<<8 | uint16(bootItem[1])
+	if itemType < pxeBootItemDefault || int(itemType-pxeBootItemDefault) > len(menu) {
+		return nil, nil
+	}
+	if itemType == pxeBootItemDefault {
+		return bootItem, nil
+	}
+	return bootItem, &menu[itemType-pxeBootItemDefault-1]
+}
@@ -0,0 +1,115 @@
+package dhcp
+
+import (
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/metrics"
+	"github.com/krolaw/dhcp4"
+)
+
+// quarantineLeaseDuration is short, so the approved machines leave the
+// quarantine subnet soon
+const quarantineLeaseDuration = 5 * time.Minute
+
+// quarantineSubnet returns the quarantine subnet of the machine, if it's
+// unknown and the quarantine is enabled
+func (h *Handler) quarantineSubnet(machineInterface datasource.MachineInterface) (*datasource.QuarantineSubnet, error) {
+	subnetStr, err := machineInterface.GetVariable(datasource.SpecialKeyQuarantineSubnet)
+	if err != nil {
+		return nil, err
+	}
+	subnet, err := datasource.UnmarshalQuarantineSubnet(subnetStr)
+	if err != nil || subnet == nil {
+		return nil, err
+	}
+
+	known, err := machineInterface.Known()
+	if err != nil || known {
+		return nil, err
+	}
+	return subnet, nil
+}
+
+// serveQuarantine replies an unknown machine with an address in the
+// quarantine subnet, along with only the netmask and the dns servers of the
+// subnet. The machine isn't network booted until it's approved, and the
+// rejected machines are not answered at all.
+func (h *Handler) serveQuarantine(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options,
+	mac net.HardwareAddr, subnet *datasource.QuarantineSubnet) dhcp4.Packet {
+	serverIP := h.serverIP.To4()
+	if serverIP == nil {
+		return nil
+	}
+
+	decision, err := h.datasource.QuarantineDecision(mac)
+	if err != nil {
+		metrics.Inc(metricDatasourceErrors)
+		h.warn(mac, err, "failed to get the quarantine decision")
+		return nil
+	}
+	if decision != nil && decision.Decision == datasource.QuarantineRejected {
+		log.WithFields(log.Fields{
+			"where":   "dhcp.serveQuarantine",
+			"object":  mac.String(),
+			"subject": msgType,
+		}).Debug("rejected machine, not answering")
+		return nil
+	}
+
+	ip, err := h.datasource.QuarantineLease(mac, subnet)
+	if err != nil {
+		metrics.Inc(metricDatasourceErrors)
+		h.warn(mac, err, "failed to get the quarantine lease")
+		return nil
+	}
+
+	responseMsgType := dhcp4.Offer
+	if msgType == dhcp4.Request {
+		if requested := requestedIP(p, options); !requested.Equal(ip) {
+			log.WithFields(log.Fields{
+				"where":   "dhcp.serveQuarantine",
+				"object":  mac.String(),
+				"subject": msgType,
+			}).Debugf("requestedIP(%s) != quarantineIp(%s)", requested, ip)
+			return nil
+		}
+		responseMsgType = dhcp4.ACK
+	}
+
+	log.WithFields(log.Fields{
+		"where":   "dhcp.serveQuarantine",
+		"action":  "quarantine",
+		"object":  mac.String(),
+		"subject": msgType,
+	}).Infof("unknown machine, quarantineIp=%s", ip)
+
+	dhcpOptions := dhcp4.Options{
+		dhcp4.OptionSubnetMask: subnet.Netmask.To4(),
+	}
+	if len(subnet.DNS) != 0 {
+		var dns []byte
+		for _, server := range subnet.DNS {
+			dns = append(dns, server.To4()...)
+		}
+		dhcpOptions[dhcp4.OptionDomainNameServer] = dns
+	}
+
+	return dhcp4.ReplyPacket(p, responseMsgType, serverIP, ip, quarantineLeaseDuration,
+		dhcpOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
+}
+
+// requestedIP returns the address which is requested in a Request, either
+// through option 50 or as ciaddr, or nil if it's malformed
+func requestedIP(p dhcp4.Packet, options dhcp4.Options) net.IP {
+	requested := net.IP(options[dhcp4.OptionRequestedIPAddress])
+	if requested == nil {
+		requested = net.IP(p.CIAddr())
+	}
+	if len(requested) != 4 || requested.Equal(net.IPv4zero) {
+		return nil
+	}
+	return requested
+}
@@ -0,0 +1,89 @@
+package dhcp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// recentErrorsSize is the number of the recent errors which are kept
+const recentErrorsSize = 128
+
+// RecentError is a dhcp request which has failed, or has been dropped
+// because of an error. Reason is what has failed, e.g. "failed to get
+// machine", and Error is the error itself.
+type RecentError struct {
+	Time   int64  `json:"time"`
+	Mac    string `json:"mac"`
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
+// recentErrors is a ring of the last errors of the handler, which is kept
+// for the operators without access to the logs. It's safe for concurrent
+// use, and a nil *recentErrors keeps nothing.
+type recentErrors struct {
+	mu      sync.Mutex
+	entries []RecentError
+	next    int // the index of the next entry, once the ring is full
+}
+
+func newRecentErrors(size int) *recentErrors {
+	return &recentErrors{entries: make([]RecentError, 0, size)}
+}
+
+func (r *recentErrors) add(e RecentError) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+}
+
+// list returns a copy of the errors, the oldest first
+func (r *recentErrors) list() []RecentError {
+	res := []RecentError{}
+	if r == nil {
+		return res
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res = append(res, r.entries[r.next:]...)
+	return append(res, r.entries[:r.next]...)
+}
+
+func (r *recentErrors) clear() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries, r.next = r.entries[:0], 0
+}
+
+// recordError adds the failure of a request to the recent errors
+func (h *Handler) recordError(mac net.HardwareAddr, err error, reason string, now time.Time) {
+	e := RecentError{Time: now.Unix(), Mac: mac.String(), Reason: reason}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	h.recentErrors.add(e)
+}
+
+// RecentErrors returns the last errors of the dhcp requests, the oldest first
+func (h *Handler) RecentErrors() []RecentError {
+	return h.recentErrors.list()
+}
+
+// ClearRecentErrors forgets the recent errors, e.g. after they're fixed
+func (h *Handler) ClearRecentErrors() {
+	h.recentErrors.clear()
+}
@@ -0,0 +1,118 @@
+package dhcp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/krolaw/dhcp4"
+)
+
+func TestRecentErrors(t *testing.T) {
+	r := newRecentErrors(3)
+	for i := 0; i < 5; i++ {
+		r.add(RecentError{Time: int64(i)})
+	}
+	list := r.list()
+	if len(list) != 3 || list[0].Time != 2 || list[2].Time != 4 {
+		t.Errorf("expected the last 3 errors, the oldest first, got %+v", list)
+	}
+
+	list[0].Time = 100
+	if r.list()[0].Time != 2 {
+		t.Error("expected the list to be a copy")
+	}
+
+	r.clear()
+	if list := r.list(); len(list) != 0 {
+		t.Error("expected no error after clearing, got", list)
+	}
+	r.add(RecentError{Time: 5})
+	if list := r.list(); len(list) != 1 || list[0].Time != 5 {
+		t.Error("expected the error which is added after clearing, got", list)
+	}
+
+	var nilErrors *recentErrors
+	nilErrors.add(RecentError{})
+	nilErrors.clear()
+	if list := nilErrors.list(); len(list) != 0 {
+		t.Error("expected nil recent errors to keep nothing, got", list)
+	}
+}
+
+func TestRecentErrorsOfServeDHCP(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:09")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	h.recentErrors = newRecentErrors(recentErrorsSize)
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyNetworkConfiguration, `{"netmask": "255.255.255.0"}`); err != nil {
+		t.Error("error while setting the network configuration:", err)
+		return
+	}
+	h.recordError(mac, errors.New("earlier"), "earlier error", time.Now())
+	h.serverIP = net.ParseIP("fe80::1")
+
+	p, options := discoverForTest(mac, nil)
+	if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply != nil {
+		t.Error("expected no reply with an ipv6 server ip")
+	}
+
+	list := h.RecentErrors()
+	if len(list) != 2 || list[1].Mac != mac.String() || list[1].Reason != "failed to build the reply" ||
+		list[1].Error == "" || list[1].Time == 0 {
+		t.Errorf("expected the failure of the reply in the recent errors, got %+v", list)
+	}
+	h.ClearRecentErrors()
+	if list := h.RecentErrors(); len(list) != 0 {
+		t.Error("expected no error after clearing, got", list)
+	}
+}
+
+func TestRecentErrorsOfQuarantine(t *testing.T) {
+	first, _ := net.ParseMAC("00:11:22:33:47:1b")
+	second, _ := net.ParseMAC("00:11:22:33:47:1c")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	h.recentErrors = newRecentErrors(recentErrorsSize)
+
+	err = ds.SetClusterVariable(datasource.SpecialKeyQuarantineSubnet,
+		`{"start": "10.99.1.10", "range": 1, "netmask": "255.255.255.0"}`)
+	if err != nil {
+		t.Error("error while setting the quarantine subnet:", err)
+		return
+	}
+
+	// the single quarantine address is taken by the first machine
+	for i, mac := range []net.HardwareAddr{first, second} {
+		p, options := discoverForTest(mac, nil)
+		if reply := h.ServeDHCP(p, dhcp4.Discover, options); (reply != nil) != (i == 0) {
+			t.Errorf("#%d: unexpected reply: %v", i, reply != nil)
+		}
+	}
+
+	list := h.RecentErrors()
+	if len(list) != 1 || list[0].Mac != second.String() || list[0].Reason != "failed to get the quarantine lease" {
+		t.Errorf("expected the failure of the quarantine lease in the recent errors, got %+v", list)
+	}
+}
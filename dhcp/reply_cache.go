@@ -0,0 +1,104 @@
+package dhcp
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+const (
+	replyCacheSize   = 1024
+	replyCacheWindow = 3 * time.Second
+)
+
+// replyCacheKey identifies the retransmissions of a dhcp message. Discover and
+// Request of a transaction share the xid, so the type is a part of the key.
+type replyCacheKey struct {
+	mac     string
+	xid     string
+	msgType dhcp4.MessageType
+}
+
+type replyCacheEntry struct {
+	key   replyCacheKey
+	reply dhcp4.Packet
+	at    time.Time
+}
+
+// replyCache is a bounded LRU of the recent replies, which is used to answer
+// the retransmitted messages without processing them again. A nil reply is
+// cached too, so the dropped messages stay dropped. It's safe for concurrent
+// use, and a nil *replyCache caches nothing.
+type replyCache struct {
+	mu      sync.Mutex
+	size    int
+	window  time.Duration
+	order   *list.List // of *replyCacheEntry, the most recent at front
+	entries map[replyCacheKey]*list.Element
+}
+
+func newReplyCache(size int, window time.Duration) *replyCache {
+	return &replyCache{
+		size:    size,
+		window:  window,
+		order:   list.New(),
+		entries: make(map[replyCacheKey]*list.Element),
+	}
+}
+
+func replyCacheKeyFor(mac net.HardwareAddr, p dhcp4.Packet, msgType dhcp4.MessageType) replyCacheKey {
+	return replyCacheKey{
+		mac:     mac.String(),
+		xid:     string(p.XId()),
+		msgType: msgType,
+	}
+}
+
+// get returns the reply which is cached for key in the last window
+func (c *replyCache) get(key replyCacheKey, now time.Time) (dhcp4.Packet, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	entry := elem.Value.(*replyCacheEntry)
+	if now.Sub(entry.at) > c.window {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.reply, true
+}
+
+// put caches reply for key, evicting the least recently used entries if the
+// cache is full
+func (c *replyCache) put(key replyCacheKey, reply dhcp4.Packet, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		entry := elem.Value.(*replyCacheEntry)
+		entry.reply, entry.at = reply, now
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&replyCacheEntry{key: key, reply: reply, at: now})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*replyCacheEntry).key)
+	}
+}
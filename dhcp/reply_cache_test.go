@@ -0,0 +1,111 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/krolaw/dhcp4"
+)
+
+func TestReplyCache(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	key := func(i byte) replyCacheKey {
+		return replyCacheKey{mac: "00:11:22:33:44:55", xid: string([]byte{0, 0, 0, i}), msgType: dhcp4.Discover}
+	}
+
+	c := newReplyCache(2, time.Second)
+	c.put(key(1), dhcp4.Packet{1}, now)
+	c.put(key(2), nil, now)
+
+	if reply, found := c.get(key(1), now); !found || !bytes.Equal(reply, dhcp4.Packet{1}) {
+		t.Error("expected the cached reply for key 1, got", reply, found)
+	}
+	if reply, found := c.get(key(2), now); !found || reply != nil {
+		t.Error("expected the cached nil reply for key 2, got", reply, found)
+	}
+
+	// key 1 is the least recently used one now
+	c.put(key(3), dhcp4.Packet{3}, now)
+	if _, found := c.get(key(1), now); found {
+		t.Error("expected key 1 to be evicted")
+	}
+	if _, found := c.get(key(3), now); !found {
+		t.Error("expected key 3 to be cached")
+	}
+
+	if _, found := c.get(key(3), now.Add(2*time.Second)); found {
+		t.Error("expected key 3 to be expired")
+	}
+
+	var nilCache *replyCache
+	nilCache.put(key(1), dhcp4.Packet{1}, now)
+	if _, found := nilCache.get(key(1), now); found {
+		t.Error("expected a nil cache to cache nothing")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i byte) {
+			defer wg.Done()
+			for j := byte(0); j < 100; j++ {
+				c.put(key(i*100+j), dhcp4.Packet{j}, now)
+				c.get(key(j), now)
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+	if c.order.Len() > 2 || len(c.entries) > 2 {
+		t.Errorf("expected at most 2 entries, got %d, %d", c.order.Len(), len(c.entries))
+	}
+}
+
+func TestDuplicateXId(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:06")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	h.replies = newReplyCache(replyCacheSize, time.Minute)
+
+	requestList := []dhcp4.Option{{Code: dhcp4.OptionParameterRequestList, Value: []byte{1, 3, 6, 252}}}
+	p, options := discoverForTest(mac, requestList)
+	first := h.ServeDHCP(p, dhcp4.Discover, options)
+	if first == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	// a changed configuration is visible only for the new transactions
+	wpadURL := "http://proxy.example.com/wpad.dat"
+	if err := ds.SetClusterVariable(datasource.SpecialKeyWPADURL, wpadURL); err != nil {
+		t.Error("error while setting wpad url:", err)
+		return
+	}
+
+	retransmitted := h.ServeDHCP(p, dhcp4.Discover, options)
+	if !bytes.Equal(first, retransmitted) {
+		t.Error("expected the same reply for the retransmitted Discover")
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{1, 2, 3, 6}, false, requestList)
+	reply := h.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if reply == nil {
+		t.Error("expected a reply for the new Discover")
+		return
+	}
+	if got := string(reply.ParseOptions()[optionWPAD]); got != wpadURL {
+		t.Errorf("expected a new reply for a new xid, got option 252=%q", got)
+	}
+}
@@ -0,0 +1,34 @@
+package dhcp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// inReprovisionCooldown reports whether the machine has been provisioned in
+// the last reprovision-cooldown, in which case it's not network booted
+// again, e.g. when its boot order or a lingering variable would otherwise
+// reinstall it in a loop. The cooldown starts when the pxelinux config is
+// served, not at the first boot, since the first boot is recorded by the
+// dhcp ACK which precedes the install.
+func inReprovisionCooldown(machineInterface datasource.MachineInterface, now time.Time) (bool, error) {
+	cooldownStr, err := machineInterface.GetVariable(datasource.SpecialKeyReprovisionCooldown)
+	if err != nil {
+		return false, fmt.Errorf("failed to get reprovision cooldown: %s", err)
+	}
+	cooldown, err := datasource.ParseReprovisionCooldown(cooldownStr)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse reprovision-cooldown=%q: %s", cooldownStr, err)
+	}
+	if cooldown == 0 {
+		return false, nil
+	}
+
+	provisioned, err := machineInterface.Provisioned()
+	if err != nil {
+		return false, fmt.Errorf("failed to get the provision time: %s", err)
+	}
+	return provisioned != 0 && now.Sub(time.Unix(provisioned, 0)) < cooldown, nil
+}
@@ -2,14 +2,19 @@ package dhcp // import "github.com/cafebazaar/blacksmith/dhcp"
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/metrics"
 	"github.com/krolaw/dhcp4"
 )
 
@@ -18,35 +23,201 @@ const (
 	maxLeaseHours = 48
 )
 
+// DHCP options which are not defined in the dhcp4 package
+const (
+	optionClientArch       dhcp4.OptionCode = 93  // Client System Architecture, rfc4578
+	optionTZPOSIX          dhcp4.OptionCode = 100 // POSIX Timezone String, rfc4833
+	optionTZDatabase       dhcp4.OptionCode = 101 // TZ Database Timezone Name, rfc4833
+	optionDomainSearch     dhcp4.OptionCode = 119 // Domain Search, rfc3397
+	optionTFTPServers      dhcp4.OptionCode = 150 // TFTP Server Address, rfc5859
+	optionIPXEEncapsulated dhcp4.OptionCode = 175 // iPXE encapsulated options
+	optionWPAD             dhcp4.OptionCode = 252 // Web Proxy Auto-Discovery (WPAD) URL
+)
+
+// Names of the metrics of the handler, see the metrics package
+const (
+	metricReceivedPrefix   = "dhcp_received_"
+	metricRepliedPrefix    = "dhcp_replied_"
+	metricReplayed         = "dhcp_replayed"
+	metricDatasourceErrors = "dhcp_datasource_errors"
+	metricForeignServers   = "dhcp_foreign_server_identifiers"
+	metricDraining         = "dhcp_draining"
+	// metricOptionsSent is labeled by the option code
+	metricOptionsSent     = "dhcp_options_sent"
+	metricPacketsReceived = "dhcp_packets_received"
+	metricLastPacket      = "dhcp_last_packet"
+)
+
+// metricMessageTypes are the names of the message types in the metrics
+var metricMessageTypes = map[dhcp4.MessageType]string{
+	dhcp4.Discover: "discover",
+	dhcp4.Offer:    "offer",
+	dhcp4.Request:  "request",
+	dhcp4.Decline:  "decline",
+	dhcp4.ACK:      "ack",
+	dhcp4.NAK:      "nak",
+	dhcp4.Release:  "release",
+	dhcp4.Inform:   "inform",
+}
+
+// countMessage increases the counter of the message type with the prefix
+func countMessage(prefix string, msgType dhcp4.MessageType) {
+	name, isIn := metricMessageTypes[msgType]
+	if !isIn {
+		name = "unknown"
+	}
+	metrics.Inc(prefix + name)
+}
+
+// tracePacket logs a hex dump of the packet, if TracePackets is set
+func (h *Handler) tracePacket(direction string, p dhcp4.Packet) {
+	if !h.options.TracePackets || log.GetLevel() < log.DebugLevel {
+		return
+	}
+	log.WithFields(log.Fields{
+		"where":  "dhcp.ServeDHCP",
+		"action": "trace",
+		"object": p.CHAddr().String(),
+	}).Debugf("%s packet (%d bytes):\n%s", direction, len(p), hex.Dump(p))
+}
+
+// MaxReplyDelay is the maximum of HandlerOptions.ReplyDelay
+const MaxReplyDelay = 10 * time.Second
+
+// delayReply delays a reply by ReplyDelay of the handler. It's only applied
+// at the debug level, so it's not enabled in production by accident. The
+// replies are sent in order, so the delays of the concurrent requests add up.
+func (h *Handler) delayReply() {
+	if h.options.ReplyDelay <= 0 || log.GetLevel() < log.DebugLevel {
+		return
+	}
+	delay := h.options.ReplyDelay
+	if delay > MaxReplyDelay {
+		delay = MaxReplyDelay
+	}
+	time.Sleep(delay)
+}
+
 func randLeaseDuration() time.Duration {
 	n := (minLeaseHours + rand.Intn(maxLeaseHours-minLeaseHours))
 	return time.Duration(n) * time.Hour
 }
 
-// StartDHCP ListenAndServe for dhcp on port 67, binds on interface=ifName if it's
-// not empty
-func StartDHCP(ifName string, serverIP net.IP, datasource datasource.DataSource) error {
-	handler := &Handler{
-		ifName:      ifName,
-		serverIP:    serverIP,
-		datasource:  datasource,
-		bootMessage: fmt.Sprintf("Blacksmith (%s)", datasource.SelfInfo().Version),
+// HandlerOptions are the settings of a Handler, which are given by the
+// command line flags. The zero value turns the optional features off.
+type HandlerOptions struct {
+	// InstanceFreshness is the window in which the instances should have had
+	// a heartbeat to be advertised as nameservers. 0 disables the filter.
+	InstanceFreshness time.Duration
+	// LogThrottleWindow is the window in which the identical warnings of the
+	// dhcp handling of a machine are logged at most logThrottleBurst times,
+	// and the rest are counted. 0 disables the throttling.
+	LogThrottleWindow time.Duration
+	// ReplyDelay delays the replies, to test the timeouts and the
+	// retransmissions of the clients in a lab. It's only applied at the
+	// debug level, and at most MaxReplyDelay.
+	ReplyDelay time.Duration
+	// NAKLimit is the number of the NAKs which are sent to a machine in each
+	// NAKLimitWindow. The rest are not sent, to break the NAK and rediscover
+	// loop of a misconfigured client. 0 disables the limit.
+	NAKLimit       int
+	NAKLimitWindow time.Duration
+	// IPAMWebhook is the url of an external ipam, which is asked for the ips
+	// of the new machines instead of assigning them from the lease range.
+	// It's not used if it's empty.
+	IPAMWebhook string
+	// IPAMTimeout is how long the ipam webhook is waited for, 0 is
+	// defaultIPAMTimeout
+	IPAMTimeout time.Duration
+	// TracePackets enables logging hex dumps of the received dhcp packets
+	// and their replies. logrus has no trace level, so they're logged at the
+	// debug level, and only if this is also set.
+	TracePackets bool
+}
+
+// NewHandler creates a Handler for the dhcp requests received on
+// interface=ifName
+func NewHandler(ifName string, serverIP net.IP, datasource datasource.DataSource,
+	options HandlerOptions) *Handler {
+	subnet, err := servingSubnet(ifName, serverIP)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"where":  "dhcp.NewHandler",
+			"object": ifName,
+		}).WithError(err).Warn("couldn't read the subnet of the interface, the ips of the machines are not checked")
+	}
+	if options.IPAMTimeout <= 0 {
+		options.IPAMTimeout = defaultIPAMTimeout
 	}
+	return &Handler{
+		ifName:       ifName,
+		subnet:       subnet,
+		serverIP:     serverIP,
+		datasource:   datasource,
+		bootMessage:  fmt.Sprintf("Blacksmith (%s)", datasource.SelfInfo().Version),
+		options:      options,
+		replies:      newReplyCache(replyCacheSize, replyCacheWindow),
+		logThrottle:  newLogThrottle(options.LogThrottleWindow),
+		naks:         newNAKLimiter(options.NAKLimit, options.NAKLimitWindow),
+		instances:    newInstancesCache(datasource.Instances, instancesCacheTTL),
+		machines:     newMachineCache(machineCacheSize, machineCacheTTL),
+		recentErrors: newRecentErrors(recentErrorsSize),
+		ipam:         newIPAMLookups(),
+		transactions: newTransactionLog(transactionsPerMachine, transactionsMachines),
+		bootServers:  newHostCache(lookupIP, hostCacheTTL),
+	}
+}
+
+// Options returns the settings which the handler is created with
+func (h *Handler) Options() HandlerOptions {
+	return h.options
+}
+
+// StartDHCP serves dhcp on port 67, only on the interface of the handler if
+// it's not empty. The server ip of the handler is expected to be an ipv4
+// address. The listener is reported as started once its socket is bound.
+func StartDHCP(handler *Handler) (err error) {
+	defer func() {
+		handler.listenerStopped(err)
+	}()
+
+	if handler.serverIP.To4() == nil {
+		return fmt.Errorf("dhcp server ip (%s) is not an ipv4 address", handler.serverIP)
+	}
+
+	ifIndex := 0
+	if handler.ifName != "" {
+		iface, ifErr := net.InterfaceByName(handler.ifName)
+		if ifErr != nil {
+			return fmt.Errorf("failed to find the dhcp interface %q: %s", handler.ifName, ifErr)
+		}
+		ifIndex = iface.Index
+	}
+	conn, err := net.ListenPacket("udp4", ":67")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	handler.listenerStarted(time.Now())
+
+	// the summaries of the suppressed warnings are logged while serving
+	stop := make(chan struct{})
+	defer close(stop)
+	go handler.logThrottle.expireEvery(stop)
 
 	log.WithFields(log.Fields{
 		"where":  "dhcp.StartDHCP",
 		"action": "announce",
-	}).Infof("Listening on %s:67 (interface: %s)", serverIP.String(), ifName)
+	}).Infof("Listening on %s:67 (interface: %s)", handler.serverIP.String(), handler.ifName)
 
-	var err error
-	if ifName != "" {
-		err = dhcp4.ListenAndServeIf(ifName, handler)
+	if ifIndex != 0 {
+		err = dhcp4.ServeIf(ifIndex, conn, handler)
 	} else {
-		err = dhcp4.ListenAndServe(handler)
+		err = dhcp4.Serve(conn, handler)
 	}
 
 	// https://groups.google.com/forum/#!topic/coreos-user/Qbn3OdVtrZU
-	if len(datasource.ClusterName()) > 50 { // 63 - 12(mac) - 1(.)
+	if len(handler.datasource.ClusterName()) > 50 { // 63 - 12(mac) - 1(.)
 		log.WithField("where", "dhcp.StartDHCP").Warn(
 			"Warning: ClusterName is too long. It may break the behaviour of the DHCP clients")
 	}
@@ -58,49 +229,312 @@ func StartDHCP(ifName string, serverIP net.IP, datasource datasource.DataSource)
 
 // Handler is passed to dhcp4 package to handle DHCP packets
 type Handler struct {
-	ifName      string
-	serverIP    net.IP
-	datasource  datasource.DataSource
-	dhcpOptions dhcp4.Options
-	bootMessage string
+	ifName       string
+	subnet       *net.IPNet // of the interface, nil if it's unknown
+	serverIP     net.IP
+	datasource   datasource.DataSource
+	dhcpOptions  dhcp4.Options
+	bootMessage  string
+	options      HandlerOptions
+	replies      *replyCache
+	logThrottle  *windowLimiter
+	naks         *windowLimiter
+	instances    *instancesCache
+	machines     *machineCache
+	recentErrors *recentErrors
+	ipam         *ipamLookups
+	transactions *transactionLog
+	bootServers  *hostCache
+	draining     int32 // accessed atomically
+	listener     listenerState
 }
 
-// dnsAddressesForDHCP returns instances. marshalled as specified in
-// rfc2132 (option 6), without the length byte
-func dnsAddressesForDHCP(instances *[]datasource.InstanceInfo) []byte {
-	var res []byte
+// countReply counts a reply which is being sent, by its message type and
+// by its options. The option codes are bounded to a byte.
+func (h *Handler) countReply(reply dhcp4.Packet) {
+	options := reply.ParseOptions()
+	if msgType := options[dhcp4.OptionDHCPMessageType]; len(msgType) == 1 {
+		countMessage(metricRepliedPrefix, dhcp4.MessageType(msgType[0]))
+	}
+	for code := range options {
+		metrics.Inc(metrics.WithLabel(metricOptionsSent, "code", strconv.Itoa(int(code))))
+	}
+}
 
-	for _, instanceInfo := range *instances {
-		res = append(res, instanceInfo.IP.To4()...)
+// SetDraining turns the drain mode on or off. A draining handler doesn't
+// answer the Discovers, so the other instances take over the new clients,
+// but still renews the leases of the current ones.
+func (h *Handler) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
 	}
+	atomic.StoreInt32(&h.draining, v)
+	metrics.Set(metricDraining, int64(v))
+}
+
+// Draining reports whether the drain mode is on
+func (h *Handler) Draining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
 
+// Interface returns the name of the interface on which the handler serves,
+// which is empty if it serves on all of them
+func (h *Handler) Interface() string {
+	return h.ifName
+}
+
+// freshInstances filters out the instances which haven't had a heartbeat in
+// the given window. Instances which don't report their heartbeats (older
+// versions) are kept.
+func freshInstances(instances []datasource.InstanceInfo, window time.Duration,
+	now time.Time) []datasource.InstanceInfo {
+	if window <= 0 {
+		return instances
+	}
+
+	var res []datasource.InstanceInfo
+	for _, instanceInfo := range instances {
+		if instanceInfo.LastHeartbeat != 0 &&
+			now.Sub(time.Unix(instanceInfo.LastHeartbeat, 0)) > window {
+			continue
+		}
+		res = append(res, instanceInfo)
+	}
 	return res
 }
 
-func (h *Handler) fillPXE() []byte {
+// PXEVendorOptions returns the pxe vendor options (option 43) which are
+// sent to the machine, with its menu timeout, boot message and menu
+func (h *Handler) PXEVendorOptions(machineInterface datasource.MachineInterface) ([]byte, error) {
+	pxeOptions, _, err := h.pxeVendorOptions(machineInterface, nil)
+	return pxeOptions, err
+}
+
+// pxeVendorOptions returns the pxe vendor options of the machine, along
+// with the menu entry which is selected by the boot item (sub-option 71) of
+// the request, which is nil for the default entry
+func (h *Handler) pxeVendorOptions(machineInterface datasource.MachineInterface,
+	options dhcp4.Options) ([]byte, *datasource.PXEMenuEntry, error) {
+	menuTimeoutStr, err := machineInterface.GetVariable(datasource.SpecialKeyPXEMenuTimeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get pxe menu timeout: %s", err)
+	}
+	menuTimeout, err := datasource.ParsePXEMenuTimeout(menuTimeoutStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse pxe-menu-timeout=%q: %s", menuTimeoutStr, err)
+	}
+	bootMessage, err := machineInterface.GetVariable(datasource.SpecialKeyPXEBootMessage)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get pxe boot message: %s", err)
+	}
+	menuStr, err := machineInterface.GetVariable(datasource.SpecialKeyPXEMenu)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get pxe menu: %s", err)
+	}
+	menu, err := datasource.UnmarshalPXEMenu(menuStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal pxe-menu=%q: %s", menuStr, err)
+	}
+	lengthStr, err := machineInterface.GetVariable(datasource.SpecialKeyPXEOptionsLength)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get pxe options length: %s", err)
+	}
+	length, err := datasource.ParsePXEOptionsLength(lengthStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse pxe-options-length=%q: %s", lengthStr, err)
+	}
+
+	bootItem, entry := selectBootItem(options, menu)
+	pxeOptions, err := h.fillPXE(menuTimeout, bootMessage, menu, bootItem, length)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pxeOptions, entry, nil
+}
+
+// fillPXE returns the pxe vendor options (option 43), pointing to the server
+// ip, which is expected to be an ipv4 address. The menu prompt waits for
+// menuTimeout seconds. The boot message of the handler is shown, unless
+// another one is given. The extra menu entries follow the default one, and
+// the selected boot item is mirrored back if it's not nil. The options are
+// padded to length (if they're shorter), and end with the end sub-option.
+func (h *Handler) fillPXE(menuTimeout byte, bootMessage string,
+	menu []datasource.PXEMenuEntry, bootItem []byte, length int) ([]byte, error) {
+	serverIP := h.serverIP.To4()
+	if serverIP == nil {
+		return nil, fmt.Errorf("server ip (%s) is not an ipv4 address", h.serverIP)
+	}
+	if bootMessage == "" {
+		bootMessage = h.bootMessage
+	}
+	if err := datasource.ValidatePXEBootMessage(bootMessage); err != nil {
+		return nil, err
+	}
+
 	// PXE vendor options
 	var pxe bytes.Buffer
 	var l byte
 	// Discovery Control - disable broadcast and multicast boot server discovery
 	pxe.Write([]byte{6, 1, 3})
-	// PXE boot server
-	pxe.Write([]byte{8, 7, 0x80, 0x00, 1})
-	pxe.Write(h.serverIP.To4())
-	// PXE boot menu - one entry, pointing to the above PXE boot server
-	l = byte(3 + len(h.bootMessage))
-	pxe.Write([]byte{9, l, 0x80, 0x00, 9})
-	pxe.WriteString(h.bootMessage)
+	// PXE boot servers - the above server for each menu entry
+	pxe.Write([]byte{8, byte(7 * (1 + len(menu)))})
+	for i := 0; i <= len(menu); i++ {
+		itemType := pxeBootItemDefault + uint16(i)
+		pxe.Write([]byte{byte(itemType >> 8), byte(itemType), 1})
+		pxe.Write(serverIP)
+	}
+	// PXE boot menu - the default entry, pointing to the above PXE boot
+	// server, followed by the extra ones
+	l = byte(3 + len(bootMessage))
+	for _, entry := range menu {
+		l += byte(3 + len(entry.Description))
+	}
+	pxe.Write([]byte{9, l, 0x80, 0x00, byte(len(bootMessage))})
+	pxe.WriteString(bootMessage)
+	for i, entry := range menu {
+		itemType := pxeBootItemDefault + uint16(i+1)
+		pxe.Write([]byte{byte(itemType >> 8), byte(itemType), byte(len(entry.Description))})
+		pxe.WriteString(entry.Description)
+	}
 	// PXE menu prompt+timeout
-	l = byte(1 + len(h.bootMessage))
-	pxe.Write([]byte{10, l, 0x2})
-	pxe.WriteString(h.bootMessage)
+	l = byte(1 + len(bootMessage))
+	pxe.Write([]byte{10, l, menuTimeout})
+	pxe.WriteString(bootMessage)
+	// PXE boot item - the selection of the client
+	if bootItem != nil {
+		pxe.Write([]byte{pxeSubOptionBootItem, byte(len(bootItem))})
+		pxe.Write(bootItem)
+	}
+	// Padding - before the end, as some firmwares choke on the bytes which
+	// follow it
+	for pxe.Len()+1 < length {
+		pxe.WriteByte(0)
+	}
 	// End vendor options
 	pxe.WriteByte(255)
-	return pxe.Bytes()
+
+	if pxe.Len() > maxPXEVendorOptionsLength {
+		return nil, fmt.Errorf("pxe vendor options are %d bytes, longer than %d, the pxe menu or the boot message should be shortened",
+			pxe.Len(), maxPXEVendorOptionsLength)
+	}
+	if err := checkPXEVendorOptions(pxe.Bytes()); err != nil {
+		return nil, err
+	}
+	return pxe.Bytes(), nil
+}
+
+// bootClient reports whether the client is network booting, i.e. it's a PXE
+// client (option 97 or the PXEClient vendor class), an iPXE (user class) or
+// an uefi HTTPClient. Only these clients receive the boot options, as they
+// may confuse the ordinary ones.
+func bootClient(options dhcp4.Options) bool {
+	if _, hasGUID := options[97]; hasGUID {
+		return true
+	}
+	vendorClass := options[dhcp4.OptionVendorClassIdentifier]
+	if bytes.HasPrefix(vendorClass, []byte("PXEClient")) ||
+		bytes.HasPrefix(vendorClass, []byte("HTTPClient")) {
+		return true
+	}
+	return ipxeClient(options)
 }
 
-// ServeDHCP replies a dhcp request
+// ipxeClient reports whether the request is sent from iPXE, which sets its
+// user class, and sends its encapsulated options as option 175
+func ipxeClient(options dhcp4.Options) bool {
+	if _, isIn := options[optionIPXEEncapsulated]; isIn {
+		return true
+	}
+	return bytes.Equal(options[dhcp4.OptionUserClass], []byte("iPXE"))
+}
+
+// vendorClassBootfile returns the first rule whose match is in the vendor
+// class (option 60), case-insensitively, or nil if there's none
+func vendorClassBootfile(vendorClass []byte,
+	rules []datasource.VendorClassBootfile) *datasource.VendorClassBootfile {
+	if len(vendorClass) == 0 {
+		return nil
+	}
+	lowered := strings.ToLower(string(vendorClass))
+	for i := range rules {
+		if strings.Contains(lowered, strings.ToLower(rules[i].Match)) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// matchVendorClass reports whether the vendor class (option 60) starts with
+// any of the given classes, case-insensitively
+func matchVendorClass(vendorClass []byte, classes []string) bool {
+	if len(vendorClass) == 0 {
+		return false
+	}
+	lowered := strings.ToLower(string(vendorClass))
+	for _, class := range classes {
+		if strings.HasPrefix(lowered, strings.ToLower(class)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeDHCP replies a dhcp request. The retransmissions of a recently
+// answered message are answered with the same reply.
 func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) (d dhcp4.Packet) {
+	h.tracePacket("received", p)
+	countMessage(metricReceivedPrefix, msgType)
+	h.countPacket(time.Now())
+	mac := p.CHAddr()
+	defer func() {
+		h.recordTransaction(mac, p, msgType, options, d, time.Now())
+		if d != nil {
+			h.delayReply()
+		}
+	}()
+
+	if msgType != dhcp4.Discover && msgType != dhcp4.Request {
+		return h.serveDHCP(p, msgType, options, mac, nil)
+	}
+
+	machineMac, unboundClientID, err := h.machineMac(p, options)
+	if err != nil {
+		metrics.Inc(metricDatasourceErrors)
+		h.warn(mac, err, "failed to look up the client identifier")
+		return nil
+	}
+	mac = machineMac
+
+	key := replyCacheKeyFor(mac, p, msgType)
+	if reply, found := h.replies.get(key, time.Now()); found {
+		log.WithFields(log.Fields{
+			"where":   "dhcp.ServeDHCP",
+			"object":  mac.String(),
+			"subject": msgType,
+		}).Debug("retransmission, replaying the last reply")
+		metrics.Inc(metricReplayed)
+		if reply != nil {
+			h.tracePacket("reply", reply)
+			h.countReply(reply)
+		}
+		return reply
+	}
+
+	reply := h.limitNAK(mac, h.serveDHCP(p, msgType, options, mac, unboundClientID))
+	h.replies.put(key, reply, time.Now())
+	if reply != nil {
+		h.tracePacket("reply", reply)
+		h.countReply(reply)
+	}
+	return reply
+}
+
+// serveDHCP replies the message of the machine which is known by mac, see
+// machineMac. The unbound client identifier, if any, is bound to it once
+// it's served.
+func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options,
+	mac net.HardwareAddr, unboundClientID []byte) dhcp4.Packet {
 
 	switch msgType {
 	case dhcp4.Discover, dhcp4.Request:
@@ -109,121 +543,352 @@ func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 				log.WithField("where", "dhcp.ServeDHCP").Debugf(
 					"identifying dhcp server in Discover?! (%v)", p)
 			}
+			h.checkForeignServer(p, msgType, net.IP(server))
 			return nil // this message is not ours
 		}
 
-		machineInterface := h.datasource.MachineInterface(p.CHAddr())
-		machine, err := machineInterface.Machine(true, nil)
-		if err != nil {
-			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
-				"failed to get machine")
+		if h.Draining() && (msgType == dhcp4.Discover || net.IP(p.CIAddr()).Equal(net.IPv4zero)) {
+			log.WithFields(log.Fields{
+				"where":   "dhcp.ServeDHCP",
+				"object":  mac.String(),
+				"subject": msgType,
+			}).Debug("draining, only the renewals are answered")
 			return nil
 		}
 
-		netConfStr, err := machineInterface.GetVariable(datasource.SpecialKeyNetworkConfiguration)
+		machineInterface := h.datasource.MachineInterface(mac)
+
+		ignored, err := machineInterface.Ignored()
 		if err != nil {
-			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
-				"failed to get network configuration")
+			metrics.Inc(metricDatasourceErrors)
+			h.warn(mac, err, "failed to get the ignore flag")
+			return nil
+		}
+		if ignored {
+			log.WithFields(log.Fields{
+				"where":   "dhcp.ServeDHCP",
+				"object":  mac.String(),
+				"subject": msgType,
+			}).Debug("the machine is ignored")
 			return nil
 		}
 
-		netConf, err := datasource.UnmarshalNetworkConfiguration(netConfStr)
+		ignoredClasses, err := machineInterface.GetVariable(datasource.SpecialKeyIgnoredVendorClasses)
 		if err != nil {
-			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
-				"failed to unmarshal network-configuration=%q", netConfStr)
+			metrics.Inc(metricDatasourceErrors)
+			h.warn(mac, err, "failed to get ignored vendor classes")
+			return nil
+		}
+		vendorClass := options[dhcp4.OptionVendorClassIdentifier]
+		if matchVendorClass(vendorClass, datasource.SplitVendorClasses(ignoredClasses)) {
+			log.WithFields(log.Fields{
+				"where":   "dhcp.ServeDHCP",
+				"object":  mac.String(),
+				"subject": msgType,
+			}).Debugf("ignoring vendor class %q", vendorClass)
 			return nil
 		}
 
-		instanceInfos, err := h.datasource.Instances()
+		quarantine, err := h.quarantineSubnet(machineInterface)
 		if err != nil {
-			log.WithField("where", "dhcp.ServeDHCP").WithError(err).Warn(
-				"failed to get instances")
+			metrics.Inc(metricDatasourceErrors)
+			h.warn(mac, err, "failed to check the quarantine")
 			return nil
 		}
+		if quarantine != nil {
+			return h.serveQuarantine(p, msgType, options, mac, quarantine)
+		}
 
-		hostname := strings.Join(strings.Split(p.CHAddr().String(), ":"), "")
-		hostname += "." + h.datasource.ClusterName()
-
-		dhcpOptions := dhcp4.Options{
-			dhcp4.OptionSubnetMask:       netConf.Netmask.To4(),
-			dhcp4.OptionDomainNameServer: dnsAddressesForDHCP(&instanceInfos),
-			dhcp4.OptionHostName:         []byte(hostname),
+		if err := h.bindClientID(unboundClientID, mac); err != nil {
+			metrics.Inc(metricDatasourceErrors)
+			h.warn(mac, err, "failed to bind the client identifier")
 		}
 
-		if netConf.Router != nil {
-			dhcpOptions[dhcp4.OptionRouter] = netConf.Router.To4()
+		machine, err := h.machine(machineInterface)
+		if err == errIPAMPending {
+			log.WithFields(log.Fields{
+				"where":   "dhcp.ServeDHCP",
+				"object":  mac.String(),
+				"subject": msgType,
+			}).Debug("waiting for the ipam webhook")
+			return nil
 		}
-		if len(netConf.ClasslessRouteOption) != 0 {
-			var res []byte
-			for _, part := range netConf.ClasslessRouteOption {
-				res = append(res, part.ToBytes()...)
+		if err != nil {
+			metrics.Inc(metricDatasourceErrors)
+			h.warn(mac, err, "failed to get machine")
+			return nil
+		}
+		if err := h.checkServingSubnet(machine); err != nil {
+			h.warn(mac, err, "machine ip is outside the serving subnet")
+			if msgType == dhcp4.Request {
+				return dhcp4.ReplyPacket(p, dhcp4.NAK, h.serverIP.To4(), nil, 0, nil)
 			}
-			dhcpOptions[dhcp4.OptionClasslessRouteFormat] = res
+			return nil
 		}
 
-		responseMsgType := dhcp4.Offer
 		if msgType == dhcp4.Request {
-			responseMsgType = dhcp4.ACK
-
-			requestedIP := net.IP(options[dhcp4.OptionRequestedIPAddress])
+			requestedIP := requestedIP(p, options)
 			if requestedIP == nil {
-				requestedIP = net.IP(p.CIAddr())
-			}
-			if len(requestedIP) != 4 || requestedIP.Equal(net.IPv4zero) {
 				log.WithFields(log.Fields{
 					"where":   "dhcp.ServeDHCP",
-					"object":  p.CHAddr().String(),
+					"object":  mac.String(),
 					"subject": msgType,
 				}).Debugf("bad request")
 				return nil
 			}
+			_, selecting := options[dhcp4.OptionServerIdentifier]
+			if err := h.checkLease(machineInterface, requestedIP, renewal(net.IP(p.CIAddr())),
+				selecting, time.Now()); err != nil {
+				h.warn(mac, err, "the lease is not honored")
+				return dhcp4.ReplyPacket(p, dhcp4.NAK, h.serverIP.To4(), nil, 0, nil)
+			}
 			if !requestedIP.Equal(machine.IP) {
 				log.WithFields(log.Fields{
 					"where":   "dhcp.ServeDHCP",
-					"object":  p.CHAddr().String(),
+					"object":  mac.String(),
 					"subject": msgType,
 				}).Debugf("requestedIP(%s) != assignedIp(%s)",
 					requestedIP.String(), machine.IP.String())
 				return nil
 			}
-
-			machineInterface.CheckIn()
 		}
 
-		guidVal, isPxe := options[97]
+		isPxe := bootClient(options)
 
 		log.WithFields(log.Fields{
 			"where":   "dhcp.ServeDHCP",
 			"action":  "debug",
-			"object":  p.CHAddr().String(),
+			"object":  mac.String(),
 			"subject": msgType,
 		}).Infof("assignedIp=%s isPxe=%v", machine.IP.String(), isPxe)
 
-		replyOptions := dhcpOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
+		packet, err := h.buildReply(p, msgType, options, machineInterface, machine)
+		if err != nil {
+			h.warn(mac, err, "failed to build the reply")
+			return nil
+		}
 
-		if isPxe { // this is a pxe request
-			guid := guidVal[1:]
+		if msgType == dhcp4.Request {
+			machineInterface.CheckIn()
+			if err := machineInterface.StoreLease(leaseOf(packet, time.Now())); err != nil {
+				metrics.Inc(metricDatasourceErrors)
+				h.warn(mac, err, "failed to store the lease")
+			}
+			if arch, isIn := clientArch(options); isIn {
+				if err := machineInterface.StoreClientArch(arch); err != nil {
+					metrics.Inc(metricDatasourceErrors)
+					h.warn(mac, err, "failed to store the client arch")
+				}
+			}
+			// the kernel args of the profile are added to the pxelinux config
+			profile, err := userClassProfile(machineInterface, options)
+			if err != nil {
+				h.warn(mac, err, "failed to get the user class profile")
+			} else {
+				match := ""
+				if profile != nil {
+					match = profile.Match
+				}
+				if err := machineInterface.StoreUserClassProfile(match); err != nil {
+					metrics.Inc(metricDatasourceErrors)
+					h.warn(mac, err, "failed to store the user class profile")
+				}
+			}
+		}
+		return packet
+
+	case dhcp4.Release, dhcp4.Decline:
+		return nil
+	}
+	return nil
+}
+
+// leaseOf returns the lease which is given by the reply at the given time
+func leaseOf(reply dhcp4.Packet, now time.Time) datasource.Lease {
+	var seconds uint32
+	if leaseTime := reply.ParseOptions()[dhcp4.OptionIPAddressLeaseTime]; len(leaseTime) == 4 {
+		seconds = binary.BigEndian.Uint32(leaseTime)
+	}
+	return datasource.Lease{
+		IP:     net.IP(reply.YIAddr()).To4(),
+		Expiry: now.Add(time.Duration(seconds) * time.Second).Unix(),
+	}
+}
+
+// buildReply builds the reply of a Discover (Offer) or a Request (ACK) of the
+// given machine, without any side effect
+func (h *Handler) buildReply(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options,
+	machineInterface datasource.MachineInterface, machine datasource.Machine) (dhcp4.Packet, error) {
+	// a non-ipv4 server ip would silently produce malformed options, e.g. the
+	// server identifier (option 54) which dhcp4.ReplyPacket adds to every reply
+	serverIP := h.serverIP.To4()
+	if serverIP == nil {
+		return nil, fmt.Errorf("server ip (%s) is not an ipv4 address", h.serverIP)
+	}
+
+	conf, err := h.MachineConfiguration(machineInterface, machine)
+	if err != nil {
+		return nil, err
+	}
+	dhcpOptions := conf.dhcpOptions()
+
+	responseMsgType := dhcp4.Offer
+	if msgType == dhcp4.Request {
+		responseMsgType = dhcp4.ACK
+	}
+
+	maintenance, err := h.datasource.Maintenance()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the maintenance mode: %s", err)
+	}
+	noInstall, err := machineInterface.NoInstall()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get no-install: %s", err)
+	}
+	// the machines which are locked to their local disks are treated the
+	// same as in the maintenance mode, and so are the bmcs, which don't boot
+	// the installer but may still get a vendor class bootfile
+	localBoot := maintenance || noInstall
+	installable := !localBoot && machine.Type != datasource.MTBMC
+
+	rulesStr, err := machineInterface.GetVariable(datasource.SpecialKeyVendorClassBootfiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vendor class bootfiles: %s", err)
+	}
+	rules, err := datasource.UnmarshalVendorClassBootfiles(rulesStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal vendor-class-bootfiles=%q: %s", rulesStr, err)
+	}
+	// the clients with a dedicated bootfile, e.g. the out-of-band
+	// controllers or the ones with a user class profile, are not pointed to
+	// the pxe boot server
+	var rule *datasource.VendorClassBootfile
+	if !localBoot {
+		profile, err := userClassProfile(machineInterface, options)
+		if err != nil {
+			return nil, err
+		}
+		if profile != nil && profile.Bootfile != "" {
+			rule = &datasource.VendorClassBootfile{
+				Match:      profile.Match,
+				Bootfile:   profile.Bootfile,
+				NextServer: profile.NextServer,
+			}
+		} else {
+			rule = vendorClassBootfile(options[dhcp4.OptionVendorClassIdentifier], rules)
+		}
+	}
+
+	cooldown, err := inReprovisionCooldown(machineInterface, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	replyOptions := conf.selectReplyOptions(dhcpOptions, options[dhcp4.OptionParameterRequestList])
+
+	// in the maintenance mode, or in the reprovision cooldown of the
+	// machine, or if it's locked by no-install or is a bmc, the pxe options
+	// are left out
+	// so the clients fall back to their local disks
+	pxeReply := bootClient(options) && installable && !cooldown && rule == nil
+	// the extra entry of the pxe menu which is selected by the client
+	var menuEntry *datasource.PXEMenuEntry
+	if pxeReply {
+		replyVendorClass := "PXEClient"
+		if bytes.HasPrefix(options[dhcp4.OptionVendorClassIdentifier], []byte("HTTPClient")) {
+			replyVendorClass = "HTTPClient"
+		}
+		replyOptions = append(replyOptions,
+			dhcp4.Option{
+				Code:  dhcp4.OptionVendorClassIdentifier,
+				Value: []byte(replyVendorClass),
+			},
+		)
+		// the first byte is the type of the identifier, followed by the
+		// identifier itself
+		guidVal, hasGUID := options[97]
+		if len(guidVal) > 1 {
 			replyOptions = append(replyOptions,
-				dhcp4.Option{
-					Code:  dhcp4.OptionVendorClassIdentifier,
-					Value: []byte("PXEClient"),
-				},
 				dhcp4.Option{
 					Code:  97, // UUID/GUID-based Client Identifier
-					Value: guid,
-				},
-				dhcp4.Option{
-					Code:  dhcp4.OptionVendorSpecificInformation,
-					Value: h.fillPXE(),
+					Value: guidVal[1:],
 				},
 			)
+		} else if hasGUID {
+			log.WithFields(log.Fields{
+				"where":   "dhcp.ServeDHCP",
+				"object":  machineInterface.Mac().String(),
+				"subject": msgType,
+			}).Warnf("malformed option 97 (len=%d), not echoing the guid", len(guidVal))
 		}
-		packet := dhcp4.ReplyPacket(p, responseMsgType, h.serverIP, machine.IP,
-			randLeaseDuration(), replyOptions)
-		return packet
+		pxeOptions, entry, err := h.pxeVendorOptions(machineInterface, options)
+		if err != nil {
+			return nil, err
+		}
+		menuEntry = entry
+		replyOptions = append(replyOptions,
+			dhcp4.Option{
+				Code:  dhcp4.OptionVendorSpecificInformation,
+				Value: pxeOptions,
+			},
+		)
+	}
+	// the other clients get their own vendor class back, if it's one of
+	// the echoed classes
+	if vendorClass := options[dhcp4.OptionVendorClassIdentifier]; !pxeReply && len(vendorClass) != 0 {
+		echoedClasses, err := machineInterface.GetVariable(datasource.SpecialKeyEchoedVendorClasses)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get echoed vendor classes: %s", err)
+		}
+		if matchVendorClass(vendorClass, datasource.SplitVendorClasses(echoedClasses)) {
+			replyOptions = append(replyOptions, dhcp4.Option{
+				Code:  dhcp4.OptionVendorClassIdentifier,
+				Value: vendorClass,
+			})
+		}
+	}
+	leaseDuration := conf.LeaseDuration
+	if leaseDuration == 0 {
+		leaseDuration = randLeaseDuration()
+	}
+	// the next step of the boot chain of the machine, if it's overridden
+	nextBootfile, nextServer := "", serverIP
+	if rule != nil {
+		nextBootfile = rule.Bootfile
+		if rule.NextServer != nil {
+			nextServer = rule.NextServer.To4()
+		}
+	} else if menuEntry != nil {
+		nextBootfile = menuEntry.Bootfile
+	} else if ipxeClient(options) && installable && !cooldown {
+		nextBootfile = conf.NextBootfile
+	}
+	if nextBootfile != "" {
+		replyOptions = append(replyOptions, dhcp4.Option{
+			Code:  dhcp4.OptionBootFileName,
+			Value: []byte(nextBootfile),
+		})
+		// the configured boot server is named in option 66, for the
+		// clients which prefer the name, and its address is in siaddr
+		if rule == nil || rule.NextServer == nil {
+			hostname, ip, err := h.bootServer(machineInterface)
+			if err != nil {
+				h.warn(machineInterface.Mac(), err, "failed to get the boot server")
+			} else if ip != nil {
+				nextServer = ip
+				replyOptions = append(replyOptions, dhcp4.Option{
+					Code:  dhcp4.OptionTFTPServerName,
+					Value: []byte(hostname),
+				})
+			}
+		}
+	}
 
-	case dhcp4.Release, dhcp4.Decline:
-		return nil
+	packet := dhcp4.ReplyPacket(p, responseMsgType, serverIP, machine.IP,
+		leaseDuration, replyOptions)
+	if nextBootfile != "" {
+		packet.SetSIAddr(nextServer)
+		packet.SetFile([]byte(nextBootfile))
 	}
-	return nil
+	return packet, nil
 }
@@ -0,0 +1,43 @@
+package dhcp
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// servingSubnet returns the subnet of the address of the interface which is
+// the server ip, e.g. 10.0.0.0/24 for 10.0.0.1/24. The machines are expected
+// to be in this subnet, as the requests are not relayed. nil is returned if
+// no interface is given.
+func servingSubnet(ifName string, serverIP net.IP) (*net.IPNet, error) {
+	if ifName == "" {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting the addresses of %s: %s", ifName, err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.Equal(serverIP) {
+			return &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no address %s", ifName, serverIP)
+}
+
+// checkServingSubnet checks that the ip of the machine is in the subnet of
+// the interface, which catches the machines with the addresses of another
+// subnet, e.g. after the lease range is changed
+func (h *Handler) checkServingSubnet(machine datasource.Machine) error {
+	if h.subnet == nil || machine.IP == nil || h.subnet.Contains(machine.IP) {
+		return nil
+	}
+	return fmt.Errorf("ip %s is outside the subnet %s of %s", machine.IP, h.subnet, h.ifName)
+}
@@ -0,0 +1,74 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/krolaw/dhcp4"
+)
+
+func TestServingSubnet(t *testing.T) {
+	if subnet, err := servingSubnet("", net.IPv4(127, 0, 0, 1)); subnet != nil || err != nil {
+		t.Errorf("expected no subnet without an interface, got %v %v", subnet, err)
+	}
+	if _, err := servingSubnet("no-such-interface", net.IPv4(127, 0, 0, 1)); err == nil {
+		t.Error("expected an error for an unknown interface")
+	}
+
+	subnet, err := servingSubnet("lo", net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Skip("no loopback interface:", err)
+	}
+	if !subnet.Contains(net.IPv4(127, 0, 0, 2)) || subnet.Contains(net.IPv4(10, 0, 0, 2)) {
+		t.Error("unexpected subnet of the loopback interface:", subnet)
+	}
+	if _, err := servingSubnet("lo", net.IPv4(10, 0, 0, 1)); err == nil {
+		t.Error("expected an error for an address which is not of the interface")
+	}
+}
+
+func TestOutOfSubnetMachine(t *testing.T) {
+	inside, _ := net.ParseMAC("00:11:22:33:47:0a")
+	outside, _ := net.ParseMAC("00:11:22:33:47:0b")
+	outsideIP := net.IPv4(10, 9, 9, 9).To4()
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	_, h.subnet, _ = net.ParseCIDR("127.0.0.0/24")
+
+	if _, err := ds.MachineInterface(outside).Machine(true, outsideIP); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	p, options := discoverForTest(inside, nil)
+	if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply == nil {
+		t.Error("expected an offer for the machine inside the subnet")
+	}
+
+	p, options = discoverForTest(outside, nil)
+	if reply := h.ServeDHCP(p, dhcp4.Discover, options); reply != nil {
+		t.Error("expected no offer for the machine outside the subnet, got", reply)
+	}
+
+	p = dhcp4.RequestPacket(dhcp4.Request, outside, nil, []byte{1, 2, 3, 5}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionRequestedIPAddress, Value: outsideIP},
+	})
+	reply := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+	if reply == nil {
+		t.Error("expected a NAK for the machine outside the subnet")
+		return
+	}
+	if msgType := reply.ParseOptions()[dhcp4.OptionDHCPMessageType]; len(msgType) != 1 ||
+		dhcp4.MessageType(msgType[0]) != dhcp4.NAK {
+		t.Errorf("expected a NAK for the machine outside the subnet, got %v", msgType)
+	}
+}
@@ -0,0 +1,83 @@
+package dhcp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// SimulatedOption is an option of a simulated reply, with its value in hex
+type SimulatedOption struct {
+	Code  dhcp4.OptionCode `json:"code"`
+	Value string           `json:"value"`
+}
+
+// Simulation is the reply which a machine would receive for a message.
+// PacketBytes is the size of the serialized reply, and BuildDurationMs is how
+// long building it (including the datasource lookups) has taken.
+type Simulation struct {
+	MessageType     string            `json:"messageType"`
+	IP              net.IP            `json:"ip"`
+	Options         []SimulatedOption `json:"options"`
+	PacketBytes     int               `json:"packetBytes"`
+	BuildDurationMs float64           `json:"buildDurationMs"`
+}
+
+// Simulate builds the reply which the machine would receive for a message of
+// msgType (Discover or Request) with the given options, without any side
+// effect. The machine is expected to exist.
+func (h *Handler) Simulate(mac net.HardwareAddr, msgType dhcp4.MessageType,
+	options []dhcp4.Option) (*Simulation, error) {
+	if msgType != dhcp4.Discover && msgType != dhcp4.Request {
+		return nil, fmt.Errorf("only Discover and Request can be simulated")
+	}
+
+	machineInterface := h.datasource.MachineInterface(mac)
+	machine, err := machineInterface.Machine(false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if msgType == dhcp4.Request {
+		options = append(options, dhcp4.Option{
+			Code:  dhcp4.OptionRequestedIPAddress,
+			Value: machine.IP.To4(),
+		})
+	}
+	p := dhcp4.RequestPacket(msgType, mac, nil, []byte{0, 0, 0, 0}, false, options)
+
+	start := time.Now()
+	reply, err := h.buildReply(p, msgType, p.ParseOptions(), machineInterface, machine)
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Since(start)
+
+	simulation := &Simulation{
+		MessageType:     "Offer",
+		IP:              reply.YIAddr(),
+		PacketBytes:     len(reply),
+		BuildDurationMs: float64(duration) / float64(time.Millisecond),
+	}
+	if msgType == dhcp4.Request {
+		simulation.MessageType = "ACK"
+	}
+
+	replyOptions := reply.ParseOptions()
+	codes := make([]int, 0, len(replyOptions))
+	for code := range replyOptions {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		simulation.Options = append(simulation.Options, SimulatedOption{
+			Code:  dhcp4.OptionCode(code),
+			Value: hex.EncodeToString(replyOptions[dhcp4.OptionCode(code)]),
+		})
+	}
+	return simulation, nil
+}
@@ -0,0 +1,141 @@
+package dhcp
+
+import (
+	"container/list"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+const (
+	// transactionsPerMachine is the number of the last transactions which
+	// are kept for each machine
+	transactionsPerMachine = 16
+	// transactionsMachines is the number of the machines whose transactions
+	// are kept, the least recently seen ones are forgotten
+	transactionsMachines = 1024
+)
+
+// Transaction is a dhcp message of a machine along with its reply. Reply is
+// empty if it's not answered. Requested are the codes in the parameter
+// request list, and Options are the codes of the options of the reply.
+type Transaction struct {
+	Time      int64  `json:"time"`
+	Type      string `json:"type"`
+	Reply     string `json:"reply,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Requested []int  `json:"requested,omitempty"`
+	Options   []int  `json:"options,omitempty"`
+}
+
+type transactionsEntry struct {
+	mac          string
+	transactions []Transaction
+}
+
+// transactionLog keeps the last transactions of the machines, for debugging
+// them without a packet capture. It's bounded both in the machines and in
+// the transactions of each one. It's safe for concurrent use, and a nil
+// *transactionLog keeps nothing.
+type transactionLog struct {
+	mu         sync.Mutex
+	perMachine int
+	machines   int
+	order      *list.List // of *transactionsEntry, the most recent at front
+	entries    map[string]*list.Element
+}
+
+func newTransactionLog(perMachine, machines int) *transactionLog {
+	return &transactionLog{
+		perMachine: perMachine,
+		machines:   machines,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (l *transactionLog) add(mac string, t Transaction) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, found := l.entries[mac]
+	if !found {
+		elem = l.order.PushFront(&transactionsEntry{mac: mac})
+		l.entries[mac] = elem
+		for l.order.Len() > l.machines {
+			oldest := l.order.Back()
+			l.order.Remove(oldest)
+			delete(l.entries, oldest.Value.(*transactionsEntry).mac)
+		}
+	}
+	l.order.MoveToFront(elem)
+
+	entry := elem.Value.(*transactionsEntry)
+	if len(entry.transactions) < l.perMachine {
+		entry.transactions = append(entry.transactions, t)
+		return
+	}
+	copy(entry.transactions, entry.transactions[1:])
+	entry.transactions[len(entry.transactions)-1] = t
+}
+
+// list returns a copy of the transactions of mac, the oldest first
+func (l *transactionLog) list(mac string) []Transaction {
+	res := []Transaction{}
+	if l == nil {
+		return res
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elem, found := l.entries[mac]; found {
+		res = append(res, elem.Value.(*transactionsEntry).transactions...)
+	}
+	return res
+}
+
+// optionCodes returns the codes of the options, sorted
+func optionCodes(options dhcp4.Options) []int {
+	var res []int
+	for code := range options {
+		res = append(res, int(code))
+	}
+	sort.Ints(res)
+	return res
+}
+
+// recordTransaction adds the message of the client and its reply, which is
+// nil if it's not answered, to the transactions of the machine
+func (h *Handler) recordTransaction(mac net.HardwareAddr, p dhcp4.Packet, msgType dhcp4.MessageType,
+	options dhcp4.Options, reply dhcp4.Packet, now time.Time) {
+	if h.transactions == nil {
+		return
+	}
+	t := Transaction{Time: now.Unix(), Type: metricMessageTypes[msgType]}
+	for _, code := range options[dhcp4.OptionParameterRequestList] {
+		t.Requested = append(t.Requested, int(code))
+	}
+	if reply != nil {
+		replyOptions := reply.ParseOptions()
+		if replyType := replyOptions[dhcp4.OptionDHCPMessageType]; len(replyType) == 1 {
+			t.Reply = metricMessageTypes[dhcp4.MessageType(replyType[0])]
+		}
+		if ip := net.IP(reply.YIAddr()); !ip.Equal(net.IPv4zero) {
+			t.IP = ip.String()
+		}
+		t.Options = optionCodes(replyOptions)
+	}
+	h.transactions.add(mac.String(), t)
+}
+
+// Transactions returns the last dhcp transactions of the machine, the oldest
+// first
+func (h *Handler) Transactions(mac net.HardwareAddr) []Transaction {
+	return h.transactions.list(mac.String())
+}
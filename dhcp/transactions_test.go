@@ -0,0 +1,83 @@
+package dhcp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+func TestTransactions(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:47:13")
+
+	h, ds, err := handlerForTest()
+	if err != nil {
+		t.Error("error in getting a Handler for our test:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	h.transactions = newTransactionLog(3, 2)
+
+	if transactions := h.Transactions(mac); len(transactions) != 0 {
+		t.Error("expected no transaction before any request, got", transactions)
+	}
+
+	p, options := discoverForTest(mac, []dhcp4.Option{
+		{Code: dhcp4.OptionParameterRequestList, Value: []byte{1, 3}},
+	})
+	reply := h.ServeDHCP(p, dhcp4.Discover, options)
+	if reply == nil {
+		t.Error("expected an offer")
+		return
+	}
+
+	transactions := h.Transactions(mac)
+	if len(transactions) != 1 {
+		t.Error("expected the discover to be recorded, got", transactions)
+		return
+	}
+	tr := transactions[0]
+	if tr.Type != "discover" || tr.Reply != "offer" || tr.IP != reply.YIAddr().String() {
+		t.Errorf("unexpected transaction %+v", tr)
+	}
+	if len(tr.Requested) != 2 || tr.Requested[0] != 1 || tr.Requested[1] != 3 {
+		t.Error("expected the requested options to be recorded, got", tr.Requested)
+	}
+	var hasMessageType bool
+	for _, code := range tr.Options {
+		hasMessageType = hasMessageType || code == int(dhcp4.OptionDHCPMessageType)
+	}
+	if !hasMessageType {
+		t.Error("expected the options of the offer to be recorded, got", tr.Options)
+	}
+
+	// bounded for each machine, the oldest are dropped
+	for i := 0; i < 4; i++ {
+		h.recordTransaction(mac, p, dhcp4.Inform, options, nil, time.Unix(int64(i), 0))
+	}
+	transactions = h.Transactions(mac)
+	if len(transactions) != 3 {
+		t.Error("expected 3 transactions to be kept, got", len(transactions))
+	}
+	for i, tr := range transactions {
+		if tr.Time != int64(i+1) || tr.Type != "inform" || tr.Reply != "" || tr.IP != "" {
+			t.Errorf("#%d: unexpected transaction %+v", i, tr)
+		}
+	}
+
+	// bounded in the machines, the least recently seen are forgotten
+	for i := 0; i < 2; i++ {
+		other, _ := net.ParseMAC(fmt.Sprintf("00:11:22:33:48:%02x", i))
+		otherP, otherOptions := discoverForTest(other, nil)
+		h.recordTransaction(other, otherP, dhcp4.Discover, otherOptions, nil, time.Now())
+	}
+	if transactions := h.Transactions(mac); len(transactions) != 0 {
+		t.Error("expected the transactions of the least recent machine to be forgotten, got", transactions)
+	}
+}
@@ -0,0 +1,28 @@
+package dhcp
+
+import (
+	"fmt"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/krolaw/dhcp4"
+)
+
+// userClassProfile returns the boot profile of the user class (option 77) of
+// the request, or nil if there's none
+func userClassProfile(machineInterface datasource.MachineInterface,
+	options dhcp4.Options) (*datasource.UserClassProfile, error) {
+	userClass := options[dhcp4.OptionUserClass]
+	if len(userClass) == 0 {
+		return nil, nil
+	}
+
+	profilesStr, err := machineInterface.GetVariable(datasource.SpecialKeyUserClassProfiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user class profiles: %s", err)
+	}
+	profiles, err := datasource.UnmarshalUserClassProfiles(profilesStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal user-class-profiles=%q: %s", profilesStr, err)
+	}
+	return datasource.FindUserClassProfile(string(userClass), profiles), nil
+}
@@ -0,0 +1,137 @@
+package dhcp
+
+import (
+	"sync"
+	"time"
+)
+
+// windowLimiterMaxKeys bounds the number of the tracked keys. Beyond it, the
+// ones of the expired windows are dropped, and then the oldest one.
+const windowLimiterMaxKeys = 1024
+
+// limiterKey identifies the events which are limited together, e.g. the
+// identical warnings of a machine
+type limiterKey struct {
+	mac string
+	msg string
+}
+
+type windowLimiterEntry struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// windowLimiter allows the events of each key at most limit times in a
+// window, and counts the rest as suppressed. It's safe for concurrent use,
+// and a nil *windowLimiter limits nothing.
+type windowLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	entries map[limiterKey]*windowLimiterEntry
+	// dropped is called, with the lock held, for each window which is
+	// dropped while some of its events are suppressed. It may be nil.
+	dropped func(key limiterKey, suppressed int)
+}
+
+func newWindowLimiter(limit int, window time.Duration) *windowLimiter {
+	if limit <= 0 || window <= 0 {
+		return nil
+	}
+	return &windowLimiter{
+		limit:   limit,
+		window:  window,
+		entries: make(map[limiterKey]*windowLimiterEntry),
+	}
+}
+
+// allow reports whether the event is allowed, along with the number of the
+// ones which are suppressed in the previous window of the key
+func (l *windowLimiter) allow(key limiterKey, now time.Time) (bool, int) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, isIn := l.entries[key]
+	if !isIn || now.Sub(entry.start) >= l.window {
+		suppressed := 0
+		if isIn {
+			suppressed = entry.suppressed
+		}
+		if !isIn && len(l.entries) >= windowLimiterMaxKeys {
+			l.dropExpired(now)
+			if len(l.entries) >= windowLimiterMaxKeys {
+				l.dropOldest()
+			}
+		}
+		l.entries[key] = &windowLimiterEntry{start: now, count: 1}
+		return true, suppressed
+	}
+
+	if entry.count < l.limit {
+		entry.count++
+		return true, 0
+	}
+	entry.suppressed++
+	return false, 0
+}
+
+// expire drops the expired windows, so the suppressed events are reported
+// even if no more events of their keys follow
+func (l *windowLimiter) expire(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dropExpired(now)
+}
+
+// expireEvery calls expire every window, until stop is closed
+func (l *windowLimiter) expireEvery(stop <-chan struct{}) {
+	if l == nil {
+		return
+	}
+	ticker := time.NewTicker(l.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			l.expire(now)
+		}
+	}
+}
+
+func (l *windowLimiter) dropExpired(now time.Time) {
+	for key, entry := range l.entries {
+		if now.Sub(entry.start) >= l.window {
+			l.drop(key, entry)
+		}
+	}
+}
+
+// dropOldest drops the window which has started first
+func (l *windowLimiter) dropOldest() {
+	var oldestKey limiterKey
+	var oldest *windowLimiterEntry
+	for key, entry := range l.entries {
+		if oldest == nil || entry.start.Before(oldest.start) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if oldest != nil {
+		l.drop(oldestKey, oldest)
+	}
+}
+
+func (l *windowLimiter) drop(key limiterKey, entry *windowLimiterEntry) {
+	delete(l.entries, key)
+	if entry.suppressed > 0 && l.dropped != nil {
+		l.dropped(key, entry.suppressed)
+	}
+}
@@ -0,0 +1,101 @@
+// Package metrics is a minimal registry of counters and gauges, which are
+// kept in memory and exposed as json
+package metrics // import "github.com/cafebazaar/blacksmith/metrics"
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Registry holds the counters and the gauges by their names. It's safe for
+// concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+	gauges   map[string]int64
+}
+
+// Snapshot is the values of a Registry at some point in time
+type Snapshot struct {
+	Counters map[string]uint64 `json:"counters"`
+	Gauges   map[string]int64  `json:"gauges"`
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: make(map[string]uint64),
+		gauges:   make(map[string]int64),
+	}
+}
+
+// Add increases the counter by delta
+func (r *Registry) Add(name string, delta uint64) {
+	r.mu.Lock()
+	r.counters[name] += delta
+	r.mu.Unlock()
+}
+
+// Inc increases the counter by one
+func (r *Registry) Inc(name string) {
+	r.Add(name, 1)
+}
+
+// Set sets the value of the gauge
+func (r *Registry) Set(name string, value int64) {
+	r.mu.Lock()
+	r.gauges[name] = value
+	r.mu.Unlock()
+}
+
+// Counter returns the value of the counter
+func (r *Registry) Counter(name string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[name]
+}
+
+// Gauge returns the value of the gauge
+func (r *Registry) Gauge(name string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gauges[name]
+}
+
+// Snapshot returns a copy of the current values
+func (r *Registry) Snapshot() Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := Snapshot{
+		Counters: make(map[string]uint64, len(r.counters)),
+		Gauges:   make(map[string]int64, len(r.gauges)),
+	}
+	for name, value := range r.counters {
+		s.Counters[name] = value
+	}
+	for name, value := range r.gauges {
+		s.Gauges[name] = value
+	}
+	return s
+}
+
+// WithLabel returns the name of the counter or the gauge of the family with
+// a label, e.g. dhcp_options_sent{code="1"}, in the OpenMetrics format. Each
+// value of the label is kept, so they should be bounded.
+func WithLabel(family, label, value string) string {
+	return fmt.Sprintf("%s{%s=%q}", family, label, value)
+}
+
+// Default is the registry which is used by the package functions
+var Default = NewRegistry()
+
+// Inc increases the counter of the Default registry by one
+func Inc(name string) {
+	Default.Inc(name)
+}
+
+// Set sets the value of the gauge of the Default registry
+func Set(name string, value int64) {
+	Default.Set(name, value)
+}
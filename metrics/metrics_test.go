@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+)
+
+// run with -race to check the registry for data races
+func TestRegistryConcurrency(t *testing.T) {
+	r := NewRegistry()
+
+	const workers, increments = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				r.Inc("counter")
+				r.Set("gauge", int64(i))
+				r.Snapshot()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s := r.Snapshot()
+	if s.Counters["counter"] != workers*increments {
+		t.Errorf("expected %d, got %d", workers*increments, s.Counters["counter"])
+	}
+	if gauge := s.Gauges["gauge"]; gauge < 0 || gauge >= workers {
+		t.Error("unexpected value for the gauge:", gauge)
+	}
+}
+
+func TestSnapshotIsACopy(t *testing.T) {
+	r := NewRegistry()
+	r.Inc("counter")
+
+	s := r.Snapshot()
+	r.Inc("counter")
+	if s.Counters["counter"] != 1 {
+		t.Error("expected the snapshot not to change, got", s.Counters["counter"])
+	}
+}
+
+func TestWithLabel(t *testing.T) {
+	r := NewRegistry()
+	r.Inc(WithLabel("options_sent", "code", "1"))
+	r.Inc(WithLabel("options_sent", "code", "1"))
+	r.Inc(WithLabel("options_sent", "code", "3"))
+
+	if n := r.Counter(`options_sent{code="1"}`); n != 2 {
+		t.Error("expected the labeled counter to be 2, got", n)
+	}
+	if n := r.Counter(WithLabel("options_sent", "code", "3")); n != 1 {
+		t.Error("expected the labeled counter to be 1, got", n)
+	}
+}
@@ -35,11 +35,12 @@ type HTTPBooter struct {
 	datasource          datasource.DataSource
 	bootParamsTemplates *template.Template
 	webPort             int
+	webScheme           string
 	bootMessageTemplate string
 }
 
 func NewHTTPBooter(listenAddr net.TCPAddr, ldlinux []byte,
-	ds datasource.DataSource, webPort int) (*HTTPBooter, error) {
+	ds datasource.DataSource, webPort int, webScheme string) (*HTTPBooter, error) {
 	bootMessageVersionedTemplate := strings.Replace(bootMessageTemplate,
 		"$VERSION", ds.SelfInfo().Version, -1)
 	bootMessageVersionedTemplate = strings.Replace(bootMessageTemplate,
@@ -49,6 +50,7 @@ func NewHTTPBooter(listenAddr net.TCPAddr, ldlinux []byte,
 		ldlinux:             ldlinux,
 		datasource:          ds,
 		webPort:             webPort,
+		webScheme:           webScheme,
 		bootMessageTemplate: bootMessageVersionedTemplate,
 	}
 	return booter, nil
@@ -68,6 +70,14 @@ func (b *HTTPBooter) ldlinuxHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(b.ldlinux)
 }
 
+// localBootConfig is the pxelinux config of the machines which should boot
+// from their local disks
+const localBootConfig = `
+DEFAULT local
+LABEL local
+LOCALBOOT 0
+`
+
 func (b *HTTPBooter) pxelinuxConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 
@@ -94,6 +104,22 @@ func (b *HTTPBooter) pxelinuxConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the installer is never served to the machines which are locked to
+	// their local disks, even if they've got here through a stale dhcp lease
+	noInstall, err := machineInterface.NoInstall()
+	if err != nil {
+		utils.LogAccess(r).WithError(err).WithField("where", "pxe.pxelinuxConfig").Warn(
+			"error in getting no-install")
+		http.Error(w, "error in getting no-install", 500)
+		return
+	}
+	if noInstall {
+		utils.LogAccess(r).WithField("where", "pxe.pxelinuxConfig").Info(
+			"no-install is set, booting from the local disk")
+		w.Write([]byte(localBootConfig))
+		return
+	}
+
 	if _, _, err := net.SplitHostPort(r.Host); err != nil {
 		r.Host = fmt.Sprintf("%s:%d", r.Host, b.listenAddr.Port)
 	}
@@ -129,11 +155,22 @@ func (b *HTTPBooter) pxelinuxConfig(w http.ResponseWriter, r *http.Request) {
 
 	params = strings.Replace(params, "\n", " ", -1)
 
+	kernelArgs, err := profileKernelArgs(machineInterface)
+	if err != nil {
+		utils.LogAccess(r).WithError(err).WithField("where", "pxe.pxelinuxConfig").Warn(
+			"error in getting the kernel args of the user class profile")
+		http.Error(w, "error in getting the kernel args of the user class profile", 500)
+		return
+	}
+	if kernelArgs != "" {
+		params += " " + kernelArgs
+	}
+
 	Cmdline := fmt.Sprintf(
-		"cloud-config-url=http://%s:%d/t/cc/%s "+
-			"coreos.config.url=http://%s:%d/t/ig/%s %s",
-		host, b.webPort, mac.String(),
-		host, b.webPort, mac.String(), params)
+		"cloud-config-url=%s://%s:%d/t/cc/%s "+
+			"coreos.config.url=%s://%s:%d/t/ig/%s %s",
+		b.webScheme, host, b.webPort, mac.String(),
+		b.webScheme, host, b.webPort, mac.String(), params)
 	bootMessage := strings.Replace(b.bootMessageTemplate, "$MAC", macStr, -1)
 	cfg := fmt.Sprintf(`
 SAY %s
@@ -144,9 +181,36 @@ APPEND initrd=%s %s
 `, strings.Replace(bootMessage, "\n", "\nSAY ", -1), KernelURL, InitrdURL, Cmdline)
 	w.Write([]byte(cfg))
 
+	// starts the reprovision cooldown of the machine
+	if err := machineInterface.StoreProvisioned(); err != nil {
+		utils.LogAccess(r).WithError(err).WithField("where", "pxe.pxelinuxConfig").Warn(
+			"error in storing the provision time")
+	}
+
 	utils.LogAccess(r).WithField("where", "pxe.pxelinuxConfig").Info()
 }
 
+// profileKernelArgs returns the kernel args of the user class profile which
+// is chosen in the last dhcp ACK of the machine, if it's still defined
+func profileKernelArgs(machineInterface datasource.MachineInterface) (string, error) {
+	match, err := machineInterface.UserClassProfile()
+	if err != nil || match == "" {
+		return "", err
+	}
+	profilesStr, err := machineInterface.GetVariable(datasource.SpecialKeyUserClassProfiles)
+	if err != nil {
+		return "", err
+	}
+	profiles, err := datasource.UnmarshalUserClassProfiles(profilesStr)
+	if err != nil {
+		return "", err
+	}
+	if profile := datasource.FindUserClassProfile(match, profiles); profile != nil {
+		return profile.KernelArgs, nil
+	}
+	return "", nil
+}
+
 // Get the contents of a blob mentioned in a previously issued
 // BootSpec. Additionally returns a pretty name for the blob for
 // logging purposes.
@@ -193,20 +257,20 @@ func (b *HTTPBooter) fileHandler(w http.ResponseWriter, r *http.Request) {
 	utils.LogAccess(r).WithField("where", "pxe.fileHandler").Infof("written=%d", written)
 }
 
-func HTTPBooterMux(listenAddr net.TCPAddr, ds datasource.DataSource, webPort int) (*http.ServeMux, error) {
+func HTTPBooterMux(listenAddr net.TCPAddr, ds datasource.DataSource, webPort int, webScheme string) (*http.ServeMux, error) {
 	ldlinux, err := FSByte(false, "/pxelinux/ldlinux.c32")
 	if err != nil {
 		return nil, err
 	}
-	booter, err := NewHTTPBooter(listenAddr, ldlinux, ds, webPort)
+	booter, err := NewHTTPBooter(listenAddr, ldlinux, ds, webPort, webScheme)
 	if err != nil {
 		return nil, err
 	}
 	return booter.Mux(), nil
 }
 
-func ServeHTTPBooter(listenAddr net.TCPAddr, ds datasource.DataSource, webPort int) error {
-	mux, err := HTTPBooterMux(listenAddr, ds, webPort)
+func ServeHTTPBooter(listenAddr net.TCPAddr, ds datasource.DataSource, webPort int, webScheme string) error {
+	mux, err := HTTPBooterMux(listenAddr, ds, webPort, webScheme)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestLogOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-log")
+	if err != nil {
+		t.Error("failed to create a temp dir:", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blacksmith.log")
+
+	w, err := LogOutput(path, 0, 0)
+	if err != nil {
+		t.Error("failed to open the log output:", err)
+		return
+	}
+	defer w.(*RotatingFile).Close()
+
+	log.SetOutput(w)
+	defer log.SetOutput(os.Stderr)
+	log.WithField("where", "utils.TestLogOutputFile").Info("written to the file")
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error("failed to read the log file:", err)
+		return
+	}
+	if !strings.Contains(string(content), "written to the file") {
+		t.Errorf("expected the log line in the file, got %q", content)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-log")
+	if err != nil {
+		t.Error("failed to create a temp dir:", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blacksmith.log")
+
+	f, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Error("failed to open the log file:", err)
+		return
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Error("failed to write:", err)
+			return
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for file, content := range expected {
+		got, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Errorf("failed to read %s: %s", file, err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s: expected %q, got %q", file, content, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected no more than 2 rotated files")
+	}
+}
@@ -1,15 +1,24 @@
 package web
 
 import (
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/dhcp"
+	"github.com/cafebazaar/blacksmith/metrics"
 	"github.com/gorilla/mux"
+	"github.com/krolaw/dhcp4"
 )
 
 // Version returns json encoded version details
@@ -29,6 +38,34 @@ type machineDetails struct {
 	Type          datasource.MachineType `json:"type"`
 	FirstAssigned int64                  `json:"firstAssigned"`
 	LastAssigned  int64                  `json:"lastAssigned"`
+	FirstBoot     int64                  `json:"firstBoot"`
+	Labels        []string               `json:"labels,omitempty"`
+	Notes         string                 `json:"notes,omitempty"`
+	LeaseIP       net.IP                 `json:"leaseIP"`
+	LeaseExpiry   int64                  `json:"leaseExpiry"`
+	LeaseActive   bool                   `json:"leaseActive"`
+	// AgentState is empty if the agent of the machine hasn't reported its
+	// state recently
+	AgentState     string `json:"agentState,omitempty"`
+	AgentStateTime int64  `json:"agentStateTime,omitempty"`
+	// ClientArch is nil if the machine has never reported its architecture
+	ClientArch     *uint16 `json:"clientArch,omitempty"`
+	ClientArchName string  `json:"clientArchName,omitempty"`
+
+	// RFC3339 (UTC) variants of the unix times above, empty for 0
+	FirstAssignedAt  string `json:"firstAssignedAt,omitempty"`
+	LastAssignedAt   string `json:"lastAssignedAt,omitempty"`
+	FirstBootAt      string `json:"firstBootAt,omitempty"`
+	LeaseExpiryAt    string `json:"leaseExpiryAt,omitempty"`
+	AgentStateTimeAt string `json:"agentStateTimeAt,omitempty"`
+}
+
+// formatUnix returns the unix time in RFC3339 (UTC), or "" for 0
+func formatUnix(unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
 }
 
 func machineToDetails(machineInterface datasource.MachineInterface) (*machineDetails, error) {
@@ -38,70 +75,817 @@ func machineToDetails(machineInterface datasource.MachineInterface) (*machineDet
 
 	machine, err := machineInterface.Machine(false, nil)
 	if err != nil {
-		return nil, errors.New("error in retrieving machine details")
+		return nil, fmt.Errorf("error in retrieving machine details: %s", err)
 	}
 	last, _ := machineInterface.LastSeen()
+	firstBoot, _ := machineInterface.FirstBoot()
+	notes, err := machineInterface.Notes()
+	if err != nil {
+		return nil, fmt.Errorf("error in retrieving machine notes: %s", err)
+	}
+	lease, err := machineInterface.Lease()
+	if err != nil {
+		return nil, fmt.Errorf("error in retrieving machine lease: %s", err)
+	}
+	arch, hasArch, err := machineInterface.ClientArch()
+	if err != nil {
+		return nil, fmt.Errorf("error in retrieving machine client arch: %s", err)
+	}
+	agentState, err := machineInterface.AgentState()
+	if err != nil {
+		return nil, fmt.Errorf("error in retrieving machine agent state: %s", err)
+	}
+
+	details := &machineDetails{
+		Name:          name,
+		Nic:           mac.String(),
+		IP:            machine.IP,
+		Type:          machine.Type,
+		FirstAssigned: machine.FirstSeen,
+		LastAssigned:  last,
+		FirstBoot:     firstBoot,
+		Labels:        machine.Labels,
+		Notes:         notes,
+	}
+	if lease != nil {
+		details.LeaseIP = lease.IP
+		details.LeaseExpiry = lease.Expiry
+		details.LeaseActive = lease.Active(time.Now())
+	}
+	if agentState != nil {
+		details.AgentState = agentState.State
+		details.AgentStateTime = agentState.Time
+	}
+	if hasArch {
+		details.ClientArch = &arch
+		details.ClientArchName = dhcp.ClientArchName(arch)
+	}
+	details.FirstAssignedAt = formatUnix(details.FirstAssigned)
+	details.LastAssignedAt = formatUnix(details.LastAssigned)
+	details.FirstBootAt = formatUnix(details.FirstBoot)
+	details.LeaseExpiryAt = formatUnix(details.LeaseExpiry)
+	details.AgentStateTimeAt = formatUnix(details.AgentStateTime)
+	return details, nil
+}
+
+// maxLookupMacs is the maximum number of the macs in a MachinesLookup
+const maxLookupMacs = 500
+
+// MachinesLookup returns the details of the machines of a json list of macs,
+// by their normalized macs. The unknown machines are mapped to null.
+func (ws *webServer) MachinesLookup(w http.ResponseWriter, r *http.Request) {
+	var macStrings []string
+	if err := json.NewDecoder(r.Body).Decode(&macStrings); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+	if len(macStrings) > maxLookupMacs {
+		http.Error(w, fmt.Sprintf(`{"error": "at most %d macs can be looked up at once"}`,
+			maxLookupMacs), http.StatusBadRequest)
+		return
+	}
+
+	res := make(map[string]*machineDetails, len(macStrings))
+	for _, macString := range macStrings {
+		mac, err := net.ParseMAC(macString)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+			return
+		}
 
-	return &machineDetails{
-		name, mac.String(),
-		machine.IP, machine.Type,
-		machine.FirstSeen, last}, nil
+		machineInterface := ws.ds.MachineInterface(mac)
+		known, err := machineInterface.Known()
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+			return
+		}
+		if !known {
+			res[mac.String()] = nil
+			continue
+		}
+
+		details, err := machineToDetails(machineInterface)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+			return
+		}
+		res[mac.String()] = details
+	}
+
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(resJSON))
 }
 
+// machineError is a machine which couldn't be listed, along with the reason
+type machineError struct {
+	Mac   string `json:"mac"`
+	Error string `json:"error"`
+}
+
+// lenientMachinesList is the result of a lenient MachinesList, which is
+// streamed in this shape
+type lenientMachinesList struct {
+	Machines []*machineDetails `json:"machines"`
+	Errors   []machineError    `json:"errors"`
+}
+
+// machinesListFlushInterval is the number of the machines after which the
+// streamed list is flushed to the client
+const machinesListFlushInterval = 100
+
 // MachinesList creates a list of the currently known machines based on the etcd
-// entries
+// entries. It's in json, unless csv is asked for by ?format=csv or by the
+// Accept header. The list fails if any machine fails, unless lenient=true is
+// given, in which case the rest of the machines are listed along with the
+// errors of the failed ones, as {"machines": [...], "errors": [...]}.
+// The machines are streamed as they're read. A list shorter than
+// machinesListFlushInterval is never flushed, and is buffered to be given an
+// ETag, so a failure in the middle of a strict list, or the export timeout,
+// is still answered with 500 or 503. Once the list is flushed the status
+// can't be changed, and the failure is logged and ends the response with an
+// unterminated array.
 func (ws *webServer) MachinesList(w http.ResponseWriter, r *http.Request) {
 	machines, err := ws.ds.MachineInterfaces()
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
 		return
 	}
-	if len(machines) == 0 {
-		io.WriteString(w, "[]")
+	if wantsCSV(r) {
+		writeMachinesCSV(w, r, machines)
 		return
 	}
-	machinesArray := make([]*machineDetails, 0, len(machines))
+	lenient := r.URL.Query().Get("lenient") == "true"
+	open := "["
+	if lenient {
+		open = `{"machines":[`
+	}
+
+	flusher, _ := w.(http.Flusher)
+	machineErrors := []machineError{}
+	written := 0
+	// fail answers the error, unless some of the list has already reached
+	// the client
+	fail := func(err error, status int) bool {
+		if written == 0 {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), status)
+			return true
+		}
+		return abortResponse(w, err, status)
+	}
 	for _, machine := range machines {
-		l, err := machineToDetails(machine)
+		if err := exportStopped(r); err != nil {
+			if !fail(err, http.StatusServiceUnavailable) {
+				log.WithField("where", "web.MachinesList").WithError(err).Warn(
+					"the list of the machines is stopped")
+			}
+			return
+		}
+
+		details, err := machineToDetails(machine)
+		var detailsJSON []byte
+		if err == nil && details != nil {
+			detailsJSON, err = json.Marshal(details)
+		}
+		if err != nil {
+			if lenient {
+				machineErrors = append(machineErrors, machineError{
+					Mac: machine.Mac().String(), Error: err.Error()})
+				continue
+			}
+			if !fail(err, http.StatusInternalServerError) {
+				log.WithFields(log.Fields{
+					"where":  "web.MachinesList",
+					"object": machine.Mac().String(),
+				}).WithError(err).Warn("failed to write the list of the machines")
+			}
+			return
+		}
+		if details == nil {
+			continue
+		}
+
+		if written == 0 {
+			io.WriteString(w, open)
+		} else {
+			io.WriteString(w, ",")
+		}
+		w.Write(detailsJSON)
+		written++
+		if flusher != nil && written%machinesListFlushInterval == 0 {
+			flusher.Flush()
+		}
+	}
+	if written == 0 {
+		io.WriteString(w, open)
+	}
+	io.WriteString(w, "]")
+
+	if lenient {
+		errorsJSON, err := json.Marshal(machineErrors)
+		if err != nil {
+			log.WithField("where", "web.MachinesList").WithError(err).Warn(
+				"failed to write the errors of the machines")
+			return
+		}
+		io.WriteString(w, `,"errors":`)
+		w.Write(errorsJSON)
+		io.WriteString(w, "}")
+	}
+}
+
+// clientArchCount is the number of machines which have reported a client
+// architecture
+type clientArchCount struct {
+	Arch  uint16 `json:"arch"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// ClientArchs returns the number of machines of each client architecture,
+// as they're last reported in option 93. The machines which have never
+// reported one are left out.
+func (ws *webServer) ClientArchs(w http.ResponseWriter, r *http.Request) {
+	machineInterfaces, err := ws.ds.MachineInterfaces()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	counts := make(map[uint16]int)
+	for _, machineInterface := range machineInterfaces {
+		arch, hasArch, err := machineInterface.ClientArch()
 		if err != nil {
 			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
 			return
 		}
-		if l != nil {
-			machinesArray = append(machinesArray, l)
+		if hasArch {
+			counts[arch]++
 		}
 	}
 
-	machinesJSON, err := json.Marshal(machinesArray)
+	archs := make([]int, 0, len(counts))
+	for arch := range counts {
+		archs = append(archs, int(arch))
+	}
+	sort.Ints(archs)
+	res := make([]clientArchCount, 0, len(archs))
+	for _, arch := range archs {
+		res = append(res, clientArchCount{
+			Arch:  uint16(arch),
+			Name:  dhcp.ClientArchName(uint16(arch)),
+			Count: counts[uint16(arch)],
+		})
+	}
+
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(resJSON))
+}
+
+// Stats returns the in-memory counters and gauges, see the metrics package
+func (ws *webServer) Stats(w http.ResponseWriter, r *http.Request) {
+	statsJSON, err := json.Marshal(metrics.Default.Snapshot())
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(statsJSON))
+}
+
+// subnetMachines is a subnet along with the machines in it
+type subnetMachines struct {
+	Subnet   string   `json:"subnet"`
+	Count    int      `json:"count"`
+	Machines []string `json:"machines,omitempty"`
+}
+
+// unknownSubnet groups the machines without a valid network configuration
+const unknownSubnet = "unknown"
+
+// MachineSubnets groups the machines by their subnets, which are derived
+// from their network configurations. With machines=true, the macs of the
+// machines are listed for each subnet.
+func (ws *webServer) MachineSubnets(w http.ResponseWriter, r *http.Request) {
+	withMachines := r.URL.Query().Get("machines") == "true"
+
+	machineInterfaces, err := ws.ds.MachineInterfaces()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	groups := make(map[string]*subnetMachines)
+	for _, machineInterface := range machineInterfaces {
+		machine, err := machineInterface.Machine(false, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+			return
+		}
+		netConfStr, err := machineInterface.GetVariable(datasource.SpecialKeyNetworkConfiguration)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+			return
+		}
+
+		subnet := unknownSubnet
+		if netConf, err := datasource.UnmarshalNetworkConfiguration(netConfStr); err == nil {
+			if ipNet, err := netConf.Subnet(machine.IP); err == nil {
+				subnet = ipNet.String()
+			}
+		}
+
+		group, isIn := groups[subnet]
+		if !isIn {
+			group = &subnetMachines{Subnet: subnet}
+			groups[subnet] = group
+		}
+		group.Count++
+		if withMachines {
+			group.Machines = append(group.Machines, machineInterface.Mac().String())
+		}
+	}
+
+	subnets := make([]string, 0, len(groups))
+	for subnet := range groups {
+		subnets = append(subnets, subnet)
+	}
+	sort.Strings(subnets)
+	res := make([]*subnetMachines, 0, len(groups))
+	for _, subnet := range subnets {
+		sort.Strings(groups[subnet].Machines)
+		res = append(res, groups[subnet])
+	}
+
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(resJSON))
+}
+
+// MachineDelete deletes associated information of a machine entirely
+func (ws *webServer) MachineDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	err = machineInterface.DeleteMachine()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	ws.invalidateMachine(mac)
+
+	io.WriteString(w, `"OK"`)
+}
+
+// ClaimMachine creates the record of a machine, if it has none yet, so it's
+// reserved before the machine boots. The ip and the type are optional, and
+// the created machine is returned. If the machine already has a record, it's
+// answered with 409, even if the record has been created by the dhcp.
+func (ws *webServer) ClaimMachine(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	var machine datasource.Machine
+	if ipString := r.FormValue("ip"); ipString != "" {
+		machine.IP = net.ParseIP(ipString).To4()
+		if machine.IP == nil {
+			http.Error(w, fmt.Sprintf(`{"error": "invalid ipv4 address: %q"}`, ipString),
+				http.StatusBadRequest)
+			return
+		}
+	}
+	if typeString := r.FormValue("type"); typeString != "" {
+		machine.Type, err = datasource.ParseMachineType(typeString)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	machine, err = ws.ds.MachineInterface(mac).Claim(machine)
+	if err == datasource.ErrMachineExists {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	ws.invalidateMachine(mac)
+
+	machineJSON, err := json.Marshal(machine)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(machineJSON)
+}
+
+// MachineNetwork returns the network configuration which the machine receives
+// in the dhcp replies
+func (ws *webServer) MachineNetwork(w http.ResponseWriter, r *http.Request) {
+	if ws.dhcpHandler == nil {
+		http.Error(w, `{"error": "dhcp is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	machine, err := machineInterface.Machine(false, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return
+	}
+
+	conf, err := ws.dhcpHandler.MachineConfiguration(machineInterface, machine)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	confJSON, err := json.Marshal(conf)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(confJSON))
+}
+
+// MachineDNS returns the dns servers which the machine receives in the dhcp
+// replies
+func (ws *webServer) MachineDNS(w http.ResponseWriter, r *http.Request) {
+	if ws.dhcpHandler == nil {
+		http.Error(w, `{"error": "dhcp is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(false, nil); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return
+	}
+
+	dns, err := ws.dhcpHandler.Nameservers(machineInterface)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	dnsJSON, err := json.Marshal(dns)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(dnsJSON))
+}
+
+// MachineNotes returns the notes of a machine
+func (ws *webServer) MachineNotes(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(false, nil); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return
+	}
+
+	notes, err := machineInterface.Notes()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	notesJSON, err := json.Marshal(map[string]string{"notes": notes})
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(notesJSON))
+}
+
+// SetMachineNotes replaces the notes of a machine with the given value, an
+// empty value removes them
+func (ws *webServer) SetMachineNotes(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	notes := r.FormValue("value")
+	if len(notes) > datasource.MaxNotesLength {
+		http.Error(w, fmt.Sprintf(`{"error": "notes are longer than %d bytes"}`,
+			datasource.MaxNotesLength), http.StatusBadRequest)
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(false, nil); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return
+	}
+
+	if err := machineInterface.SetNotes(notes); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// SetMachineType changes the type of a machine to the given value, either
+// the name of a MachineType (normal, static, bmc) or its number
+func (ws *webServer) SetMachineType(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	machineType, err := datasource.ParseMachineType(r.FormValue("value"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	machine, err := machineInterface.Machine(false, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return
+	}
+
+	machine.Type = machineType
+	if _, err := machineInterface.StoreMachine(machine); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	ws.invalidateMachine(mac)
+
+	io.WriteString(w, `"OK"`)
+}
+
+// AgentHeartbeat stores the state which is reported by the agent of a
+// machine (booting, running or shutting-down). The state expires after ttl,
+// a go duration which defaults to datasource.DefaultAgentStateTTL.
+func (ws *webServer) AgentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	state := r.FormValue("state")
+	if err := datasource.ValidateAgentState(state); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+	ttl := datasource.DefaultAgentStateTTL
+	if ttlStr := r.FormValue("ttl"); ttlStr != "" {
+		ttl, err = time.ParseDuration(ttlStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+			return
+		}
+		if ttl < time.Second || ttl > datasource.MaxAgentStateTTL {
+			http.Error(w, fmt.Sprintf(`{"error": "the ttl should be between 1s and %s"}`,
+				datasource.MaxAgentStateTTL), http.StatusBadRequest)
+			return
+		}
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(false, nil); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return
+	}
+
+	if err := machineInterface.SetAgentState(state, ttl); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// ExpireMachineLease marks the active lease of a machine as expired and
+// revoked, so the next request of the machine for its ip is answered with a
+// NAK, and the machine starts over with a Discover
+func (ws *webServer) ExpireMachineLease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	lease, err := machineInterface.Lease()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	if lease == nil || !lease.Active(now) {
+		http.Error(w, `{"error": "no active lease"}`, http.StatusNotFound)
+		return
+	}
+
+	lease.Expiry, lease.Revoked = now.Unix(), true
+	if err := machineInterface.StoreLease(*lease); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// MachineSimulate returns the reply which the machine would receive for a
+// dhcp message, without any side effect. type is either discover (default)
+// or request, and with pxe=true the message is sent as a pxe client.
+func (ws *webServer) MachineSimulate(w http.ResponseWriter, r *http.Request) {
+	if ws.dhcpHandler == nil {
+		http.Error(w, `{"error": "dhcp is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	var msgType dhcp4.MessageType
+	switch query.Get("type") {
+	case "", "discover":
+		msgType = dhcp4.Discover
+	case "request":
+		msgType = dhcp4.Request
+	default:
+		http.Error(w, fmt.Sprintf(`{"error": "unknown message type: %q"}`, query.Get("type")),
+			http.StatusBadRequest)
+		return
+	}
+
+	var options []dhcp4.Option
+	if query.Get("pxe") == "true" {
+		// the guid type, followed by an all zero guid
+		options = append(options, dhcp4.Option{Code: 97, Value: make([]byte, 17)})
+	}
+
+	if _, err := ws.ds.MachineInterface(mac).Machine(false, nil); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return
+	}
+
+	simulation, err := ws.dhcpHandler.Simulate(mac, msgType, options)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	simulationJSON, err := json.Marshal(simulation)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(simulationJSON))
+}
+
+// MachinePXEOptions returns the pxe vendor options (option 43) which the
+// machine receives, in hex, to be compared with a capture of a known-good
+// reply
+func (ws *webServer) MachinePXEOptions(w http.ResponseWriter, r *http.Request) {
+	if ws.dhcpHandler == nil {
+		http.Error(w, `{"error": "dhcp is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(false, nil); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return
+	}
+
+	pxeOptions, err := ws.dhcpHandler.PXEVendorOptions(machineInterface)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	pxeOptionsJSON, err := json.Marshal(map[string]string{"hex": hex.EncodeToString(pxeOptions)})
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
 		return
 	}
-	io.WriteString(w, string(machinesJSON))
+	io.WriteString(w, string(pxeOptionsJSON))
 }
 
-// MachineDelete deletes associated information of a machine entirely
-func (ws *webServer) MachineDelete(w http.ResponseWriter, r *http.Request) {
+// PreflightMachine checks whether the machine is ready to boot, and returns
+// the result of each check along with the reasons of the failed ones
+func (ws *webServer) PreflightMachine(w http.ResponseWriter, r *http.Request) {
+	if ws.dhcpHandler == nil {
+		http.Error(w, `{"error": "dhcp is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
 	vars := mux.Vars(r)
 	macString := vars["mac"]
 
 	mac, err := net.ParseMAC(macString)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
 		return
 	}
 
-	machineInterface := ws.ds.MachineInterface(mac)
-	err = machineInterface.DeleteMachine()
+	report, err := ws.dhcpHandler.Preflight(mac)
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
 		return
 	}
 
-	io.WriteString(w, `"OK"`)
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(reportJSON))
 }
 
-// MachineVariable returns all the flags set for the machine
+// MachineVariables returns all the flags set for the machine. With
+// metadata=true, the modification times are included too. The variables can
+// be filtered by a key prefix, and paged with limit and after (the last key of
+// the previous page); X-More-Variables is set if there are more.
 func (ws *webServer) MachineVariables(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	macString := vars["mac"]
@@ -114,11 +898,44 @@ func (ws *webServer) MachineVariables(w http.ResponseWriter, r *http.Request) {
 
 	machineInterface := ws.ds.MachineInterface(mac)
 
-	flags, err := machineInterface.ListVariables()
+	query := r.URL.Query()
+	prefix, after := query.Get("prefix"), query.Get("after")
+	var limit int
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf(`{"error": "invalid limit: %q"}`, limitStr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var flags interface{}
+	var more bool
+	if query.Get("metadata") == "true" {
+		var variables map[string]datasource.VariableInfo
+		variables, err = machineInterface.ListVariablesWithMetadata()
+		if err == nil {
+			keys := make([]string, 0, len(variables))
+			for k := range variables {
+				keys = append(keys, k)
+			}
+			keys, more = datasource.PageKeys(keys, prefix, after, limit)
+			page := make(map[string]datasource.VariableInfo)
+			for _, k := range keys {
+				page[k] = variables[k]
+			}
+			flags = page
+		}
+	} else {
+		flags, more, err = machineInterface.ListVariablesPage(prefix, after, limit)
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
 		return
 	}
+	if more {
+		w.Header().Set("X-More-Variables", "true")
+	}
 
 	flagsJSON, err := json.Marshal(flags)
 	if err != nil {
@@ -128,6 +945,22 @@ func (ws *webServer) MachineVariables(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, string(flagsJSON))
 }
 
+// writeValidationError responds with the invalid fields, if the error is a
+// *datasource.ValidationError, and reports whether it has responded
+func writeValidationError(w http.ResponseWriter, err error) bool {
+	validationErr, ok := err.(*datasource.ValidationError)
+	if !ok {
+		return false
+	}
+	errJSON, err := json.Marshal(validationErr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return true
+	}
+	http.Error(w, string(errJSON), http.StatusBadRequest)
+	return true
+}
+
 func (ws *webServer) SetMachineVariable(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
@@ -150,10 +983,14 @@ func (ws *webServer) SetMachineVariable(w http.ResponseWriter, r *http.Request)
 
 	err = machineInterface.SetVariable(name, value)
 
+	if writeValidationError(w, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, `{"error": "Error while setting value"}`, http.StatusInternalServerError)
 		return
 	}
+	ws.invalidateMachine(machineInterface.Mac())
 
 	io.WriteString(w, `"OK"`)
 }
@@ -181,10 +1018,46 @@ func (ws *webServer) DelMachineVariable(w http.ResponseWriter, r *http.Request)
 		http.Error(w, `{"error": "Error while delleting value"}`, http.StatusInternalServerError)
 		return
 	}
+	ws.invalidateMachine(machineInterface.Mac())
 
 	io.WriteString(w, `"OK"`)
 }
 
+// ClearMachineVariables deletes all the variables of the machine, but keeps
+// its record and its no-install lock. With preserve-network=true, the network
+// configuration is kept too.
+func (ws *webServer) ClearMachineVariables(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(false, nil); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return
+	}
+
+	// no-install is a safety lock, which is only removed explicitly
+	preserve := []string{datasource.SpecialKeyNoInstall}
+	if r.URL.Query().Get("preserve-network") == "true" {
+		preserve = append(preserve, datasource.SpecialKeyNetworkConfiguration)
+	}
+
+	count, err := machineInterface.DeleteVariables(preserve...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	ws.invalidateMachine(mac)
+
+	io.WriteString(w, fmt.Sprintf(`{"removed": %d}`, count))
+}
+
 // ClusterVariables returns all the cluster general variables
 func (ws *webServer) ClusterVariablesList(w http.ResponseWriter, r *http.Request) {
 	flags, err := ws.ds.ListClusterVariables()
@@ -209,10 +1082,14 @@ func (ws *webServer) SetClusterVariables(w http.ResponseWriter, r *http.Request)
 	var err error
 	err = ws.ds.SetClusterVariable(name, value)
 
+	if writeValidationError(w, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, `{"error": "Error while setting value"}`, http.StatusInternalServerError)
 		return
 	}
+	ws.invalidateMachines()
 
 	io.WriteString(w, `"OK"`)
 }
@@ -227,6 +1104,375 @@ func (ws *webServer) DelClusterVariables(w http.ResponseWriter, r *http.Request)
 		http.Error(w, `{"error": "Error while delleting value"}`, http.StatusInternalServerError)
 		return
 	}
+	ws.invalidateMachines()
+
+	io.WriteString(w, `"OK"`)
+}
+
+// Maintenance returns whether the maintenance mode is on
+func (ws *webServer) Maintenance(w http.ResponseWriter, r *http.Request) {
+	on, err := ws.ds.Maintenance()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	maintenanceJSON, err := json.Marshal(map[string]bool{"maintenance": on})
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(maintenanceJSON))
+}
+
+// SetMaintenance turns the maintenance mode on or off
+func (ws *webServer) SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	on, err := strconv.ParseBool(r.FormValue("value"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	if err := ws.ds.SetMaintenance(on); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, `"OK"`)
+}
+
+// Drain returns whether this instance is draining
+func (ws *webServer) Drain(w http.ResponseWriter, r *http.Request) {
+	if ws.dhcpHandler == nil {
+		http.Error(w, `{"error": "dhcp is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	drainJSON, err := json.Marshal(map[string]bool{"draining": ws.dhcpHandler.Draining()})
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(drainJSON))
+}
+
+// SetDrain turns the drain mode of this instance on or off
+func (ws *webServer) SetDrain(w http.ResponseWriter, r *http.Request) {
+	if ws.dhcpHandler == nil {
+		http.Error(w, `{"error": "dhcp is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	draining, err := strconv.ParseBool(r.FormValue("value"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	ws.dhcpHandler.SetDraining(draining)
+
+	io.WriteString(w, `"OK"`)
+}
+
+// Readyz reports whether this instance is ready to take new clients, which
+// it's not while draining
+func (ws *webServer) Readyz(w http.ResponseWriter, r *http.Request) {
+	if ws.dhcpHandler != nil && ws.dhcpHandler.Draining() {
+		http.Error(w, `{"ready": false, "draining": true}`, http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, `{"ready": true}`)
+}
+
+// DHCPProbe reports the status of the dhcp listener of this instance. It's
+// 503 unless the listener is bound and serving, even if the process is up.
+func (ws *webServer) DHCPProbe(w http.ResponseWriter, r *http.Request) {
+	if ws.dhcpHandler == nil {
+		http.Error(w, `{"error": "dhcp is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	status := ws.dhcpHandler.ListenerStatus()
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	if !status.Listening {
+		http.Error(w, string(statusJSON), http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, string(statusJSON))
+}
+
+// DHCPErrors returns the recent errors of the dhcp requests, the oldest
+// first, see dhcp.RecentError
+func (ws *webServer) DHCPErrors(w http.ResponseWriter, r *http.Request) {
+	if ws.dhcpHandler == nil {
+		http.Error(w, `{"error": "dhcp is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	errorsJSON, err := json.Marshal(ws.dhcpHandler.RecentErrors())
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(errorsJSON))
+}
+
+// ClearDHCPErrors forgets the recent errors of the dhcp requests
+func (ws *webServer) ClearDHCPErrors(w http.ResponseWriter, r *http.Request) {
+	if ws.dhcpHandler == nil {
+		http.Error(w, `{"error": "dhcp is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	ws.dhcpHandler.ClearRecentErrors()
+	io.WriteString(w, `"OK"`)
+}
+
+// MachineDHCPTransactions returns the last dhcp transactions of the
+// machine, the oldest first, see dhcp.Transaction
+func (ws *webServer) MachineDHCPTransactions(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+	if ws.dhcpHandler == nil {
+		http.Error(w, `{"error": "dhcp is not configured"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	transactionsJSON, err := json.Marshal(ws.dhcpHandler.Transactions(mac))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(transactionsJSON))
+}
+
+// QuarantinedMachines returns the addresses of the machines which are held
+// in the quarantine subnet, by their macs
+func (ws *webServer) QuarantinedMachines(w http.ResponseWriter, r *http.Request) {
+	quarantined, err := ws.ds.QuarantinedMachines()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	quarantinedJSON, err := json.Marshal(quarantined)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(quarantinedJSON))
+}
+
+// ApproveMachine releases a machine from the quarantine, so it's served
+// normally from its next dhcp request
+func (ws *webServer) ApproveMachine(w http.ResponseWriter, r *http.Request) {
+	ws.decideQuarantine(w, r, datasource.QuarantineApproved)
+}
+
+// RejectMachine stops answering the dhcp requests of a quarantined machine
+func (ws *webServer) RejectMachine(w http.ResponseWriter, r *http.Request) {
+	ws.decideQuarantine(w, r, datasource.QuarantineRejected)
+}
+
+// decideQuarantine approves or rejects a quarantined machine. The decisions
+// are recorded along with the remote address of the request, and logged.
+func (ws *webServer) decideQuarantine(w http.ResponseWriter, r *http.Request, decision string) {
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	if decision == datasource.QuarantineApproved {
+		_, err = ws.ds.ApproveMachine(mac, r.RemoteAddr)
+	} else {
+		err = ws.ds.RejectMachine(mac, r.RemoteAddr)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"where":   "web.decideQuarantine",
+		"action":  decision,
+		"object":  mac.String(),
+		"subject": r.RemoteAddr,
+	}).Info("quarantined machine is " + decision)
+
+	io.WriteString(w, `"OK"`)
+}
+
+// QuarantineDecisions returns the last decisions which are made about the
+// quarantined machines, by their macs
+func (ws *webServer) QuarantineDecisions(w http.ResponseWriter, r *http.Request) {
+	decisions, err := ws.ds.QuarantineDecisions()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	decisionsJSON, err := json.Marshal(decisions)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(decisionsJSON))
+}
+
+// etcdKeys are the etcd keys which a machine or a variable maps to
+type etcdKeys struct {
+	Machine         string `json:"machine,omitempty"`
+	MachineVariable string `json:"machineVariable,omitempty"`
+	ClusterVariable string `json:"clusterVariable,omitempty"`
+}
+
+// EtcdKeys returns the etcd keys which the given mac and/or variable map to,
+// for inspecting etcd directly. Nothing is read from etcd.
+func (ws *webServer) EtcdKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	macString, variable := query.Get("mac"), query.Get("variable")
+	if macString == "" && variable == "" {
+		http.Error(w, `{"error": "mac or variable is required"}`, http.StatusBadRequest)
+		return
+	}
+	if strings.Contains(variable, "/") || variable == "." || variable == ".." {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, "invalid variable name: "+variable),
+			http.StatusBadRequest)
+		return
+	}
+
+	var keys etcdKeys
+	if variable != "" {
+		keys.ClusterVariable = ws.ds.ClusterVariableEtcdKey(variable)
+	}
+	if macString != "" {
+		mac, err := net.ParseMAC(macString)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+			return
+		}
+		machineInterface := ws.ds.MachineInterface(mac)
+		keys.Machine = machineInterface.EtcdKey("")
+		if variable != "" {
+			keys.MachineVariable = machineInterface.EtcdKey(variable)
+		}
+	}
+
+	keysJSON, err := json.Marshal(keys)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(keysJSON))
+}
+
+// Metrics returns the gauges of the machines and their leases, and the
+// counters and the gauges of the metrics registry, in the OpenMetrics text
+// format
+func (ws *webServer) Metrics(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	// a failing datasource doesn't fail the scrape, it's reported by
+	// blacksmith_web_inventory_errors_total instead
+	inv, err := ws.inventory.get(ws.ds, time.Now())
+	if err != nil {
+		metrics.Inc(metricInventoryErrors)
+		log.WithField("where", "web.Metrics").WithError(err).Warn("couldn't collect the inventory")
+	} else {
+		writeInventoryMetrics(&b, inv)
+	}
+	writeRegistryMetrics(&b, metrics.Default.Snapshot())
+	b.WriteString("# EOF\n")
+
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// Subnets returns the subnet definitions
+func (ws *webServer) Subnets(w http.ResponseWriter, r *http.Request) {
+	subnets, err := ws.ds.Subnets()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	subnetsJSON, err := json.Marshal(subnets)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(subnetsJSON))
+}
+
+// SetSubnet creates or replaces the subnet definition of the json body,
+// which is refused with 409 if it overlaps another subnet
+func (ws *webServer) SetSubnet(w http.ResponseWriter, r *http.Request) {
+	var subnet datasource.SubnetDefinition
+	if err := json.NewDecoder(r.Body).Decode(&subnet); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	if err := ws.ds.SetSubnet(&subnet); err != nil {
+		switch err.(type) {
+		case *datasource.InvalidSubnetError:
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		case *datasource.SubnetOverlapError:
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusConflict)
+		default:
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	subnetJSON, err := json.Marshal(subnet)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(subnetJSON))
+}
+
+// DeleteSubnet deletes the subnet definition of the cidr in the path, e.g.
+// /api/subnets/10.0.0.0/24
+func (ws *webServer) DeleteSubnet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cidr := vars["ip"] + "/" + vars["size"]
+
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	subnets, err := ws.ds.Subnets()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	found := false
+	for _, s := range subnets {
+		found = found || s.CIDR == subnet.String()
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf(`{"error": "subnet %s is not defined"}`, subnet), http.StatusNotFound)
+		return
+	}
+
+	if err := ws.ds.DeleteSubnet(subnet.String()); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
 
 	io.WriteString(w, `"OK"`)
 }
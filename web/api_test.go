@@ -1,14 +1,22 @@
 package web
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/dhcp"
+	"github.com/cafebazaar/blacksmith/metrics"
+	"github.com/krolaw/dhcp4"
 )
 
 func TestMachineVariablesAPI(t *testing.T) {
@@ -120,3 +128,2280 @@ func TestMachineVariablesAPI(t *testing.T) {
 		return
 	}
 }
+
+func TestMachineNetworkAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:66")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	err = ds.SetClusterVariable(datasource.SpecialKeyNetworkConfiguration, `{
+		"netmask": "255.255.255.0",
+		"router": "127.0.0.254",
+		"classlessRouteOption": [{"router": "127.0.0.253", "size": 8, "destination": "10.0.0.0"}]
+	}`)
+	if err != nil {
+		t.Error("error while setting the network configuration:", err)
+		return
+	}
+
+	dhcpHandler := dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})
+	r := &webServer{ds: ds, dhcpHandler: dhcpHandler}
+	h := r.Handler()
+
+	////////////////////////////////
+	// Unknown machine
+	req, err := http.NewRequest("GET", fmt.Sprintf(
+		"http://test.com/api/machines/%s/network", mac1), nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Error("unexpected status code for an unknown machine:", w.Code)
+		return
+	}
+
+	////////////////////////////////
+	// Simulated dhcp reply
+	p := dhcp4.RequestPacket(dhcp4.Discover, mac1, nil, []byte{1, 2, 3, 4}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionParameterRequestList, Value: []byte{1, 3, 6, 12, 121}},
+	})
+	reply := dhcpHandler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	replyOptions := reply.ParseOptions()
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Error("unexpected status code while getting the network configuration:", w.Code)
+		return
+	}
+
+	var conf dhcp.MachineConfiguration
+	if err := json.Unmarshal(w.Body.Bytes(), &conf); err != nil {
+		t.Error("error while unmarshalling the network configuration:", err)
+		return
+	}
+
+	var dns []byte
+	for _, ip := range conf.DNS {
+		dns = append(dns, ip.To4()...)
+	}
+	var routes []byte
+	for _, part := range conf.ClasslessRouteOption {
+		routes = append(routes, part.ToBytes()...)
+	}
+
+	if !conf.IP.Equal(reply.YIAddr()) {
+		t.Errorf("ip: expected %s, got %s", reply.YIAddr(), conf.IP)
+	}
+	if !bytes.Equal(conf.Netmask.To4(), replyOptions[dhcp4.OptionSubnetMask]) {
+		t.Errorf("netmask: expected %v, got %s", replyOptions[dhcp4.OptionSubnetMask], conf.Netmask)
+	}
+	if !bytes.Equal(conf.Router.To4(), replyOptions[dhcp4.OptionRouter]) {
+		t.Errorf("router: expected %v, got %s", replyOptions[dhcp4.OptionRouter], conf.Router)
+	}
+	if !bytes.Equal(routes, replyOptions[dhcp4.OptionClasslessRouteFormat]) {
+		t.Errorf("classless routes: expected %v, got %v", replyOptions[dhcp4.OptionClasslessRouteFormat], routes)
+	}
+	if !bytes.Equal(dns, replyOptions[dhcp4.OptionDomainNameServer]) {
+		t.Errorf("dns: expected %v, got %v", replyOptions[dhcp4.OptionDomainNameServer], dns)
+	}
+	if conf.Hostname != string(replyOptions[dhcp4.OptionHostName]) {
+		t.Errorf("hostname: expected %q, got %q", replyOptions[dhcp4.OptionHostName], conf.Hostname)
+	}
+}
+
+func TestMaintenanceAPI(t *testing.T) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	tests := []struct {
+		method   string
+		url      string
+		code     int
+		expected string
+	}{
+		{"GET", "http://test.com/api/maintenance", 200, `{"maintenance":false}`},
+		{"PUT", "http://test.com/api/maintenance?value=true", 200, `"OK"`},
+		{"GET", "http://test.com/api/maintenance", 200, `{"maintenance":true}`},
+		{"PUT", "http://test.com/api/maintenance?value=maybe", http.StatusBadRequest, ""},
+		{"PUT", "http://test.com/api/maintenance?value=false", 200, `"OK"`},
+		{"GET", "http://test.com/api/maintenance", 200, `{"maintenance":false}`},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("#%d: expected status code %d, got %d", i, tt.code, w.Code)
+			continue
+		}
+		if tt.expected != "" && w.Body.String() != tt.expected {
+			t.Errorf("#%d: expected %s, got %s", i, tt.expected, w.Body.String())
+		}
+	}
+}
+
+func TestMachineVariablesMetadataAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:77")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	mi := ds.MachineInterface(mac1)
+	if _, err := mi.Machine(true, nil); err != nil {
+		t.Error("error while creating machine:", err)
+		return
+	}
+	if err := mi.SetVariable("test", "value"); err != nil {
+		t.Error("error while setting the variable:", err)
+		return
+	}
+
+	////////////////////////////////
+	// Legacy flat mode
+	req, err := http.NewRequest("GET", fmt.Sprintf(
+		"http://test.com/api/machines/%s/variables", mac1), nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var flat map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &flat); err != nil {
+		t.Error("error while unmarshalling the flat variables:", err, w.Body.String())
+		return
+	}
+	if flat["test"] != "value" {
+		t.Errorf("expected test=value in the flat variables, got %v", flat)
+	}
+
+	////////////////////////////////
+	// With metadata
+	req, err = http.NewRequest("GET", fmt.Sprintf(
+		"http://test.com/api/machines/%s/variables?metadata=true", mac1), nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var variables map[string]datasource.VariableInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &variables); err != nil {
+		t.Error("error while unmarshalling the variables:", err, w.Body.String())
+		return
+	}
+	variable, found := variables["test"]
+	if !found || variable.Value != "value" {
+		t.Errorf("expected test=value in the variables, got %v", variables)
+		return
+	}
+	if variable.Modified == 0 || variable.ModifiedIndex == 0 {
+		t.Errorf("expected the modification times to be present, got %+v", variable)
+	}
+
+	////////////////////////////////
+	// Filtered by prefix, and paged
+	for _, key := range []string{"test-1", "test-2"} {
+		if err := mi.SetVariable(key, "value"); err != nil {
+			t.Error("error while setting the variable:", err)
+			return
+		}
+	}
+	req, err = http.NewRequest("GET", fmt.Sprintf(
+		"http://test.com/api/machines/%s/variables?prefix=test-&limit=1", mac1), nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	flat = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &flat); err != nil {
+		t.Error("error while unmarshalling the filtered variables:", err, w.Body.String())
+		return
+	}
+	if _, found := flat["test-1"]; len(flat) != 1 || !found {
+		t.Errorf("expected only test-1 in the filtered variables, got %v", flat)
+	}
+	if w.Header().Get("X-More-Variables") != "true" {
+		t.Error("expected X-More-Variables to be set")
+	}
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(
+		"http://test.com/api/machines/%s/variables?limit=-1", mac1), nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Error("unexpected status code for an invalid limit:", w.Code)
+	}
+}
+
+func TestClearMachineVariablesAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:88")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:89")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	mi := ds.MachineInterface(mac1)
+	if _, err := mi.Machine(true, nil); err != nil {
+		t.Error("error while creating machine:", err)
+		return
+	}
+
+	clearVariables := func(url string) (int, string) {
+		req, err := http.NewRequest("DELETE", url, nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return 0, ""
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	for _, key := range []string{"a", "b", datasource.SpecialKeyNetworkConfiguration, datasource.SpecialKeyNoInstall} {
+		value := "x"
+		switch key {
+		case datasource.SpecialKeyNetworkConfiguration:
+			value = `{"netmask": "255.255.255.0"}`
+		case datasource.SpecialKeyNoInstall:
+			value = "true"
+		}
+		if err := mi.SetVariable(key, value); err != nil {
+			t.Error("error while setting variable:", err)
+			return
+		}
+	}
+
+	////////////////////////////////
+	// Preserving the network configuration
+	code, body := clearVariables(fmt.Sprintf(
+		"http://test.com/api/machines/%s/variables?preserve-network=true", mac1))
+	if code != 200 || body != `{"removed": 2}` {
+		t.Error("unexpected response while clearing the variables:", code, body)
+		return
+	}
+	variables, err := mi.ListVariables()
+	if err != nil {
+		t.Error("error while listing the variables:", err)
+		return
+	}
+	if _, found := variables[datasource.SpecialKeyNetworkConfiguration]; !found {
+		t.Error("expected the network configuration to be preserved")
+	}
+	if _, found := variables["a"]; found {
+		t.Error("expected the variable to be removed")
+	}
+	if _, err := mi.Machine(false, nil); err != nil {
+		t.Error("expected the machine record to be kept:", err)
+	}
+
+	////////////////////////////////
+	// Everything
+	code, body = clearVariables(fmt.Sprintf("http://test.com/api/machines/%s/variables", mac1))
+	if code != 200 || body != `{"removed": 1}` {
+		t.Error("unexpected response while clearing the variables:", code, body)
+	}
+	if noInstall, err := mi.NoInstall(); err != nil || !noInstall {
+		t.Error("expected no-install to be kept:", noInstall, err)
+	}
+
+	////////////////////////////////
+	// Unknown machine
+	code, _ = clearVariables(fmt.Sprintf("http://test.com/api/machines/%s/variables", mac2))
+	if code != http.StatusNotFound {
+		t.Error("unexpected status code for an unknown machine:", code)
+	}
+}
+
+func TestMachineSimulateAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:99")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	dhcpHandler := dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})
+	r := &webServer{ds: ds, dhcpHandler: dhcpHandler}
+	h := r.Handler()
+
+	simulate := func(query string) (int, map[string]interface{}) {
+		req, err := http.NewRequest("GET", fmt.Sprintf(
+			"http://test.com/api/machines/%s/simulate%s", mac1, query), nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return 0, nil
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		var res map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+
+	if code, _ := simulate(""); code != http.StatusNotFound {
+		t.Error("unexpected status code for an unknown machine:", code)
+		return
+	}
+
+	mi := ds.MachineInterface(mac1)
+	if _, err := mi.Machine(true, nil); err != nil {
+		t.Error("error while creating machine:", err)
+		return
+	}
+
+	p := dhcp4.RequestPacket(dhcp4.Discover, mac1, nil, []byte{1, 2, 3, 4}, false, nil)
+	offer := dhcpHandler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if offer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	code, res := simulate("?type=discover")
+	if code != 200 {
+		t.Error("unexpected status code while simulating:", code)
+		return
+	}
+	packetBytes, ok := res["packetBytes"].(float64)
+	if !ok || int(packetBytes) != len(offer) {
+		t.Errorf("expected packetBytes=%d, got %v", len(offer), res["packetBytes"])
+	}
+	buildDurationMs, ok := res["buildDurationMs"].(float64)
+	if !ok || buildDurationMs < 0 || buildDurationMs > 10000 {
+		t.Error("unexpected buildDurationMs:", res["buildDurationMs"])
+	}
+
+	code, res = simulate("?type=request&pxe=true")
+	if code != 200 || res["messageType"] != "ACK" {
+		t.Error("unexpected response while simulating a request:", code, res)
+	}
+	if packetBytes, _ := res["packetBytes"].(float64); int(packetBytes) <= len(offer) {
+		t.Error("expected the pxe options to enlarge the packet, got", packetBytes)
+	}
+	if firstBoot, _ := mi.FirstBoot(); firstBoot != 0 {
+		t.Error("expected no side effect for a simulated request")
+	}
+
+	if code, _ := simulate("?type=inform"); code != http.StatusBadRequest {
+		t.Error("unexpected status code for an unknown message type:", code)
+	}
+}
+
+func TestDrainAPI(t *testing.T) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	r := &webServer{ds: ds, dhcpHandler: dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})}
+	h := r.Handler()
+
+	tests := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{"GET", "http://test.com/readyz", 200},
+		{"PUT", "http://test.com/api/drain?value=true", 200},
+		{"GET", "http://test.com/readyz", http.StatusServiceUnavailable},
+		{"PUT", "http://test.com/api/drain?value=maybe", http.StatusBadRequest},
+		{"PUT", "http://test.com/api/drain?value=false", 200},
+		{"GET", "http://test.com/readyz", 200},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("#%d: expected status code %d, got %d", i, tt.code, w.Code)
+		}
+	}
+}
+
+func TestDHCPProbeAPI(t *testing.T) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	probe := func(ws *webServer) (int, dhcp.ListenerStatus) {
+		var status dhcp.ListenerStatus
+		req, _ := http.NewRequest("GET", "http://test.com/api/dhcp/probe", nil)
+		w := httptest.NewRecorder()
+		ws.Handler().ServeHTTP(w, req)
+		json.Unmarshal(w.Body.Bytes(), &status)
+		return w.Code, status
+	}
+
+	if code, _ := probe(&webServer{ds: ds}); code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d without a dhcp handler, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	dhcpHandler := dhcp.NewHandler("", net.ParseIP("::1"), ds, dhcp.HandlerOptions{})
+	ws := &webServer{ds: ds, dhcpHandler: dhcpHandler}
+	code, status := probe(ws)
+	if code != http.StatusServiceUnavailable || status.Listening || status.StartedAt != 0 {
+		t.Errorf("expected a listener which isn't started, got %d %+v", code, status)
+	}
+
+	if err := dhcp.StartDHCP(dhcpHandler); err == nil {
+		t.Error("expected an error for starting dhcp on an ipv6 address")
+		return
+	}
+	code, status = probe(ws)
+	if code != http.StatusServiceUnavailable || status.Listening || status.StartedAt != 0 ||
+		!strings.Contains(status.Error, "not an ipv4 address") {
+		t.Errorf("expected a failed listener, got %d %+v", code, status)
+	}
+}
+
+func TestDHCPNotConfigured(t *testing.T) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+	h := (&webServer{ds: ds}).Handler()
+
+	for _, tt := range []struct{ method, url string }{
+		{"GET", "http://test.com/api/machines/00:11:22:33:44:55/network"},
+		{"GET", "http://test.com/api/machines/00:11:22:33:44:55/dns"},
+		{"GET", "http://test.com/api/machines/00:11:22:33:44:55/simulate"},
+		{"GET", "http://test.com/api/machines/00:11:22:33:44:55/pxe-options"},
+		{"GET", "http://test.com/api/machines/00:11:22:33:44:55/preflight"},
+		{"GET", "http://test.com/api/drain"},
+		{"PUT", "http://test.com/api/drain?value=true"},
+	} {
+		req, err := http.NewRequest(tt.method, tt.url, nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s: expected status code %d without a dhcp handler, got %d",
+				tt.method, tt.url, http.StatusServiceUnavailable, w.Code)
+		}
+	}
+}
+
+func TestDHCPErrorsAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:f8")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	dhcpHandler := dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})
+	h := (&webServer{ds: ds, dhcpHandler: dhcpHandler}).Handler()
+	do := func(method string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://test.com/api/dhcp/errors", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if err := ds.DeleteClusterVariable(datasource.SpecialKeyNetworkConfiguration); err != nil {
+		t.Error("error while deleting the network configuration:", err)
+		return
+	}
+	p := dhcp4.RequestPacket(dhcp4.Discover, mac1, nil, []byte{1, 2, 3, 4}, false, nil)
+	if reply := dhcpHandler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions()); reply != nil {
+		t.Error("expected no reply without a network configuration")
+	}
+
+	var recentErrors []dhcp.RecentError
+	w := do("GET")
+	if err := json.Unmarshal(w.Body.Bytes(), &recentErrors); err != nil || w.Code != http.StatusOK {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body.String())
+		return
+	}
+	if len(recentErrors) != 1 || recentErrors[0].Mac != mac1.String() ||
+		!strings.Contains(recentErrors[0].Error, "network-configuration") {
+		t.Errorf("expected the failure of the Discover, got %+v", recentErrors)
+	}
+
+	if w := do("DELETE"); w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d while clearing the errors: %s", w.Code, w.Body.String())
+	}
+	if w := do("GET"); strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Error("expected no error after clearing, got", w.Body.String())
+	}
+}
+
+func TestMachineDHCPTransactionsAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:45:01")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	dhcpHandler := dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})
+	h := (&webServer{ds: ds, dhcpHandler: dhcpHandler}).Handler()
+	get := func(mac string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://test.com/api/machines/"+mac+"/dhcp-transactions", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get(mac1.String()); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("expected no transaction before any request, got %d: %s", w.Code, w.Body.String())
+	}
+
+	p := dhcp4.RequestPacket(dhcp4.Discover, mac1, nil, []byte{1, 2, 3, 4}, false, nil)
+	dhcpHandler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+
+	var transactions []dhcp.Transaction
+	w := get(mac1.String())
+	if err := json.Unmarshal(w.Body.Bytes(), &transactions); err != nil || w.Code != http.StatusOK {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body.String())
+		return
+	}
+	if len(transactions) != 1 || transactions[0].Type != "discover" {
+		t.Errorf("expected the discover to be listed, got %+v", transactions)
+	}
+
+	if w := get("not-a-mac"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid mac, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMachinePXEOptionsAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:f2")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	machineInterface := ds.MachineInterface(mac1)
+	if _, err := machineInterface.Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+	if err := machineInterface.SetVariable(datasource.SpecialKeyPXEBootMessage, "Rack 12"); err != nil {
+		t.Error("error while setting the pxe boot message:", err)
+		return
+	}
+
+	dhcpHandler := dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})
+	h := (&webServer{ds: ds, dhcpHandler: dhcpHandler}).Handler()
+
+	for path, code := range map[string]int{
+		"not-a-mac":         http.StatusBadRequest,
+		"00:11:22:33:44:f1": http.StatusNotFound,
+		mac1.String():       http.StatusOK,
+	} {
+		req, _ := http.NewRequest("GET", "http://test.com/api/machines/"+path+"/pxe-options", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("%s: expected status code %d, got %d", path, code, w.Code)
+			continue
+		}
+		if code != http.StatusOK {
+			continue
+		}
+
+		var res map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Error("error while unmarshaling the pxe options:", err)
+			continue
+		}
+
+		// the same bytes are sent in option 43 of the replies
+		p := dhcp4.RequestPacket(dhcp4.Discover, mac1, nil, []byte{1, 2, 3, 4}, false, []dhcp4.Option{
+			{Code: 97, Value: make([]byte, 17)},
+		})
+		reply := dhcpHandler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+		if reply == nil {
+			t.Error("expected a reply for the Discover")
+			continue
+		}
+		expected := fmt.Sprintf("%x", reply.ParseOptions()[dhcp4.OptionVendorSpecificInformation])
+		if res["hex"] != expected {
+			t.Errorf("expected the pxe options %s, got %s", expected, res["hex"])
+		}
+	}
+}
+
+func TestMachinesListLenient(t *testing.T) {
+	good1, _ := net.ParseMAC("00:11:22:33:44:ee")
+	good2, _ := net.ParseMAC("00:11:22:33:44:ef")
+	bad, _ := net.ParseMAC("00:11:22:33:44:f0")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	for _, mac := range []net.HardwareAddr{good1, good2} {
+		if _, err := ds.MachineInterface(mac).Machine(true, nil); err != nil {
+			t.Error("error while creating the machine:", err)
+			return
+		}
+	}
+	// a variable without a machine record, e.g. one which is left from a
+	// partial delete
+	if err := ds.MachineInterface(bad).SetVariable("foo", "bar"); err != nil {
+		t.Error("error while setting the variable:", err)
+		return
+	}
+
+	h := (&webServer{ds: ds}).Handler()
+	list := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://test.com/api/machines"+query, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// the bad machine comes after the good ones, but the strict list still
+	// fails with 500, as nothing is flushed yet, and without an ETag
+	for _, query := range []string{"", "?format=csv"} {
+		if w := list(query); w.Code != http.StatusInternalServerError || w.Header().Get("ETag") != "" {
+			t.Errorf("%q: expected the strict list to fail, got %d: %s", query, w.Code, w.Body.String())
+		}
+	}
+
+	w := list("?lenient=true")
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the lenient list to succeed, got %d: %s", w.Code, w.Body.String())
+		return
+	}
+	var res lenientMachinesList
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Error("error while unmarshaling the list:", err)
+		return
+	}
+	listed := make(map[string]bool)
+	for _, details := range res.Machines {
+		listed[details.Nic] = true
+	}
+	if !listed[good1.String()] || !listed[good2.String()] || listed[bad.String()] {
+		t.Errorf("expected the good machines to be listed, got %v", listed)
+	}
+	if len(res.Errors) != 1 || res.Errors[0].Mac != bad.String() || res.Errors[0].Error == "" {
+		t.Errorf("expected an error for %s, got %+v", bad, res.Errors)
+	}
+}
+
+func TestMachinesListStreaming(t *testing.T) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	const count = 2*machinesListFlushInterval + 10
+	macs := make(map[string]bool)
+	for i := 0; i < count; i++ {
+		mac := net.HardwareAddr{0x02, 0x11, 0x22, 0x33, byte(i >> 8), byte(i)}
+		ip := net.IPv4(10, 1, byte(i>>8), byte(i))
+		if _, err := ds.MachineInterface(mac).Machine(true, ip); err != nil {
+			t.Error("error while creating the machine:", err)
+			return
+		}
+		macs[mac.String()] = true
+	}
+
+	h := (&webServer{ds: ds}).Handler()
+	for _, query := range []string{"", "?lenient=true"} {
+		req, _ := http.NewRequest("GET", "http://test.com/api/machines"+query, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: unexpected status %d: %s", query, w.Code, w.Body.String())
+			continue
+		}
+
+		var machines []*machineDetails
+		if query == "" {
+			err = json.Unmarshal(w.Body.Bytes(), &machines)
+		} else {
+			var res lenientMachinesList
+			err = json.Unmarshal(w.Body.Bytes(), &res)
+			if len(res.Errors) != 0 {
+				t.Errorf("%q: unexpected errors: %+v", query, res.Errors)
+			}
+			machines = res.Machines
+		}
+		if err != nil {
+			t.Errorf("%q: invalid json of the streamed list: %s", query, err)
+			continue
+		}
+		listed := 0
+		for _, details := range machines {
+			if macs[details.Nic] {
+				listed++
+			}
+		}
+		if listed != count {
+			t.Errorf("%q: expected %d machines to be listed, got %d", query, count, listed)
+		}
+	}
+
+	// behind all the middlewares of ServeWeb, the list is still flushed, and
+	// so is given no ETag
+	ws := &webServer{
+		ds:      ds,
+		exports: newExportLimiter(4, time.Minute),
+		options: Options{LogRequests: true},
+	}
+	for _, query := range []string{"", "?format=csv"} {
+		req, _ := http.NewRequest("GET", "http://test.com/api/machines"+query, nil)
+		w := httptest.NewRecorder()
+		ws.httpHandler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK || !w.Flushed || w.Header().Get("ETag") != "" {
+			t.Errorf("%q: expected the list to be streamed, got %d, flushed: %v, etag: %q",
+				query, w.Code, w.Flushed, w.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestMetricsAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:aa")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	dhcpHandler := dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})
+	r := &webServer{ds: ds, dhcpHandler: dhcpHandler}
+	h := r.Handler()
+
+	optionsSent := metrics.WithLabel("dhcp_options_sent", "code", "1")
+	expected := fmt.Sprintf(`blacksmith_dhcp_options_sent_total{code="1"} %d`, metrics.Default.Counter(optionsSent)+1)
+	p := dhcp4.RequestPacket(dhcp4.Discover, mac1, nil, []byte{1, 2, 3, 4}, false, nil)
+	if reply := dhcpHandler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions()); reply == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+
+	req, err := http.NewRequest("GET", "http://test.com/metrics", nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Error("unexpected status code while getting the metrics:", w.Code)
+		return
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "# TYPE blacksmith_dhcp_options_sent counter\n") ||
+		!strings.Contains(body, expected) ||
+		!strings.HasSuffix(body, "# EOF\n") {
+		t.Error("unexpected metrics:", body)
+	}
+}
+
+func TestMachineNotesAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:bb")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if _, err := ds.MachineInterface(mac1).Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	notesURL := "http://test.com/api/machines/" + mac1.String() + "/notes"
+	tooLong := strings.Repeat("x", datasource.MaxNotesLength+1)
+	tests := []struct {
+		method   string
+		url      string
+		code     int
+		expected string
+	}{
+		{"GET", notesURL, 200, `{"notes":""}`},
+		{"PUT", notesURL + "?value=bad+NIC%2C+RMA+pending", 200, `"OK"`},
+		{"GET", notesURL, 200, `{"notes":"bad NIC, RMA pending"}`},
+		{"PUT", notesURL + "?value=" + tooLong, http.StatusBadRequest, ""},
+		{"GET", notesURL, 200, `{"notes":"bad NIC, RMA pending"}`},
+		{"PUT", "http://test.com/api/machines/00:11:22:33:44:bc/notes?value=x", http.StatusNotFound, ""},
+		{"PUT", "http://test.com/api/machines/invalid/notes?value=x", http.StatusBadRequest, ""},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("#%d: expected status code %d, got %d", i, tt.code, w.Code)
+			continue
+		}
+		if tt.expected != "" && w.Body.String() != tt.expected {
+			t.Errorf("#%d: expected %s, got %s", i, tt.expected, w.Body.String())
+		}
+	}
+
+	req, err := http.NewRequest("GET", "http://test.com/api/machines", nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `"notes":"bad NIC, RMA pending"`) {
+		t.Error("expected the notes in the machines list, got", w.Body.String())
+	}
+}
+
+func TestEtcdKeysAPI(t *testing.T) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	cluster := ds.ClusterName()
+	tests := []struct {
+		url      string
+		code     int
+		expected string
+	}{
+		{"http://test.com/api/etcd-keys?mac=00:11:22:33:44:cc", 200,
+			`{"machine":"` + cluster + `/machines/0011223344cc"}`},
+		{"http://test.com/api/etcd-keys?variable=net-conf", 200,
+			`{"clusterVariable":"` + cluster + `/cluster-variables/net-conf"}`},
+		{"http://test.com/api/etcd-keys?mac=00:11:22:33:44:cc&variable=net-conf", 200,
+			`{"machine":"` + cluster + `/machines/0011223344cc",` +
+				`"machineVariable":"` + cluster + `/machines/0011223344cc/net-conf",` +
+				`"clusterVariable":"` + cluster + `/cluster-variables/net-conf"}`},
+		{"http://test.com/api/etcd-keys", http.StatusBadRequest, ""},
+		{"http://test.com/api/etcd-keys?mac=invalid", http.StatusBadRequest, ""},
+		{"http://test.com/api/etcd-keys?variable=../../machines", http.StatusBadRequest, ""},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("#%d: expected status code %d, got %d", i, tt.code, w.Code)
+			continue
+		}
+		if tt.expected != "" && w.Body.String() != tt.expected {
+			t.Errorf("#%d: expected %s, got %s", i, tt.expected, w.Body.String())
+		}
+	}
+}
+
+func TestQuarantineAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:dd")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	subnet, err := datasource.UnmarshalQuarantineSubnet(`{"start": "10.99.0.10", "range": 5, "netmask": "255.255.255.0"}`)
+	if err != nil {
+		t.Error("error while parsing the quarantine subnet:", err)
+		return
+	}
+	if _, err := ds.QuarantineLease(mac1, subnet); err != nil {
+		t.Error("error while quarantining the machine:", err)
+		return
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	tests := []struct {
+		method   string
+		url      string
+		code     int
+		expected string
+	}{
+		{"GET", "http://test.com/api/quarantine", 200, `{"00:11:22:33:44:dd":"10.99.0.10"}`},
+		{"POST", "http://test.com/api/quarantine/invalid/approve", http.StatusBadRequest, ""},
+		{"POST", "http://test.com/api/quarantine/00:11:22:33:44:dd/approve", 200, `"OK"`},
+		{"GET", "http://test.com/api/quarantine", 200, `{}`},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("#%d: expected status code %d, got %d", i, tt.code, w.Code)
+			continue
+		}
+		if tt.expected != "" && w.Body.String() != tt.expected {
+			t.Errorf("#%d: expected %s, got %s", i, tt.expected, w.Body.String())
+		}
+	}
+
+	if known, _ := ds.MachineInterface(mac1).Known(); !known {
+		t.Error("expected the approved machine to have a record")
+	}
+}
+
+func TestQuarantineApprovalFlow(t *testing.T) {
+	approved, _ := net.ParseMAC("00:11:22:33:44:de")
+	rejected, _ := net.ParseMAC("00:11:22:33:44:df")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	err = ds.SetClusterVariable(datasource.SpecialKeyQuarantineSubnet,
+		`{"start": "10.99.0.10", "range": 5, "netmask": "255.255.255.0"}`)
+	if err != nil {
+		t.Error("error while setting the quarantine subnet:", err)
+		return
+	}
+
+	dhcpHandler := dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})
+	r := &webServer{ds: ds, dhcpHandler: dhcpHandler}
+	h := r.Handler()
+
+	// distinct xids, so the replies are not served from the reply cache
+	xid := byte(0)
+	discover := func(mac net.HardwareAddr) dhcp4.Packet {
+		xid++
+		p := dhcp4.RequestPacket(dhcp4.Discover, mac, nil, []byte{4, 0, 0, xid}, false,
+			[]dhcp4.Option{{Code: 97, Value: []byte{0, 1}}})
+		return dhcpHandler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	}
+	do := func(method, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		req.RemoteAddr = "10.0.0.5:4321"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, mac := range []net.HardwareAddr{approved, rejected} {
+		offer := discover(mac)
+		if offer == nil {
+			t.Error("expected a quarantine offer for", mac)
+			return
+		}
+		if _, isIn := offer.ParseOptions()[dhcp4.OptionVendorSpecificInformation]; isIn {
+			t.Error("expected no boot options in the quarantine for", mac)
+		}
+	}
+
+	w := do("GET", "http://test.com/api/quarantine")
+	expected := `{"00:11:22:33:44:de":"10.99.0.10","00:11:22:33:44:df":"10.99.0.11"}`
+	if w.Code != 200 || w.Body.String() != expected {
+		t.Errorf("unexpected quarantined machines: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := do("POST", "http://test.com/api/quarantine/"+approved.String()+"/approve"); w.Code != 200 {
+		t.Error("unexpected status code while approving:", w.Code)
+	}
+	if w := do("POST", "http://test.com/api/quarantine/"+rejected.String()+"/reject"); w.Code != 200 {
+		t.Error("unexpected status code while rejecting:", w.Code)
+	}
+
+	machine, err := ds.MachineInterface(approved).Machine(false, nil)
+	if err != nil {
+		t.Error("expected a record for the approved machine:", err)
+		return
+	}
+	offer := discover(approved)
+	if offer == nil || !offer.YIAddr().Equal(machine.IP) {
+		t.Error("expected a normal lease for the approved machine")
+	} else if _, isIn := offer.ParseOptions()[dhcp4.OptionVendorSpecificInformation]; !isIn {
+		t.Error("expected the boot options for the approved machine")
+	}
+	if offer := discover(rejected); offer != nil {
+		t.Error("expected no reply for the rejected machine, got", offer.YIAddr())
+	}
+
+	w = do("GET", "http://test.com/api/quarantine")
+	if w.Body.String() != `{}` {
+		t.Error("expected no quarantined machine, got", w.Body.String())
+	}
+
+	var decisions map[string]datasource.QuarantineDecision
+	w = do("GET", "http://test.com/api/quarantine/decisions")
+	if err := json.Unmarshal(w.Body.Bytes(), &decisions); err != nil {
+		t.Error("error while unmarshaling the decisions:", err)
+		return
+	}
+	for mac, expected := range map[string]string{
+		approved.String(): datasource.QuarantineApproved,
+		rejected.String(): datasource.QuarantineRejected,
+	} {
+		decision := decisions[mac]
+		if decision.Decision != expected || decision.By != "10.0.0.5:4321" || decision.Time == 0 {
+			t.Errorf("unexpected decision for %s: %+v", mac, decision)
+		}
+	}
+}
+
+func TestMachineDetailsLease(t *testing.T) {
+	leased, _ := net.ParseMAC("00:11:22:33:44:e0")
+	unleased, _ := net.ParseMAC("00:11:22:33:44:e1")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	dhcpHandler := dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})
+	r := &webServer{ds: ds, dhcpHandler: dhcpHandler}
+	h := r.Handler()
+
+	p := dhcp4.RequestPacket(dhcp4.Discover, leased, nil, []byte{6, 0, 0, 1}, false, nil)
+	offer := dhcpHandler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if offer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	p = dhcp4.RequestPacket(dhcp4.Request, leased, nil, []byte{6, 0, 0, 2}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionRequestedIPAddress, Value: offer.YIAddr().To4()},
+	})
+	if ack := dhcpHandler.ServeDHCP(p, dhcp4.Request, p.ParseOptions()); ack == nil {
+		t.Error("expected a reply for the Request")
+		return
+	}
+	if _, err := ds.MachineInterface(unleased).Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	req, err := http.NewRequest("GET", "http://test.com/api/machines", nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var machines []machineDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &machines); err != nil {
+		t.Error("error while unmarshaling the machines:", err)
+		return
+	}
+	found := 0
+	for _, machine := range machines {
+		switch machine.Nic {
+		case leased.String():
+			found++
+			if !machine.LeaseIP.Equal(offer.YIAddr()) || !machine.LeaseActive ||
+				machine.LeaseExpiry <= time.Now().Unix() {
+				t.Errorf("unexpected lease for the leased machine: %+v", machine)
+			}
+		case unleased.String():
+			found++
+			if machine.LeaseIP != nil || machine.LeaseActive || machine.LeaseExpiry != 0 {
+				t.Errorf("expected no lease for the unleased machine: %+v", machine)
+			}
+		}
+	}
+	if found != 2 {
+		t.Error("expected both machines in the list, got", w.Body.String())
+	}
+}
+
+func TestExpireMachineLeaseAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:e2")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	machineInterface := ds.MachineInterface(mac1)
+	machine, err := machineInterface.Machine(true, nil)
+	if err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+	expire := func() int {
+		req, _ := http.NewRequest("DELETE", "http://test.com/api/machines/"+mac1.String()+"/lease", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := expire(); code != http.StatusNotFound {
+		t.Error("expected 404 without any lease, got", code)
+	}
+
+	err = machineInterface.StoreLease(datasource.Lease{IP: machine.IP, Expiry: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Error("error while storing the lease:", err)
+		return
+	}
+	if code := expire(); code != 200 {
+		t.Error("unexpected status code while expiring the lease:", code)
+	}
+
+	lease, err := machineInterface.Lease()
+	if err != nil || lease == nil {
+		t.Error("expected the lease to be kept:", err)
+		return
+	}
+	if lease.Active(time.Now()) || !lease.Revoked || !lease.IP.Equal(machine.IP) {
+		t.Errorf("expected the lease to be expired and revoked: %+v", lease)
+	}
+
+	if code := expire(); code != http.StatusNotFound {
+		t.Error("expected 404 for an expired lease, got", code)
+	}
+}
+
+func TestMachineSubnetsAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:e3")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:e4")
+	mac3, _ := net.ParseMAC("00:11:22:33:44:e5")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if err := ds.SetClusterVariable(datasource.SpecialKeyNetworkConfiguration, `{"netmask": "255.255.255.0"}`); err != nil {
+		t.Error("error while setting the network configuration:", err)
+		return
+	}
+	for _, machine := range []struct {
+		mac net.HardwareAddr
+		ip  net.IP
+	}{
+		{mac1, nil},
+		{mac2, net.IPv4(10, 1, 0, 5)},
+		{mac3, net.IPv4(10, 1, 0, 6)},
+	} {
+		if _, err := ds.MachineInterface(machine.mac).Machine(true, machine.ip); err != nil {
+			t.Error("error while creating the machine:", err)
+			return
+		}
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	req, err := http.NewRequest("GET", "http://test.com/api/machines/subnets?machines=true", nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var subnets []subnetMachines
+	if err := json.Unmarshal(w.Body.Bytes(), &subnets); err != nil {
+		t.Error("error while unmarshaling the subnets:", err, w.Body.String())
+		return
+	}
+	counts := make(map[string]int)
+	for _, subnet := range subnets {
+		counts[subnet.Subnet] = subnet.Count
+		if len(subnet.Machines) != subnet.Count {
+			t.Errorf("%s: expected %d machines, got %v", subnet.Subnet, subnet.Count, subnet.Machines)
+		}
+	}
+	if counts["10.1.0.0/24"] != 2 {
+		t.Error("expected 2 machines in 10.1.0.0/24, got", w.Body.String())
+	}
+	// the instance itself is a machine of the lease range too
+	if counts["127.0.0.0/24"] < 1 {
+		t.Error("expected the machines of the lease range in 127.0.0.0/24, got", w.Body.String())
+	}
+}
+
+func TestPreflightMachineAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:e6")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:e7")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if _, err := ds.MachineInterface(mac1).Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+	if err := ds.DeleteClusterVariable(datasource.SpecialKeyNetworkConfiguration); err != nil {
+		t.Error("error while deleting the network configuration:", err)
+		return
+	}
+
+	dhcpHandler := dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})
+	r := &webServer{ds: ds, dhcpHandler: dhcpHandler}
+	h := r.Handler()
+
+	preflight := func(mac net.HardwareAddr) map[string]dhcp.PreflightCheck {
+		req, err := http.NewRequest("GET", fmt.Sprintf(
+			"http://test.com/api/machines/%s/preflight", mac), nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return nil
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Error("unexpected status code while preflighting:", w.Code, w.Body.String())
+			return nil
+		}
+
+		var report dhcp.PreflightReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Error("error while unmarshaling the report:", err)
+			return nil
+		}
+		if report.Ready {
+			t.Error("expected the machine not to be ready:", w.Body.String())
+		}
+		checks := make(map[string]dhcp.PreflightCheck)
+		for _, check := range report.Checks {
+			checks[check.Name] = check
+		}
+		return checks
+	}
+
+	// missing network configuration
+	checks := preflight(mac1)
+	if checks == nil {
+		return
+	}
+	if !checks[dhcp.PreflightRecord].Passed || !checks[dhcp.PreflightIP].Passed {
+		t.Error("expected the record and the ip checks to pass:", checks)
+	}
+	if check := checks[dhcp.PreflightNetworkConfiguration]; check.Passed || check.Reason == "" {
+		t.Error("expected the network configuration check to fail with a reason:", check)
+	}
+	if checks[dhcp.PreflightBootfile].Passed {
+		t.Error("expected the bootfile check to fail")
+	}
+
+	// unknown machine
+	checks = preflight(mac2)
+	if checks == nil {
+		return
+	}
+	if len(checks) != 4 {
+		t.Error("expected all the checks to be reported:", checks)
+	}
+	for name, check := range checks {
+		if check.Passed {
+			t.Errorf("%s: expected the check to fail for an unknown machine", name)
+		}
+	}
+}
+
+func TestClientArchsAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:e8")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:e9")
+	mac3, _ := net.ParseMAC("00:11:22:33:44:ea")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	for _, machine := range []struct {
+		mac  net.HardwareAddr
+		arch uint16
+	}{
+		{mac1, 7},
+		{mac2, 9},
+		{mac3, 0},
+	} {
+		machineInterface := ds.MachineInterface(machine.mac)
+		if _, err := machineInterface.Machine(true, nil); err != nil {
+			t.Error("error while creating the machine:", err)
+			return
+		}
+		if err := machineInterface.StoreClientArch(machine.arch); err != nil {
+			t.Error("error while storing the client arch:", err)
+			return
+		}
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	req, err := http.NewRequest("GET", "http://test.com/api/machines", nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var machines []machineDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &machines); err != nil {
+		t.Error("error while unmarshaling the machines:", err)
+		return
+	}
+	for _, machine := range machines {
+		if machine.Nic == mac1.String() && (machine.ClientArch == nil ||
+			*machine.ClientArch != 7 || machine.ClientArchName != "x64 UEFI") {
+			t.Errorf("unexpected client arch in the machine details: %+v", machine)
+		}
+	}
+
+	req, err = http.NewRequest("GET", "http://test.com/api/machines/client-archs", nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var counts []clientArchCount
+	if err := json.Unmarshal(w.Body.Bytes(), &counts); err != nil {
+		t.Error("error while unmarshaling the counts:", err, w.Body.String())
+		return
+	}
+	expected := []clientArchCount{
+		{Arch: 0, Name: "x86 BIOS", Count: 1},
+		{Arch: 7, Name: "x64 UEFI", Count: 1},
+		{Arch: 9, Name: "x64 UEFI", Count: 1},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %v, got %v", expected, counts)
+	}
+}
+
+func TestStatsAPI(t *testing.T) {
+	metrics.Inc("test_stats_api")
+
+	r := &webServer{}
+
+	req, err := http.NewRequest("GET", "http://test.com/api/stats", nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w := httptest.NewRecorder()
+	r.Stats(w, req)
+	if w.Code != 200 {
+		t.Error("unexpected status code:", w.Code)
+		return
+	}
+
+	var stats metrics.Snapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Error("error while unmarshaling the stats:", err)
+		return
+	}
+	if stats.Counters["test_stats_api"] == 0 {
+		t.Error("expected the counter in the stats, got", w.Body.String())
+	}
+}
+
+func TestSetMachineTypeAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:eb")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	machine, err := ds.MachineInterface(mac1).Machine(true, nil)
+	if err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	typeURL := "http://test.com/api/machines/" + mac1.String() + "/type"
+	tests := []struct {
+		url      string
+		code     int
+		expected datasource.MachineType
+	}{
+		{typeURL + "?value=bmc", 200, datasource.MTBMC},
+		{typeURL + "?value=unknown", http.StatusBadRequest, datasource.MTBMC},
+		{typeURL + "?value=7", http.StatusBadRequest, datasource.MTBMC},
+		{typeURL + "?value=2", 200, datasource.MTStatic},
+		{"http://test.com/api/machines/00:11:22:33:44:ec/type?value=bmc", http.StatusNotFound, datasource.MTStatic},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("PUT", tt.url, nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("#%d: expected status code %d, got %d", i, tt.code, w.Code)
+			continue
+		}
+
+		stored, err := ds.MachineInterface(mac1).Machine(false, nil)
+		if err != nil {
+			t.Error("error while getting the machine:", err)
+			return
+		}
+		if stored.Type != tt.expected {
+			t.Errorf("#%d: expected type %d, got %d", i, tt.expected, stored.Type)
+		}
+		if !stored.IP.Equal(machine.IP) || stored.FirstSeen != machine.FirstSeen {
+			t.Errorf("#%d: expected the rest of the machine to be kept, got %+v", i, stored)
+		}
+	}
+}
+
+func TestClaimMachineAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:fc")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:fd")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	claimURL := func(mac net.HardwareAddr) string {
+		return "http://test.com/api/machines/" + mac.String() + "/claim"
+	}
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{claimURL(mac1) + "?ip=127.0.0.5&type=static", 200},
+		{claimURL(mac1), http.StatusConflict},
+		{claimURL(mac2) + "?ip=127.0.0.5", http.StatusInternalServerError},
+		{claimURL(mac2) + "?ip=invalid", http.StatusBadRequest},
+		{claimURL(mac2) + "?type=unknown", http.StatusBadRequest},
+		{"http://test.com/api/machines/invalid/claim", http.StatusBadRequest},
+		{claimURL(mac2), 200},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", tt.url, nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("#%d: expected status code %d, got %d: %s", i, tt.code, w.Code, w.Body.String())
+		}
+	}
+
+	machine, err := ds.MachineInterface(mac1).Machine(false, nil)
+	if err != nil {
+		t.Error("error while getting the claimed machine:", err)
+		return
+	}
+	if !machine.IP.Equal(net.IPv4(127, 0, 0, 5)) || machine.Type != datasource.MTStatic {
+		t.Error("expected the claimed ip and type to be kept, got", machine)
+	}
+	if _, err := ds.MachineInterface(mac2).Machine(false, nil); err != nil {
+		t.Error("expected the second machine to be claimed:", err)
+	}
+}
+
+func TestAgentHeartbeatAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:ed")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if _, err := ds.MachineInterface(mac1).Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	agentState := func() string {
+		req, err := http.NewRequest("GET", "http://test.com/api/machines", nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return ""
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		var machines []machineDetails
+		if err := json.Unmarshal(w.Body.Bytes(), &machines); err != nil {
+			t.Error("error while unmarshaling the machines:", err)
+			return ""
+		}
+		for _, machine := range machines {
+			if machine.Nic == mac1.String() {
+				return machine.AgentState
+			}
+		}
+		t.Error("the machine is missing from the list")
+		return ""
+	}
+
+	heartbeatURL := "http://test.com/api/machines/" + mac1.String() + "/heartbeat"
+	tests := []struct {
+		url      string
+		code     int
+		expected string
+	}{
+		{heartbeatURL + "?state=booting", 200, datasource.AgentStateBooting},
+		{heartbeatURL + "?state=sleeping", http.StatusBadRequest, datasource.AgentStateBooting},
+		{heartbeatURL + "?state=running&ttl=2h", http.StatusBadRequest, datasource.AgentStateBooting},
+		{heartbeatURL + "?state=running&ttl=1s", 200, datasource.AgentStateRunning},
+		{"http://test.com/api/machines/00:11:22:33:44:ee/heartbeat?state=running", http.StatusNotFound,
+			datasource.AgentStateRunning},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", tt.url, nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("#%d: expected status code %d, got %d", i, tt.code, w.Code)
+			continue
+		}
+		if state := agentState(); state != tt.expected {
+			t.Errorf("#%d: expected state %q, got %q", i, tt.expected, state)
+		}
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if state := agentState(); state != "" {
+		t.Error("expected the state to be expired, got", state)
+	}
+}
+
+func TestMachinesLookupAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:f0")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:f1")
+	unknown, _ := net.ParseMAC("00:11:22:33:44:f2")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	for _, mac := range []net.HardwareAddr{mac1, mac2} {
+		if _, err := ds.MachineInterface(mac).Machine(true, nil); err != nil {
+			t.Error("error while creating the machine:", err)
+			return
+		}
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	lookup := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://test.com/api/machines/lookup", strings.NewReader(body))
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return nil
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// the macs are normalized in the result
+	w := lookup(fmt.Sprintf(`["%s", "00-11-22-33-44-F1", "%s"]`, mac1, unknown))
+	if w.Code != 200 {
+		t.Error("unexpected status code:", w.Code, w.Body.String())
+		return
+	}
+	var res map[string]*machineDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Error("error while unmarshaling the result:", err)
+		return
+	}
+	if len(res) != 3 {
+		t.Error("expected 3 macs in the result, got", w.Body.String())
+	}
+	for _, mac := range []net.HardwareAddr{mac1, mac2} {
+		if details := res[mac.String()]; details == nil || details.Nic != mac.String() {
+			t.Errorf("expected the details of %s, got %+v", mac, details)
+		}
+	}
+	if details, isIn := res[unknown.String()]; !isIn || details != nil {
+		t.Error("expected null for the unknown machine, got", w.Body.String())
+	}
+
+	tooMany := make([]string, maxLookupMacs+1)
+	for i := range tooMany {
+		tooMany[i] = mac1.String()
+	}
+	tooManyJSON, _ := json.Marshal(tooMany)
+	for i, body := range []string{`["invalid"]`, `{}`, string(tooManyJSON)} {
+		if w := lookup(body); w.Code != http.StatusBadRequest {
+			t.Errorf("#%d: expected status code %d, got %d", i, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestMachineDetailsTimes(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:f3")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	dhcpHandler := dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})
+	r := &webServer{ds: ds, dhcpHandler: dhcpHandler}
+	h := r.Handler()
+
+	p := dhcp4.RequestPacket(dhcp4.Discover, mac1, nil, []byte{8, 0, 0, 1}, false, nil)
+	offer := dhcpHandler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if offer == nil {
+		t.Error("expected a reply for the Discover")
+		return
+	}
+	p = dhcp4.RequestPacket(dhcp4.Request, mac1, nil, []byte{8, 0, 0, 2}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionRequestedIPAddress, Value: offer.YIAddr().To4()},
+	})
+	if ack := dhcpHandler.ServeDHCP(p, dhcp4.Request, p.ParseOptions()); ack == nil {
+		t.Error("expected a reply for the Request")
+		return
+	}
+
+	req, err := http.NewRequest("GET", "http://test.com/api/machines", nil)
+	if err != nil {
+		t.Error("error while NewRequest:", err)
+		return
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var machines []machineDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &machines); err != nil {
+		t.Error("error while unmarshaling the machines:", err)
+		return
+	}
+	for _, machine := range machines {
+		if machine.Nic != mac1.String() {
+			continue
+		}
+		for name, tt := range map[string]struct {
+			unix      int64
+			formatted string
+		}{
+			"firstAssigned": {machine.FirstAssigned, machine.FirstAssignedAt},
+			"lastAssigned":  {machine.LastAssigned, machine.LastAssignedAt},
+			"firstBoot":     {machine.FirstBoot, machine.FirstBootAt},
+			"leaseExpiry":   {machine.LeaseExpiry, machine.LeaseExpiryAt},
+		} {
+			if tt.unix == 0 {
+				t.Errorf("%s: expected the time to be set", name)
+				continue
+			}
+			parsed, err := time.Parse(time.RFC3339, tt.formatted)
+			if err != nil {
+				t.Errorf("%s: invalid RFC3339 time %q: %s", name, tt.formatted, err)
+				continue
+			}
+			if parsed.Unix() != tt.unix {
+				t.Errorf("%s: expected %d, got %q", name, tt.unix, tt.formatted)
+			}
+		}
+		if machine.AgentStateTimeAt != "" {
+			t.Error("expected no formatted time for an unset time, got", machine.AgentStateTimeAt)
+		}
+		return
+	}
+	t.Error("the machine is missing from the list")
+}
+
+func TestSubnetsAPI(t *testing.T) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	tests := []struct {
+		method   string
+		url      string
+		body     string
+		code     int
+		expected string
+	}{
+		{"GET", "http://test.com/api/subnets", "", 200, `[]`},
+		{"PUT", "http://test.com/api/subnets", `{"cidr": "10.0.1.7/24", "router": "10.0.1.1", "dns": ["8.8.8.8"]}`, 200,
+			`{"cidr":"10.0.1.0/24","netmask":"255.255.255.0","router":"10.0.1.1","dns":["8.8.8.8"]}`},
+		{"PUT", "http://test.com/api/subnets", `{"cidr": "10.0.0.0/24"}`, 200, ""},
+		// invalid definitions
+		{"PUT", "http://test.com/api/subnets", `{"cidr": "10.0.2.0"}`, http.StatusBadRequest, ""},
+		{"PUT", "http://test.com/api/subnets", `{"cidr": "10.0.2.0/24", "netmask": "255.255.0.0"}`, http.StatusBadRequest, ""},
+		{"PUT", "http://test.com/api/subnets", `{"cidr": "10.0.2.0/24", "router": "10.0.3.1"}`, http.StatusBadRequest, ""},
+		{"PUT", "http://test.com/api/subnets",
+			`{"cidr": "10.0.2.0/24", "classlessRouteOption": [{"router": "10.0.3.1", "size": 8, "destination": "10.0.0.0"}]}`,
+			http.StatusBadRequest, ""},
+		{"PUT", "http://test.com/api/subnets", `{"cidr": "10.0.2.0/24", "rangeStart": "10.0.2.10"}`, http.StatusBadRequest, ""},
+		{"PUT", "http://test.com/api/subnets",
+			`{"cidr": "10.0.2.0/24", "rangeStart": "10.0.2.10", "rangeEnd": "10.0.3.10"}`, http.StatusBadRequest, ""},
+		{"PUT", "http://test.com/api/subnets",
+			`{"cidr": "10.0.2.0/24", "rangeStart": "10.0.2.100", "rangeEnd": "10.0.2.10"}`, http.StatusBadRequest, ""},
+		{"PUT", "http://test.com/api/subnets",
+			`{"cidr": "10.0.2.0/24", "rangeStart": "10.0.2.10", "rangeEnd": "10.0.2.100", "exclude": ["10.0.2.1"]}`,
+			http.StatusBadRequest, ""},
+		{"PUT", "http://test.com/api/subnets",
+			`{"cidr": "10.0.2.0/24", "rangeStart": "10.0.2.10", "rangeEnd": "10.0.2.100", "exclude": ["10.0.2.50"]}`, 200,
+			`{"cidr":"10.0.2.0/24","netmask":"255.255.255.0","rangeStart":"10.0.2.10","rangeEnd":"10.0.2.100","exclude":["10.0.2.50"]}`},
+		{"DELETE", "http://test.com/api/subnets/10.0.2.0/24", "", 200, `"OK"`},
+		{"PUT", "http://test.com/api/subnets", `{"cidr": "10.0.0.0/16"}`, http.StatusConflict, ""},
+		{"PUT", "http://test.com/api/subnets", `{"cidr": "10.0.1.128/25"}`, http.StatusConflict, ""},
+		// replacing a subnet doesn't overlap itself
+		{"PUT", "http://test.com/api/subnets", `{"cidr": "10.0.1.0/24", "router": "10.0.1.254"}`, 200, ""},
+		{"GET", "http://test.com/api/subnets", "", 200,
+			`[{"cidr":"10.0.0.0/24","netmask":"255.255.255.0"},{"cidr":"10.0.1.0/24","netmask":"255.255.255.0","router":"10.0.1.254"}]`},
+		{"DELETE", "http://test.com/api/subnets/10.0.1.0/24", "", 200, `"OK"`},
+		{"DELETE", "http://test.com/api/subnets/10.0.1.0/24", "", http.StatusNotFound, ""},
+		{"DELETE", "http://test.com/api/subnets/10.0.1.0/99", "", http.StatusBadRequest, ""},
+		{"GET", "http://test.com/api/subnets", "", 200, `[{"cidr":"10.0.0.0/24","netmask":"255.255.255.0"}]`},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("#%d: expected status code %d, got %d: %s", i, tt.code, w.Code, w.Body.String())
+			continue
+		}
+		if tt.expected != "" && w.Body.String() != tt.expected {
+			t.Errorf("#%d: expected %s, got %s", i, tt.expected, w.Body.String())
+		}
+	}
+}
+
+func TestNetworkConfigurationErrors(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:ff")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if _, err := ds.MachineInterface(mac).Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	netConf := `{"netmask": "255.255.255.0", "router": "10.0.0.1", "classlessRouteOption": [` +
+		`{"router": "127.0.0.1", "size": 24, "destination": "10.1.0.0"}, {"router": "::1", "size": 40}]}`
+	expected := datasource.ValidationError{Errors: []datasource.FieldError{
+		{Field: "router", Reason: "10.0.0.1 is outside the subnet 127.0.0.0/24"},
+		{Field: "classlessRouteOption[1].size", Reason: "40 is larger than 32"},
+		{Field: "classlessRouteOption[1].destination", Reason: "not an ipv4 address"},
+		{Field: "classlessRouteOption[1].router", Reason: "not an ipv4 address"},
+	}}
+
+	for _, path := range []string{
+		"/api/variables/net-conf",
+		"/api/machines/" + mac.String() + "/variables/net-conf",
+	} {
+		req, err := http.NewRequest("PUT", "http://test.com"+path+"?value="+url.QueryEscape(netConf), nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d: %s", path, w.Code, w.Body.String())
+			continue
+		}
+		var got datasource.ValidationError
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Errorf("%s: error while unmarshaling the errors: %s", path, err)
+			continue
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s: expected %+v, got %+v", path, expected, got)
+		}
+	}
+}
+
+func TestMachineDNSAPI(t *testing.T) {
+	mac1, _ := net.ParseMAC("00:11:22:33:44:f7")
+	unknown, _ := net.ParseMAC("00:11:22:33:44:f6")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	machineInterface := ds.MachineInterface(mac1)
+	if _, err := machineInterface.Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	h := (&webServer{ds: ds, dhcpHandler: dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})}).Handler()
+
+	tests := []struct {
+		mac       string
+		dnsSource string
+		status    int
+		expected  []string
+	}{
+		{"not-a-mac", "", http.StatusBadRequest, nil},
+		{unknown.String(), "", http.StatusNotFound, nil},
+		{mac1.String(), `{"mode": "self"}`, http.StatusOK, []string{"127.0.0.1"}},
+		{mac1.String(), `{"mode": "static", "servers": ["8.8.8.8", "8.8.4.4", "8.8.8.8"]}`,
+			http.StatusOK, []string{"8.8.8.8", "8.8.4.4"}},
+	}
+
+	for i, test := range tests {
+		if test.dnsSource != "" {
+			if err := machineInterface.SetVariable(datasource.SpecialKeyDNSSource, test.dnsSource); err != nil {
+				t.Errorf("#%d: error while setting the dns source: %s", i, err)
+				continue
+			}
+		}
+
+		req, err := http.NewRequest("GET", "http://test.com/api/machines/"+test.mac+"/dns", nil)
+		if err != nil {
+			t.Errorf("#%d: error while NewRequest: %s", i, err)
+			continue
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("#%d: expected status %d, got %d: %s", i, test.status, w.Code, w.Body.String())
+			continue
+		}
+		if test.expected == nil {
+			continue
+		}
+		var dns []string
+		if err := json.Unmarshal(w.Body.Bytes(), &dns); err != nil {
+			t.Errorf("#%d: error while unmarshaling the result: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(dns, test.expected) {
+			t.Errorf("#%d: expected %q, got %q", i, test.expected, dns)
+		}
+	}
+}
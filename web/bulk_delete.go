@@ -0,0 +1,138 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// machinesFilter selects the machines by a label, a type and a subnet. The
+// criteria which are given are all required to match.
+type machinesFilter struct {
+	label       string
+	hasType     bool
+	machineType datasource.MachineType
+	subnet      *net.IPNet
+}
+
+// parseMachinesFilter reads the label, type and subnet (in cidr notation)
+// parameters. At least one of them is required.
+func parseMachinesFilter(query url.Values) (*machinesFilter, error) {
+	f := &machinesFilter{label: query.Get("label")}
+	if typeStr := query.Get("type"); typeStr != "" {
+		machineType, err := datasource.ParseMachineType(typeStr)
+		if err != nil {
+			return nil, err
+		}
+		f.hasType, f.machineType = true, machineType
+	}
+	if subnetStr := query.Get("subnet"); subnetStr != "" {
+		_, subnet, err := net.ParseCIDR(subnetStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet: %q", subnetStr)
+		}
+		f.subnet = subnet
+	}
+	if f.label == "" && !f.hasType && f.subnet == nil {
+		return nil, errors.New("at least one of label, type and subnet is required")
+	}
+	return f, nil
+}
+
+func (f *machinesFilter) matches(machine datasource.Machine) bool {
+	if f.hasType && machine.Type != f.machineType {
+		return false
+	}
+	if f.subnet != nil && !f.subnet.Contains(machine.IP) {
+		return false
+	}
+	if f.label != "" {
+		for _, label := range machine.Labels {
+			if label == f.label {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+type machinesDeleteResult struct {
+	DryRun   bool     `json:"dryRun"`
+	Matched  int      `json:"matched"`
+	Deleted  int      `json:"deleted"`
+	Machines []string `json:"machines"`
+}
+
+// MachinesDelete deletes the machines which match the label, type and subnet
+// parameters. With dryRun=true the matching machines are only listed,
+// otherwise confirm=true is required.
+func (ws *webServer) MachinesDelete(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseMachinesFilter(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+	dryRun := query.Get("dryRun") == "true"
+	if !dryRun && query.Get("confirm") != "true" {
+		http.Error(w, `{"error": "confirm=true is required to delete the machines"}`, http.StatusBadRequest)
+		return
+	}
+
+	machineInterfaces, err := ws.ds.MachineInterfaces()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	var matched []datasource.MachineInterface
+	for _, machineInterface := range machineInterfaces {
+		machine, err := machineInterface.Machine(false, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+			return
+		}
+		if filter.matches(machine) {
+			matched = append(matched, machineInterface)
+		}
+	}
+
+	res := machinesDeleteResult{DryRun: dryRun, Matched: len(matched), Machines: []string{}}
+	for _, machineInterface := range matched {
+		res.Machines = append(res.Machines, machineInterface.Mac().String())
+	}
+	sort.Strings(res.Machines)
+
+	if !dryRun {
+		for _, machineInterface := range matched {
+			if err := machineInterface.DeleteMachine(); err != nil {
+				http.Error(w, fmt.Sprintf(`{"error": %q}`, fmt.Sprintf(
+					"deleted %d of %d machines: %s", res.Deleted, res.Matched, err)),
+					http.StatusInternalServerError)
+				return
+			}
+			ws.invalidateMachine(machineInterface.Mac())
+			res.Deleted++
+		}
+		log.WithFields(log.Fields{
+			"where":  "web.MachinesDelete",
+			"action": "delete",
+		}).Infof("deleted %d machines (query: %s)", res.Deleted, r.URL.RawQuery)
+	}
+
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(resJSON))
+}
@@ -0,0 +1,105 @@
+package web
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+func TestMachinesDelete(t *testing.T) {
+	rack1a, _ := net.ParseMAC("00:11:22:33:44:fc")
+	rack1b, _ := net.ParseMAC("00:11:22:33:44:fd")
+	rack2, _ := net.ParseMAC("00:11:22:33:44:fe")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	for mac, label := range map[string]string{
+		rack1a.String(): "rack1", rack1b.String(): "rack1", rack2.String(): "rack2",
+	} {
+		hw, _ := net.ParseMAC(mac)
+		machine := datasource.Machine{Labels: []string{label, "prod"}}
+		if _, err := ds.MachineInterface(hw).StoreMachine(machine); err != nil {
+			t.Error("error while storing the machine:", err)
+			return
+		}
+	}
+
+	h := (&webServer{ds: ds}).Handler()
+
+	tests := []struct {
+		query    string
+		status   int
+		expected *machinesDeleteResult
+	}{
+		{"", http.StatusBadRequest, nil},
+		{"?label=rack1", http.StatusBadRequest, nil},
+		{"?subnet=10.0.0.0&confirm=true", http.StatusBadRequest, nil},
+		{"?type=rack&dryRun=true", http.StatusBadRequest, nil},
+		{"?label=rack1&dryRun=true", http.StatusOK, &machinesDeleteResult{
+			DryRun: true, Matched: 2, Machines: []string{rack1a.String(), rack1b.String()},
+		}},
+		{"?label=rack3&dryRun=true", http.StatusOK, &machinesDeleteResult{
+			DryRun: true, Machines: []string{},
+		}},
+		{"?label=rack1&type=normal&confirm=true", http.StatusOK, &machinesDeleteResult{
+			Matched: 2, Deleted: 2, Machines: []string{rack1a.String(), rack1b.String()},
+		}},
+		{"?label=prod&dryRun=true", http.StatusOK, &machinesDeleteResult{
+			DryRun: true, Matched: 1, Machines: []string{rack2.String()},
+		}},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest("DELETE", "http://test.com/api/machines"+test.query, nil)
+		if err != nil {
+			t.Errorf("#%d: error while NewRequest: %s", i, err)
+			continue
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("#%d: expected status %d, got %d: %s", i, test.status, w.Code, w.Body.String())
+			continue
+		}
+		if test.expected == nil {
+			continue
+		}
+		var res machinesDeleteResult
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Errorf("#%d: error while unmarshaling the result: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, *test.expected) {
+			t.Errorf("#%d: expected %+v, got %+v", i, *test.expected, res)
+		}
+	}
+
+	for mac, expected := range map[string]bool{
+		rack1a.String(): false, rack1b.String(): false, rack2.String(): true,
+	} {
+		hw, _ := net.ParseMAC(mac)
+		if known, err := ds.MachineInterface(hw).Known(); err != nil || known != expected {
+			t.Errorf("%s: expected known=%v, got (%v, %v)", mac, expected, known, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package web
+
+import (
+	"encoding/csv"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// machineDetailsCSVHeader is the header of the csv of the machines, in the
+// order of the fields of machineDetails, named as in its json
+var machineDetailsCSVHeader = []string{
+	"name", "nic", "ip", "type", "firstAssigned", "lastAssigned", "firstBoot",
+	"labels", "notes", "leaseIP", "leaseExpiry", "leaseActive", "agentState",
+	"agentStateTime", "clientArch", "clientArchName", "firstAssignedAt",
+	"lastAssignedAt", "firstBootAt", "leaseExpiryAt", "agentStateTimeAt",
+}
+
+// wantsCSV reports whether the response is asked to be in csv, either by
+// ?format=csv or by the Accept header
+func wantsCSV(r *http.Request) bool {
+	if format := r.FormValue("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+// csvIP returns the ip as a string, or "" for nil
+func csvIP(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// csvRecord returns the fields of the details in the order of
+// machineDetailsCSVHeader. The labels are separated by semicolons.
+func (d *machineDetails) csvRecord() []string {
+	clientArch := ""
+	if d.ClientArch != nil {
+		clientArch = strconv.Itoa(int(*d.ClientArch))
+	}
+	return []string{
+		d.Name,
+		d.Nic,
+		csvIP(d.IP),
+		strconv.Itoa(int(d.Type)),
+		strconv.FormatInt(d.FirstAssigned, 10),
+		strconv.FormatInt(d.LastAssigned, 10),
+		strconv.FormatInt(d.FirstBoot, 10),
+		strings.Join(d.Labels, ";"),
+		d.Notes,
+		csvIP(d.LeaseIP),
+		strconv.FormatInt(d.LeaseExpiry, 10),
+		strconv.FormatBool(d.LeaseActive),
+		d.AgentState,
+		strconv.FormatInt(d.AgentStateTime, 10),
+		clientArch,
+		d.ClientArchName,
+		d.FirstAssignedAt,
+		d.LastAssignedAt,
+		d.FirstBootAt,
+		d.LeaseExpiryAt,
+		d.AgentStateTimeAt,
+	}
+}
+
+// writeMachinesCSV writes the details of the machines as csv, flushing them
+// every machinesListFlushInterval rows. An error in the middle, or the
+// timeout of the request, is answered with 500 or 503 if nothing is flushed
+// yet, and otherwise it's logged and ends the response.
+func writeMachinesCSV(w http.ResponseWriter, r *http.Request, machines []datasource.MachineInterface) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(machineDetailsCSVHeader)
+
+	flusher, _ := w.(http.Flusher)
+	written := 0
+	for _, machine := range machines {
+		if err := exportStopped(r); err != nil {
+			if !abortResponse(w, err, http.StatusServiceUnavailable) {
+				log.WithField("where", "web.MachinesList").WithError(err).Warn(
+					"the csv of the machines is stopped")
+				csvWriter.Flush()
+			}
+			return
+		}
+		details, err := machineToDetails(machine)
+		if err != nil {
+			if !abortResponse(w, err, http.StatusInternalServerError) {
+				log.WithFields(log.Fields{
+					"where":  "web.MachinesList",
+					"object": machine.Mac().String(),
+				}).WithError(err).Warn("failed to write the csv of the machines")
+				csvWriter.Flush()
+			}
+			return
+		}
+		if details == nil {
+			continue
+		}
+		csvWriter.Write(details.csvRecord())
+		written++
+		if flusher != nil && written%machinesListFlushInterval == 0 {
+			csvWriter.Flush()
+			flusher.Flush()
+		}
+	}
+	csvWriter.Flush()
+}
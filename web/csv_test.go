@@ -0,0 +1,96 @@
+package web
+
+import (
+	"encoding/csv"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+func TestMachinesListCSV(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:f8")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	machine, err := ds.MachineInterface(mac).Machine(true, nil)
+	if err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	tests := []struct {
+		url    string
+		accept string
+		csv    bool
+	}{
+		{"http://test.com/api/machines?format=csv", "", true},
+		{"http://test.com/api/machines", "text/csv", true},
+		{"http://test.com/api/machines", "application/json", false},
+		{"http://test.com/api/machines?format=json", "text/csv", false},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Errorf("#%d: error while NewRequest: %s", i, err)
+			continue
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if !test.csv {
+			if !strings.HasPrefix(w.Body.String(), "[") {
+				t.Errorf("#%d: expected json, got %q", i, w.Body.String())
+			}
+			continue
+		}
+
+		if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/csv") {
+			t.Errorf("#%d: unexpected content type: %q", i, contentType)
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Errorf("#%d: error while reading the csv: %s", i, err)
+			continue
+		}
+		if len(records) == 0 || !reflect.DeepEqual(records[0], machineDetailsCSVHeader) {
+			t.Errorf("#%d: unexpected header: %q", i, records)
+			continue
+		}
+		var row []string
+		for _, record := range records[1:] {
+			if len(record) > 1 && record[1] == mac.String() {
+				row = record
+			}
+		}
+		if len(row) != len(machineDetailsCSVHeader) || row[2] != machine.IP.String() ||
+			row[11] != "false" {
+			t.Errorf("#%d: unexpected row of the machine: %q", i, row)
+		}
+	}
+}
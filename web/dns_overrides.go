@@ -0,0 +1,101 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// SetMachineDomain overrides the domain (option 15) of the machine
+func (ws *webServer) SetMachineDomain(w http.ResponseWriter, r *http.Request) {
+	ws.setMachineOverride(w, r, datasource.SpecialKeyDomainName)
+}
+
+// DeleteMachineDomain removes the domain override of the machine, so it
+// gets the one of the cluster
+func (ws *webServer) DeleteMachineDomain(w http.ResponseWriter, r *http.Request) {
+	ws.deleteMachineOverride(w, r, datasource.SpecialKeyDomainName)
+}
+
+// SetMachineSearchDomains overrides the search list (option 119) of the
+// machine with the given comma separated domains
+func (ws *webServer) SetMachineSearchDomains(w http.ResponseWriter, r *http.Request) {
+	ws.setMachineOverride(w, r, datasource.SpecialKeySearchDomains)
+}
+
+// DeleteMachineSearchDomains removes the search list override of the
+// machine, so it gets the one of the cluster
+func (ws *webServer) DeleteMachineSearchDomains(w http.ResponseWriter, r *http.Request) {
+	ws.deleteMachineOverride(w, r, datasource.SpecialKeySearchDomains)
+}
+
+// overrideMachine returns the interface of the known machine of the request,
+// or writes the error
+func (ws *webServer) overrideMachine(w http.ResponseWriter, r *http.Request) datasource.MachineInterface {
+	macString := mux.Vars(r)["mac"]
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return nil
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(false, nil); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return nil
+	}
+	return machineInterface
+}
+
+func (ws *webServer) setMachineOverride(w http.ResponseWriter, r *http.Request, key string) {
+	machineInterface := ws.overrideMachine(w, r)
+	if machineInterface == nil {
+		return
+	}
+
+	value := r.FormValue("value")
+	if value == "" {
+		http.Error(w, fmt.Sprintf(`{"error": "empty %s, delete it to use the one of the cluster"}`, key),
+			http.StatusBadRequest)
+		return
+	}
+	if err := datasource.ValidateVariable(key, value); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	if err := machineInterface.SetVariable(key, value); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	ws.invalidateMachine(machineInterface.Mac())
+
+	io.WriteString(w, `"OK"`)
+}
+
+func (ws *webServer) deleteMachineOverride(w http.ResponseWriter, r *http.Request, key string) {
+	machineInterface := ws.overrideMachine(w, r)
+	if machineInterface == nil {
+		return
+	}
+
+	variables, err := machineInterface.ListVariables()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	if _, isSet := variables[key]; isSet {
+		if err := machineInterface.DeleteVariable(key); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+			return
+		}
+		ws.invalidateMachine(machineInterface.Mac())
+	}
+
+	io.WriteString(w, `"OK"`)
+}
@@ -0,0 +1,110 @@
+package web
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/dhcp"
+)
+
+func TestMachineDNSOverrides(t *testing.T) {
+	overridden, _ := net.ParseMAC("00:11:22:33:44:f5")
+	other, _ := net.ParseMAC("00:11:22:33:44:f4")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	for _, mac := range []net.HardwareAddr{overridden, other} {
+		if _, err := ds.MachineInterface(mac).Machine(true, nil); err != nil {
+			t.Error("error while creating the machine:", err)
+			return
+		}
+	}
+	if err := ds.SetClusterVariable(datasource.SpecialKeySearchDomains, "example.com"); err != nil {
+		t.Error("error while setting the search domains:", err)
+		return
+	}
+
+	h := (&webServer{ds: ds, dhcpHandler: dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})}).Handler()
+	do := func(method, path, value string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://test.com/api/machines/"+path, strings.NewReader(url.Values{"value": {value}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	network := func(mac net.HardwareAddr) (string, []string) {
+		var conf dhcp.MachineConfiguration
+		w := do("GET", mac.String()+"/network", "")
+		if err := json.Unmarshal(w.Body.Bytes(), &conf); err != nil {
+			t.Errorf("error while unmarshaling the network of %s: %s", mac, err)
+		}
+		return conf.Domain, conf.SearchDomains
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		value  string
+		status int
+	}{
+		{"PUT", "not-a-mac/domain", "zone-b.example.com", http.StatusBadRequest},
+		{"PUT", "00:11:22:33:44:f3/domain", "zone-b.example.com", http.StatusNotFound},
+		{"PUT", overridden.String() + "/domain", "zone_b", http.StatusBadRequest},
+		{"PUT", overridden.String() + "/domain", "", http.StatusBadRequest},
+		{"PUT", overridden.String() + "/search-domains", "b_example.com", http.StatusBadRequest},
+		{"PUT", overridden.String() + "/domain", "zone-b.example.com", http.StatusOK},
+		{"PUT", overridden.String() + "/search-domains", "b.example.com, example.com", http.StatusOK},
+	}
+	for i, test := range tests {
+		if w := do(test.method, test.path, test.value); w.Code != test.status {
+			t.Errorf("#%d: expected status %d, got %d: %s", i, test.status, w.Code, w.Body.String())
+		}
+	}
+
+	domain, searchDomains := network(overridden)
+	if domain != "zone-b.example.com" {
+		t.Errorf("expected the overridden domain, got %q", domain)
+	}
+	if expected := []string{"zone-b.example.com", "b.example.com", "example.com"}; !reflect.DeepEqual(searchDomains, expected) {
+		t.Errorf("expected the overridden search domains %q, got %q", expected, searchDomains)
+	}
+
+	domain, searchDomains = network(other)
+	if domain != ds.ClusterName() {
+		t.Errorf("expected the cluster name as the domain of the other machine, got %q", domain)
+	}
+	if expected := []string{ds.ClusterName(), "example.com"}; !reflect.DeepEqual(searchDomains, expected) {
+		t.Errorf("expected the search domains of the cluster %q, got %q", expected, searchDomains)
+	}
+
+	for _, path := range []string{"/domain", "/search-domains", "/domain"} {
+		if w := do("DELETE", overridden.String()+path, ""); w.Code != http.StatusOK {
+			t.Errorf("DELETE %s: unexpected status %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+	domain, searchDomains = network(overridden)
+	if domain != ds.ClusterName() || !reflect.DeepEqual(searchDomains, []string{ds.ClusterName(), "example.com"}) {
+		t.Errorf("expected the defaults of the cluster after deleting the overrides, got %q %q", domain, searchDomains)
+	}
+}
@@ -0,0 +1,142 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// etagMaxBuffer is the longest payload which is buffered to be hashed as its
+// ETag. The longer ones are streamed without an ETag, so a huge list of the
+// machines doesn't have to be kept in memory. A handler which flushes is
+// streamed too, whatever its length.
+const etagMaxBuffer = 4 << 20
+
+// etagWriter buffers a successful response until it's finished, to hash it
+type etagWriter struct {
+	http.ResponseWriter
+	buf       bytes.Buffer
+	status    int
+	streaming bool
+}
+
+func (w *etagWriter) WriteHeader(status int) {
+	if w.streaming || w.status != 0 {
+		return
+	}
+	w.status = status
+	if status != http.StatusOK {
+		w.stream()
+	}
+}
+
+func (w *etagWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.streaming {
+		return w.ResponseWriter.Write(p)
+	}
+	n, err := w.buf.Write(p)
+	if w.buf.Len() > etagMaxBuffer {
+		w.stream()
+	}
+	return n, err
+}
+
+// Flush gives up on the ETag, as the handler wants what's written so far to
+// reach the client
+func (w *etagWriter) Flush() {
+	if !w.streaming {
+		w.stream()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// stream gives up on the ETag, and writes what's buffered so far
+func (w *etagWriter) stream() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.streaming = true
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.buf.Bytes())
+	w.buf.Reset()
+}
+
+// abort discards the buffered response, so the handler can answer another
+// one, e.g. an error in the middle of a list. It reports false if the
+// response is already streamed, in which case it can't be changed.
+func (w *etagWriter) abort() bool {
+	if w.streaming {
+		return false
+	}
+	w.buf.Reset()
+	w.status = 0
+	return true
+}
+
+// abortResponse answers the error instead of what's written of the response,
+// if none of it has reached the client yet, see etagWriter.abort. It reports
+// false if the response is already sent, and then nothing is written.
+func abortResponse(w http.ResponseWriter, err error, status int) bool {
+	if ew, ok := w.(*etagWriter); !ok || !ew.abort() {
+		return false
+	}
+	http.Error(w, fmt.Sprintf(`{"error": %q}`, err), status)
+	return true
+}
+
+// finish writes the buffered response, or answers 304 if its ETag is one of
+// the ones in If-None-Match
+func (w *etagWriter) finish(r *http.Request) {
+	if w.streaming {
+		return
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(w.buf.Bytes()))
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+		w.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.buf.Bytes())
+}
+
+// etagMatches reports whether the If-None-Match header matches the etag. The
+// weak comparison is used, as it's specified for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// withETag returns the handler with an ETag, the hash of its payload, in its
+// successful responses to GET, so the clients which poll it can ask with
+// If-None-Match and get a 304 if it's not changed. It still reads the
+// datasource, but nothing is sent back.
+func withETag(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			handler(w, r)
+			return
+		}
+		ew := &etagWriter{ResponseWriter: w}
+		handler(ew, r)
+		ew.finish(r)
+	}
+}
@@ -0,0 +1,138 @@
+package web
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+func TestETag(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:fe")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if _, err := ds.MachineInterface(mac).Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	h := (&webServer{ds: ds}).Handler()
+	get := func(url, ifNoneMatch string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, url := range []string{"http://test.com/api/machines", "http://test.com/api/variables"} {
+		w := get(url, "")
+		etag := w.Header().Get("ETag")
+		if w.Code != http.StatusOK || etag == "" {
+			t.Errorf("%s: expected 200 with an ETag, got %d %q", url, w.Code, etag)
+			continue
+		}
+
+		if w := get(url, etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("%s: expected a 304 on a repeat request, got %d: %s", url, w.Code, w.Body.String())
+		}
+		if w := get(url, `"other", W/`+etag); w.Code != http.StatusNotModified {
+			t.Errorf("%s: expected a 304 for a weak match in a list, got %d", url, w.Code)
+		}
+		if w := get(url, `"other"`); w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("%s: expected the payload for another ETag, got %d", url, w.Code)
+		}
+	}
+
+	// a change makes a new ETag
+	etag := get("http://test.com/api/variables", "").Header().Get("ETag")
+	if err := ds.SetClusterVariable("foo", "bar"); err != nil {
+		t.Error("error while setting the cluster variable:", err)
+		return
+	}
+	w := get("http://test.com/api/variables", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("expected the changed variables with a new ETag, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestETagStreaming(t *testing.T) {
+	large := make([]byte, etagMaxBuffer+1)
+	h := withETag(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(large[:etagMaxBuffer/2])
+		w.Write(large[etagMaxBuffer/2:])
+	})
+
+	req, _ := http.NewRequest("GET", "http://test.com/api/machines", nil)
+	w := httptest.NewRecorder()
+	h(w, req)
+	if w.Code != http.StatusOK || w.Body.Len() != len(large) || w.Header().Get("ETag") != "" {
+		t.Errorf("expected the large payload to be streamed without an ETag, got %d %d %q",
+			w.Code, w.Body.Len(), w.Header().Get("ETag"))
+	}
+
+	flushed := withETag(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[1"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("]"))
+	})
+	w = httptest.NewRecorder()
+	flushed(w, req)
+	if w.Code != http.StatusOK || !w.Flushed || w.Body.String() != "[1]" || w.Header().Get("ETag") != "" {
+		t.Errorf("expected the flushed payload to be streamed without an ETag, got %d %v %q %q",
+			w.Code, w.Flushed, w.Body.String(), w.Header().Get("ETag"))
+	}
+
+	failing := withETag(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "failed"}`, http.StatusInternalServerError)
+	})
+	w = httptest.NewRecorder()
+	failing(w, req)
+	if w.Code != http.StatusInternalServerError || w.Header().Get("ETag") != "" {
+		t.Errorf("expected the failure without an ETag, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	// a failure in the middle replaces what's buffered, but not what's
+	// flushed
+	for _, flush := range []bool{false, true} {
+		aborted := withETag(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("[1"))
+			if flush {
+				w.(http.Flusher).Flush()
+			}
+			if !abortResponse(w, errors.New("failed"), http.StatusInternalServerError) {
+				w.Write([]byte(","))
+			}
+		})
+		w = httptest.NewRecorder()
+		aborted(w, req)
+		if flush && (w.Code != http.StatusOK || w.Body.String() != "[1,") {
+			t.Errorf("expected the flushed payload to be kept, got %d %q", w.Code, w.Body.String())
+		}
+		if !flush && (w.Code != http.StatusInternalServerError || w.Header().Get("ETag") != "" ||
+			w.Body.String() != "{\"error\": \"failed\"}\n") {
+			t.Errorf("expected the buffered payload to be replaced by the failure, got %d %q %q",
+				w.Code, w.Body.String(), w.Header().Get("ETag"))
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+// The events which happen once, or are only known by their last time, next
+// to the ones of datasource.MachineEvent
+const (
+	eventCreated       = "created"
+	eventFirstBoot     = "first-boot"
+	eventLastSeen      = "last-seen"
+	eventLeaseExpiry   = "lease-expiry"
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+// machineEvent is an entry of the timeline of a machine. Detail depends on
+// the event, e.g. the name of the variable which is set.
+type machineEvent struct {
+	Time   int64  `json:"time"`
+	At     string `json:"at"`
+	Event  string `json:"event"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type eventsByTime []machineEvent
+
+func (e eventsByTime) Len() int           { return len(e) }
+func (e eventsByTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e eventsByTime) Less(i, j int) bool { return e[i].Time < e[j].Time }
+
+// machineEvents merges the recorded events of the machine with the times of
+// its creation, boots and lease into a timeline, ordered by time. The events
+// of the same second are kept in the order they're recorded. Only the last
+// limit events are returned.
+func (ws *webServer) machineEvents(machineInterface datasource.MachineInterface,
+	limit int) ([]machineEvent, error) {
+	events := []machineEvent{}
+	add := func(unix int64, event, detail string) {
+		if unix != 0 {
+			events = append(events, machineEvent{Time: unix, Event: event, Detail: detail})
+		}
+	}
+
+	machine, err := machineInterface.Machine(false, nil)
+	if err != nil {
+		return nil, err
+	}
+	add(machine.FirstSeen, eventCreated, machine.IP.String())
+
+	// 0, and then left out, for the machines which have never booted
+	firstBoot, err := machineInterface.FirstBoot()
+	if err != nil {
+		return nil, fmt.Errorf("error in retrieving machine first boot: %s", err)
+	}
+	add(firstBoot, eventFirstBoot, "")
+
+	recorded, err := machineInterface.Events()
+	if err != nil {
+		return nil, fmt.Errorf("error in retrieving machine events: %s", err)
+	}
+	for _, event := range recorded {
+		add(event.Time, event.Event, event.Detail)
+	}
+
+	lastSeen, err := machineInterface.LastSeen()
+	if err != nil {
+		return nil, fmt.Errorf("error in retrieving machine last seen: %s", err)
+	}
+	add(lastSeen, eventLastSeen, "")
+
+	lease, err := machineInterface.Lease()
+	if err != nil {
+		return nil, fmt.Errorf("error in retrieving machine lease: %s", err)
+	}
+	if lease != nil {
+		add(lease.Expiry, eventLeaseExpiry, lease.IP.String())
+	}
+
+	sort.Stable(eventsByTime(events))
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	for i := range events {
+		events[i].At = formatUnix(events[i].Time)
+	}
+	return events, nil
+}
+
+// MachineEvents returns the timeline of the machine, merged from its
+// recorded events, e.g. its leases, agent states, quarantine decision and
+// variables, and the times of its creation and boots. Only the last limit
+// (default 100, at most 1000) events are returned.
+func (ws *webServer) MachineEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultEventsLimit
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxEventsLimit {
+			http.Error(w, fmt.Sprintf(`{"error": "invalid limit: %q"}`, limitStr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	if _, err := machineInterface.Machine(false, nil); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return
+	}
+
+	events, err := ws.machineEvents(machineInterface, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	eventsJSON, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(eventsJSON))
+}
@@ -0,0 +1,133 @@
+package web
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+func TestMachineEventsAPI(t *testing.T) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:60")
+	machineInterface := ds.MachineInterface(mac)
+	machine, err := machineInterface.Machine(true, nil)
+	if err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+	for _, key := range []string{"b", "a"} {
+		if err := machineInterface.SetVariable(key, "value"); err != nil {
+			t.Error("error while setting a variable:", err)
+			return
+		}
+	}
+	expiry := time.Now().Add(time.Hour).Unix()
+	if err := machineInterface.StoreLease(datasource.Lease{IP: machine.IP, Expiry: expiry}); err != nil {
+		t.Error("error while storing the lease:", err)
+		return
+	}
+
+	// the renewal of the lease isn't recorded
+	if err := machineInterface.StoreLease(datasource.Lease{IP: machine.IP, Expiry: expiry}); err != nil {
+		t.Error("error while storing the lease:", err)
+		return
+	}
+	if err := machineInterface.DeleteVariable("b"); err != nil {
+		t.Error("error while deleting a variable:", err)
+		return
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	get := func(url string) ([]machineEvent, int) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal("error while NewRequest:", err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			return nil, w.Code
+		}
+		var events []machineEvent
+		if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+			t.Fatalf("unexpected body: %s", w.Body.String())
+		}
+		return events, w.Code
+	}
+
+	events, code := get("http://test.com/api/machines/00:11:22:33:44:60/events")
+	if code != http.StatusOK {
+		t.Error("unexpected status code:", code)
+		return
+	}
+	expected := []struct{ event, detail string }{
+		{eventCreated, machine.IP.String()},
+		{datasource.EventVariableSet, "b"},
+		{datasource.EventVariableSet, "a"},
+		{datasource.EventLease, machine.IP.String()},
+		{datasource.EventVariableDeleted, "b"},
+		{eventLeaseExpiry, machine.IP.String()},
+	}
+	if len(events) != len(expected) {
+		t.Errorf("expected %d events, got %v", len(expected), events)
+		return
+	}
+	for i, event := range events {
+		if i > 0 && event.Time < events[i-1].Time {
+			t.Errorf("#%d: expected the events to be ordered by time, got %v", i, events)
+		}
+		if event.At != formatUnix(event.Time) {
+			t.Errorf("#%d: unexpected time: %s", i, event.At)
+		}
+	}
+	if events[len(events)-1].Event != eventLeaseExpiry || events[len(events)-1].Time != expiry {
+		t.Error("expected the lease expiry to be the last event, got", events[len(events)-1])
+	}
+	// the events of the same second are kept in the order they're recorded
+	for i, e := range expected[:len(expected)-1] {
+		if events[i].Event != e.event || events[i].Detail != e.detail {
+			t.Errorf("#%d: expected %s %s, got %v", i, e.event, e.detail, events[i])
+		}
+	}
+
+	// only the last events are returned
+	events, code = get("http://test.com/api/machines/00:11:22:33:44:60/events?limit=2")
+	if code != http.StatusOK || len(events) != 2 || events[1].Event != eventLeaseExpiry {
+		t.Error("unexpected events with a limit:", code, events)
+	}
+
+	for _, tt := range []struct {
+		url  string
+		code int
+	}{
+		{"http://test.com/api/machines/00:11:22:33:44:61/events", http.StatusNotFound},
+		{"http://test.com/api/machines/not-a-mac/events", http.StatusBadRequest},
+		{"http://test.com/api/machines/00:11:22:33:44:60/events?limit=0", http.StatusBadRequest},
+	} {
+		if _, code := get(tt.url); code != tt.code {
+			t.Errorf("%s: expected status code %d, got %d", tt.url, tt.code, code)
+		}
+	}
+}
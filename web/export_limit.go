@@ -0,0 +1,76 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// exportLimiter guards the heavy endpoints which read or write all the
+// machines, so the concurrent backups don't overload etcd. Only the exports
+// and the imports take a slot, not the json list which the ui polls. The
+// timeout is
+// set as the deadline of the context of the request, which the handlers
+// check between the machines, so their responses are still streamed. A nil
+// *exportLimiter limits nothing.
+type exportLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newExportLimiter(concurrency int, timeout time.Duration) *exportLimiter {
+	if concurrency <= 0 && timeout <= 0 {
+		return nil
+	}
+	l := &exportLimiter{timeout: timeout}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+	return l
+}
+
+// wrap returns the handler guarded by the limiter. Only the requests for
+// which isExport returns true take a slot, so e.g. the json list of the
+// machines which the ui polls is not refused, and the rest only get the
+// timeout. isExport may be nil, in which case all the requests take a slot.
+func (l *exportLimiter) wrap(handler http.HandlerFunc, isExport func(*http.Request) bool) http.Handler {
+	if l == nil {
+		return handler
+	}
+
+	var limited http.Handler = handler
+	if l.slots != nil {
+		limited = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isExport != nil && !isExport(r) {
+				handler(w, r)
+				return
+			}
+			select {
+			case l.slots <- struct{}{}:
+				defer func() { <-l.slots }()
+			default:
+				w.Header().Set("Retry-After", "10")
+				http.Error(w, `{"error": "another export or import is in progress"}`,
+					http.StatusTooManyRequests)
+				return
+			}
+			handler(w, r)
+		})
+	}
+	if l.timeout > 0 {
+		withSlot := limited
+		limited = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), l.timeout)
+			defer cancel()
+			withSlot.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	return limited
+}
+
+// exportStopped returns the error of the context of the request, if it's
+// timed out or canceled, so the export or the import is stopped
+func exportStopped(r *http.Request) error {
+	return r.Context().Err()
+}
@@ -0,0 +1,130 @@
+package web
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+func TestExportLimiter(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	export := func(w http.ResponseWriter, r *http.Request) {
+		if wantsCSV(r) {
+			started <- struct{}{}
+			<-release
+		}
+		w.Write([]byte(`"OK"`))
+	}
+	h := newExportLimiter(1, time.Minute).wrap(export, wantsCSV)
+	serve := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://test.com/api/machines?format=csv", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- serve() }()
+	<-started
+
+	if w := serve(); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected the second concurrent export to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// the json list, which the ui polls, is not limited
+	req, _ := http.NewRequest("GET", "http://test.com/api/machines", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the json list to be served along with the export, got %d: %s", w.Code, w.Body.String())
+	}
+
+	close(release)
+	if w := <-first; w.Code != http.StatusOK {
+		t.Errorf("expected the first export to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// the slot is freed
+	go func() { <-started }()
+	if w := serve(); w.Code != http.StatusOK {
+		t.Errorf("expected an export after the first one to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestExportLimiterTimeout(t *testing.T) {
+	h := newExportLimiter(0, 10*time.Millisecond).wrap(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			http.Error(w, `{"error": "timed out"}`, http.StatusServiceUnavailable)
+		case <-time.After(time.Second):
+		}
+	}, nil)
+
+	req, _ := http.NewRequest("GET", "http://test.com/api/machines", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the deadline of the slow export to pass, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if newExportLimiter(0, 0) != nil {
+		t.Error("expected no limiter without a limit and a timeout")
+	}
+}
+
+func TestMachinesExportTimeout(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:45:02")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+	if _, err := ds.MachineInterface(mac).Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	// passed before the first machine
+	h := (&webServer{ds: ds, exports: newExportLimiter(0, time.Nanosecond)}).Handler()
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("GET", "http://test.com/api/machines", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the timed out export to fail, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "http://test.com/api/machines?format=csv", ""); w.Code != http.StatusServiceUnavailable || w.Header().Get("ETag") != "" {
+		t.Errorf("expected the timed out csv to fail instead of a cached header, got %d: %q", w.Code, w.Body.String())
+	}
+
+	w := do("POST", "http://test.com/api/machines/import", `[{"mac": "00:11:22:33:45:03"}]`)
+	var results []importResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body.String())
+	} else if len(results) != 1 || results[0].Status != importStatusError {
+		t.Errorf("expected the rows of the timed out import to fail, got %+v", results)
+	}
+	if known, _ := ds.MachineInterface(net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x45, 0x03}).Known(); known {
+		t.Error("expected no machine to be imported after the timeout")
+	}
+}
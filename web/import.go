@@ -0,0 +1,184 @@
+package web
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+const (
+	importStatusCreated   = "created"
+	importStatusUpdated   = "updated"
+	importStatusDuplicate = "duplicate"
+	importStatusError     = "error"
+)
+
+// importRow is a machine to be imported. Type is the name or the number of a
+// MachineType, and can be left empty.
+type importRow struct {
+	Mac    string   `json:"mac"`
+	IP     string   `json:"ip"`
+	Type   string   `json:"type"`
+	Labels []string `json:"labels"`
+}
+
+type importResult struct {
+	Row    int    `json:"row"`
+	Mac    string `json:"mac"`
+	IP     net.IP `json:"ip,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// parseImportCSV reads rows in the form of `mac,ip,type,labels`, in which
+// labels are separated by spaces. Only the mac is required, and a first line
+// starting with "mac" is considered as the header.
+func parseImportCSV(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []importRow
+	for i, record := range records {
+		if i == 0 && len(record) > 0 && strings.EqualFold(record[0], "mac") {
+			continue
+		}
+		if len(record) > 4 {
+			return nil, fmt.Errorf("too many fields in line %d", i+1)
+		}
+		fields := make([]string, 4)
+		copy(fields, record)
+		rows = append(rows, importRow{
+			Mac:    fields[0],
+			IP:     fields[1],
+			Type:   fields[2],
+			Labels: strings.Fields(fields[3]),
+		})
+	}
+	return rows, nil
+}
+
+func parseImportRows(r *http.Request) ([]importRow, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = "csv"
+		} else {
+			format = "json"
+		}
+	}
+
+	switch format {
+	case "csv":
+		return parseImportCSV(r.Body)
+	case "json":
+		var rows []importRow
+		err := json.NewDecoder(r.Body).Decode(&rows)
+		return rows, err
+	}
+	return nil, fmt.Errorf("unknown format: %q", format)
+}
+
+func (ws *webServer) importMachine(row importRow, force bool) (net.IP, string, error) {
+	mac, err := net.ParseMAC(row.Mac)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var machine datasource.Machine
+	if row.IP != "" {
+		machine.IP = net.ParseIP(row.IP).To4()
+		if machine.IP == nil {
+			return nil, "", fmt.Errorf("invalid ipv4 address: %q", row.IP)
+		}
+	}
+	if row.Type != "" {
+		machine.Type, err = datasource.ParseMachineType(row.Type)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	machine.Labels = row.Labels
+
+	machineInterface := ws.ds.MachineInterface(mac)
+	status := importStatusCreated
+	current, err := machineInterface.Machine(false, nil)
+	if err == nil {
+		if !force {
+			return current.IP, importStatusDuplicate, nil
+		}
+		status = importStatusUpdated
+		machine.FirstSeen = current.FirstSeen
+		if machine.IP == nil {
+			machine.IP = current.IP
+		}
+	}
+
+	machine, err = machineInterface.StoreMachine(machine)
+	if err != nil {
+		return nil, "", err
+	}
+	ws.invalidateMachine(mac)
+	return machine.IP, status, nil
+}
+
+// MachinesImport creates the machines given as a json list or csv rows, and
+// returns the result of each row. Existing machines are reported as
+// duplicates, unless force is set. The rows which are left once the import
+// is timed out are reported as errors.
+func (ws *webServer) MachinesImport(w http.ResponseWriter, r *http.Request) {
+	rows, err := parseImportRows(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusBadRequest)
+		return
+	}
+	force := r.URL.Query().Get("force") == "true"
+
+	results := make([]importResult, 0, len(rows))
+	seen := make(map[string]bool)
+	for i, row := range rows {
+		result := importResult{Row: i + 1, Mac: row.Mac}
+		// the rest of the rows are not imported once the import is timed out
+		if err := exportStopped(r); err != nil {
+			result.Status, result.Error = importStatusError, err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		if mac, err := net.ParseMAC(row.Mac); err == nil {
+			if seen[mac.String()] {
+				result.Status = importStatusDuplicate
+				result.Error = "mac is repeated in the batch"
+				results = append(results, result)
+				continue
+			}
+			seen[mac.String()] = true
+		}
+
+		ip, status, err := ws.importMachine(row, force)
+		if err != nil {
+			result.Status, result.Error = importStatusError, err.Error()
+		} else {
+			result.IP, result.Status = ip, status
+		}
+		results = append(results, result)
+	}
+
+	resultsJSON, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(resultsJSON))
+}
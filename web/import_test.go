@@ -0,0 +1,151 @@
+package web
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+func importForTest(h http.Handler, url, contentType, body string) ([]importResult, int, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 {
+		return nil, w.Code, nil
+	}
+
+	var results []importResult
+	err = json.Unmarshal(w.Body.Bytes(), &results)
+	return results, w.Code, err
+}
+
+func TestMachinesImport(t *testing.T) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	////////////////////////////////
+	// A valid json batch
+	results, code, err := importForTest(h, "http://test.com/api/machines/import",
+		"application/json", `[
+			{"mac": "00:11:22:33:55:01", "ip": "127.0.0.9", "type": "static", "labels": ["rack-a"]},
+			{"mac": "00:11:22:33:55:02", "type": "bmc"}
+		]`)
+	if err != nil || code != 200 {
+		t.Error("error while importing the json batch:", err, code)
+		return
+	}
+	for i, result := range results {
+		if result.Status != importStatusCreated {
+			t.Errorf("#%d: expected %q, got %+v", i, importStatusCreated, result)
+		}
+	}
+
+	mac1, _ := net.ParseMAC("00:11:22:33:55:01")
+	machine1, err := ds.MachineInterface(mac1).Machine(false, nil)
+	if err != nil {
+		t.Error("error while getting the imported machine:", err)
+		return
+	}
+	if !machine1.IP.Equal(net.IPv4(127, 0, 0, 9)) || machine1.Type != datasource.MTStatic ||
+		len(machine1.Labels) != 1 || machine1.Labels[0] != "rack-a" {
+		t.Errorf("the imported machine doesn't match the row: %+v", machine1)
+	}
+
+	mac2, _ := net.ParseMAC("00:11:22:33:55:02")
+	machine2, err := ds.MachineInterface(mac2).Machine(false, nil)
+	if err != nil {
+		t.Error("error while getting the imported machine:", err)
+		return
+	}
+	if machine2.IP == nil || machine2.Type != datasource.MTBMC {
+		t.Errorf("the imported machine doesn't match the row: %+v", machine2)
+	}
+
+	////////////////////////////////
+	// A partially invalid csv batch
+	results, code, err = importForTest(h, "http://test.com/api/machines/import",
+		"text/csv", "mac,ip,type,labels\n"+
+			"00:11:22:33:55:03,127.0.0.10,,rack-b etcd\n"+
+			"00:11:22:33:55:01,,,\n"+
+			"not-a-mac,,,\n"+
+			"00:11:22:33:55:04,127.0.0.9,,\n"+
+			"00:11:22:33:55:05,,unknown-type,\n"+
+			"00:11:22:33:55:03,,,\n")
+	if err != nil || code != 200 {
+		t.Error("error while importing the csv batch:", err, code)
+		return
+	}
+
+	expected := []string{
+		importStatusCreated,
+		importStatusDuplicate, // already exists
+		importStatusError,     // invalid mac
+		importStatusError,     // ip is assigned to 00:11:22:33:55:01
+		importStatusError,     // invalid type
+		importStatusDuplicate, // repeated in the batch
+	}
+	if len(results) != len(expected) {
+		t.Errorf("expected %d results, got %d: %+v", len(expected), len(results), results)
+		return
+	}
+	for i, result := range results {
+		if result.Status != expected[i] {
+			t.Errorf("#%d: expected %q, got %+v", i, expected[i], result)
+		}
+	}
+
+	////////////////////////////////
+	// Overwriting with force
+	results, code, err = importForTest(h, "http://test.com/api/machines/import?force=true",
+		"application/json", `[{"mac": "00:11:22:33:55:01", "labels": ["rack-c"]}]`)
+	if err != nil || code != 200 {
+		t.Error("error while importing with force:", err, code)
+		return
+	}
+	if len(results) != 1 || results[0].Status != importStatusUpdated {
+		t.Errorf("expected the machine to be updated, got %+v", results)
+		return
+	}
+	machine1, err = ds.MachineInterface(mac1).Machine(false, nil)
+	if err != nil {
+		t.Error("error while getting the imported machine:", err)
+		return
+	}
+	if !machine1.IP.Equal(net.IPv4(127, 0, 0, 9)) || len(machine1.Labels) != 1 || machine1.Labels[0] != "rack-c" {
+		t.Errorf("the machine isn't updated as expected: %+v", machine1)
+	}
+
+	////////////////////////////////
+	// A malformed body
+	_, code, _ = importForTest(h, "http://test.com/api/machines/import",
+		"application/json", `{"mac": `)
+	if code != http.StatusBadRequest {
+		t.Error("unexpected status code for a malformed body:", code)
+	}
+}
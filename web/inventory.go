@@ -0,0 +1,175 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/metrics"
+)
+
+const (
+	// inventoryCacheTTL is how long the inventory is reused by the scrapes of
+	// /metrics, as collecting it reads all the machines from etcd
+	inventoryCacheTTL = 30 * time.Second
+	// leaseExpiringWindow is the window of blacksmith_leases_expiring
+	leaseExpiringWindow = time.Hour
+
+	metricInventoryErrors = "web_inventory_errors"
+)
+
+// inventory is a summary of the machines and their leases
+type inventory struct {
+	machines       int
+	machinesByType map[string]int
+	activeLeases   int
+	expiringLeases int
+	// failed is the number of the machines whose records couldn't be read
+	failed int
+}
+
+// collectInventory reads the machines and their leases from the datasource.
+// The machines which can't be read are counted, and are not fatal.
+func collectInventory(ds datasource.DataSource, now time.Time) (*inventory, error) {
+	machineInterfaces, err := ds.MachineInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting the machine interfaces: %s", err)
+	}
+
+	inv := &inventory{machinesByType: make(map[string]int)}
+	for _, machineInterface := range machineInterfaces {
+		machine, err := machineInterface.Machine(false, nil)
+		if err != nil {
+			inv.failed++
+			continue
+		}
+		inv.machines++
+		inv.machinesByType[machine.Type.String()]++
+
+		lease, err := machineInterface.Lease()
+		if err != nil {
+			inv.failed++
+			continue
+		}
+		if lease != nil && lease.Active(now) {
+			inv.activeLeases++
+			if !lease.Active(now.Add(leaseExpiringWindow)) {
+				inv.expiringLeases++
+			}
+		}
+	}
+	return inv, nil
+}
+
+// inventoryCache keeps the last collected inventory for its ttl. It's safe
+// for concurrent use, and a nil *inventoryCache collects on every call.
+type inventoryCache struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	at  time.Time
+	inv *inventory
+}
+
+func newInventoryCache(ttl time.Duration) *inventoryCache {
+	return &inventoryCache{ttl: ttl}
+}
+
+// get returns the cached inventory, or collects it if it's expired. The
+// concurrent scrapes wait for a single collection.
+func (c *inventoryCache) get(ds datasource.DataSource, now time.Time) (*inventory, error) {
+	if c == nil {
+		return collectInventory(ds, now)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inv != nil && now.Sub(c.at) < c.ttl {
+		return c.inv, nil
+	}
+	inv, err := collectInventory(ds, now)
+	if err != nil {
+		return nil, err
+	}
+	c.inv, c.at = inv, now
+	return inv, nil
+}
+
+// writeInventoryMetrics writes the gauges of the inventory in the
+// OpenMetrics text format
+func writeInventoryMetrics(b *bytes.Buffer, inv *inventory) {
+	b.WriteString("# TYPE blacksmith_machines gauge\n")
+	b.WriteString("# HELP blacksmith_machines Number of the known machines.\n")
+	fmt.Fprintf(b, "blacksmith_machines %d\n", inv.machines)
+
+	types := make([]string, 0, len(inv.machinesByType))
+	for name := range inv.machinesByType {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	b.WriteString("# TYPE blacksmith_machines_by_type gauge\n")
+	b.WriteString("# HELP blacksmith_machines_by_type Number of the known machines of the type.\n")
+	for _, name := range types {
+		fmt.Fprintf(b, "blacksmith_machines_by_type{type=%q} %d\n", name, inv.machinesByType[name])
+	}
+
+	b.WriteString("# TYPE blacksmith_leases_active gauge\n")
+	b.WriteString("# HELP blacksmith_leases_active Number of the leases which haven't expired.\n")
+	fmt.Fprintf(b, "blacksmith_leases_active %d\n", inv.activeLeases)
+
+	b.WriteString("# TYPE blacksmith_leases_expiring gauge\n")
+	fmt.Fprintf(b, "# HELP blacksmith_leases_expiring Number of the active leases which expire in %s.\n",
+		leaseExpiringWindow)
+	fmt.Fprintf(b, "blacksmith_leases_expiring %d\n", inv.expiringLeases)
+
+	b.WriteString("# TYPE blacksmith_machines_unreadable gauge\n")
+	b.WriteString("# HELP blacksmith_machines_unreadable Number of the machines whose records couldn't be read.\n")
+	fmt.Fprintf(b, "blacksmith_machines_unreadable %d\n", inv.failed)
+}
+
+// writeRegistryMetrics writes the counters and the gauges of the metrics
+// registry (e.g. dhcp_datasource_errors) in the OpenMetrics text format. The
+// labeled ones (see metrics.WithLabel) are written under their family.
+func writeRegistryMetrics(b *bytes.Buffer, s metrics.Snapshot) {
+	counters := make([]string, 0, len(s.Counters))
+	for name := range s.Counters {
+		counters = append(counters, name)
+	}
+	sort.Strings(counters)
+	lastFamily := ""
+	for _, name := range counters {
+		family, labels := splitMetricName(name)
+		if family != lastFamily {
+			fmt.Fprintf(b, "# TYPE blacksmith_%s counter\n", family)
+			lastFamily = family
+		}
+		fmt.Fprintf(b, "blacksmith_%s_total%s %d\n", family, labels, s.Counters[name])
+	}
+
+	gauges := make([]string, 0, len(s.Gauges))
+	for name := range s.Gauges {
+		gauges = append(gauges, name)
+	}
+	sort.Strings(gauges)
+	lastFamily = ""
+	for _, name := range gauges {
+		family, labels := splitMetricName(name)
+		if family != lastFamily {
+			fmt.Fprintf(b, "# TYPE blacksmith_%s gauge\n", family)
+			lastFamily = family
+		}
+		fmt.Fprintf(b, "blacksmith_%s%s %d\n", family, labels, s.Gauges[name])
+	}
+}
+
+// splitMetricName splits the name of a registry metric into its family and
+// its labels, e.g. {code="1"}, which are empty if it has none
+func splitMetricName(name string) (string, string) {
+	if i := strings.Index(name, "{"); i >= 0 {
+		return name[:i], name[i:]
+	}
+	return name, ""
+}
@@ -0,0 +1,112 @@
+package web
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/dhcp"
+)
+
+func TestInventoryMetrics(t *testing.T) {
+	expiring, _ := net.ParseMAC("00:11:22:33:44:e1")
+	active, _ := net.ParseMAC("00:11:22:33:44:e2")
+	expired, _ := net.ParseMAC("00:11:22:33:44:e3")
+	unreadable, _ := net.ParseMAC("00:11:22:33:44:e4")
+	late, _ := net.ParseMAC("00:11:22:33:44:e5")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	now := time.Now()
+	leases := map[string]int64{
+		expiring.String(): now.Add(10 * time.Minute).Unix(),
+		active.String():   now.Add(24 * time.Hour).Unix(),
+		expired.String():  now.Add(-time.Minute).Unix(),
+	}
+	for _, mac := range []net.HardwareAddr{expiring, active, expired} {
+		machineInterface := ds.MachineInterface(mac)
+		machine, err := machineInterface.Machine(true, nil)
+		if err != nil {
+			t.Error("error while creating the machine:", err)
+			return
+		}
+		lease := datasource.Lease{IP: machine.IP, Expiry: leases[mac.String()]}
+		if err := machineInterface.StoreLease(lease); err != nil {
+			t.Error("error while storing the lease:", err)
+			return
+		}
+	}
+	// a variable without a machine record
+	if err := ds.MachineInterface(unreadable).SetVariable("foo", "bar"); err != nil {
+		t.Error("error while setting the variable:", err)
+		return
+	}
+
+	ws := &webServer{
+		ds:          ds,
+		dhcpHandler: dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{}),
+		inventory:   newInventoryCache(time.Hour),
+	}
+	h := ws.Handler()
+	scrape := func() string {
+		req, _ := http.NewRequest("GET", "http://test.com/metrics", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Error("unexpected status code while getting the metrics:", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	body := scrape()
+	for _, line := range []string{
+		"# TYPE blacksmith_machines gauge\n",
+		`blacksmith_machines_by_type{type="normal"} 3` + "\n",
+		"blacksmith_leases_active 2\n",
+		"blacksmith_leases_expiring 1\n",
+		"blacksmith_machines_unreadable 1\n",
+		"# TYPE blacksmith_dhcp_machine_cache_hits counter\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected %q in the metrics:\n%s", line, body)
+		}
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Error("expected the metrics to end with # EOF:", body)
+	}
+
+	// the inventory is cached between the scrapes
+	if err := ds.MachineInterface(unreadable).DeleteMachine(); err != nil {
+		t.Error("error while deleting the unreadable machine:", err)
+		return
+	}
+	if _, err := ds.MachineInterface(late).Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+	if body := scrape(); !strings.Contains(body, `blacksmith_machines_by_type{type="normal"} 3`+"\n") {
+		t.Error("expected the cached inventory in the metrics:", body)
+	}
+	ws.inventory = nil
+	if body := scrape(); !strings.Contains(body, `blacksmith_machines_by_type{type="normal"} 4`+"\n") {
+		t.Error("expected the new machine in the uncached metrics:", body)
+	}
+}
@@ -0,0 +1,140 @@
+package web
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+)
+
+const (
+	configSourceFlag    = "flag"
+	configSourceDefault = "default"
+	redactedValue       = "<redacted>"
+)
+
+// secretNames are the parts of the names of the flags and the variables
+// whose values are redacted
+var secretNames = []string{"password", "secret", "token", "credential"}
+
+type configValue struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+type runtimeConfig struct {
+	Flags     map[string]configValue                  `json:"flags"`
+	Variables map[string]datasource.EffectiveVariable `json:"variables"`
+	Toggles   map[string]interface{}                  `json:"toggles"`
+}
+
+// redact hides the values of the secrets, and the passwords in the urls
+func redact(name, value string) string {
+	lowered := strings.ToLower(name)
+	for _, secret := range secretNames {
+		if strings.Contains(lowered, secret) {
+			return redactedValue
+		}
+	}
+
+	// the etcd endpoints are a comma separated list of urls
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		u, err := url.Parse(strings.TrimSpace(part))
+		if err != nil || u.User == nil {
+			continue
+		}
+		if _, hasPassword := u.User.Password(); hasPassword {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+			parts[i] = u.String()
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// flagsConfig returns the values of the flags, and whether they're given or
+// left with their defaults
+func flagsConfig(fs *flag.FlagSet) map[string]configValue {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	flags := make(map[string]configValue)
+	fs.VisitAll(func(f *flag.Flag) {
+		source := configSourceDefault
+		if given[f.Name] {
+			source = configSourceFlag
+		}
+		flags[f.Name] = configValue{Value: redact(f.Name, f.Value.String()), Source: source}
+	})
+	return flags
+}
+
+// RuntimeConfig returns the configuration which is in effect on this
+// instance: the command line flags, the cluster variables along with their
+// sources, and the current values of the switches which may be changed at
+// runtime. The secrets are redacted.
+func (ws *webServer) RuntimeConfig(w http.ResponseWriter, r *http.Request) {
+	variables, err := ws.ds.EffectiveClusterVariables()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	for key, variable := range variables {
+		variable.Value = redact(key, variable.Value)
+		variables[key] = variable
+	}
+
+	conf := runtimeConfig{
+		Flags:     flagsConfig(flag.CommandLine),
+		Variables: variables,
+		Toggles: map[string]interface{}{
+			"readOnly":          ws.options.ReadOnly,
+			"exportConcurrency": ws.options.ExportConcurrency,
+			"exportTimeout":     ws.options.ExportTimeout.String(),
+			"logRequests":       ws.options.LogRequests,
+		},
+	}
+	if ws.dhcpHandler != nil {
+		options := ws.dhcpHandler.Options()
+		conf.Toggles["draining"] = ws.dhcpHandler.Draining()
+		conf.Toggles["tracePackets"] = options.TracePackets
+		conf.Toggles["dnsFreshness"] = options.InstanceFreshness.String()
+		conf.Toggles["logThrottleWindow"] = options.LogThrottleWindow.String()
+		conf.Toggles["replyDelay"] = options.ReplyDelay.String()
+		conf.Toggles["nakLimit"] = options.NAKLimit
+		conf.Toggles["nakLimitWindow"] = options.NAKLimitWindow.String()
+		conf.Toggles["ipamWebhook"] = redact("ipamWebhook", options.IPAMWebhook)
+		conf.Toggles["ipamTimeout"] = options.IPAMTimeout.String()
+	}
+
+	confJSON, err := json.Marshal(conf)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(confJSON))
+}
+
+// ConfigProblems validates the stored cluster and machine variables, and
+// returns the broken ones. The same check is run on the startup.
+func (ws *webServer) ConfigProblems(w http.ResponseWriter, r *http.Request) {
+	problems, err := datasource.CheckConfigs(ws.ds)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	problemsJSON, err := json.Marshal(problems)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, string(problemsJSON))
+}
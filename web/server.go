@@ -1,19 +1,66 @@
 package web // import "github.com/cafebazaar/blacksmith/web"
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 
 	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/dhcp"
 )
 
+// Options are the settings of the web api, which are given by the command
+// line flags
+type Options struct {
+	// LogRequests enables the access log
+	LogRequests bool
+	// ReadOnly makes the web api a read-only replica, which refuses the
+	// requests that change the state of the cluster
+	ReadOnly bool
+	// ExportConcurrency is the number of the exports and imports of the
+	// machines which are served at the same time, the rest are refused with
+	// 429. 0 disables the limit.
+	ExportConcurrency int
+	// ExportTimeout is how long an export or an import of the machines may
+	// take, it's stopped once it's passed. 0 disables the timeout.
+	ExportTimeout time.Duration
+}
+
 type webServer struct {
-	ds datasource.DataSource
+	ds          datasource.DataSource
+	dhcpHandler *dhcp.Handler
+	options     Options
+	inventory   *inventoryCache
+	exports     *exportLimiter
+}
+
+// invalidateMachine drops the cached record of the machine in the dhcp
+// handler, after the machine or its variables are changed
+func (ws *webServer) invalidateMachine(mac net.HardwareAddr) {
+	if ws.dhcpHandler != nil {
+		ws.dhcpHandler.InvalidateMachine(mac)
+	}
+}
+
+// invalidateMachines drops the cached records of all the machines in the
+// dhcp handler
+func (ws *webServer) invalidateMachines() {
+	if ws.dhcpHandler != nil {
+		ws.dhcpHandler.InvalidateMachines()
+	}
 }
 
 // Handler uses a multiplexing router to route http requests
@@ -26,21 +73,69 @@ func (ws *webServer) Handler() http.Handler {
 
 	mux.HandleFunc("/api/version", ws.Version)
 
-	mux.HandleFunc("/api/machines", ws.MachinesList)
+	mux.HandleFunc("/api/machines", ws.MachinesDelete).Methods("DELETE")
+	mux.Handle("/api/machines", ws.exports.wrap(withETag(ws.MachinesList), wantsCSV))
+	mux.Handle("/api/machines/import", ws.exports.wrap(ws.MachinesImport, nil)).Methods("POST")
+	mux.HandleFunc("/api/machines/lookup", ws.MachinesLookup).Methods("POST")
+	mux.HandleFunc("/api/machines/subnets", ws.MachineSubnets).Methods("GET")
+	mux.HandleFunc("/api/machines/client-archs", ws.ClientArchs).Methods("GET")
 	mux.HandleFunc("/api/machines/{mac}", ws.MachineDelete).Methods("DELETE")
+	mux.HandleFunc("/api/machines/{mac}/claim", ws.ClaimMachine).Methods("POST")
+	mux.HandleFunc("/api/machines/{mac}/network", ws.MachineNetwork).Methods("GET")
+	mux.HandleFunc("/api/machines/{mac}/dns", ws.MachineDNS).Methods("GET")
+	mux.HandleFunc("/api/machines/{mac}/domain", ws.SetMachineDomain).Methods("PUT")
+	mux.HandleFunc("/api/machines/{mac}/domain", ws.DeleteMachineDomain).Methods("DELETE")
+	mux.HandleFunc("/api/machines/{mac}/search-domains", ws.SetMachineSearchDomains).Methods("PUT")
+	mux.HandleFunc("/api/machines/{mac}/search-domains", ws.DeleteMachineSearchDomains).Methods("DELETE")
+	mux.HandleFunc("/api/machines/{mac}/simulate", ws.MachineSimulate).Methods("GET")
+	mux.HandleFunc("/api/machines/{mac}/pxe-options", ws.MachinePXEOptions).Methods("GET")
+	mux.HandleFunc("/api/machines/{mac}/preflight", ws.PreflightMachine).Methods("GET")
+	mux.HandleFunc("/api/machines/{mac}/events", ws.MachineEvents).Methods("GET")
+	mux.HandleFunc("/api/machines/{mac}/dhcp-transactions", ws.MachineDHCPTransactions).Methods("GET")
+	mux.HandleFunc("/api/machines/{mac}/notes", ws.MachineNotes).Methods("GET")
+	mux.HandleFunc("/api/machines/{mac}/notes", ws.SetMachineNotes).Methods("PUT")
+	mux.HandleFunc("/api/machines/{mac}/lease", ws.ExpireMachineLease).Methods("DELETE")
+	mux.HandleFunc("/api/machines/{mac}/type", ws.SetMachineType).Methods("PUT")
+	mux.HandleFunc("/api/machines/{mac}/heartbeat", ws.AgentHeartbeat).Methods("POST")
+	mux.HandleFunc("/api/machines/{mac}/wake", ws.WakeMachine).Methods("POST")
+
+	mux.HandleFunc("/api/quarantine", ws.QuarantinedMachines).Methods("GET")
+	mux.HandleFunc("/api/quarantine/decisions", ws.QuarantineDecisions).Methods("GET")
+	mux.HandleFunc("/api/quarantine/{mac}/approve", ws.ApproveMachine).Methods("POST")
+	mux.HandleFunc("/api/quarantine/{mac}/reject", ws.RejectMachine).Methods("POST")
 
 	// mux.PathPrefix("/api/machine/").HandlerFunc(ws.NodeSetIPMI).Methods("PUT")
 
 	// Machine variables; used in templates
 	mux.PathPrefix("/api/machines/{mac}/variables").HandlerFunc(ws.MachineVariables).Methods("GET")
+	mux.HandleFunc("/api/machines/{mac}/variables", ws.ClearMachineVariables).Methods("DELETE")
 	mux.PathPrefix("/api/machines/{mac}/variables/{name}").HandlerFunc(ws.SetMachineVariable).Methods("PUT")
 	mux.PathPrefix("/api/machines/{mac}/variables/{name}").HandlerFunc(ws.DelMachineVariable).Methods("DELETE")
 
 	// Cluster variables; used in templates
-	mux.PathPrefix("/api/variables").HandlerFunc(ws.ClusterVariablesList).Methods("GET")
+	mux.PathPrefix("/api/variables").HandlerFunc(withETag(ws.ClusterVariablesList)).Methods("GET")
 	mux.PathPrefix("/api/variables/{name}").HandlerFunc(ws.SetClusterVariables).Methods("PUT")
 	mux.PathPrefix("/api/variables/{name}").HandlerFunc(ws.DelClusterVariables).Methods("DELETE")
 
+	mux.HandleFunc("/api/drain", ws.Drain).Methods("GET")
+	mux.HandleFunc("/api/drain", ws.SetDrain).Methods("PUT")
+	mux.HandleFunc("/api/dhcp/probe", ws.DHCPProbe).Methods("GET")
+	mux.HandleFunc("/api/dhcp/errors", ws.DHCPErrors).Methods("GET")
+	mux.HandleFunc("/api/dhcp/errors", ws.ClearDHCPErrors).Methods("DELETE")
+	mux.HandleFunc("/readyz", ws.Readyz)
+	mux.HandleFunc("/metrics", ws.Metrics).Methods("GET")
+	mux.HandleFunc("/api/stats", ws.Stats).Methods("GET")
+	mux.HandleFunc("/api/config", ws.RuntimeConfig).Methods("GET")
+	mux.HandleFunc("/api/config/problems", ws.ConfigProblems).Methods("GET")
+	mux.HandleFunc("/api/etcd-keys", ws.EtcdKeys).Methods("GET")
+
+	mux.HandleFunc("/api/maintenance", ws.Maintenance).Methods("GET")
+	mux.HandleFunc("/api/maintenance", ws.SetMaintenance).Methods("PUT")
+
+	mux.HandleFunc("/api/subnets", ws.Subnets).Methods("GET")
+	mux.HandleFunc("/api/subnets", ws.SetSubnet).Methods("PUT")
+	mux.HandleFunc("/api/subnets/{ip}/{size}", ws.DeleteSubnet).Methods("DELETE")
+
 	// TODO: returning other files functionalities
 	mux.PathPrefix("/files/").Handler(http.StripPrefix("/files/",
 		http.FileServer(http.Dir(filepath.Join(ws.ds.WorkspacePath(), "files")))))
@@ -56,32 +151,257 @@ func (ws *webServer) Handler() http.Handler {
 
 	mux.PathPrefix("/static/").Handler(http.FileServer(FS(false)))
 
+	mux.NotFoundHandler = http.HandlerFunc(notFound)
+
 	return mux
 }
 
+// notFound replies the requests to the unknown routes with a json 404
+func notFound(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(struct {
+		Error string `json:"error"`
+		Path  string `json:"path"`
+	}{"not found", r.URL.Path})
+	if err != nil {
+		http.Error(w, `{"error": "not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(body)
+}
+
+// requestIDHeader carries the id of a request, which is logged in the access
+// log and sent back, so a request can be followed through the logs of the
+// proxies and of blacksmith
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the length of the longest request id which is taken
+// from the client
+const maxRequestIDLength = 128
+
+// requestID returns the id of the request which is given by the client (or
+// a proxy) in requestIDHeader, or a new random one if there's none or it's
+// not a printable token
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	valid := id != "" && len(id) <= maxRequestIDLength
+	for i := 0; valid && i < len(id); i++ {
+		valid = id[i] > ' ' && id[i] < 0x7f
+	}
+	if valid {
+		return id
+	}
+
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// statusRecorder keeps the status code which is written to a ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes through to the underlying ResponseWriter, so the streaming
+// handlers behind the access log still stream
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// logHandler logs the method, path, status, duration, remote address and id
+// of each request
 func logHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		if id != "" {
+			w.Header().Set(requestIDHeader, id)
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(recorder, r)
+
+		log.WithFields(log.Fields{
+			"where":      "web.logHandler",
+			"action":     "access",
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     recorder.status,
+			"duration":   time.Since(start).String(),
+			"remote":     r.RemoteAddr,
+			"request_id": id,
+		}).Infof("%s %s %d", r.Method, r.URL.Path, recorder.status)
+	})
+}
+
+// readOnlySafe are the api requests with a method other than GET and HEAD,
+// which don't change the state of the cluster. Draining changes only this
+// instance, and the heartbeats of the agents should reach any instance.
+var readOnlySafe = map[string]bool{
+	"POST /api/machines/lookup": true,
+	"PUT /api/drain":            true,
+}
+
+// isReadOnlySafe reports whether the request is allowed on a read-only
+// replica
+func isReadOnlySafe(r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || !strings.HasPrefix(r.URL.Path, "/api/") {
+		return true
+	}
+	if readOnlySafe[r.Method+" "+r.URL.Path] {
+		return true
+	}
+	// POST /api/machines/{mac}/heartbeat
+	parts := strings.Split(r.URL.Path, "/")
+	return r.Method == "POST" && len(parts) == 5 &&
+		parts[2] == "machines" && parts[4] == "heartbeat"
+}
+
+// readOnlyHandler refuses the api requests which may change the state of the
+// cluster with 403, if the ReadOnly option is set
+func (ws *webServer) readOnlyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ws.options.ReadOnly && !isReadOnlySafe(r) {
+			http.Error(w, `{"error": "this instance is a read-only replica"}`, http.StatusForbidden)
+			return
+		}
 		h.ServeHTTP(w, r)
 	})
 }
 
-//ServeWeb serves api of Blacksmith and a ui connected to that api
-func ServeWeb(ds datasource.DataSource, listenAddr net.TCPAddr) error {
-	r := &webServer{ds: ds}
+// LoadTLSConfig loads the given certificate and key files, and returns a
+// tls.Config suitable for ServeWeb
+func LoadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both the certificate and the key files are needed")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading the key pair: %s", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
 
-	logWriter := log.StandardLogger().Writer()
-	defer logWriter.Close()
+// httpHandler returns Handler along with the middlewares which are enabled
+// by the options
+func (ws *webServer) httpHandler() http.Handler {
+	h := ws.readOnlyHandler(ws.Handler())
+	if ws.options.LogRequests {
+		h = logHandler(h)
+	}
+	return h
+}
 
-	loggedRouter := handlers.LoggingHandler(logWriter, r.Handler())
+// NewHandler returns the handler of the api and the ui, along with the
+// middlewares which are enabled by the options. It's to be shared by all the
+// listeners of the instance, so they share the export limit and the caches.
+func NewHandler(ds datasource.DataSource, dhcpHandler *dhcp.Handler, options Options) http.Handler {
+	r := &webServer{
+		ds:          ds,
+		dhcpHandler: dhcpHandler,
+		options:     options,
+		inventory:   newInventoryCache(inventoryCacheTTL),
+		exports:     newExportLimiter(options.ExportConcurrency, options.ExportTimeout),
+	}
+	return r.httpHandler()
+}
+
+func serveWeb(handler http.Handler, listener net.Listener) error {
 	s := &http.Server{
-		Addr:    listenAddr.String(),
-		Handler: loggedRouter,
+		Handler: handler,
+	}
+
+	return s.Serve(listener)
+}
+
+// ServeWeb serves the handler, which is given by NewHandler, on listenAddr.
+// If tlsConfig is not nil, it's served over https.
+func ServeWeb(handler http.Handler, listenAddr net.TCPAddr, tlsConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", listenAddr.String())
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
 	}
 
 	log.WithFields(log.Fields{
 		"where":  "web.ServeWeb",
 		"action": "announce",
+	}).Infof("Listening on %s (tls: %v)", listenAddr.String(), tlsConfig != nil)
+
+	return serveWeb(handler, listener)
+}
+
+// listenUnix listens on a unix domain socket at socketPath, which is given
+// the permissions of mode. A socket which is left from a previous run is
+// removed, but any other file at socketPath is kept and it's an error.
+func listenUnix(socketPath string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(socketPath); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, fmt.Errorf("error while removing the stale socket: %s", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error while setting the permissions of the socket: %s", err)
+	}
+	return listener, nil
+}
+
+// ServeUnixSocket serves the handler, which is shared with ServeWeb, on a
+// unix domain socket, for the local integrations which shouldn't need a tcp
+// port. It's never served over tls, so access to it is limited by the
+// permissions (mode) of the socket.
+func ServeUnixSocket(handler http.Handler, socketPath string, mode os.FileMode) error {
+	listener, err := listenUnix(socketPath, mode)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"where":  "web.ServeUnixSocket",
+		"action": "announce",
+	}).Infof("Listening on %s (mode: %s)", socketPath, mode)
+
+	return serveWeb(handler, listener)
+}
+
+// ServeHTTPSRedirect listens for plain http requests on listenAddr, and
+// redirects them to the same path on the https port
+func ServeHTTPSRedirect(listenAddr net.TCPAddr, httpsPort int) error {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := fmt.Sprintf("https://%s%s",
+			net.JoinHostPort(host, strconv.Itoa(httpsPort)), r.URL.RequestURI())
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+
+	log.WithFields(log.Fields{
+		"where":  "web.ServeHTTPSRedirect",
+		"action": "announce",
 	}).Infof("Listening on %s", listenAddr.String())
 
-	return s.ListenAndServe()
+	return http.ListenAndServe(listenAddr.String(), redirect)
 }
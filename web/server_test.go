@@ -0,0 +1,380 @@
+package web
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/dhcp"
+)
+
+// selfSignedForTest writes a self-signed certificate for 127.0.0.1 and its
+// key into dir, and returns the paths along with the parsed certificate
+func selfSignedForTest(dir string) (string, string, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"Blacksmith Test"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", "", nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		return "", "", nil, err
+	}
+	err = ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return certFile, keyFile, cert, nil
+}
+
+func TestServeWebTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-tls")
+	if err != nil {
+		t.Error("error while creating a temp dir:", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, cert, err := selfSignedForTest(dir)
+	if err != nil {
+		t.Error("error while creating a self-signed certificate:", err)
+		return
+	}
+
+	if _, err := LoadTLSConfig(certFile, filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("expecting an error while loading a missing key")
+	}
+	if _, err := LoadTLSConfig(certFile, ""); err == nil {
+		t.Error("expecting an error while loading without a key")
+	}
+
+	tlsConfig, err := LoadTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Error("error while loading the tls config:", err)
+		return
+	}
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error("error while listening:", err)
+		return
+	}
+	defer listener.Close()
+	go serveWeb(NewHandler(ds, nil, Options{}), tls.NewListener(listener, tlsConfig))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+
+	resp, err := client.Get("https://" + listener.Addr().String() + "/api/version")
+	if err != nil {
+		t.Error("error while getting the version over https:", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Error("unexpected status code while getting the version over https:", resp.StatusCode)
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blacksmith-socket")
+	if err != nil {
+		t.Error("error while creating a temp dir:", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	socketPath := filepath.Join(dir, "api.sock")
+	// a stale socket of a previous run
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Error("error while listening:", err)
+		return
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(socketPath, 0600)
+	if err != nil {
+		t.Error("error while listening on the unix socket:", err)
+		return
+	}
+	defer listener.Close()
+	go serveWeb(NewHandler(ds, nil, Options{}), listener)
+
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Error("error while getting the socket info:", err)
+		return
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Error("unexpected permissions of the socket:", fi.Mode().Perm())
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		}},
+	}
+	resp, err := client.Get("http://blacksmith/api/version")
+	if err != nil {
+		t.Error("error while getting the version over the unix socket:", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Error("unexpected status code while getting the version over the unix socket:", resp.StatusCode)
+	}
+
+	regularFile := filepath.Join(dir, "regular")
+	if err := ioutil.WriteFile(regularFile, nil, 0644); err != nil {
+		t.Error("error while writing a file:", err)
+		return
+	}
+	if _, err := listenUnix(regularFile, 0600); err == nil {
+		t.Error("expected an error while listening on a regular file")
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	r := &webServer{ds: ds}
+	h := r.Handler()
+
+	for _, path := range []string{"/api/unknown", "/api/machines/00:11:22:33:44:55/unknown", "/nothing"} {
+		req, err := http.NewRequest("GET", "http://test.com"+path, nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: unexpected status code: %d", path, w.Code)
+			continue
+		}
+		var body map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: expected a json body, got %q", path, w.Body.String())
+			continue
+		}
+		if body["error"] != "not found" || body["path"] != path {
+			t.Errorf("%s: unexpected body: %v", path, body)
+		}
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+
+	h := logHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		// the streaming handlers still stream behind the access log
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Error("expected the ResponseWriter to be a Flusher")
+			return
+		}
+		flusher.Flush()
+	}))
+
+	tests := []struct {
+		requestID string
+		expected  string // empty for a random one
+	}{
+		{"", ""},
+		{"abc-123", "abc-123"},
+		{"not a token", ""},
+		{strings.Repeat("a", maxRequestIDLength+1), ""},
+	}
+
+	for i, tt := range tests {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+
+		req, err := http.NewRequest("PUT", "http://test.com/api/maintenance", nil)
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+		req.RemoteAddr = "10.0.0.1:1234"
+		if tt.requestID != "" {
+			req.Header.Set(requestIDHeader, tt.requestID)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		logged := buf.String()
+		if !strings.Contains(logged, "PUT /api/maintenance 418") || !strings.Contains(logged, "10.0.0.1:1234") {
+			t.Errorf("#%d: expected the access log, got %q", i, logged)
+		}
+		if !w.Flushed {
+			t.Errorf("#%d: expected the response to be flushed", i)
+		}
+
+		id := w.Header().Get(requestIDHeader)
+		if id == "" || (tt.expected != "" && id != tt.expected) || (tt.expected == "" && id == tt.requestID) {
+			t.Errorf("#%d: unexpected request id %q", i, id)
+		}
+		if !strings.Contains(logged, "request_id="+id) {
+			t.Errorf("#%d: expected the request id to be logged, got %q", i, logged)
+		}
+	}
+
+	// the access log is only added if it's enabled
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+	for _, enabled := range []bool{true, false} {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		req, _ := http.NewRequest("GET", "http://test.com/api/version", nil)
+		(&webServer{ds: ds, options: Options{LogRequests: enabled}}).httpHandler().ServeHTTP(httptest.NewRecorder(), req)
+		if logged := strings.Contains(buf.String(), "GET /api/version"); logged != enabled {
+			t.Errorf("expected the access log to be logged=%v, got %q", enabled, buf.String())
+		}
+	}
+}
+
+func TestReadOnlyHandler(t *testing.T) {
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	r := &webServer{
+		ds:          ds,
+		dhcpHandler: dhcp.NewHandler("", net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{}),
+		options:     Options{ReadOnly: true},
+	}
+	h := r.httpHandler()
+
+	tests := []struct {
+		method string
+		url    string
+		body   string
+		code   int
+	}{
+		{"GET", "http://test.com/api/maintenance", "", 200},
+		{"PUT", "http://test.com/api/maintenance?value=true", "", http.StatusForbidden},
+		{"PUT", "http://test.com/api/variables/foo?value=bar", "", http.StatusForbidden},
+		{"DELETE", "http://test.com/api/variables/coreos-version", "", http.StatusForbidden},
+		{"DELETE", "http://test.com/api/machines/00:11:22:33:44:55", "", http.StatusForbidden},
+		{"POST", "http://test.com/api/machines/lookup", `["00:11:22:33:44:55"]`, 200},
+		{"PUT", "http://test.com/api/drain?value=false", "", 200},
+		{"POST", "http://test.com/api/machines/00:11:22:33:44:55/heartbeat?state=running", "", http.StatusNotFound},
+		{"POST", "http://test.com/api/machines/00:11:22:33:44:55/flags", "", http.StatusForbidden},
+		{"GET", "http://test.com/api/maintenance", "", 200},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		if err != nil {
+			t.Error("error while NewRequest:", err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("#%d: expected status code %d, got %d", i, tt.code, w.Code)
+		}
+	}
+
+	maintenance, err := ds.Maintenance()
+	if err != nil {
+		t.Error("error while getting the maintenance mode:", err)
+		return
+	}
+	if maintenance {
+		t.Error("expected the maintenance mode not to be changed by a read-only replica")
+	}
+	if _, err := ds.GetClusterVariable("coreos-version"); err != nil {
+		t.Error("expected the cluster variable not to be deleted by a read-only replica:", err)
+	}
+}
@@ -0,0 +1,111 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// wakeOnLANPort is the udp port of the magic packets (discard)
+const wakeOnLANPort = 9
+
+// sendWakePacket sends the magic packet to the broadcast address. It's
+// replaced in the tests.
+var sendWakePacket = func(addr *net.UDPAddr, packet []byte) error {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
+
+// magicPacket returns the wake-on-lan magic packet of the mac: 6 bytes of
+// 0xff followed by 16 repetitions of the mac
+func magicPacket(mac net.HardwareAddr) []byte {
+	packet := bytes.Repeat([]byte{0xff}, 6)
+	return append(packet, bytes.Repeat(mac, 16)...)
+}
+
+// broadcastAddr returns the broadcast address of the first ipv4 network of
+// the interface, if it's up
+func broadcastAddr(ifName string) (*net.UDPAddr, error) {
+	if ifName == "" {
+		return nil, errors.New("no interface is configured for the dhcp")
+	}
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %q: %s", ifName, err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %q is down", ifName)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the addresses of interface %q: %s", ifName, err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		ip := ipNet.IP.To4()
+		mask := ipNet.Mask
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		broadcast := make(net.IP, net.IPv4len)
+		for i := range ip {
+			broadcast[i] = ip[i] | ^mask[i]
+		}
+		return &net.UDPAddr{IP: broadcast, Port: wakeOnLANPort}, nil
+	}
+	return nil, fmt.Errorf("interface %q has no ipv4 address", ifName)
+}
+
+// WakeMachine sends a wake-on-lan magic packet for the machine, as a
+// broadcast on the interface of the dhcp
+func (ws *webServer) WakeMachine(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	macString := vars["mac"]
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil || len(mac) != 6 {
+		http.Error(w, fmt.Sprintf(`{"error": "invalid mac: %q"}`, macString), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := ws.ds.MachineInterface(mac).Machine(false, nil); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusNotFound)
+		return
+	}
+
+	ifName := ""
+	if ws.dhcpHandler != nil {
+		ifName = ws.dhcpHandler.Interface()
+	}
+	addr, err := broadcastAddr(ifName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := sendWakePacket(addr, magicPacket(mac)); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"where":  "web.WakeMachine",
+		"action": "wake",
+		"object": mac.String(),
+	}).Infof("sent the magic packet to %s", addr)
+	io.WriteString(w, `"OK"`)
+}
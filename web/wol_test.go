@@ -0,0 +1,108 @@
+package web
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cafebazaar/blacksmith/datasource"
+	"github.com/cafebazaar/blacksmith/dhcp"
+)
+
+func TestMagicPacket(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:f9")
+	packet := magicPacket(mac)
+	if len(packet) != 102 {
+		t.Errorf("expected 102 bytes, got %d", len(packet))
+		return
+	}
+	if !bytes.Equal(packet[:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("unexpected synchronization stream: %x", packet[:6])
+	}
+	for i := 0; i < 16; i++ {
+		if !bytes.Equal(packet[6+6*i:12+6*i], mac) {
+			t.Errorf("#%d: unexpected repetition of the mac: %x", i, packet[6+6*i:12+6*i])
+		}
+	}
+}
+
+func TestWakeMachineAPI(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:fa")
+	unknown, _ := net.ParseMAC("00:11:22:33:44:fb")
+
+	ds, err := datasource.ForTest(nil)
+	if err != nil {
+		t.Error("error in getting a DataSource instance for our test:", err)
+		return
+	}
+
+	if err := ds.WhileMaster(); err != nil {
+		t.Error("failed to register as the master instance:", err)
+		return
+	}
+	defer func() {
+		if err := ds.Shutdown(); err != nil {
+			t.Error("failed to shutdown:", err)
+		}
+	}()
+
+	if _, err := ds.MachineInterface(mac).Machine(true, nil); err != nil {
+		t.Error("error while creating the machine:", err)
+		return
+	}
+
+	var sentAddr *net.UDPAddr
+	var sentPacket []byte
+	defer func(send func(*net.UDPAddr, []byte) error) {
+		sendWakePacket = send
+	}(sendWakePacket)
+	sendWakePacket = func(addr *net.UDPAddr, packet []byte) error {
+		sentAddr, sentPacket = addr, packet
+		return nil
+	}
+
+	tests := []struct {
+		ifName string
+		mac    string
+		status int
+	}{
+		{"lo", mac.String(), http.StatusOK},
+		{"lo", "not-a-mac", http.StatusBadRequest},
+		{"lo", unknown.String(), http.StatusNotFound},
+		{"no-such-interface", mac.String(), http.StatusInternalServerError},
+		{"", mac.String(), http.StatusInternalServerError},
+	}
+
+	for i, test := range tests {
+		sentAddr, sentPacket = nil, nil
+		dhcpHandler := dhcp.NewHandler(test.ifName, net.IPv4(127, 0, 0, 1), ds, dhcp.HandlerOptions{})
+		h := (&webServer{ds: ds, dhcpHandler: dhcpHandler}).Handler()
+
+		req, err := http.NewRequest("POST", "http://test.com/api/machines/"+test.mac+"/wake", nil)
+		if err != nil {
+			t.Errorf("#%d: error while NewRequest: %s", i, err)
+			continue
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("#%d: expected status %d, got %d: %s", i, test.status, w.Code, w.Body.String())
+			continue
+		}
+		if test.status != http.StatusOK {
+			if sentPacket != nil {
+				t.Errorf("#%d: unexpected magic packet", i)
+			}
+			continue
+		}
+		if sentAddr == nil || !sentAddr.IP.Equal(net.IPv4(127, 255, 255, 255)) || sentAddr.Port != wakeOnLANPort {
+			t.Errorf("#%d: unexpected broadcast address: %v", i, sentAddr)
+		}
+		if !bytes.Equal(sentPacket, magicPacket(mac)) {
+			t.Errorf("#%d: unexpected magic packet: %x", i, sentPacket)
+		}
+	}
+}